@@ -0,0 +1,119 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/fleet"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/watcher"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Serve the agent API for a coordinator until it fails. The agent only needs docker and registry access, it does not
+// keep a history or watch Steam. On SIGHUP the tokens and certificates are read again from the config file.
+func runAgent(configPath string, config watcher.Options, dockerCli engine.Client, args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := flags.String("listen", config.Fleet.Listen, "address to serve the agent API on")
+	name := flags.String("name", "", "name reported to the coordinator, defaults to the hostname")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher agent [--listen <address>] [--name <name>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if config.Fleet.Token == "" {
+		return fmt.Errorf("fleet.token must be set to run an agent")
+	}
+	if *name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+		*name = hostname
+	}
+
+	registryAuth, err := registry.NewResolver(config.DockerConfig, config.Registries)
+	if err != nil {
+		return fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+
+	agent := fleet.NewAgent(*name, agentTokens(config), dockerCli, registryAuth, config.Rollout.RconPassword)
+	agent.OnlyLabelled(config.Fleet.Labelled)
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           agent.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	var serverTLS *fleet.ServerTLS
+	if config.Fleet.TLS.Enabled() {
+		if serverTLS, err = fleet.NewServerTLS(config.Fleet.TLS.Files()); err != nil {
+			return err
+		}
+		server.TLSConfig = serverTLS.Config()
+	} else {
+		log.Warn().Msg("Agent API is not using TLS, anyone with the token can restart game servers")
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			config, err := watcher.LoadConfig(configPath, true)
+			if err != nil {
+				log.Err(err).Msg("Failed to reload config, keeping the current tokens and certificates")
+				continue
+			}
+			agent.SetTokens(agentTokens(config))
+			if serverTLS != nil {
+				if err := serverTLS.Reload(config.Fleet.TLS.Files()); err != nil {
+					log.Err(err).Msg("Failed to reload certificates, keeping the current ones")
+					continue
+				}
+			}
+			log.Info().Msg("Reloaded agent tokens and certificates")
+		}
+	}()
+
+	log.Info().Str("address", *listen).Str("name", *name).Bool("tls", serverTLS != nil).Msg("Serving agent API")
+	if serverTLS != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func agentTokens(config watcher.Options) []string {
+	return append([]string{config.Fleet.Token}, config.Fleet.AcceptedTokens...)
+}
+
+// Create a fleet CA and certificates for the coordinator and an agent
+func runGenCerts(args []string) error {
+	flags := flag.NewFlagSet("gen-certs", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "directory to write the certificates to, an existing CA in it is reused")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher gen-certs [--dir <directory>] <agent host> [<agent host or address>...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	written, err := fleet.GenerateCertificates(*dir, flags.Args())
+	if err != nil {
+		return err
+	}
+	for _, file := range written {
+		fmt.Println(file)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Exit code of check when a new build is available
+const EXIT_OUTDATED = 10
+
+func runCheck(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher check")
+		fmt.Fprintln(flags.Output(), "Compares Steam with the newest build once and prints both buildids as JSON, without building anything.")
+		fmt.Fprintf(flags.Output(), "Exits with 0 if the build is up to date, %d if a new build is available and 1 on errors.\n", EXIT_OUTDATED)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	result, err := updateWatcher.CheckOnce()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(result); encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return err
+	}
+	if result.Outdated {
+		os.Exit(EXIT_OUTDATED)
+	}
+	return nil
+}
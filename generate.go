@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/watcher"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"sort"
+)
+
+// Backends the watcher builds with in a cluster
+const (
+	// docker:dind sidecar, for the docker engine
+	BACKEND_DIND = "dind"
+	// buildkitd sidecar on the node's containerd, for the containerd engine
+	BACKEND_BUILDKITD = "buildkitd"
+	BACKEND_KANIKO    = "kaniko"
+)
+
+// Where the generated deployment keeps its files
+const (
+	podConfigDir   = "/etc/csgo-watcher"
+	podStateDir    = "/var/lib/csgo-watcher"
+	podBuildkitDir = "/run/buildkit"
+	// Socket of containerd on the node
+	nodeContainerdSocket = "/run/containerd/containerd.sock"
+)
+
+type manifestSettings struct {
+	name      string
+	namespace string
+	image     string
+	backend   string
+	storage   string
+}
+
+// Print manifests for running the watcher in a cluster with the loaded config
+func runGenerate(config watcher.Options, args []string) error {
+	if len(args) == 0 || args[0] != "k8s" {
+		fmt.Fprintln(os.Stderr, "usage: csgo-update-watcher generate k8s [flags]")
+		os.Exit(2)
+	}
+
+	defaultBackend := BACKEND_DIND
+	if config.Engine == engine.CONTAINERD {
+		defaultBackend = BACKEND_BUILDKITD
+	}
+	settings := manifestSettings{}
+	flags := flag.NewFlagSet("generate k8s", flag.ExitOnError)
+	flags.StringVar(&settings.name, "name", "csgo-update-watcher", "name of the generated resources")
+	flags.StringVar(&settings.namespace, "namespace", "csgo-watcher", "namespace the watcher runs in")
+	flags.StringVar(&settings.image, "image", "ghcr.io/shootingrange/csgo-update-watcher:"+watcher.Version, "image of the watcher, including the container files")
+	flags.StringVar(&settings.backend, "backend", defaultBackend, "how images are built in the pod, dind or buildkitd")
+	flags.StringVar(&settings.storage, "storage", "1Gi", "size of the volume of the history")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher generate k8s [--namespace <namespace>] [--backend dind|buildkitd] [--image <image>] | kubectl apply -f -")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+
+	manifests, err := kubernetesManifests(config, settings)
+	if err != nil {
+		return err
+	}
+	documents := make([]interface{}, len(manifests))
+	for i, manifest := range manifests {
+		documents[i] = manifest
+	}
+	output, err := encodeYAML(documents...)
+	if err != nil {
+		return err
+	}
+	// The CRD is printed as written, the operator needs it installed first
+	if config.Kubernetes.Operator.Enabled {
+		fmt.Print(kube.GameServerImageCRD + "---\n")
+	}
+	_, err = os.Stdout.Write(output)
+	return err
+}
+
+// YAML documents indented like kubectl does
+func encodeYAML(documents ...interface{}) ([]byte, error) {
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	for _, document := range documents {
+		if err := encoder.Encode(document); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+type object = map[string]interface{}
+
+// ServiceAccount, RBAC, config Secret, PVC, Deployment and Service of the watcher. The config is adjusted to the pod:
+// the history moves to the volume under a host name that survives restarts, Kubernetes is reached with the service
+// account and the engine to the backend.
+func kubernetesManifests(config watcher.Options, settings manifestSettings) ([]object, error) {
+	switch settings.backend {
+	case BACKEND_DIND:
+		config.Engine = engine.DOCKER
+	case BACKEND_BUILDKITD:
+		config.Engine = engine.CONTAINERD
+		config.Containerd.Address = nodeContainerdSocket
+		config.Containerd.BuildkitHost = "unix://" + podBuildkitDir + "/buildkitd.sock"
+		config.Containerd.Nerdctl = ""
+	case BACKEND_KANIKO:
+		return nil, fmt.Errorf("the kaniko backend is not supported, the watcher needs a container engine to run steamcmd and the game servers in")
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected %s or %s", settings.backend, BACKEND_DIND, BACKEND_BUILDKITD)
+	}
+	config.Kubernetes.Kubeconfig, config.Kubernetes.Context = "", ""
+	persistent := config.State.Driver != "postgres" && config.State.Path != ""
+	if persistent {
+		config.State.Path = podStateDir + "/state.db"
+	}
+	// Pod names change with every restart
+	if config.State.Host == "" {
+		config.State.Host = settings.name
+	}
+	warnUnmountedFiles(config)
+
+	configFile, err := encodeYAML(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	labels := object{"app.kubernetes.io/name": settings.name}
+	metadata := func() object {
+		return object{"name": settings.name, "namespace": settings.namespace, "labels": labels}
+	}
+
+	manifests := []object{}
+	manifests = append(manifests, object{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata":   metadata(),
+	})
+	manifests = append(manifests, rbacManifests(config, settings, labels)...)
+	manifests = append(manifests, object{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   metadata(),
+		"stringData": object{"config.yml": string(configFile)},
+	})
+
+	volumes := []object{{"name": "config", "secret": object{"secretName": settings.name}}}
+	mounts := []object{{"name": "config", "mountPath": podConfigDir, "readOnly": true}}
+	if persistent {
+		manifests = append(manifests, object{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata":   metadata(),
+			"spec": object{
+				"accessModes": []string{"ReadWriteOnce"},
+				"resources":   object{"requests": object{"storage": settings.storage}},
+			},
+		})
+		volumes = append(volumes, object{"name": "state", "persistentVolumeClaim": object{"claimName": settings.name}})
+		mounts = append(mounts, object{"name": "state", "mountPath": podStateDir})
+	}
+
+	watcherContainer := object{
+		"name":         "watcher",
+		"image":        settings.image,
+		"args":         []string{"-config", podConfigDir + "/config.yml"},
+		"volumeMounts": mounts,
+	}
+	containers := []object{watcherContainer}
+	switch settings.backend {
+	case BACKEND_DIND:
+		watcherContainer["env"] = []object{{"name": "DOCKER_HOST", "value": "tcp://127.0.0.1:2375"}}
+		containers = append(containers, object{
+			"name":  "dind",
+			"image": "docker:20.10-dind",
+			// Listen on localhost without TLS, only the pod can reach it
+			"env":             []object{{"name": "DOCKER_TLS_CERTDIR", "value": ""}},
+			"args":            []string{"--host=tcp://127.0.0.1:2375"},
+			"securityContext": object{"privileged": true},
+			"volumeMounts":    []object{{"name": "docker", "mountPath": "/var/lib/docker"}},
+		})
+		volumes = append(volumes, object{"name": "docker", "emptyDir": object{}})
+	case BACKEND_BUILDKITD:
+		containerdMount := object{"name": "containerd", "mountPath": nodeContainerdSocket}
+		buildkitMount := object{"name": "buildkit", "mountPath": podBuildkitDir}
+		watcherContainer["volumeMounts"] = append(mounts, containerdMount, buildkitMount)
+		containers = append(containers, object{
+			"name":  "buildkitd",
+			"image": "moby/buildkit:v0.10.3",
+			"args": []string{
+				"--addr", "unix://" + podBuildkitDir + "/buildkitd.sock",
+				"--oci-worker=false",
+				"--containerd-worker=true",
+				"--containerd-worker-addr=" + nodeContainerdSocket,
+			},
+			"securityContext": object{"privileged": true},
+			"volumeMounts":    []object{containerdMount, buildkitMount},
+		})
+		volumes = append(volumes,
+			object{"name": "containerd", "hostPath": object{"path": nodeContainerdSocket, "type": "Socket"}},
+			object{"name": "buildkit", "emptyDir": object{}},
+		)
+	}
+
+	var containerPorts, servicePorts []object
+	for _, api := range []struct{ name, key, listen string }{
+		{"api", "api.listen", config.API.Listen},
+		{"grpc", "api.grpc_listen", config.API.GRPCListen},
+	} {
+		if api.listen == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(api.listen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", api.key, api.listen, err)
+		}
+		number, err := net.LookupPort("tcp", port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", api.key, api.listen, err)
+		}
+		containerPorts = append(containerPorts, object{"name": api.name, "containerPort": number})
+		servicePorts = append(servicePorts, object{"name": api.name, "port": number, "targetPort": api.name})
+	}
+	if len(containerPorts) > 0 {
+		watcherContainer["ports"] = containerPorts
+	}
+
+	manifests = append(manifests, object{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   metadata(),
+		"spec": object{
+			// Only one watcher may build and the bolt history is locked by its writer
+			"replicas": 1,
+			"strategy": object{"type": "Recreate"},
+			"selector": object{"matchLabels": labels},
+			"template": object{
+				"metadata": object{"labels": labels},
+				"spec": object{
+					"serviceAccountName": settings.name,
+					"containers":         containers,
+					"volumes":            volumes,
+				},
+			},
+		},
+	})
+	if len(servicePorts) > 0 {
+		manifests = append(manifests, object{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   metadata(),
+			"spec": object{
+				"selector": labels,
+				"ports":    servicePorts,
+			},
+		})
+	}
+	return manifests, nil
+}
+
+// Roles for updating the workloads of every namespace and for the operator, cluster wide if it watches all
+// namespaces
+func rbacManifests(config watcher.Options, settings manifestSettings, labels object) []object {
+	rules := map[string][]object{}
+	for _, workload := range config.Kubernetes.Workloads {
+		var rule object
+		switch workload.Kind {
+		case kube.KIND_DEPLOYMENT:
+			rule = object{"apiGroups": []string{"apps"}, "resources": []string{"deployments"}, "verbs": []string{"get", "patch"}}
+		case kube.KIND_STATEFULSET:
+			rule = object{"apiGroups": []string{"apps"}, "resources": []string{"statefulsets"}, "verbs": []string{"get", "patch"}}
+		case kube.KIND_FLEET:
+			rule = object{"apiGroups": []string{"agones.dev"}, "resources": []string{"fleets"}, "verbs": []string{"get", "patch"}}
+			rules[workload.Namespace] = append(rules[workload.Namespace],
+				object{"apiGroups": []string{"agones.dev"}, "resources": []string{"gameserversets"}, "verbs": []string{"list"}})
+		}
+		rules[workload.Namespace] = append(rules[workload.Namespace], rule)
+	}
+	// The empty namespace stands for the whole cluster
+	if operator := config.Kubernetes.Operator; operator.Enabled {
+		rules[operator.Namespace] = append(rules[operator.Namespace],
+			object{"apiGroups": []string{kube.GROUP}, "resources": []string{"gameserverimages"}, "verbs": []string{"get", "list", "watch"}},
+			object{"apiGroups": []string{kube.GROUP}, "resources": []string{"gameserverimages/status"}, "verbs": []string{"update"}},
+		)
+	}
+	if lock := config.Lock; lock.Driver == "kubernetes" {
+		rules[lock.Namespace] = append(rules[lock.Namespace],
+			object{"apiGroups": []string{"coordination.k8s.io"}, "resources": []string{"leases"}, "verbs": []string{"get", "create", "update"}})
+	}
+
+	namespaces := []string{}
+	for namespace := range rules {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	manifests := []object{}
+	for _, namespace := range namespaces {
+		role, binding := "Role", "RoleBinding"
+		metadata := object{"name": settings.name, "namespace": namespace, "labels": labels}
+		if namespace == "" {
+			role, binding = "ClusterRole", "ClusterRoleBinding"
+			metadata = object{"name": settings.name, "labels": labels}
+		}
+		manifests = append(manifests, object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       role,
+			"metadata":   metadata,
+			"rules":      rules[namespace],
+		}, object{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       binding,
+			"metadata":   metadata,
+			"roleRef":    object{"apiGroup": "rbac.authorization.k8s.io", "kind": role, "name": settings.name},
+			"subjects":   []object{{"kind": "ServiceAccount", "name": settings.name, "namespace": settings.namespace}},
+		})
+	}
+	return manifests
+}
+
+// Files the config refers to are not part of the generated manifests
+func warnUnmountedFiles(config watcher.Options) {
+	files := []string{config.ContainerFiles, config.DockerConfig, config.Fleet.TLS.CA, config.Fleet.TLS.Cert, config.Fleet.TLS.Key, config.Fleet.Discovery.SSHConfig, config.Fleet.Discovery.Inventory, config.SteamLogin.PasswordFile, config.SteamLogin.GuardSecretFile, config.Lock.Path, config.API.TLS.Cert, config.API.TLS.Key, config.API.TLS.ClientCA}
+	for _, project := range config.Compose.Projects {
+		files = append(files, project.File)
+	}
+	for _, file := range files {
+		if file != "" {
+			fmt.Fprintf(os.Stderr, "warning: %s is referenced by the config but not mounted into the pod\n", file)
+		}
+	}
+}
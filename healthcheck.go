@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Time the API has to answer the healthcheck
+const healthcheckTimeout = 5 * time.Second
+
+func runHealthcheck(options watcher.Options, args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	intervals := flags.Int("intervals", watcher.DEFAULT_HEALTH_INTERVALS, "check intervals without a check until the watcher is unhealthy")
+	url := flags.String("url", "", "health endpoint of the watcher, GET /health of api.listen by default")
+	file := flags.String("file", options.HealthFile, "status file of the watcher instead of the API")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher healthcheck [--intervals <n>] [--url <url> | --file <path>]")
+		fmt.Fprintln(flags.Output(), "Exits with 1 if the last check of the watcher is older than the given number of check intervals, e.g. for a container HEALTHCHECK.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *intervals <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var status watcher.Status
+	var err error
+	if *file != "" && *url == "" {
+		status, err = readHealthFile(*file)
+	} else {
+		status, err = queryHealth(options.API, *url)
+	}
+	if err != nil {
+		return err
+	}
+	if err := status.Healthy(*intervals, time.Now()); err != nil {
+		return fmt.Errorf("unhealthy: %w", err)
+	}
+	return nil
+}
+
+func readHealthFile(path string) (watcher.Status, error) {
+	var status watcher.Status
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return status, fmt.Errorf("failed to read health file: %w", err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("invalid health file %s: %w", path, err)
+	}
+	return status, nil
+}
+
+// The status of GET /health, judged here like the file
+func queryHealth(api watcher.APIConfig, url string) (watcher.Status, error) {
+	var response struct {
+		Status watcher.Status `json:"status"`
+	}
+	client := &http.Client{Timeout: healthcheckTimeout}
+	if url == "" {
+		if api.Listen == "" {
+			return response.Status, fmt.Errorf("neither api.listen nor health_file is set, pass --url or --file")
+		}
+		host, port, err := net.SplitHostPort(api.Listen)
+		if err != nil {
+			return response.Status, fmt.Errorf("invalid api.listen %q: %w", api.Listen, err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		scheme := "http"
+		if api.TLS.Cert != "" {
+			// The watcher's own certificate is not issued for localhost, and the health of it is public anyway
+			scheme = "https"
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+		url = scheme + "://" + net.JoinHostPort(host, port) + "/health"
+	}
+
+	reply, err := client.Get(url)
+	if err != nil {
+		return response.Status, fmt.Errorf("failed to query watcher health: %w", err)
+	}
+	defer reply.Body.Close()
+	if reply.StatusCode != http.StatusOK && reply.StatusCode != http.StatusServiceUnavailable {
+		return response.Status, fmt.Errorf("failed to query watcher health: %s", reply.Status)
+	}
+	if err := json.NewDecoder(reply.Body).Decode(&response); err != nil {
+		return response.Status, fmt.Errorf("invalid health response: %w", err)
+	}
+	return response.Status, nil
+}
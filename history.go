@@ -0,0 +1,65 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runHistory(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Int("limit", 20, "number of builds to show")
+	host := flags.String("host", "", "only show builds of this watcher host, all hosts sharing the store by default")
+	asJson := flags.Bool("json", false, "print the builds as JSON")
+	flags.Parse(args)
+
+	entries, err := updateWatcher.History(*limit, 0, *host)
+	if err != nil {
+		return fmt.Errorf("failed to read build history: %w", err)
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILDID\tHOST\tDETECTED\tBUILT\tDURATION\tPUSHED\tOUTCOME")
+	for _, entry := range entries {
+		pushed := "-"
+		if len(entry.Pushed) > 0 {
+			pushed = formatTime(entry.PushedAt)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Buildid,
+			entry.Host,
+			formatTime(entry.DetectedAt),
+			formatTime(entry.FinishedAt),
+			formatDuration(entry.Duration()),
+			pushed,
+			entry.Outcome,
+		)
+	}
+
+	return w.Flush()
+}
+
+// Format a timestamp for humans, empty times become "-"
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprint(d.Round(time.Second))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/store"
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func runInspect(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the provenance as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher inspect [--json] <tag>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	provenance, err := updateWatcher.Inspect(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(provenance)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Image:\t%s\n", provenance.Image)
+	fmt.Fprintf(w, "Image ID:\t%s\n", provenance.ImageID)
+	if provenance.Buildid != 0 {
+		fmt.Fprintf(w, "Buildid:\t%d\n", provenance.Buildid)
+	} else {
+		fmt.Fprintf(w, "Buildid:\tunknown\n")
+	}
+	fmt.Fprintf(w, "Created:\t%s\n", provenance.Created.Format(time.RFC3339))
+	fmt.Fprintf(w, "Size:\t%.1f MB\n", float64(provenance.Size)/1000/1000)
+	printList(w, "Tags", provenance.Tags)
+	printList(w, "Digests", provenance.Digests)
+	printList(w, "Pushed to", provenance.PushedRegistries)
+	if provenance.ContextDigest != "" {
+		fmt.Fprintf(w, "Context:\t%s\n", provenance.ContextDigest)
+	}
+	if provenance.ContextRevision != "" {
+		fmt.Fprintf(w, "Context revision:\t%s\n", provenance.ContextRevision)
+	}
+
+	if len(provenance.AttestedIn) > 0 {
+		printList(w, "Attested in", provenance.AttestedIn)
+		if provenance.Branch != "" {
+			fmt.Fprintf(w, "Branch:\t%s\n", provenance.Branch)
+		}
+		if !provenance.BuildFinished.IsZero() {
+			fmt.Fprintf(w, "Build time:\t%s (took %s)\n",
+				provenance.BuildFinished.Format(time.RFC3339),
+				provenance.BuildFinished.Sub(provenance.BuildStarted).Round(time.Second))
+		}
+		depots := []string{}
+		for _, depot := range provenance.Depots {
+			depots = append(depots, fmt.Sprintf("%d manifest %s", depot.ID, depot.Manifest))
+		}
+		printList(w, "Depots", depots)
+	}
+
+	if !provenance.DetectedAt.IsZero() {
+		fmt.Fprintf(w, "Detected:\t%s\n", provenance.DetectedAt.Format(time.RFC3339))
+	}
+	if build := provenance.Build; build != nil {
+		fmt.Fprintf(w, "Built:\t%s (took %s, %s)\n",
+			build.FinishedAt.Format(time.RFC3339), build.Duration().Round(time.Second), build.Outcome)
+		if !build.PushedAt.IsZero() {
+			fmt.Fprintf(w, "Pushed:\t%s\n", build.PushedAt.Format(time.RFC3339))
+		}
+		printList(w, "Pushed images", build.Pushed)
+		if build.ContextDigest != "" && provenance.ContextDigest == "" {
+			fmt.Fprintf(w, "Context:\t%s\n", build.ContextDigest)
+		}
+		validations := []string{}
+		for _, name := range sortedValidations(build.Validations) {
+			validation := build.Validations[name]
+			line := name + ": passed"
+			if !validation.Passed {
+				line = name + ": failed"
+			}
+			if validation.Detail != "" {
+				line += " (" + validation.Detail + ")"
+			}
+			if validation.Error != "" {
+				line += ": " + validation.Error
+			}
+			validations = append(validations, line)
+		}
+		printList(w, "Validations", validations)
+	}
+
+	if len(provenance.Labels) > 0 {
+		keys := make([]string, 0, len(provenance.Labels))
+		for key := range provenance.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintln(w, "Labels:\t")
+		for _, key := range keys {
+			fmt.Fprintf(w, "  %s\t%s\n", key, provenance.Labels[key])
+		}
+	}
+
+	return w.Flush()
+}
+
+func sortedValidations(validations map[string]store.Validation) []string {
+	names := make([]string, 0, len(validations))
+	for name := range validations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printList(w *tabwriter.Writer, name string, values []string) {
+	if len(values) == 0 {
+		fmt.Fprintf(w, "%s:\tnone\n", name)
+		return
+	}
+
+	for i, value := range values {
+		if i == 0 {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
+		} else {
+			fmt.Fprintf(w, "\t%s\n", value)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/secrets"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"time"
+)
+
+type logFlags struct {
+	level      *string
+	format     *string
+	file       *string
+	maxSize    *int
+	maxBackups *int
+	maxAge     *int
+}
+
+func registerLogFlags() logFlags {
+	return logFlags{
+		level:      flag.String("log-level", "info", "minimum log level: trace, debug, info, warn or error"),
+		format:     flag.String("log-format", "json", "log format: json or console"),
+		file:       flag.String("log-file", "", "write logs to this file instead of stderr, rotated by size"),
+		maxSize:    flag.Int("log-max-size", 100, "size in megabytes after which the log file is rotated"),
+		maxBackups: flag.Int("log-max-backups", 5, "number of rotated log files to keep"),
+		maxAge:     flag.Int("log-max-age", 30, "days to keep rotated log files"),
+	}
+}
+
+// Configure the global logger from the flags
+func (this logFlags) setup() error {
+	level, err := zerolog.ParseLevel(*this.level)
+	if err != nil || level == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level %q", *this.level)
+	}
+	zerolog.SetGlobalLevel(level)
+
+	var output io.Writer = os.Stderr
+	if *this.file != "" {
+		output = &lumberjack.Logger{
+			Filename:   *this.file,
+			MaxSize:    *this.maxSize,
+			MaxBackups: *this.maxBackups,
+			MaxAge:     *this.maxAge,
+		}
+	}
+
+	switch *this.format {
+	case "json":
+	case "console":
+		output = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339, NoColor: *this.file != ""}
+	default:
+		return fmt.Errorf("invalid log format %q, expected json or console", *this.format)
+	}
+
+	log.Logger = zerolog.New(secrets.Writer(output)).With().Timestamp().Logger()
+	return nil
+}
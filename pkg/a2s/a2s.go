@@ -0,0 +1,150 @@
+package a2s
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultTimeout = 2 * time.Second
+
+var (
+	packetHeader = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	infoRequest  = append(append([]byte{}, packetHeader...), append([]byte{'T'}, []byte("Source Engine Query\x00")...)...)
+)
+
+const (
+	responseChallenge = 'A'
+	responseInfo      = 'I'
+)
+
+// Subset of the A2S_INFO response
+type Info struct {
+	Name       string `json:"name"`
+	Map        string `json:"map"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players"`
+	Bots       int    `json:"bots"`
+}
+
+// Humans on the server, bots are included in Players by the protocol
+func (this Info) Humans() int {
+	if this.Players < this.Bots {
+		return 0
+	}
+	return this.Players - this.Bots
+}
+
+// Query the A2S_INFO of a game server, e.g. 127.0.0.1:27015. Without a deadline on ctx the query times out after
+// two seconds.
+func QueryInfo(ctx context.Context, address string) (*Info, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", address, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", address, err)
+	}
+
+	request := infoRequest
+	// Servers answer the first request with a challenge that has to be appended to a second one
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("failed to query %s: %w", address, err)
+		}
+
+		buffer := make([]byte, 1400)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s: %w", address, err)
+		}
+		response := buffer[:n]
+		if len(response) < 5 || !bytes.Equal(response[:4], packetHeader) {
+			return nil, fmt.Errorf("invalid response from %s", address)
+		}
+
+		switch response[4] {
+		case responseChallenge:
+			if len(response) < 9 {
+				return nil, fmt.Errorf("invalid challenge from %s", address)
+			}
+			request = append(append([]byte{}, infoRequest...), response[5:9]...)
+		case responseInfo:
+			info, err := parseInfo(response[5:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid response from %s: %w", address, err)
+			}
+			return info, nil
+		default:
+			return nil, fmt.Errorf("unexpected response type %#x from %s", response[4], address)
+		}
+	}
+
+	return nil, fmt.Errorf("no info from %s after repeated challenges", address)
+}
+
+func parseInfo(data []byte) (*Info, error) {
+	reader := bytes.NewReader(data)
+
+	var protocol byte
+	if err := binary.Read(reader, binary.LittleEndian, &protocol); err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	var err error
+	if info.Name, err = readString(reader); err != nil {
+		return nil, err
+	}
+	if info.Map, err = readString(reader); err != nil {
+		return nil, err
+	}
+	// Folder and game
+	for i := 0; i < 2; i++ {
+		if _, err = readString(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	var fields struct {
+		AppID      uint16
+		Players    uint8
+		MaxPlayers uint8
+		Bots       uint8
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &fields); err != nil {
+		return nil, err
+	}
+	info.Players = int(fields.Players)
+	info.MaxPlayers = int(fields.MaxPlayers)
+	info.Bots = int(fields.Bots)
+
+	return info, nil
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	var value []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", errors.New("unterminated string")
+		}
+		if b == 0 {
+			return string(value), nil
+		}
+		value = append(value, b)
+	}
+}
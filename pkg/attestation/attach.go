@@ -0,0 +1,244 @@
+package attestation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	emptyConfigMediaType = "application/vnd.oci.empty.v1+json"
+
+	sbomTagSuffix       = ".sbom"
+	provenanceTagSuffix = ".att"
+)
+
+// OCI 1.1 image manifest used as an artifact manifest
+type artifactManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Raw manifest that can be passed to remote.Put
+type rawManifest struct {
+	data      []byte
+	mediaType types.MediaType
+}
+
+func (this rawManifest) RawManifest() ([]byte, error) {
+	return this.data, nil
+}
+
+func (this rawManifest) MediaType() (types.MediaType, error) {
+	return this.mediaType, nil
+}
+
+// Attach the SBOM and provenance of a build to its pushed image as OCI referrers. The image reference in build must
+// include the digest. Registries without the referrers API still find the artifacts through cosign style fallback
+// tags <repository>:sha256-<digest>.sbom and .att.
+func Attach(ctx context.Context, build BuildInfo, keychain authn.Keychain) error {
+	digestRef, err := name.NewDigest(build.Image)
+	if err != nil {
+		return fmt.Errorf("attestations require a digest reference, got %s: %w", build.Image, err)
+	}
+	options := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain)}
+
+	subject, err := remote.Head(digestRef, options...)
+	if err != nil {
+		return fmt.Errorf("failed to get manifest of %s: %w", build.Image, err)
+	}
+
+	sbom, err := marshal(NewSBOM(build))
+	if err != nil {
+		return err
+	}
+	if err := attach(digestRef, subject, SBOMMediaType, sbom, sbomTagSuffix, options); err != nil {
+		return fmt.Errorf("failed to attach sbom: %w", err)
+	}
+
+	provenance, err := marshal(NewProvenance(build))
+	if err != nil {
+		return err
+	}
+	if err := attach(digestRef, subject, ProvenanceMediaType, provenance, provenanceTagSuffix, options); err != nil {
+		return fmt.Errorf("failed to attach provenance: %w", err)
+	}
+
+	return nil
+}
+
+func attach(subjectRef name.Digest, subject *v1.Descriptor, mediaType string, data []byte, tagSuffix string, options []remote.Option) error {
+	repo := subjectRef.Context()
+
+	config := static.NewLayer([]byte("{}"), emptyConfigMediaType)
+	layer := static.NewLayer(data, types.MediaType(mediaType))
+	for _, blob := range []v1.Layer{config, layer} {
+		if err := remote.WriteLayer(repo, blob, options...); err != nil {
+			return fmt.Errorf("failed to upload blob: %w", err)
+		}
+	}
+
+	configDesc, err := descriptorOf(config)
+	if err != nil {
+		return err
+	}
+	layerDesc, err := descriptorOf(layer)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  mediaType,
+		Config:        configDesc,
+		Layers:        []v1.Descriptor{layerDesc},
+		Subject: &v1.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	artifact := rawManifest{manifest, ociManifestMediaType}
+
+	digest, _, err := v1.SHA256(strings.NewReader(string(manifest)))
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(repo.Digest(digest.String()), artifact, options...); err != nil {
+		return fmt.Errorf("failed to push artifact manifest: %w", err)
+	}
+
+	if err := remote.Tag(repo.Tag(fallbackTag(subject.Digest, tagSuffix)), artifact, options...); err != nil {
+		return fmt.Errorf("failed to push fallback tag: %w", err)
+	}
+
+	return nil
+}
+
+func descriptorOf(layer v1.Layer) (v1.Descriptor, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+// sha256:abc becomes sha256-abc<suffix>
+func fallbackTag(digest v1.Hash, suffix string) string {
+	return digest.Algorithm + "-" + digest.Hex + suffix
+}
+
+// FallbackTags returns the tags the attestations of an image with the given digest are stored under, so they can be
+// copied along with the image.
+func FallbackTags(digest string) ([]string, error) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	return []string{fallbackTag(hash, sbomTagSuffix), fallbackTag(hash, provenanceTagSuffix)}, nil
+}
+
+// IsNotFound reports whether err is a registry 404, e.g. for an image without attestations
+func IsNotFound(err error) bool {
+	var transportErr *transport.Error
+	return errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound
+}
+
+// Fetch the SBOM and provenance attached to a pushed image (reference including the digest). Missing attestations
+// are returned as nil without an error.
+func Fetch(ctx context.Context, image string, keychain authn.Keychain) (*SPDXDocument, *Statement, error) {
+	digestRef, err := name.NewDigest(image)
+	if err != nil {
+		return nil, nil, fmt.Errorf("attestations require a digest reference, got %s: %w", image, err)
+	}
+	digest, err := v1.NewHash(digestRef.DigestStr())
+	if err != nil {
+		return nil, nil, err
+	}
+	options := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain)}
+
+	var sbom *SPDXDocument
+	data, err := fetchArtifact(digestRef.Context(), fallbackTag(digest, sbomTagSuffix), options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch sbom: %w", err)
+	}
+	if data != nil {
+		sbom = &SPDXDocument{}
+		if err := json.Unmarshal(data, sbom); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse sbom: %w", err)
+		}
+	}
+
+	var provenance *Statement
+	data, err = fetchArtifact(digestRef.Context(), fallbackTag(digest, provenanceTagSuffix), options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch provenance: %w", err)
+	}
+	if data != nil {
+		provenance = &Statement{}
+		if err := json.Unmarshal(data, provenance); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse provenance: %w", err)
+		}
+	}
+
+	return sbom, provenance, nil
+}
+
+func fetchArtifact(repo name.Repository, tag string, options []remote.Option) ([]byte, error) {
+	desc, err := remote.Get(repo.Tag(tag), options...)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var manifest artifactManifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse artifact manifest: %w", err)
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("artifact manifest %s has no layers", tag)
+	}
+
+	layer, err := remote.Layer(repo.Digest(manifest.Layers[0].Digest.String()), options...)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
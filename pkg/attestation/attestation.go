@@ -0,0 +1,254 @@
+package attestation
+
+import (
+	"csgo-update-watcher/pkg/steam"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SBOMMediaType       = "application/spdx+json"
+	ProvenanceMediaType = "application/vnd.in-toto+json"
+
+	slsaProvenanceType = "https://slsa.dev/provenance/v0.2"
+	inTotoStatement    = "https://in-toto.io/Statement/v0.1"
+	builderID          = "https://github.com/ShootingRange/csgo-update-watcher"
+	buildType          = "https://github.com/ShootingRange/csgo-update-watcher/steam-build@v1"
+)
+
+// Everything known about a build that ends up in its SBOM and provenance
+type BuildInfo struct {
+	// Image reference the attestations are about, including the digest
+	Image           string        `json:"image"`
+	AppID           int           `json:"appid"`
+	Buildid         int           `json:"buildid"`
+	Branch          string        `json:"branch"`
+	Depots          []steam.Depot `json:"depots"`
+	BaseImage       string        `json:"base_image"`
+	BaseImageDigest string        `json:"base_image_digest"`
+	Dockerfile      string        `json:"dockerfile"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	WatcherVersion  string        `json:"watcher_version"`
+}
+
+// Minimal SPDX 2.2 document, see https://spdx.github.io/spdx-spec/
+type SPDXDocument struct {
+	SPDXVersion       string         `json:"spdxVersion"`
+	DataLicense       string         `json:"dataLicense"`
+	SPDXID            string         `json:"SPDXID"`
+	Name              string         `json:"name"`
+	DocumentNamespace string         `json:"documentNamespace"`
+	CreationInfo      SPDXCreation   `json:"creationInfo"`
+	Packages          []SPDXPackage  `json:"packages"`
+	Relationships     []SPDXRelation `json:"relationships"`
+}
+
+type SPDXCreation struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type SPDXPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	Supplier         string         `json:"supplier,omitempty"`
+	Checksums        []SPDXChecksum `json:"checksums,omitempty"`
+	ExternalRefs     []SPDXExtRef   `json:"externalRefs,omitempty"`
+}
+
+type SPDXChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type SPDXExtRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type SPDXRelation struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// in-toto statement wrapping a SLSA v0.2 provenance predicate
+type Statement struct {
+	Type          string     `json:"_type"`
+	PredicateType string     `json:"predicateType"`
+	Subject       []Subject  `json:"subject"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Provenance struct {
+	Builder    ProvenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation ProvenanceInvocation `json:"invocation"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials"`
+}
+
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type ProvenanceInvocation struct {
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type ProvenanceMetadata struct {
+	BuildStartedOn  time.Time `json:"buildStartedOn"`
+	BuildFinishedOn time.Time `json:"buildFinishedOn"`
+}
+
+type ProvenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+func NewSBOM(build BuildInfo) SPDXDocument {
+	name, digest := splitDigest(build.Image)
+
+	document := SPDXDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              build.Image,
+		DocumentNamespace: "https://github.com/ShootingRange/csgo-update-watcher/sbom/" + strings.TrimPrefix(digest, "sha256:"),
+		CreationInfo: SPDXCreation{
+			Created:  build.FinishedAt.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: csgo-update-watcher-" + build.WatcherVersion},
+		},
+	}
+
+	image := SPDXPackage{
+		SPDXID:           "SPDXRef-Image",
+		Name:             name,
+		VersionInfo:      digest,
+		DownloadLocation: "NOASSERTION",
+	}
+	if hexDigest := strings.TrimPrefix(digest, "sha256:"); hexDigest != digest {
+		image.Checksums = []SPDXChecksum{{Algorithm: "SHA256", ChecksumValue: hexDigest}}
+	}
+	document.Packages = append(document.Packages, image)
+	document.Relationships = append(document.Relationships, SPDXRelation{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"})
+
+	app := SPDXPackage{
+		SPDXID:           "SPDXRef-SteamApp-" + strconv.Itoa(build.AppID),
+		Name:             "steam-app-" + strconv.Itoa(build.AppID),
+		VersionInfo:      strconv.Itoa(build.Buildid),
+		DownloadLocation: "https://steamdb.info/app/" + strconv.Itoa(build.AppID) + "/",
+		Supplier:         "Organization: Valve Corporation",
+	}
+	document.Packages = append(document.Packages, app)
+	document.Relationships = append(document.Relationships, SPDXRelation{"SPDXRef-Image", "CONTAINS", app.SPDXID})
+
+	for _, depot := range build.Depots {
+		id := "SPDXRef-SteamDepot-" + strconv.Itoa(depot.ID)
+		document.Packages = append(document.Packages, SPDXPackage{
+			SPDXID:           id,
+			Name:             "steam-depot-" + strconv.Itoa(depot.ID),
+			VersionInfo:      depot.Manifest,
+			DownloadLocation: "https://steamdb.info/depot/" + strconv.Itoa(depot.ID) + "/",
+			Supplier:         "Organization: Valve Corporation",
+		})
+		document.Relationships = append(document.Relationships, SPDXRelation{app.SPDXID, "CONTAINS", id})
+	}
+
+	if build.BaseImage != "" {
+		base := SPDXPackage{
+			SPDXID:           "SPDXRef-BaseImage",
+			Name:             build.BaseImage,
+			VersionInfo:      build.BaseImageDigest,
+			DownloadLocation: "NOASSERTION",
+		}
+		document.Packages = append(document.Packages, base)
+		document.Relationships = append(document.Relationships, SPDXRelation{"SPDXRef-Image", "DESCENDANT_OF", base.SPDXID})
+	}
+
+	return document
+}
+
+func NewProvenance(build BuildInfo) Statement {
+	name, digest := splitDigest(build.Image)
+
+	materials := []ProvenanceMaterial{}
+	if build.BaseImage != "" {
+		material := ProvenanceMaterial{URI: "docker-image://" + build.BaseImage}
+		if algorithm, value := splitHash(build.BaseImageDigest); algorithm != "" {
+			material.Digest = map[string]string{algorithm: value}
+		}
+		materials = append(materials, material)
+	}
+	for _, depot := range build.Depots {
+		materials = append(materials, ProvenanceMaterial{
+			URI:    fmt.Sprintf("steam://depot/%d/manifest/%s", depot.ID, depot.Manifest),
+			Digest: map[string]string{"steam-manifest": depot.Manifest},
+		})
+	}
+
+	subject := Subject{Name: name, Digest: map[string]string{}}
+	if algorithm, value := splitHash(digest); algorithm != "" {
+		subject.Digest[algorithm] = value
+	}
+
+	return Statement{
+		Type:          inTotoStatement,
+		PredicateType: slsaProvenanceType,
+		Subject:       []Subject{subject},
+		Predicate: Provenance{
+			Builder:   ProvenanceBuilder{ID: builderID + "@" + build.WatcherVersion},
+			BuildType: buildType,
+			Invocation: ProvenanceInvocation{
+				Parameters: map[string]interface{}{
+					"appid":      build.AppID,
+					"buildid":    build.Buildid,
+					"branch":     build.Branch,
+					"dockerfile": build.Dockerfile,
+				},
+			},
+			Metadata: ProvenanceMetadata{
+				BuildStartedOn:  build.StartedAt.UTC(),
+				BuildFinishedOn: build.FinishedAt.UTC(),
+			},
+			Materials: materials,
+		},
+	}
+}
+
+// Split repo@sha256:abc into repo and sha256:abc
+func splitDigest(image string) (string, string) {
+	parts := strings.SplitN(image, "@", 2)
+	if len(parts) != 2 {
+		return image, ""
+	}
+	return parts[0], parts[1]
+}
+
+func splitHash(digest string) (string, string) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+func marshal(value interface{}) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode attestation: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,239 @@
+// Package catalog publishes the current image references of every branch, variant and publish target as a single
+// JSON document, so deployment tooling can discover the newest images without listing registry tags.
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Artifact type of the catalog in a registry and media type of its only layer
+	MEDIA_TYPE = "application/vnd.csgo-watcher.catalog.v1+json"
+	// File name tools like oras pull write the catalog to
+	FILE_NAME = "catalog.json"
+
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	emptyConfigMediaType = "application/vnd.oci.empty.v1+json"
+	titleAnnotation      = "org.opencontainers.image.title"
+)
+
+// How long a PUT of the catalog to a URL may take
+const uploadTimeout = 30 * time.Second
+
+// Current images of every branch, variant and target
+type Catalog struct {
+	AppID       int       `json:"appid"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Entries     []Entry   `json:"entries"`
+}
+
+// The newest published image of a branch and variant in one publish target
+type Entry struct {
+	Branch  string `json:"branch"`
+	Variant string `json:"variant"`
+	// Name of the publish target
+	Target      string    `json:"target"`
+	Repository  string    `json:"repository"`
+	Buildid     int       `json:"buildid"`
+	Image       string    `json:"image"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Entries of the same key replace each other
+func (this Entry) Key() string {
+	return this.Target + " " + this.Repository + " " + this.Variant + " " + this.Branch
+}
+
+// Build a catalog of the entries, sorted by target, branch and variant
+func New(appid int, entries map[string]Entry) Catalog {
+	catalog := Catalog{AppID: appid, GeneratedAt: time.Now().UTC(), Entries: []Entry{}}
+	for _, entry := range entries {
+		catalog.Entries = append(catalog.Entries, entry)
+	}
+	sort.Slice(catalog.Entries, func(i, j int) bool {
+		a, b := catalog.Entries[i], catalog.Entries[j]
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		if a.Branch != b.Branch {
+			return a.Branch < b.Branch
+		}
+		return a.Variant < b.Variant
+	})
+	return catalog
+}
+
+// Publisher writes the catalog to every configured destination
+type Publisher struct {
+	// Registry reference the catalog is pushed to as an OCI artifact
+	reference string
+	keychain  authn.Keychain
+	// URL the catalog is PUT to, with extra headers like Authorization
+	url     string
+	headers map[string]string
+	file    string
+	client  *http.Client
+}
+
+// Empty destinations are skipped
+func NewPublisher(reference string, keychain authn.Keychain, url string, headers map[string]string, file string) *Publisher {
+	return &Publisher{reference, keychain, url, headers, file, &http.Client{Timeout: uploadTimeout}}
+}
+
+// Write the catalog to every destination, a failing destination does not stop the others
+func (this *Publisher) Publish(ctx context.Context, catalog Catalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	data = append(data, '\n')
+
+	failed := []string{}
+	if this.reference != "" {
+		if err := push(ctx, this.reference, data, this.keychain); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if this.url != "" {
+		if err := this.upload(ctx, data); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if this.file != "" {
+		if err := writeFile(this.file, data); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to publish catalog: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Raw manifest that can be passed to remote.Put
+type rawManifest struct {
+	data      []byte
+	mediaType types.MediaType
+}
+
+func (this rawManifest) RawManifest() ([]byte, error) {
+	return this.data, nil
+}
+
+func (this rawManifest) MediaType() (types.MediaType, error) {
+	return this.mediaType, nil
+}
+
+// OCI 1.1 image manifest used as an artifact manifest
+type artifactManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType"`
+	Config        v1.Descriptor   `json:"config"`
+	Layers        []v1.Descriptor `json:"layers"`
+}
+
+// Push the catalog as an artifact with the catalog as its only layer, `oras pull <reference>` writes it to FILE_NAME
+func push(ctx context.Context, reference string, data []byte, keychain authn.Keychain) error {
+	tag, err := name.NewTag(reference)
+	if err != nil {
+		return fmt.Errorf("invalid catalog reference %s: %w", reference, err)
+	}
+	options := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain)}
+
+	config := static.NewLayer([]byte("{}"), emptyConfigMediaType)
+	layer := static.NewLayer(data, MEDIA_TYPE)
+	descriptors := []v1.Descriptor{}
+	for _, blob := range []v1.Layer{config, layer} {
+		if err := remote.WriteLayer(tag.Context(), blob, options...); err != nil {
+			return fmt.Errorf("failed to upload catalog to %s: %w", reference, err)
+		}
+		digest, err := blob.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := blob.Size()
+		if err != nil {
+			return err
+		}
+		mediaType, err := blob.MediaType()
+		if err != nil {
+			return err
+		}
+		descriptors = append(descriptors, v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size})
+	}
+	descriptors[1].Annotations = map[string]string{titleAnnotation: FILE_NAME}
+
+	manifest, err := json.Marshal(artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  MEDIA_TYPE,
+		Config:        descriptors[0],
+		Layers:        descriptors[1:],
+	})
+	if err != nil {
+		return err
+	}
+	if err := remote.Tag(tag, rawManifest{manifest, ociManifestMediaType}, options...); err != nil {
+		return fmt.Errorf("failed to push catalog to %s: %w", reference, err)
+	}
+	return nil
+}
+
+// PUT the catalog to the URL, e.g. a presigned object storage URL or a WebDAV server
+func (this *Publisher) upload(ctx context.Context, data []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, this.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid catalog url: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range this.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := this.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to upload catalog: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(http.MaxBytesReader(nil, response.Body, 1024))
+		return fmt.Errorf("failed to upload catalog: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Replace the file without readers ever seeing half of it
+func writeFile(path string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
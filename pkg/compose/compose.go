@@ -0,0 +1,371 @@
+// Package compose redeploys docker compose projects with new builds: the image tags of their services are rewritten
+// in the compose files and the changed services recreated with the compose CLI.
+package compose
+
+import (
+	"bytes"
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Labels compose puts on the containers of its services
+const (
+	LABEL_PROJECT      = "com.docker.compose.project"
+	LABEL_CONFIG_FILES = "com.docker.compose.project.config_files"
+	LABEL_WORKING_DIR  = "com.docker.compose.project.working_dir"
+	LABEL_SERVICE      = "com.docker.compose.service"
+)
+
+// A compose project kept on the newest build
+type Project struct {
+	// Compose file the image tags are rewritten in
+	File string `yaml:"file"`
+	// Project name, compose's default (the directory of the file) if empty
+	Name string `yaml:"name"`
+	// Only these services, every service with a managed image if empty
+	Services []string `yaml:"services"`
+}
+
+func (this Project) String() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return this.File
+}
+
+// Outcome of redeploying a project, unchanged projects have no images
+type Result struct {
+	Project string `json:"project"`
+	// Service name to the image it was updated to
+	Images map[string]string `json:"images,omitempty"`
+	Err    error             `json:"-"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// Finds the projects of running containers, implemented by the docker client
+type DockerClient interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+}
+
+// Updater rewrites the images of compose services, matching them by variant like rollouts do
+type Updater struct {
+	// The compose CLI and its leading arguments, e.g. docker compose
+	command  []string
+	projects []Project
+	// Find further projects by the labels of running containers, nil to only update the configured projects
+	docker  DockerClient
+	variant rollout.VariantFunc
+}
+
+// Update the given projects with command, ["docker", "compose"] if empty. With a docker client the projects of running
+// containers with a managed image are found by their labels too, their compose files have to be readable at the paths
+// compose recorded.
+func NewUpdater(command []string, projects []Project, docker DockerClient, variant rollout.VariantFunc) *Updater {
+	if len(command) == 0 {
+		command = []string{"docker", "compose"}
+	}
+	return &Updater{command, projects, docker, variant}
+}
+
+// A project with all of its compose files, as recorded by compose for discovered projects
+type project struct {
+	name       string
+	files      []string
+	workingDir string
+	services   []string
+}
+
+func (this project) String() string {
+	if this.name != "" {
+		return this.name
+	}
+	return strings.Join(this.files, ",")
+}
+
+// Rewrite the compose files of every project running an older image of one of the images and recreate the changed
+// services, one project at a time. A failing project does not stop the others.
+func (this *Updater) Update(ctx context.Context, images []string) ([]Result, error) {
+	return this.updateAll(ctx, images, false)
+}
+
+// The services Update would change, nothing is written or recreated
+func (this *Updater) DryRun(ctx context.Context, images []string) ([]Result, error) {
+	return this.updateAll(ctx, images, true)
+}
+
+func (this *Updater) updateAll(ctx context.Context, images []string, dryRun bool) ([]Result, error) {
+	replacements := map[string]string{}
+	for _, image := range images {
+		if variant, ok := this.variant(image); ok {
+			replacements[variant] = image
+		}
+	}
+
+	projects, err := this.allProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	failed := []string{}
+	for _, project := range projects {
+		result := Result{Project: project.String()}
+		result.Images, result.Err = this.update(ctx, project, replacements, dryRun)
+		if result.Err != nil {
+			result.Error = result.Err.Error()
+			log.Err(result.Err).Str("project", result.Project).Msg("Failed to redeploy compose project")
+			failed = append(failed, fmt.Sprintf("%s: %s", project, result.Err))
+		} else if len(result.Images) > 0 && !dryRun {
+			log.Info().Str("project", result.Project).Msg("Redeployed compose project")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to redeploy %d of %d compose projects: %s", len(failed), len(projects), strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// The configured projects and, with a docker client, the discovered ones that are not configured
+func (this *Updater) allProjects(ctx context.Context) ([]project, error) {
+	projects := []project{}
+	configured := map[string]bool{}
+	for _, configuredProject := range this.projects {
+		file, err := filepath.Abs(configuredProject.File)
+		if err != nil {
+			return nil, err
+		}
+		configured[file] = true
+		projects = append(projects, project{
+			name:       configuredProject.Name,
+			files:      []string{file},
+			workingDir: filepath.Dir(file),
+			services:   configuredProject.Services,
+		})
+	}
+	if this.docker == nil {
+		return projects, nil
+	}
+
+	containers, err := this.docker.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LABEL_PROJECT)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list compose containers: %w", err)
+	}
+	discovered := map[string]*project{}
+	for _, container := range containers {
+		if _, ok := this.variant(container.Image); !ok {
+			continue
+		}
+		name := container.Labels[LABEL_PROJECT]
+		files := strings.Split(container.Labels[LABEL_CONFIG_FILES], ",")
+		if files[0] == "" || configured[files[0]] {
+			continue
+		}
+		if discovered[name] == nil {
+			discovered[name] = &project{name: name, files: files, workingDir: container.Labels[LABEL_WORKING_DIR]}
+		}
+		discovered[name].services = append(discovered[name].services, container.Labels[LABEL_SERVICE])
+	}
+	names := []string{}
+	for name := range discovered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		projects = append(projects, *discovered[name])
+	}
+	return projects, nil
+}
+
+func (this *Updater) update(ctx context.Context, project project, replacements map[string]string, dryRun bool) (map[string]string, error) {
+	replace := func(image string) (string, bool) {
+		variant, ok := this.variant(image)
+		if !ok {
+			return "", false
+		}
+		replacement, ok := replacements[variant]
+		return replacement, ok && replacement != image
+	}
+
+	updated := map[string]string{}
+	rewritten := map[string][]byte{}
+	for _, file := range project.files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compose file: %w", err)
+		}
+		result, images, err := rewrite(data, project.services, replace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite %s: %w", file, err)
+		}
+		if len(images) > 0 {
+			rewritten[file] = result
+		}
+		for service, image := range images {
+			updated[service] = image
+		}
+	}
+	if len(updated) == 0 || dryRun {
+		return updated, nil
+	}
+
+	log.Info().Str("project", project.String()).Interface("images", updated).Msg("Rewriting compose files")
+	for file, data := range rewritten {
+		if err := writeFile(file, data); err != nil {
+			return nil, err
+		}
+	}
+
+	services := []string{}
+	for service := range updated {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	if err := this.run(ctx, project, append([]string{"pull"}, services...)...); err != nil {
+		return updated, err
+	}
+	// Only the changed services are recreated, their dependencies keep running
+	return updated, this.run(ctx, project, append([]string{"up", "--detach", "--no-deps"}, services...)...)
+}
+
+// Run the compose CLI in the project directory
+func (this *Updater) run(ctx context.Context, project project, args ...string) error {
+	global := []string{}
+	if project.name != "" {
+		global = append(global, "--project-name", project.name)
+	}
+	for _, file := range project.files {
+		global = append(global, "--file", file)
+	}
+	arguments := append(append(append([]string{}, this.command[1:]...), global...), args...)
+	cmd := exec.CommandContext(ctx, this.command[0], arguments...)
+	cmd.Dir = project.workingDir
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(output.String()); message != "" {
+			return fmt.Errorf("compose %s: %s", args[0], message)
+		}
+		return fmt.Errorf("compose %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// Replace the file without leaving it half written, keeping its permissions
+func writeFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("failed to write compose file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write compose file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write compose file: %w", err)
+	}
+	if err := os.Chmod(temp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// An image value to replace, at its position in the file
+type edit struct {
+	line, column int
+	old, new     string
+}
+
+// Point the image of every selected service at its replacement. The values are replaced where they are in the file so
+// comments and formatting stay as they are. Returns the file and the updated services with their new images.
+func rewrite(data []byte, services []string, replace func(image string) (string, bool)) ([]byte, map[string]string, error) {
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+	if len(document.Content) == 0 {
+		return data, nil, nil
+	}
+	selected := map[string]bool{}
+	for _, service := range services {
+		selected[service] = true
+	}
+
+	updated := map[string]string{}
+	edits := []edit{}
+	servicesNode := mappingValue(document.Content[0], "services")
+	if servicesNode == nil || servicesNode.Kind != yaml.MappingNode {
+		return data, nil, nil
+	}
+	for i := 0; i+1 < len(servicesNode.Content); i += 2 {
+		name := servicesNode.Content[i].Value
+		if len(selected) > 0 && !selected[name] {
+			continue
+		}
+		image := mappingValue(servicesNode.Content[i+1], "image")
+		// Interpolated images like ${IMAGE} are left to the environment
+		if image == nil || image.Kind != yaml.ScalarNode || strings.Contains(image.Value, "$") {
+			continue
+		}
+		replacement, ok := replace(image.Value)
+		if !ok {
+			continue
+		}
+		column := image.Column - 1
+		if image.Style == yaml.DoubleQuotedStyle || image.Style == yaml.SingleQuotedStyle {
+			column++
+		}
+		updated[name] = replacement
+		edits = append(edits, edit{image.Line - 1, column, image.Value, replacement})
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	// Later edits first, so the positions of earlier ones on the same line stay valid
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].line != edits[j].line {
+			return edits[i].line > edits[j].line
+		}
+		return edits[i].column > edits[j].column
+	})
+	for _, edit := range edits {
+		line := lines[edit.line]
+		if edit.column+len(edit.old) > len(line) || string(line[edit.column:edit.column+len(edit.old)]) != edit.old {
+			return nil, nil, fmt.Errorf("image %q is not written as a single plain or quoted value on line %d", edit.old, edit.line+1)
+		}
+		rewritten := append([]byte{}, line[:edit.column]...)
+		rewritten = append(rewritten, edit.new...)
+		lines[edit.line] = append(rewritten, line[edit.column+len(edit.old):]...)
+	}
+	return bytes.Join(lines, []byte("\n")), updated, nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
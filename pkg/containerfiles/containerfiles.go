@@ -0,0 +1,21 @@
+// Package containerfiles holds the default build context of the images: the Dockerfiles of the base, preinstalled,
+// get5, plugins, repositories and checker images and the helper scripts the watcher runs in them. They are compiled
+// into the binary, so the watcher runs without a checkout of csgo-container next to it.
+package containerfiles
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed files
+var files embed.FS
+
+// The default build context, with the Dockerfiles at its root
+func FS() fs.FS {
+	context, err := fs.Sub(files, "files")
+	if err != nil {
+		panic(err)
+	}
+	return context
+}
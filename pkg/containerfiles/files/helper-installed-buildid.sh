@@ -0,0 +1,8 @@
+#!/bin/sh
+# Print the buildid of the installed dedicated server
+set -eu
+
+awk '
+	/"buildid"/ { gsub(/[^0-9]/, "", $2); print $2; found = 1; exit }
+	END { if (!found) exit 1 }
+' "${STEAMAPPDIR}/steamapps/appmanifest_${STEAMAPPID}.acf"
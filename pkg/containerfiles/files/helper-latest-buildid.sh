@@ -0,0 +1,18 @@
+#!/bin/sh
+# Print the buildid of the public branch on Steam
+set -eu
+
+# Log in with the account of steam_login if the watcher mounted it
+login="+login anonymous"
+if [ -f /run/secrets/steam_login ]; then
+	login="+runscript /run/secrets/steam_login"
+fi
+
+# shellcheck disable=SC2086
+info=$("${STEAMCMDDIR}/steamcmd.sh" ${login} +app_info_update 1 +app_info_print "${STEAMAPPID}" +quit)
+printf '%s\n' "${info}" | awk '
+	/"branches"/ { branches = 1 }
+	branches && /"public"/ { public = 1 }
+	public && /"buildid"/ { gsub(/[^0-9]/, "", $2); print $2; found = 1; exit }
+	END { if (!found) exit 1 }
+'
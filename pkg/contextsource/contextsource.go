@@ -0,0 +1,312 @@
+// Package contextsource fetches the Dockerfiles and scripts of the build context from a git repository or an OCI
+// artifact, so container definitions are versioned apart from the watcher deployment. Fetched files are cached: an
+// unchanged artifact is not downloaded again and a failing fetch leaves the files of the last one.
+package contextsource
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"csgo-update-watcher/pkg/gamefiles"
+	"csgo-update-watcher/pkg/gitops"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Full commit hashes, which ls-remote does not resolve
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Layer annotations of artifacts pushed with oras
+const (
+	titleAnnotation = "org.opencontainers.image.title"
+	// The layer is a tar.gz of the directory named by the title
+	unpackAnnotation = "io.deis.oras.content.unpack"
+)
+
+// Where the build context comes from, at most one of git and artifact
+type Source struct {
+	Git Git `yaml:"git"`
+	// OCI artifact like ghcr.io/shootingrange/csgo-container:v2, pushed with oras or as an image
+	Artifact string `yaml:"artifact"`
+	// Directory fetched files are kept in, defaults to the user's cache directory
+	Cache string `yaml:"cache"`
+}
+
+type Git struct {
+	URL string `yaml:"url"`
+	// Branch, tag or commit, the default branch if empty
+	Ref string `yaml:"ref"`
+	// Subdirectory holding the Dockerfiles, the root if empty
+	Dir        string `yaml:"dir"`
+	SSHKey     string `yaml:"ssh_key"`
+	KnownHosts string `yaml:"known_hosts"`
+	// HTTPS token, with username defaulting to x-access-token
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+}
+
+func (this Source) Enabled() bool {
+	return this.Git.URL != "" || this.Artifact != ""
+}
+
+func (this Source) Validate() error {
+	if this.Git.URL != "" && this.Artifact != "" {
+		return fmt.Errorf("git and artifact are exclusive")
+	}
+	if this.Artifact != "" {
+		if _, err := name.ParseReference(this.Artifact); err != nil {
+			return fmt.Errorf("invalid artifact %s: %w", this.Artifact, err)
+		}
+	}
+	if dir := path.Clean("/" + this.Git.Dir); this.Git.Dir != "" && dir == "/" {
+		return fmt.Errorf("invalid git dir %s", this.Git.Dir)
+	}
+	return nil
+}
+
+// Fetcher fetches a source into its cache
+type Fetcher struct {
+	source   Source
+	keychain authn.Keychain
+}
+
+func NewFetcher(source Source, keychain authn.Keychain) *Fetcher {
+	return &Fetcher{source, keychain}
+}
+
+// Fetch the newest files, returning the directory holding them and their revision, the commit or the digest of the
+// artifact. If the fetch fails the files of the last successful fetch are returned along with its error, if there
+// are any.
+func (this *Fetcher) Fetch(ctx context.Context) (string, string, error) {
+	cache := this.source.Cache
+	if cache == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to find cache directory: %w", err)
+		}
+		cache = filepath.Join(userCache, "csgo-update-watcher", "context")
+	}
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	if this.source.Artifact != "" {
+		return this.fetchArtifact(ctx, cache)
+	}
+	return this.fetchGit(ctx, cache)
+}
+
+// Keep one shallow checkout per URL, fetching only the ref
+func (this *Fetcher) fetchGit(ctx context.Context, cache string) (string, string, error) {
+	source := this.source.Git
+	checkout := filepath.Join(cache, "git-"+shortHash(source.URL))
+	dir := filepath.Join(checkout, filepath.FromSlash(path.Clean("/"+source.Dir)))
+	git := this.git()
+	cached := func(err error) (string, string, error) {
+		if revision, revErr := git.Run(ctx, checkout, "rev-parse", "HEAD"); revErr == nil {
+			return dir, revision, err
+		}
+		return "", "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(checkout, ".git")); err != nil {
+		if _, err := git.Run(ctx, "", "init", "--quiet", checkout); err != nil {
+			return "", "", fmt.Errorf("failed to create checkout of %s: %w", source.URL, err)
+		}
+		if _, err := git.Run(ctx, checkout, "remote", "add", "origin", source.URL); err != nil {
+			return "", "", fmt.Errorf("failed to create checkout of %s: %w", source.URL, err)
+		}
+	}
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := git.Run(ctx, checkout, "fetch", "--quiet", "--depth", "1", "--force", "origin", ref); err != nil {
+		return cached(fmt.Errorf("failed to fetch %s of %s: %w", ref, source.URL, err))
+	}
+	if _, err := git.Run(ctx, checkout, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return cached(fmt.Errorf("failed to check out %s of %s: %w", ref, source.URL, err))
+	}
+	if _, err := git.Run(ctx, checkout, "clean", "--quiet", "-ffdx"); err != nil {
+		return cached(fmt.Errorf("failed to clean checkout of %s: %w", source.URL, err))
+	}
+	revision, err := git.Run(ctx, checkout, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return "", "", fmt.Errorf("%s has no directory %s at %s", source.URL, source.Dir, revision)
+	}
+	return dir, revision, nil
+}
+
+func (this *Fetcher) git() gitops.Git {
+	source := this.source.Git
+	return gitops.NewGit(gitops.Repository{
+		URL:        source.URL,
+		SSHKey:     source.SSHKey,
+		KnownHosts: source.KnownHosts,
+		Token:      source.Token,
+		Username:   source.Username,
+	})
+}
+
+// Head asks the remote for the commit of the git ref without fetching anything, for polling. Annotated tags are
+// resolved to their commit, refs that are commits are their own head.
+func (this *Fetcher) Head(ctx context.Context) (string, error) {
+	source := this.source.Git
+	if source.URL == "" {
+		return "", fmt.Errorf("only git sources have a head")
+	}
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if commitPattern.MatchString(ref) {
+		return ref, nil
+	}
+	output, err := this.git().Run(ctx, "", "ls-remote", "--", source.URL, ref, ref+"^{}")
+	if err != nil {
+		return "", fmt.Errorf("failed to ask %s for %s: %w", source.URL, ref, err)
+	}
+	head := ""
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.HasSuffix(fields[1], "^{}") {
+			return fields[0], nil
+		}
+		if head == "" {
+			head = fields[0]
+		}
+	}
+	if head == "" {
+		return "", fmt.Errorf("%s has no ref %s", source.URL, ref)
+	}
+	return head, nil
+}
+
+// Every digest of the artifact is extracted into a directory of its own, the last one is kept for failing fetches
+func (this *Fetcher) fetchArtifact(ctx context.Context, cache string) (string, string, error) {
+	prefix := filepath.Join(cache, "oci-"+shortHash(this.source.Artifact))
+	last := prefix + ".last"
+	cached := func(err error) (string, string, error) {
+		if digest, readErr := ioutil.ReadFile(last); readErr == nil {
+			revision := strings.TrimSpace(string(digest))
+			return prefix + "-" + strings.TrimPrefix(revision, "sha256:"), revision, err
+		}
+		return "", "", err
+	}
+
+	reference, err := name.ParseReference(this.source.Artifact)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid artifact %s: %w", this.source.Artifact, err)
+	}
+	options := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(this.keychain)}
+	image, err := remote.Image(reference, options...)
+	if err != nil {
+		return cached(fmt.Errorf("failed to fetch %s: %w", this.source.Artifact, err))
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return cached(fmt.Errorf("failed to fetch %s: %w", this.source.Artifact, err))
+	}
+	dir := prefix + "-" + digest.Hex
+	if _, err := os.Stat(dir); err == nil {
+		return dir, digest.String(), nil
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return cached(fmt.Errorf("failed to fetch %s: %w", this.source.Artifact, err))
+	}
+	temp, err := ioutil.TempDir(cache, ".oci-")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create directory for %s: %w", this.source.Artifact, err)
+	}
+	defer os.RemoveAll(temp)
+	for _, descriptor := range manifest.Layers {
+		layer, err := remote.Layer(reference.Context().Digest(descriptor.Digest.String()), options...)
+		if err != nil {
+			return cached(fmt.Errorf("failed to fetch layer %s of %s: %w", descriptor.Digest, this.source.Artifact, err))
+		}
+		blob, err := layer.Compressed()
+		if err != nil {
+			return cached(fmt.Errorf("failed to fetch layer %s of %s: %w", descriptor.Digest, this.source.Artifact, err))
+		}
+		err = writeLayer(blob, temp, descriptor.Annotations, string(descriptor.MediaType))
+		blob.Close()
+		if err != nil {
+			return cached(fmt.Errorf("failed to extract layer %s of %s: %w", descriptor.Digest, this.source.Artifact, err))
+		}
+	}
+
+	if err := os.Rename(temp, dir); err != nil {
+		return "", "", fmt.Errorf("failed to cache %s: %w", this.source.Artifact, err)
+	}
+	if previous, _, _ := cached(nil); previous != "" && previous != dir {
+		os.RemoveAll(previous)
+	}
+	if err := ioutil.WriteFile(last, []byte(digest.String()+"\n"), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to cache %s: %w", this.source.Artifact, err)
+	}
+	return dir, digest.String(), nil
+}
+
+// Write a layer like oras pull does: packed directories are extracted into the directory of their title, other
+// layers with a title are written to that file. Image layers without a title are extracted into dir.
+func writeLayer(blob io.Reader, dir string, annotations map[string]string, mediaType string) error {
+	title := annotations[titleAnnotation]
+	target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+title)))
+	if title != "" && annotations[unpackAnnotation] != "true" {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, blob)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if title == "" && !strings.Contains(mediaType, "tar") {
+		return fmt.Errorf("layer of type %s has no title", mediaType)
+	}
+
+	// Tar layers may or may not be gzipped
+	buffered := bufio.NewReader(blob)
+	var files io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		files = decompressed
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return gamefiles.Extract(files, target)
+}
+
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:6])
+}
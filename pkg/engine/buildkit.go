@@ -0,0 +1,350 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Store of the OCI layout local base images are sent to buildkitd in
+const localStore = "local"
+
+type BuildKitOptions struct {
+	// buildkitd images are built with, e.g. tcp://build-box:1234, or docker-container://buildx_buildkit_<name>0 for
+	// the builder of docker buildx create --name <name>. Empty builds with the engine.
+	Address string             `yaml:"address"`
+	TLS     BuildKitTLSOptions `yaml:"tls"`
+	// Path of the buildctl binary, looked up in PATH if empty
+	Buildctl string `yaml:"buildctl"`
+}
+
+// Client certificates of a buildkitd listening on tcp
+type BuildKitTLSOptions struct {
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Name the server certificate is verified against, the host of address if empty
+	ServerName string `yaml:"server_name"`
+}
+
+func (this BuildKitOptions) Enabled() bool {
+	return this.Address != ""
+}
+
+func (this BuildKitOptions) Validate() error {
+	if !this.Enabled() {
+		return nil
+	}
+	if !strings.Contains(this.Address, "://") {
+		return fmt.Errorf("address %q needs a scheme, e.g. tcp://", this.Address)
+	}
+	if (this.TLS.Cert == "") != (this.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	return nil
+}
+
+// Saves the local base images of and loads the results of BuildKit builds, implemented by the docker and podman
+// clients
+type ImageTransfer interface {
+	ImageSave(ctx context.Context, images []string) (io.ReadCloser, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+}
+
+// BuildKit builds images with the buildctl CLI on a buildkitd of another host, so the game is downloaded and the
+// images are assembled there. Built images are loaded into the engine, which runs them. Build args naming images of
+// the local repository, e.g. BASE_IMAGE, are sent along as named contexts since buildkitd cannot pull them. Resource
+// limits of builds are up to buildkitd.
+type BuildKit struct {
+	binary  string
+	options BuildKitOptions
+	engine  ImageTransfer
+	// Repository of the images only the engine has
+	localRepository string
+}
+
+func NewBuildKit(options BuildKitOptions, engine ImageTransfer, localRepository string) (*BuildKit, error) {
+	binary := options.Buildctl
+	if binary == "" {
+		binary = "buildctl"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find buildctl: %w", err)
+	}
+	return &BuildKit{binary: path, options: options, engine: engine, localRepository: localRepository}, nil
+}
+
+func (this *BuildKit) command(ctx context.Context, args ...string) *exec.Cmd {
+	global := []string{"--addr", this.options.Address}
+	if this.options.TLS.CA != "" {
+		global = append(global, "--tlscacert", this.options.TLS.CA)
+	}
+	if this.options.TLS.Cert != "" {
+		global = append(global, "--tlscert", this.options.TLS.Cert, "--tlskey", this.options.TLS.Key)
+	}
+	if this.options.TLS.ServerName != "" {
+		global = append(global, "--tlsservername", this.options.TLS.ServerName)
+	}
+	return exec.CommandContext(ctx, this.binary, append(global, args...)...)
+}
+
+func (this *BuildKit) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	return this.ImageBuildWithSecrets(ctx, buildContext, options, nil)
+}
+
+// Build with the dockerfile frontend, the output of buildctl is returned as a docker JSON message stream like
+// Nerdctl's
+func (this *BuildKit) ImageBuildWithSecrets(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions, secrets map[string]string) (types.ImageBuildResponse, error) {
+	dir, err := ioutil.TempDir("", "csgo-watcher-build-")
+	if err != nil {
+		return types.ImageBuildResponse{}, fmt.Errorf("failed to create build context directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	contextDir := filepath.Join(dir, "context")
+	if err := os.Mkdir(contextDir, 0700); err != nil {
+		cleanup()
+		return types.ImageBuildResponse{}, fmt.Errorf("failed to create build context directory: %w", err)
+	}
+	if err := extractTar(buildContext, contextDir); err != nil {
+		cleanup()
+		return types.ImageBuildResponse{}, fmt.Errorf("failed to extract build context: %w", err)
+	}
+
+	configDir, err := writeRegistryConfig(options.AuthConfigs)
+	if err != nil {
+		cleanup()
+		return types.ImageBuildResponse{}, err
+	}
+	env := []string{}
+	if configDir != "" {
+		env = append(env, "DOCKER_CONFIG="+configDir)
+		removeContext := cleanup
+		cleanup = func() {
+			removeContext()
+			os.RemoveAll(configDir)
+		}
+	}
+
+	dockerfile := options.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	dockerfile = filepath.Join(contextDir, dockerfile)
+	args := []string{"build", "--frontend", "dockerfile.v0", "--progress", "plain",
+		"--local", "context=" + contextDir, "--local", "dockerfile=" + filepath.Dir(dockerfile),
+		"--opt", "filename=" + filepath.Base(dockerfile)}
+	if options.Target != "" {
+		args = append(args, "--opt", "target="+options.Target)
+	}
+	if options.NoCache {
+		args = append(args, "--no-cache")
+	} else {
+		// Keeps the cache metadata in the images, so later builds can reuse their layers from the registry
+		args = append(args, "--export-cache", "type=inline")
+	}
+	for _, image := range options.CacheFrom {
+		args = append(args, "--import-cache", "type=registry,ref="+image)
+	}
+	buildArgs := map[string]string{}
+	for key, value := range options.BuildArgs {
+		if value != nil {
+			buildArgs[key] = *value
+		}
+	}
+	local := []string{}
+	for _, key := range sortedKeys(buildArgs) {
+		args = append(args, "--opt", "build-arg:"+key+"="+buildArgs[key])
+		if this.isLocal(buildArgs[key]) && !contains(local, buildArgs[key]) {
+			local = append(local, buildArgs[key])
+		}
+	}
+	for _, key := range sortedKeys(options.Labels) {
+		args = append(args, "--opt", "label:"+key+"="+options.Labels[key])
+	}
+	for _, id := range sortedKeys(secrets) {
+		args = append(args, "--secret", "id="+id+",src="+secrets[id])
+	}
+	if len(local) > 0 {
+		contexts, err := this.writeLocalImages(ctx, filepath.Join(dir, localStore), local)
+		if err != nil {
+			cleanup()
+			return types.ImageBuildResponse{}, err
+		}
+		args = append(args, contexts...)
+	}
+	// Quoted as the names are a single CSV field
+	args = append(args, "--output", `type=docker,"name=`+strings.Join(options.Tags, ",")+`"`)
+
+	body, err := this.stream(ctx, env, cleanup, args...)
+	if err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	return types.ImageBuildResponse{Body: body}, nil
+}
+
+// Whether the image is of the local repository, e.g. csgo-watched:base
+func (this *BuildKit) isLocal(image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	local, err := reference.ParseNormalizedNamed(this.localRepository)
+	return err == nil && named.Name() == local.Name()
+}
+
+// Save the images from the engine into an OCI layout at dir, returns the buildctl arguments replacing the images in
+// FROM with the layout's
+func (this *BuildKit) writeLocalImages(ctx context.Context, dir string, images []string) ([]string, error) {
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+	args := []string{"--oci-layout", localStore + "=" + dir}
+	for _, image := range images {
+		digest, err := this.appendLocalImage(ctx, path, image)
+		if err != nil {
+			return nil, err
+		}
+		// The dockerfile frontend looks up named contexts by the familiar name of FROM
+		context := strings.TrimSuffix(familiar(image), ":latest")
+		args = append(args, "--opt", "context:"+context+"=oci-layout://"+localStore+"@"+digest)
+	}
+	return args, nil
+}
+
+// Save one image at a time, the archive's only image is read without matching its name, which podman qualifies with
+// localhost/
+func (this *BuildKit) appendLocalImage(ctx context.Context, path layout.Path, image string) (string, error) {
+	saved, err := this.engine.ImageSave(ctx, []string{image})
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s for buildkit: %w", image, err)
+	}
+	spool := string(path) + ".tar"
+	err = writeFile(spool, saved)
+	saved.Close()
+	defer os.Remove(spool)
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s for buildkit: %w", image, err)
+	}
+
+	img, err := tarball.ImageFromPath(spool, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read saved image %s: %w", image, err)
+	}
+	if err := path.AppendImage(img); err != nil {
+		return "", fmt.Errorf("failed to write %s to OCI layout: %w", image, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+func writeFile(path string, reader io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Run buildctl in the background and load the image it writes to stdout into the engine. The progress on stderr is
+// returned as a docker JSON message stream, failures of the build or the load end it with an error message. cleanup
+// runs once both finished.
+func (this *BuildKit) stream(ctx context.Context, env []string, cleanup func(), args ...string) (io.ReadCloser, error) {
+	cmd := this.command(ctx, args...)
+	cmd.Env = append(os.Environ(), env...)
+	image, err := cmd.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	progress, err := cmd.StderrPipe()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to run buildctl: %w", err)
+	}
+
+	loaded := make(chan error, 1)
+	go func() {
+		err := this.load(ctx, image)
+		// Keep reading so buildctl does not block on a full pipe
+		io.Copy(ioutil.Discard, image)
+		loaded <- err
+	}()
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer cleanup()
+		encoder := json.NewEncoder(writer)
+		scanner := bufio.NewScanner(progress)
+		last := ""
+		for scanner.Scan() {
+			last = scanner.Text()
+			if err := encoder.Encode(jsonmessage.JSONMessage{Stream: last + "\n"}); err != nil {
+				break
+			}
+		}
+		io.Copy(ioutil.Discard, progress)
+
+		message := ""
+		loadErr := <-loaded
+		if err := cmd.Wait(); err != nil {
+			message = fmt.Sprintf("buildctl build: %s", err)
+			if last != "" {
+				message += ": " + last
+			}
+		} else if loadErr != nil {
+			message = fmt.Sprintf("failed to load built image: %s", loadErr)
+		}
+		if message != "" {
+			encoder.Encode(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: message}, ErrorMessage: message})
+		}
+		writer.Close()
+	}()
+	return reader, nil
+}
+
+// Load the docker archive into the engine
+func (this *BuildKit) load(ctx context.Context, archive io.Reader) error {
+	response, err := this.engine.ImageLoad(ctx, archive, true)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return message.Error
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package engine connects to the container engine images are built and game servers run with. Every engine speaks
+// the Docker API, the differences are handled here.
+package engine
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DOCKER = "docker"
+	PODMAN = "podman"
+	// containerd without dockerd, through nerdctl
+	CONTAINERD = "containerd"
+)
+
+var engines = []string{DOCKER, PODMAN, CONTAINERD}
+
+// Client is every docker API call the watcher makes, implemented by *client.Client of the docker SDK for docker and
+// podman and by Nerdctl for containerd
+type Client interface {
+	rollout.DockerClient
+
+	ContainerWait(ctx context.Context, container string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ImageBuild(ctx context.Context, context io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+	ImageTag(ctx context.Context, image string, ref string) error
+	ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error)
+}
+
+// The BuildKit cache of engines building through the docker API. nerdctl's buildkitd is not covered.
+type BuildCache interface {
+	DiskUsage(ctx context.Context) (types.DiskUsage, error)
+	BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error)
+}
+
+// Builds images, the engine's Client or a remote BuildKit
+type Builder interface {
+	ImageBuild(ctx context.Context, context io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
+}
+
+// Builds with BuildKit secret mounts, the files of secrets by id. The docker API builds with the classic builder,
+// which has none.
+type SecretBuilder interface {
+	ImageBuildWithSecrets(ctx context.Context, context io.Reader, options types.ImageBuildOptions, secrets map[string]string) (types.ImageBuildResponse, error)
+}
+
+var (
+	_ Client        = &client.Client{}
+	_ Client        = &Nerdctl{}
+	_ BuildCache    = &client.Client{}
+	_ SecretBuilder = &Nerdctl{}
+	_ Builder       = &BuildKit{}
+	_ SecretBuilder = &BuildKit{}
+	_ ImageTransfer = &client.Client{}
+)
+
+func Validate(name string) error {
+	for _, engine := range engines {
+		if name == engine {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown engine %q, expected one of: %s", name, strings.Join(engines, ", "))
+}
+
+// How to reach the docker or podman API in place of DOCKER_HOST and the other docker CLI variables, e.g. a remote
+// dockerd started with --tlsverify
+type DockerOptions struct {
+	// e.g. tcp://docker.example.com:2376 or unix:///var/run/docker.sock
+	Host string `yaml:"host"`
+	// API version, e.g. 1.41, negotiated with the engine if empty
+	APIVersion string `yaml:"api_version"`
+	// Client certificates and the CA of a tcp host, in place of DOCKER_CERT_PATH
+	TLS DockerTLSOptions `yaml:"tls"`
+}
+
+// PEM files like the ca.pem, cert.pem and key.pem of DOCKER_CERT_PATH
+type DockerTLSOptions struct {
+	// CA the certificate of the engine is verified with, the system roots if empty
+	CA string `yaml:"ca"`
+	// Client certificate and key, for engines verifying their clients
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (this DockerTLSOptions) Enabled() bool {
+	return this.CA != "" || this.Cert != "" || this.Key != ""
+}
+
+func (this DockerOptions) Enabled() bool {
+	return this.Host != "" || this.APIVersion != "" || this.TLS.Enabled()
+}
+
+// Validate the options without connecting
+func (this DockerOptions) Validate() error {
+	if this.Host != "" {
+		parsed, err := client.ParseHostURL(this.Host)
+		if err != nil {
+			return fmt.Errorf("host %q is invalid: %w", this.Host, err)
+		}
+		if parsed.Scheme != "tcp" && parsed.Scheme != "unix" {
+			return fmt.Errorf("host must be a tcp:// or unix:// address, %s:// is not supported", parsed.Scheme)
+		}
+		if this.TLS.Enabled() && parsed.Scheme != "tcp" {
+			return fmt.Errorf("tls needs a tcp:// host")
+		}
+	}
+	if (this.TLS.Cert == "") != (this.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	return nil
+}
+
+// Connect to the engine. For docker and podman the docker options take precedence over DOCKER_HOST and the other
+// docker CLI variables, Podman's socket is found without either. containerd is driven through nerdctl with the given
+// options.
+func Connect(name string, containerd ContainerdOptions, docker DockerOptions) (Client, error) {
+	if err := Validate(name); err != nil {
+		return nil, err
+	}
+	if name == CONTAINERD {
+		return NewNerdctl(containerd)
+	}
+
+	options := []client.Opt{client.FromEnv}
+	if docker.Host != "" {
+		options = append(options, client.WithHost(docker.Host))
+	} else if name == PODMAN && os.Getenv("DOCKER_HOST") == "" {
+		host, err := PodmanHost()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, client.WithHost(host))
+	}
+	if docker.TLS.Enabled() {
+		options = append(options, client.WithTLSClientConfig(docker.TLS.CA, docker.TLS.Cert, docker.TLS.Key))
+	}
+	if docker.APIVersion != "" {
+		options = append(options, client.WithVersion(docker.APIVersion))
+	} else {
+		options = append(options, client.WithAPIVersionNegotiation())
+	}
+
+	dockerCli, err := client.NewClientWithOpts(options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s client: %w", name, err)
+	}
+	return dockerCli, nil
+}
+
+// Address of the Podman API: CONTAINER_HOST like the podman CLI, then the rootless socket of the current user, then
+// the rootful socket
+func PodmanHost() (string, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		if !strings.HasPrefix(host, "unix://") && !strings.HasPrefix(host, "tcp://") {
+			return "", fmt.Errorf("CONTAINER_HOST %q is not supported, use a unix:// or tcp:// address", host)
+		}
+		return host, nil
+	}
+
+	candidates := podmanSockets(os.Getenv("XDG_RUNTIME_DIR"), os.Getuid())
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return "unix://" + path, nil
+		}
+	}
+	return "", fmt.Errorf("no podman socket at %s, enable it with `systemctl --user enable --now podman.socket` (without --user for rootful podman)", strings.Join(candidates, ", "))
+}
+
+// Where Podman's socket may be, in the order it is looked for
+func podmanSockets(runtimeDir string, uid int) []string {
+	candidates := []string{}
+	if runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, "podman", "podman.sock"))
+	}
+	if uid != 0 {
+		candidates = append(candidates, fmt.Sprintf("/run/user/%d/podman/podman.sock", uid))
+	}
+	return append(candidates, "/run/podman/podman.sock")
+}
+
+// Podman stores images without a registry as localhost/<name> and lists them that way, so local images are named
+// like that from the start
+func LocalImageName(name string, image string) string {
+	if name != PODMAN {
+		return image
+	}
+	if slash := strings.Index(image, "/"); slash >= 0 {
+		domain := image[:slash]
+		if domain == "localhost" || strings.ContainsAny(domain, ".:") {
+			return image
+		}
+	}
+	return "localhost/" + image
+}
+
+// Adapt the build options to the engine. Podman keeps the intermediate containers of every build step around unless
+// told otherwise, which quickly fills rootless storage.
+func BuildOptions(name string, options types.ImageBuildOptions) types.ImageBuildOptions {
+	if name != PODMAN {
+		return options
+	}
+	options.Remove = true
+	options.ForceRemove = true
+	return options
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"github.com/docker/docker/api/types"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPodmanHostFromContainerHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"unix:///run/user/1000/podman/podman.sock", true},
+		{"tcp://podman.example.com:8080", true},
+		{"ssh://core@podman.example.com/run/podman/podman.sock", false},
+		{"/run/podman/podman.sock", false},
+		{"podman.example.com:8080", false},
+	}
+	for _, test := range tests {
+		t.Setenv("CONTAINER_HOST", test.host)
+		host, err := PodmanHost()
+		if test.valid && (err != nil || host != test.host) {
+			t.Errorf("CONTAINER_HOST %q resolved to %q, %v", test.host, host, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("CONTAINER_HOST %q is accepted as %q", test.host, host)
+		}
+	}
+}
+
+func TestPodmanHostFromRuntimeDir(t *testing.T) {
+	runtimeDir, err := ioutil.TempDir("", "podman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(runtimeDir)
+	path := filepath.Join(runtimeDir, "podman", "podman.sock")
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONTAINER_HOST", "")
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	// Leftover files that are not sockets are skipped
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if host, err := PodmanHost(); err == nil && host == "unix://"+path {
+		t.Errorf("regular file %s is used as the podman socket", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, err := PodmanHost()
+	if err != nil || host != "unix://"+path {
+		t.Errorf("podman host is %q, %v, want unix://%s", host, err, path)
+	}
+}
+
+func TestPodmanSockets(t *testing.T) {
+	tests := []struct {
+		runtimeDir string
+		uid        int
+		sockets    []string
+	}{
+		{"/run/user/1000", 1000, []string{"/run/user/1000/podman/podman.sock", "/run/user/1000/podman/podman.sock", "/run/podman/podman.sock"}},
+		{"/tmp/runtime", 1000, []string{"/tmp/runtime/podman/podman.sock", "/run/user/1000/podman/podman.sock", "/run/podman/podman.sock"}},
+		{"", 1000, []string{"/run/user/1000/podman/podman.sock", "/run/podman/podman.sock"}},
+		{"/run/user/0", 0, []string{"/run/user/0/podman/podman.sock", "/run/podman/podman.sock"}},
+		{"", 0, []string{"/run/podman/podman.sock"}},
+	}
+	for _, test := range tests {
+		sockets := podmanSockets(test.runtimeDir, test.uid)
+		if !reflect.DeepEqual(sockets, test.sockets) {
+			t.Errorf("sockets of XDG_RUNTIME_DIR %q and uid %d are %v, want %v", test.runtimeDir, test.uid, sockets, test.sockets)
+		}
+	}
+}
+
+func TestPodmanHostWithoutSocket(t *testing.T) {
+	t.Setenv("CONTAINER_HOST", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/nonexistent")
+	_, err := PodmanHost()
+	if err == nil {
+		t.Skip("podman socket found")
+	}
+	if !strings.Contains(err.Error(), "/nonexistent/podman/podman.sock") || !strings.Contains(err.Error(), "/run/podman/podman.sock") {
+		t.Errorf("error %q does not list the sockets looked for", err)
+	}
+}
+
+func TestLocalImageName(t *testing.T) {
+	tests := []struct {
+		engine string
+		image  string
+		name   string
+	}{
+		{PODMAN, "csgo-watched:buildid-1234", "localhost/csgo-watched:buildid-1234"},
+		{PODMAN, "library/csgo:buildid-1234", "localhost/library/csgo:buildid-1234"},
+		{PODMAN, "localhost/csgo:buildid-1234", "localhost/csgo:buildid-1234"},
+		{PODMAN, "localhost:5000/csgo:buildid-1234", "localhost:5000/csgo:buildid-1234"},
+		{PODMAN, "registry:5000/csgo:buildid-1234", "registry:5000/csgo:buildid-1234"},
+		{PODMAN, "registry.example.com/csgo:buildid-1234", "registry.example.com/csgo:buildid-1234"},
+		{DOCKER, "csgo-watched:buildid-1234", "csgo-watched:buildid-1234"},
+		{CONTAINERD, "csgo-watched:buildid-1234", "csgo-watched:buildid-1234"},
+	}
+	for _, test := range tests {
+		if name := LocalImageName(test.engine, test.image); name != test.name {
+			t.Errorf("%s names %q %q, want %q", test.engine, test.image, name, test.name)
+		}
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	tests := []struct {
+		engine string
+		remove bool
+	}{
+		{PODMAN, true},
+		{DOCKER, false},
+		{CONTAINERD, false},
+	}
+	for _, test := range tests {
+		options := BuildOptions(test.engine, types.ImageBuildOptions{Tags: []string{"csgo-watched:buildid-1234"}})
+		if options.Remove != test.remove || options.ForceRemove != test.remove {
+			t.Errorf("%s builds with Remove %t and ForceRemove %t, want %t", test.engine, options.Remove, options.ForceRemove, test.remove)
+		}
+		if !reflect.DeepEqual(options.Tags, []string{"csgo-watched:buildid-1234"}) {
+			t.Errorf("%s builds with the tags %v", test.engine, options.Tags)
+		}
+	}
+}
@@ -0,0 +1,871 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned for docker API calls nerdctl has no equivalent of
+var ErrUnsupported = errors.New("not supported by nerdctl")
+
+// Labels nerdctl keeps the docker-style settings of its containers in
+const (
+	nerdctlLabelPrefix   = "nerdctl/"
+	labelNerdctlNetworks = "nerdctl/networks"
+	labelNerdctlPorts    = "nerdctl/ports"
+	labelRestartPolicy   = "containerd.io/restart.policy"
+	labelRestartStatus   = "containerd.io/restart.status"
+)
+
+// Mounts nerdctl sets up for every container, they are not part of its configuration
+var managedMounts = []string{"/etc/hosts", "/etc/resolv.conf", "/etc/hostname"}
+
+// Named volumes are bind mounts of <data root>/volumes/<namespace>/<name>/_data
+var volumePath = regexp.MustCompile(`/volumes/[^/]+/([^/]+)/_data$`)
+
+type ContainerdOptions struct {
+	// Namespace of the images and containers, nerdctl's default ("default") if empty
+	Namespace string `yaml:"namespace"`
+	// containerd socket, nerdctl's default (/run/containerd/containerd.sock) if empty
+	Address string `yaml:"address"`
+	// buildkitd images are built with, e.g. unix:///run/buildkit/buildkitd.sock, nerdctl's default if empty
+	BuildkitHost string `yaml:"buildkit_host"`
+	// Path of the nerdctl binary, looked up in PATH if empty
+	Nerdctl string `yaml:"nerdctl"`
+}
+
+// Nerdctl makes the docker API calls of the watcher with the nerdctl CLI, for containerd hosts without dockerd.
+// Containers are recreated from nerdctl's own labels and the OCI spec, as its docker compatible inspect output leaves
+// most of the configuration out.
+type Nerdctl struct {
+	binary  string
+	options ContainerdOptions
+}
+
+func NewNerdctl(options ContainerdOptions) (*Nerdctl, error) {
+	binary := options.Nerdctl
+	if binary == "" {
+		binary = "nerdctl"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find nerdctl: %w", err)
+	}
+	return &Nerdctl{binary: path, options: options}, nil
+}
+
+func (this *Nerdctl) command(ctx context.Context, args ...string) *exec.Cmd {
+	global := []string{}
+	if this.options.Namespace != "" {
+		global = append(global, "--namespace", this.options.Namespace)
+	}
+	if this.options.Address != "" {
+		global = append(global, "--address", this.options.Address)
+	}
+	return exec.CommandContext(ctx, this.binary, append(global, args...)...)
+}
+
+// Run nerdctl and return its stdout
+func (this *Nerdctl) run(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := this.command(ctx, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("nerdctl %s: %s", args[0], message)
+		}
+		return nil, fmt.Errorf("nerdctl %s: %w", args[0], err)
+	}
+	return output, nil
+}
+
+// Run nerdctl in the background and return its output as a docker JSON message stream, failures end the stream with
+// an error message like docker's do. cleanup runs once nerdctl exited.
+func (this *Nerdctl) stream(ctx context.Context, env []string, cleanup func(), args ...string) (io.ReadCloser, error) {
+	cmd := this.command(ctx, args...)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to run nerdctl: %w", err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer cleanup()
+		encoder := json.NewEncoder(writer)
+		scanner := bufio.NewScanner(output)
+		last := ""
+		for scanner.Scan() {
+			last = scanner.Text()
+			if err := encoder.Encode(jsonmessage.JSONMessage{Stream: last + "\n"}); err != nil {
+				break
+			}
+		}
+		// Keep reading so nerdctl does not block on a full pipe
+		io.Copy(ioutil.Discard, output)
+
+		if err := cmd.Wait(); err != nil {
+			message := fmt.Sprintf("nerdctl %s: %s", args[0], err)
+			if last != "" {
+				message += ": " + last
+			}
+			encoder.Encode(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: message}, ErrorMessage: message})
+		}
+		writer.Close()
+	}()
+	return reader, nil
+}
+
+func (this *Nerdctl) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	args := []string{"ps", "-q", "--no-trunc"}
+	if options.All {
+		args = append(args, "-a")
+	}
+	output, err := this.run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(output))
+
+	containers := []types.Container{}
+	for _, id := range ids {
+		details, err := this.ContainerInspect(ctx, id)
+		if err != nil {
+			// Removed in the meantime
+			log.Debug().Err(err).Str("container", id).Msg("Failed to inspect listed container")
+			continue
+		}
+		summary := containerSummary(details)
+		ok, err := matchesFilters(summary, options.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			containers = append(containers, summary)
+		}
+	}
+	return containers, nil
+}
+
+func containerSummary(details types.ContainerJSON) types.Container {
+	summary := types.Container{
+		ID:      details.ID,
+		Names:   []string{details.Name},
+		Image:   details.Config.Image,
+		ImageID: details.Image,
+		Labels:  details.Config.Labels,
+		Command: strings.Join(append([]string{details.Path}, details.Args...), " "),
+	}
+	if created, err := time.Parse(time.RFC3339Nano, details.Created); err == nil {
+		summary.Created = created.Unix()
+	}
+	if details.State != nil {
+		summary.State = details.State.Status
+		summary.Status = details.State.Status
+	}
+	summary.HostConfig.NetworkMode = string(details.HostConfig.NetworkMode)
+	for port, bindings := range details.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			public, _ := strconv.Atoi(binding.HostPort)
+			summary.Ports = append(summary.Ports, types.Port{IP: binding.HostIP, PrivatePort: uint16(port.Int()), PublicPort: uint16(public), Type: port.Proto()})
+		}
+	}
+	if details.NetworkSettings != nil {
+		summary.NetworkSettings = &types.SummaryNetworkSettings{Networks: details.NetworkSettings.Networks}
+	}
+	return summary
+}
+
+// The subset of docker's container list filters the watcher uses
+func matchesFilters(summary types.Container, args filters.Args) (bool, error) {
+	for _, key := range args.Keys() {
+		switch key {
+		case "id":
+			matched := false
+			for _, id := range args.Get(key) {
+				matched = matched || strings.HasPrefix(summary.ID, id)
+			}
+			if !matched {
+				return false, nil
+			}
+		case "name":
+			if !args.Match(key, strings.TrimPrefix(summary.Names[0], "/")) {
+				return false, nil
+			}
+		case "status":
+			if !args.ExactMatch(key, summary.State) {
+				return false, nil
+			}
+		case "label":
+			if !args.MatchKVList(key, summary.Labels) {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("container filter %q: %w", key, ErrUnsupported)
+		}
+	}
+	return true, nil
+}
+
+// The parts of nerdctl's native inspect output that are missing from its docker compatible one
+type nativeContainer struct {
+	Labels map[string]string `json:"Labels"`
+	Spec   struct {
+		Hostname string `json:"hostname"`
+		Process  struct {
+			User struct {
+				UID uint32 `json:"uid"`
+				GID uint32 `json:"gid"`
+			} `json:"user"`
+			Args []string `json:"args"`
+			Env  []string `json:"env"`
+			Cwd  string   `json:"cwd"`
+		} `json:"process"`
+	} `json:"Spec"`
+}
+
+type nerdctlPort struct {
+	HostPort      int
+	ContainerPort int
+	Protocol      string
+	HostIP        string
+}
+
+func (this *Nerdctl) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	var compat []types.ContainerJSON
+	if err := this.inspect(ctx, &compat, "container", "inspect", "--mode=dockercompat", id); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	var native []nativeContainer
+	if err := this.inspect(ctx, &native, "container", "inspect", "--mode=native", id); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	if len(compat) != 1 || len(native) != 1 || compat[0].ContainerJSONBase == nil {
+		return types.ContainerJSON{}, fmt.Errorf("no such container: %s", id)
+	}
+	details, spec := compat[0], native[0]
+
+	if !strings.HasPrefix(details.Name, "/") {
+		details.Name = "/" + details.Name
+	}
+	if details.Config == nil {
+		details.Config = &container.Config{}
+	}
+	config := details.Config
+	config.Image = familiar(config.Image)
+	if config.Image == "" {
+		config.Image = familiar(details.Image)
+	}
+	config.Hostname = spec.Spec.Hostname
+	config.Env = spec.Spec.Process.Env
+	config.WorkingDir = spec.Spec.Process.Cwd
+	if user := spec.Spec.Process.User; user.UID != 0 || user.GID != 0 {
+		config.User = fmt.Sprintf("%d:%d", user.UID, user.GID)
+	}
+	// The spec holds the resolved command, keep it apart like docker does
+	if args := spec.Spec.Process.Args; len(args) > 0 {
+		config.Entrypoint = args[:1]
+		config.Cmd = args[1:]
+	}
+	config.Labels = map[string]string{}
+	for key, value := range spec.Labels {
+		if !strings.HasPrefix(key, nerdctlLabelPrefix) && !strings.HasPrefix(key, "containerd.io/restart.") {
+			config.Labels[key] = value
+		}
+	}
+
+	hostConfig := &container.HostConfig{PortBindings: nat.PortMap{}}
+	networks := []string{}
+	if value := spec.Labels[labelNerdctlNetworks]; value != "" {
+		if err := json.Unmarshal([]byte(value), &networks); err != nil {
+			return details, fmt.Errorf("invalid %s label of %s: %w", labelNerdctlNetworks, id, err)
+		}
+	}
+	if len(networks) > 0 {
+		hostConfig.NetworkMode = container.NetworkMode(networks[0])
+	}
+	if value := spec.Labels[labelNerdctlPorts]; value != "" {
+		var ports []nerdctlPort
+		if err := json.Unmarshal([]byte(value), &ports); err != nil {
+			return details, fmt.Errorf("invalid %s label of %s: %w", labelNerdctlPorts, id, err)
+		}
+		for _, port := range ports {
+			key := nat.Port(strconv.Itoa(port.ContainerPort) + "/" + port.Protocol)
+			hostConfig.PortBindings[key] = append(hostConfig.PortBindings[key], nat.PortBinding{HostIP: port.HostIP, HostPort: strconv.Itoa(port.HostPort)})
+		}
+	}
+	for _, mount := range details.Mounts {
+		if contains(managedMounts, mount.Destination) {
+			continue
+		}
+		source := mount.Source
+		if match := volumePath.FindStringSubmatch(source); match != nil {
+			source = match[1]
+		} else if mount.Name != "" {
+			source = mount.Name
+		}
+		bind := source + ":" + mount.Destination
+		if !mount.RW {
+			bind += ":ro"
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+	if policy := spec.Labels[labelRestartPolicy]; policy != "" {
+		name, retries := policy, 0
+		if colon := strings.Index(policy, ":"); colon >= 0 {
+			name = policy[:colon]
+			retries, _ = strconv.Atoi(policy[colon+1:])
+		}
+		hostConfig.RestartPolicy = container.RestartPolicy{Name: name, MaximumRetryCount: retries}
+	} else if spec.Labels[labelRestartStatus] != "" {
+		hostConfig.RestartPolicy = container.RestartPolicy{Name: "always"}
+	}
+	details.HostConfig = hostConfig
+
+	// nerdctl names the endpoints after the interface, e.g. unknown-eth0, the networks are in the same order
+	if details.NetworkSettings != nil {
+		endpoints := map[string]*network.EndpointSettings{}
+		for key, endpoint := range details.NetworkSettings.Networks {
+			name := key
+			if index := strings.LastIndex(key, "-eth"); index >= 0 {
+				if i, err := strconv.Atoi(key[index+4:]); err == nil && i < len(networks) {
+					name = networks[i]
+				}
+			}
+			endpoints[name] = endpoint
+		}
+		details.NetworkSettings.Networks = endpoints
+	}
+
+	return details, nil
+}
+
+func (this *Nerdctl) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	args := []string{"create"}
+	if containerName != "" {
+		args = append(args, "--name", containerName)
+	}
+	if config.Hostname != "" {
+		args = append(args, "--hostname", config.Hostname)
+	}
+	for _, env := range config.Env {
+		args = append(args, "-e", env)
+	}
+	for _, key := range sortedKeys(config.Labels) {
+		args = append(args, "-l", key+"="+config.Labels[key])
+	}
+	if config.WorkingDir != "" {
+		args = append(args, "-w", config.WorkingDir)
+	}
+	if config.User != "" {
+		args = append(args, "-u", config.User)
+	}
+	command := []string(config.Cmd)
+	if len(config.Entrypoint) > 0 {
+		args = append(args, "--entrypoint", config.Entrypoint[0])
+		command = append(append([]string{}, config.Entrypoint[1:]...), command...)
+	}
+
+	if hostConfig != nil {
+		if mode := string(hostConfig.NetworkMode); mode != "" && mode != "default" {
+			args = append(args, "--net", mode)
+		}
+		for port, bindings := range hostConfig.PortBindings {
+			for _, binding := range bindings {
+				published := binding.HostPort + ":" + string(port)
+				if binding.HostIP != "" {
+					published = binding.HostIP + ":" + published
+				}
+				args = append(args, "-p", published)
+			}
+		}
+		for _, bind := range hostConfig.Binds {
+			args = append(args, "-v", bind)
+		}
+		for _, mount := range hostConfig.Mounts {
+			volume := mount.Source + ":" + mount.Target
+			if mount.ReadOnly {
+				volume += ":ro"
+			}
+			args = append(args, "-v", volume)
+		}
+		if policy := hostConfig.RestartPolicy; policy.Name != "" && policy.Name != "no" {
+			if policy.MaximumRetryCount > 0 {
+				args = append(args, "--restart", policy.Name+":"+strconv.Itoa(policy.MaximumRetryCount))
+			} else {
+				args = append(args, "--restart", policy.Name)
+			}
+		}
+		if hostConfig.Privileged {
+			args = append(args, "--privileged")
+		}
+		for _, capability := range hostConfig.CapAdd {
+			args = append(args, "--cap-add", capability)
+		}
+		for _, capability := range hostConfig.CapDrop {
+			args = append(args, "--cap-drop", capability)
+		}
+		for _, host := range hostConfig.ExtraHosts {
+			args = append(args, "--add-host", host)
+		}
+		for _, dns := range hostConfig.DNS {
+			args = append(args, "--dns", dns)
+		}
+		if hostConfig.Memory > 0 {
+			args = append(args, "-m", strconv.FormatInt(hostConfig.Memory, 10))
+		}
+		if hostConfig.NanoCPUs > 0 {
+			args = append(args, "--cpus", strconv.FormatFloat(float64(hostConfig.NanoCPUs)/1e9, 'f', -1, 64))
+		}
+		if hostConfig.PidsLimit != nil && *hostConfig.PidsLimit > 0 {
+			args = append(args, "--pids-limit", strconv.FormatInt(*hostConfig.PidsLimit, 10))
+		}
+	}
+	if networkingConfig != nil {
+		for name, endpoint := range networkingConfig.EndpointsConfig {
+			if hostConfig == nil || name != string(hostConfig.NetworkMode) {
+				args = append(args, "--net", name)
+			}
+			if endpoint != nil && endpoint.IPAMConfig != nil && endpoint.IPAMConfig.IPv4Address != "" {
+				args = append(args, "--ip", endpoint.IPAMConfig.IPv4Address)
+			}
+		}
+	}
+
+	args = append(args, config.Image)
+	args = append(args, command...)
+	output, err := this.run(ctx, args...)
+	if err != nil {
+		return container.ContainerCreateCreatedBody{}, err
+	}
+	return container.ContainerCreateCreatedBody{ID: strings.TrimSpace(string(output))}, nil
+}
+
+func (this *Nerdctl) ContainerStart(ctx context.Context, id string, options types.ContainerStartOptions) error {
+	_, err := this.run(ctx, "start", id)
+	return err
+}
+
+func (this *Nerdctl) ContainerStop(ctx context.Context, id string, timeout *time.Duration) error {
+	args := []string{"stop"}
+	if timeout != nil {
+		args = append(args, "-t", strconv.Itoa(int(timeout.Seconds())))
+	}
+	_, err := this.run(ctx, append(args, id)...)
+	return err
+}
+
+func (this *Nerdctl) ContainerRename(ctx context.Context, id string, name string) error {
+	_, err := this.run(ctx, "rename", id, name)
+	return err
+}
+
+func (this *Nerdctl) ContainerRemove(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+	args := []string{"rm"}
+	if options.Force {
+		args = append(args, "-f")
+	}
+	if options.RemoveVolumes {
+		args = append(args, "-v")
+	}
+	_, err := this.run(ctx, append(args, id)...)
+	return err
+}
+
+// nerdctl can only attach networks when creating a container, so containers in more than one network cannot be
+// recreated by rollouts
+func (this *Nerdctl) NetworkConnect(ctx context.Context, networkName string, id string, config *network.EndpointSettings) error {
+	return fmt.Errorf("connecting %s to network %s: %w", id, networkName, ErrUnsupported)
+}
+
+func (this *Nerdctl) ContainerWait(ctx context.Context, id string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	results := make(chan container.ContainerWaitOKBody, 1)
+	errs := make(chan error, 1)
+	go func() {
+		output, err := this.run(ctx, "wait", id)
+		if err != nil {
+			errs <- err
+			return
+		}
+		code, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+		if err != nil {
+			errs <- fmt.Errorf("unexpected nerdctl wait output %q", output)
+			return
+		}
+		results <- container.ContainerWaitOKBody{StatusCode: code}
+	}()
+	return results, errs
+}
+
+// The logs are multiplexed like docker's logs of containers without a TTY
+func (this *Nerdctl) ContainerLogs(ctx context.Context, id string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := this.command(ctx, "logs", id)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nerdctl logs: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	var multiplexed bytes.Buffer
+	if options.ShowStdout {
+		stdcopy.NewStdWriter(&multiplexed, stdcopy.Stdout).Write(stdout.Bytes())
+	}
+	if options.ShowStderr {
+		stdcopy.NewStdWriter(&multiplexed, stdcopy.Stderr).Write(stderr.Bytes())
+	}
+	return ioutil.NopCloser(&multiplexed), nil
+}
+
+type nerdctlImage struct {
+	Repository string
+	Tag        string
+}
+
+func (this *Nerdctl) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	output, err := this.run(ctx, "images", "--format", "{{json .}}")
+	if err != nil {
+		return nil, err
+	}
+	references := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		var image nerdctlImage
+		if line == "" || json.Unmarshal([]byte(line), &image) != nil || image.Repository == "<none>" || image.Tag == "<none>" {
+			continue
+		}
+		references = append(references, image.Repository+":"+image.Tag)
+	}
+	if len(references) == 0 {
+		return []types.ImageSummary{}, nil
+	}
+
+	var inspected []types.ImageInspect
+	if err := this.inspect(ctx, &inspected, append([]string{"image", "inspect", "--mode=dockercompat"}, references...)...); err != nil {
+		return nil, err
+	}
+	byID := map[string]*types.ImageSummary{}
+	summaries := []*types.ImageSummary{}
+	for _, image := range inspected {
+		summary, ok := byID[image.ID]
+		if !ok {
+			summary = &types.ImageSummary{ID: image.ID, Size: image.Size, RepoTags: []string{}, RepoDigests: image.RepoDigests}
+			if created, err := time.Parse(time.RFC3339Nano, image.Created); err == nil {
+				summary.Created = created.Unix()
+			}
+			if image.Config != nil {
+				summary.Labels = image.Config.Labels
+			}
+			byID[image.ID] = summary
+			summaries = append(summaries, summary)
+		}
+		for _, tag := range image.RepoTags {
+			summary.RepoTags = appendMissing(summary.RepoTags, familiar(tag))
+		}
+	}
+
+	images := make([]types.ImageSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		images = append(images, *summary)
+	}
+	return images, nil
+}
+
+func (this *Nerdctl) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	output, err := this.run(ctx, "image", "inspect", "--mode=dockercompat", image)
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	var inspected []types.ImageInspect
+	if err := json.Unmarshal(output, &inspected); err != nil {
+		return types.ImageInspect{}, nil, fmt.Errorf("failed to decode nerdctl image inspect output: %w", err)
+	}
+	if len(inspected) == 0 {
+		return types.ImageInspect{}, nil, fmt.Errorf("no such image: %s", image)
+	}
+	result := inspected[0]
+	for i, tag := range result.RepoTags {
+		result.RepoTags[i] = familiar(tag)
+	}
+	raw, _ := json.Marshal(result)
+	return result, raw, nil
+}
+
+func (this *Nerdctl) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	env, cleanup, err := registryConfig(ref, options.RegistryAuth)
+	if err != nil {
+		return nil, err
+	}
+	return this.stream(ctx, env, cleanup, "pull", ref)
+}
+
+func (this *Nerdctl) ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error) {
+	env, cleanup, err := registryConfig(ref, options.RegistryAuth)
+	if err != nil {
+		return nil, err
+	}
+	return this.stream(ctx, env, cleanup, "push", ref)
+}
+
+func (this *Nerdctl) ImageTag(ctx context.Context, image string, ref string) error {
+	_, err := this.run(ctx, "tag", image, ref)
+	return err
+}
+
+// Build with buildkitd from the extracted context
+func (this *Nerdctl) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	return this.ImageBuildWithSecrets(ctx, buildContext, options, nil)
+}
+
+// Build with the files of secrets mounted by RUN --mount=type=secret,id=<id>
+func (this *Nerdctl) ImageBuildWithSecrets(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions, secrets map[string]string) (types.ImageBuildResponse, error) {
+	dir, err := ioutil.TempDir("", "csgo-watcher-build-")
+	if err != nil {
+		return types.ImageBuildResponse{}, fmt.Errorf("failed to create build context directory: %w", err)
+	}
+	if err := extractTar(buildContext, dir); err != nil {
+		os.RemoveAll(dir)
+		return types.ImageBuildResponse{}, fmt.Errorf("failed to extract build context: %w", err)
+	}
+
+	configDir, err := writeRegistryConfig(options.AuthConfigs)
+	if err != nil {
+		os.RemoveAll(dir)
+		return types.ImageBuildResponse{}, err
+	}
+	env := []string{}
+	if configDir != "" {
+		env = append(env, "DOCKER_CONFIG="+configDir)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+		if configDir != "" {
+			os.RemoveAll(configDir)
+		}
+	}
+
+	args := []string{"build"}
+	if this.options.BuildkitHost != "" {
+		args = append(args, "--buildkit-host", this.options.BuildkitHost)
+	}
+	for _, tag := range options.Tags {
+		args = append(args, "-t", tag)
+	}
+	if options.Dockerfile != "" {
+		args = append(args, "-f", filepath.Join(dir, options.Dockerfile))
+	}
+	if options.Target != "" {
+		args = append(args, "--target", options.Target)
+	}
+	if options.NoCache {
+		args = append(args, "--no-cache")
+	} else {
+		// Keeps the cache metadata in the images, so later builds can reuse their layers from the registry
+		args = append(args, "--cache-to", "type=inline")
+	}
+	for _, image := range options.CacheFrom {
+		args = append(args, "--cache-from", "type=registry,ref="+image)
+	}
+	for key, value := range options.BuildArgs {
+		if value != nil {
+			args = append(args, "--build-arg", key+"="+*value)
+		}
+	}
+	for _, key := range sortedKeys(options.Labels) {
+		args = append(args, "--label", key+"="+options.Labels[key])
+	}
+	for _, id := range sortedKeys(secrets) {
+		args = append(args, "--secret", "id="+id+",src="+secrets[id])
+	}
+	args = append(args, "--progress", "plain", dir)
+
+	body, err := this.stream(ctx, env, cleanup, args...)
+	if err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	return types.ImageBuildResponse{Body: body}, nil
+}
+
+func (this *Nerdctl) inspect(ctx context.Context, value interface{}, args ...string) error {
+	output, err := this.run(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(output, value); err != nil {
+		return fmt.Errorf("failed to decode nerdctl %s output: %w", args[0], err)
+	}
+	return nil
+}
+
+// A DOCKER_CONFIG with the credentials of an X-Registry-Auth header, for nerdctl to read them from
+func registryConfig(ref string, encodedAuth string) ([]string, func(), error) {
+	if encodedAuth == "" {
+		return nil, func() {}, nil
+	}
+	data, err := base64.URLEncoding.DecodeString(encodedAuth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid registry auth: %w", err)
+	}
+	var auth types.AuthConfig
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, nil, fmt.Errorf("invalid registry auth: %w", err)
+	}
+	server := auth.ServerAddress
+	if named, err := reference.ParseNormalizedNamed(ref); server == "" && err == nil {
+		server = reference.Domain(named)
+	}
+
+	dir, err := writeRegistryConfig(map[string]types.AuthConfig{server: auth})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"DOCKER_CONFIG=" + dir}, func() { os.RemoveAll(dir) }, nil
+}
+
+// Write the credentials as a docker CLI config.json into a new directory, none if there are no credentials
+func writeRegistryConfig(auths map[string]types.AuthConfig) (string, error) {
+	if len(auths) == 0 {
+		return "", nil
+	}
+	dir, err := ioutil.TempDir("", "csgo-watcher-auth-")
+	if err != nil {
+		return "", fmt.Errorf("failed to write registry credentials: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), DockerConfig(auths), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to write registry credentials: %w", err)
+	}
+	return dir, nil
+}
+
+// The credentials as a docker CLI config.json, read by nerdctl, buildctl and the builders of kubernetes jobs
+func DockerConfig(auths map[string]types.AuthConfig) []byte {
+	type entry struct {
+		Auth          string `json:"auth,omitempty"`
+		IdentityToken string `json:"identitytoken,omitempty"`
+		RegistryToken string `json:"registrytoken,omitempty"`
+	}
+	config := struct {
+		Auths map[string]entry `json:"auths"`
+	}{Auths: map[string]entry{}}
+	for server, auth := range auths {
+		// Docker Hub credentials are looked up under their legacy address
+		if server == "docker.io" || server == "index.docker.io" {
+			server = "https://index.docker.io/v1/"
+		}
+		value := entry{Auth: auth.Auth, IdentityToken: auth.IdentityToken, RegistryToken: auth.RegistryToken}
+		if value.Auth == "" && auth.Username != "" {
+			value.Auth = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		}
+		config.Auths[server] = value
+	}
+	data, _ := json.Marshal(config)
+	return data
+}
+
+func extractTar(reader io.Reader, dir string) error {
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.Clean("/"+header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(header.Mode)|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, archive)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// nerdctl reports fully qualified names like docker.io/library/csgo-watched:base, docker the familiar csgo-watched:base
+func familiar(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarString(named)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMissing(values []string, value string) []string {
+	if contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
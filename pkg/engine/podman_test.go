@@ -0,0 +1,66 @@
+//go:build podman
+// +build podman
+
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"io/ioutil"
+	"testing"
+)
+
+// Builds against a running Podman API, run with `go test -tags podman ./pkg/engine` after
+// `systemctl --user start podman.socket`
+func TestPodmanBuild(t *testing.T) {
+	ctx := context.Background()
+	podman, err := Connect(PODMAN, ContainerdOptions{}, DockerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := []byte("FROM scratch\nLABEL io.csgo-watcher.test=true\n")
+	buildContext := &bytes.Buffer{}
+	tw := tar.NewWriter(buildContext)
+	tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))})
+	tw.Write(dockerfile)
+	tw.Close()
+
+	image := LocalImageName(PODMAN, "csgo-watcher-test:podman")
+	options := BuildOptions(PODMAN, types.ImageBuildOptions{Tags: []string{image}})
+	response, err := podman.ImageBuild(ctx, buildContext, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jsonmessage.DisplayJSONMessagesStream(response.Body, ioutil.Discard, 0, false, nil)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer podman.(*client.Client).ImageRemove(ctx, image, types.ImageRemoveOptions{Force: true})
+
+	inspect, _, err := podman.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		t.Fatalf("built image is not named %s: %s", image, err)
+	}
+	if inspect.Config == nil || inspect.Config.Labels["io.csgo-watcher.test"] != "true" {
+		t.Errorf("built image is missing its label: %+v", inspect.Config)
+	}
+
+	images, err := podman.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, summary := range images {
+		for _, tag := range summary.RepoTags {
+			if tag == image {
+				return
+			}
+		}
+	}
+	t.Errorf("podman does not list the built image as %s", image)
+}
@@ -0,0 +1,192 @@
+// Package eventstream publishes the events of the watcher to message brokers, NATS subjects and Kafka topics, for
+// any number of consumers the watcher does not know about. Events are queued and published in the background, a
+// broker that is down or slow drops events instead of holding up builds.
+package eventstream
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/metrics"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events queued when no buffer is configured
+const DEFAULT_BUFFER = 256
+
+// How long publishing a single event may take
+const publishTimeout = 10 * time.Second
+
+type Config struct {
+	NATS  NATSConfig  `yaml:"nats"`
+	Kafka KafkaConfig `yaml:"kafka"`
+	// Event types to publish, every type if empty
+	Events []string `yaml:"events"`
+	// Events queued while the brokers are slow, further events are dropped
+	Buffer int `yaml:"buffer"`
+}
+
+func (this Config) Enabled() bool {
+	return this.NATS.Enabled() || this.Kafka.Enabled()
+}
+
+// Validate the options of the enabled brokers, nothing is connected to
+func (this Config) Validate() error {
+	if this.NATS.Enabled() && this.NATS.Subject == "" {
+		return fmt.Errorf("event_stream.nats.subject must not be empty")
+	}
+	if strings.ContainsAny(this.NATS.Subject, " \t*>") {
+		return fmt.Errorf("event_stream.nats.subject must not contain whitespace or wildcards")
+	}
+	if this.Kafka.Enabled() && this.Kafka.Topic == "" {
+		return fmt.Errorf("event_stream.kafka.topic must not be empty")
+	}
+	for _, broker := range this.Kafka.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return fmt.Errorf("event_stream.kafka.brokers must be host:port: %w", err)
+		}
+	}
+	if this.Buffer < 0 {
+		return fmt.Errorf("event_stream.buffer must not be negative")
+	}
+	return nil
+}
+
+// Open connects to the enabled brokers of a valid config. The stream has no sinks if none is enabled.
+func Open(config Config) (*Stream, error) {
+	sinks := []Sink{}
+	if config.NATS.Enabled() {
+		sink, err := NewNATS(config.NATS)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.Kafka.Enabled() {
+		sink, err := NewKafka(config.Kafka)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return New(sinks, config.Events, config.Buffer), nil
+}
+
+// An encoded event
+type Message struct {
+	// Event type, e.g. build
+	Type string
+	// Keeps the events of one watcher in order on brokers that partition, the host of the watcher
+	Key  string
+	Data []byte
+}
+
+// Sink publishes messages to one broker
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, message Message) error
+	// Publish what is still buffered until ctx is done, then disconnect
+	Close(ctx context.Context) error
+}
+
+// Stream publishes messages to every sink, in the order they were sent
+type Stream struct {
+	sinks    []Sink
+	messages chan Message
+	// Only publishes these types, every type if empty
+	types map[string]bool
+
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// New starts publishing to sinks in the background until Close
+func New(sinks []Sink, types []string, buffer int) *Stream {
+	if buffer <= 0 {
+		buffer = DEFAULT_BUFFER
+	}
+	stream := &Stream{
+		sinks:    sinks,
+		messages: make(chan Message, buffer),
+		types:    map[string]bool{},
+		done:     make(chan struct{}),
+	}
+	for _, kind := range types {
+		stream.types[kind] = true
+	}
+	go stream.run()
+	return stream
+}
+
+// Names of the sinks
+func (this *Stream) Names() []string {
+	names := []string{}
+	for _, sink := range this.sinks {
+		names = append(names, sink.Name())
+	}
+	return names
+}
+
+// Queue the message without blocking, it is dropped if the queue is full or the stream closed
+func (this *Stream) Send(message Message) {
+	if len(this.types) > 0 && !this.types[message.Type] {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return
+	}
+	select {
+	case this.messages <- message:
+	default:
+		metrics.StreamedEventsDropped.Inc()
+		log.Warn().Str("event", message.Type).Msg("Dropped streamed event, the brokers are not keeping up")
+	}
+}
+
+func (this *Stream) run() {
+	defer close(this.done)
+	for message := range this.messages {
+		for _, sink := range this.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+			err := sink.Publish(ctx, message)
+			cancel()
+			if err != nil {
+				metrics.StreamErrors.WithLabelValues(sink.Name()).Inc()
+				log.Err(err).Str("sink", sink.Name()).Str("event", message.Type).Msg("Failed to stream event")
+				continue
+			}
+			metrics.StreamedEvents.WithLabelValues(sink.Name(), message.Type).Inc()
+		}
+	}
+}
+
+// Close publishes the queued messages and disconnects from the brokers, giving up once timeout passed
+func (this *Stream) Close(timeout time.Duration) {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.messages)
+	this.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case <-this.done:
+	case <-ctx.Done():
+		log.Warn().Int("events", len(this.messages)).Msg("Gave up on streaming the remaining events")
+	}
+	for _, sink := range this.sinks {
+		if err := sink.Close(ctx); err != nil {
+			log.Err(err).Str("sink", sink.Name()).Msg("Failed to close event stream")
+		}
+	}
+}
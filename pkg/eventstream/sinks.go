@@ -0,0 +1,127 @@
+package eventstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"time"
+)
+
+type NATSConfig struct {
+	// e.g. nats://nats:4222, several servers separated by commas
+	URL string `yaml:"url"`
+	// Events are published to <subject>.<event type>, e.g. csgo-update-watcher.build
+	Subject string `yaml:"subject"`
+	Token   string `yaml:"token"`
+	// Path to a .creds file with the JWT and NKey seed of the user
+	Credentials string `yaml:"credentials"`
+}
+
+func (this NATSConfig) Enabled() bool {
+	return this.URL != ""
+}
+
+// Publishes every event to the subject of its type
+type natsSink struct {
+	connection *nats.Conn
+	subject    string
+}
+
+// NewNATS connects in the background, events published until the server is reached are buffered by the client
+func NewNATS(config NATSConfig) (Sink, error) {
+	options := []nats.Option{
+		nats.Name("csgo-update-watcher"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if config.Credentials != "" {
+		options = append(options, nats.UserCredentials(config.Credentials))
+	}
+	connection, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	return &natsSink{connection, config.Subject}, nil
+}
+
+func (this *natsSink) Name() string {
+	return "nats"
+}
+
+func (this *natsSink) Publish(ctx context.Context, message Message) error {
+	return this.connection.Publish(this.subject+"."+message.Type, message.Data)
+}
+
+func (this *natsSink) Close(ctx context.Context) error {
+	defer this.connection.Close()
+	if !this.connection.IsConnected() {
+		return fmt.Errorf("dropped buffered events, NATS is not connected")
+	}
+	return this.connection.FlushWithContext(ctx)
+}
+
+type KafkaConfig struct {
+	// Bootstrap brokers as host:port
+	Brokers []string `yaml:"brokers"`
+	// Every event is written to this topic, with its type in the type header
+	Topic string `yaml:"topic"`
+	TLS   bool   `yaml:"tls"`
+	// SASL/PLAIN credentials, no authentication if empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (this KafkaConfig) Enabled() bool {
+	return len(this.Brokers) > 0
+}
+
+// Writes every event to one topic, partitioned by host
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafka connects on the first event
+func NewKafka(config KafkaConfig) (Sink, error) {
+	transport := &kafka.Transport{}
+	if config.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if config.Username != "" {
+		transport.SASL = plain.Mechanism{Username: config.Username, Password: config.Password}
+	}
+	return &kafkaSink{&kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Events are rare, waiting for a batch to fill up would only delay them
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    transport,
+	}}, nil
+}
+
+func (this *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (this *kafkaSink) Publish(ctx context.Context, message Message) error {
+	err := this.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(message.Key),
+		Value:   message.Data,
+		Headers: []kafka.Header{{Key: "type", Value: []byte(message.Type)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to kafka topic %s: %w", this.writer.Topic, err)
+	}
+	return nil
+}
+
+func (this *kafkaSink) Close(ctx context.Context) error {
+	return this.writer.Close()
+}
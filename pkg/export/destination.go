@@ -0,0 +1,164 @@
+package export
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/s3"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Destination stores archives by file name, a directory or a bucket
+type Destination interface {
+	String() string
+	// Where an archive of the destination is, for logs
+	Location(name string) string
+	// Store the archive, readers of the destination never see a partial one
+	Write(ctx context.Context, name string, archive io.Reader) (int64, error)
+	// File names of the archives
+	List(ctx context.Context) ([]string, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Remove(ctx context.Context, name string) error
+}
+
+// A local directory, e.g. on an NFS share or a removable disk
+type Directory string
+
+func (this Directory) String() string {
+	return string(this)
+}
+
+func (this Directory) Location(name string) string {
+	return filepath.Join(string(this), name)
+}
+
+func (this Directory) Write(ctx context.Context, name string, archive io.Reader) (int64, error) {
+	if err := os.MkdirAll(string(this), 0755); err != nil {
+		return 0, err
+	}
+	// Hidden until complete, List skips it
+	temp, err := ioutil.TempFile(string(this), "."+name+".*")
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(temp, archive)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(string(this), name))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return 0, fmt.Errorf("failed to write %s to %s: %w", name, this, err)
+	}
+	return size, nil
+}
+
+func (this Directory) List(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(string(this))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (this Directory) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(this), name))
+}
+
+func (this Directory) Remove(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(string(this), name))
+}
+
+// Objects below a prefix of a bucket, s3.path is the prefix
+type Bucket struct {
+	bucket *s3.Bucket
+	config s3.Config
+}
+
+func NewBucket(config s3.Config) (*Bucket, error) {
+	bucket, err := s3.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{bucket, config}, nil
+}
+
+func (this *Bucket) String() string {
+	return this.config.String()
+}
+
+func (this *Bucket) Location(name string) string {
+	return "s3://" + this.config.Bucket + "/" + this.key(name)
+}
+
+func (this *Bucket) key(name string) string {
+	return this.prefix() + name
+}
+
+func (this *Bucket) prefix() string {
+	prefix := strings.Trim(this.config.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func (this *Bucket) Write(ctx context.Context, name string, archive io.Reader) (int64, error) {
+	counter := &countingReader{reader: archive}
+	// Multipart uploads only become visible once complete
+	if err := this.bucket.Put(ctx, this.key(name), counter, -1, "application/x-tar"); err != nil {
+		return 0, err
+	}
+	return counter.count, nil
+}
+
+func (this *Bucket) List(ctx context.Context) ([]string, error) {
+	objects, err := this.bucket.List(ctx, this.prefix())
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, object := range objects {
+		// Only the archives directly below the prefix
+		if name := strings.TrimPrefix(object.Key, this.prefix()); !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (this *Bucket) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return this.bucket.Get(ctx, this.key(name))
+}
+
+func (this *Bucket) Remove(ctx context.Context, name string) error {
+	return this.bucket.Remove(ctx, this.key(name))
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	this.count += int64(n)
+	return n, err
+}
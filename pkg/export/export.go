@@ -0,0 +1,246 @@
+// Package export writes the images of builds as archives to directories or buckets for hosts without access to a
+// registry, and keeps only the newest archives. Archives are named after the buildid, so the hosts reading them know
+// what they hold before loading them with Load.
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/rs/zerolog/log"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Compressions of archives
+const (
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_NONE = "none"
+)
+
+// Formats of archives
+const (
+	// What docker save writes and docker load reads
+	FORMAT_DOCKER = "docker"
+	// Tar of an OCI image layout, e.g. for ctr import or skopeo copy oci-archive:
+	FORMAT_OCI = "oci"
+)
+
+// Where the images are read from
+const (
+	// docker save of the local images
+	SOURCE_ENGINE = "engine"
+	// Copied from the registry in-process, the pushed images
+	SOURCE_REGISTRY = "registry"
+)
+
+// Saves images from the engine as a docker archive, implemented by the docker and podman clients
+type DockerClient interface {
+	ImageSave(ctx context.Context, images []string) (io.ReadCloser, error)
+}
+
+// Outcome of exporting a build
+type Result struct {
+	// Where the archive was written to, e.g. /mnt/exports/csgo-buildid-123.tar.gz
+	Archive string `json:"archive"`
+	// Size of the archive in bytes
+	Size int64 `json:"size,omitempty"`
+	// Older archives removed afterwards
+	Removed []string `json:"removed,omitempty"`
+	Err     error    `json:"-"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Names of archives, e.g. csgo-buildid-123.tar.gz or csgo-buildid-123.oci.tar
+var archiveName = regexp.MustCompile(`^csgo-buildid-([0-9]+)(\.oci)?\.tar(\.gz)?$`)
+
+// File name of the archive of a buildid
+func ArchiveName(buildid int, format string, compression string) string {
+	name := "csgo-buildid-" + strconv.Itoa(buildid)
+	if format == FORMAT_OCI {
+		name += ".oci"
+	}
+	name += ".tar"
+	if compression == COMPRESSION_GZIP {
+		name += ".gz"
+	}
+	return name
+}
+
+// Buildid of an archive name, false for other files
+func ParseArchiveName(name string) (int, bool) {
+	match := archiveName.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	buildid, err := strconv.Atoi(match[1])
+	return buildid, err == nil
+}
+
+// How archives are written
+type Options struct {
+	Format      string
+	Compression string
+	Source      string
+	// Archives kept, 0 keeps all
+	Keep int
+}
+
+func (this Options) Validate() error {
+	if this.Format != FORMAT_DOCKER && this.Format != FORMAT_OCI {
+		return fmt.Errorf("format must be %s or %s", FORMAT_DOCKER, FORMAT_OCI)
+	}
+	if this.Compression != COMPRESSION_GZIP && this.Compression != COMPRESSION_NONE {
+		return fmt.Errorf("compression must be %s or %s", COMPRESSION_GZIP, COMPRESSION_NONE)
+	}
+	if this.Source != SOURCE_ENGINE && this.Source != SOURCE_REGISTRY {
+		return fmt.Errorf("source must be %s or %s", SOURCE_ENGINE, SOURCE_REGISTRY)
+	}
+	if this.Keep < 0 {
+		return fmt.Errorf("keep must not be negative")
+	}
+	return nil
+}
+
+// Exporter saves the images of every build into one archive, layers shared by the images are stored once
+type Exporter struct {
+	// Saves the images of SOURCE_ENGINE
+	docker DockerClient
+	// Pulls the images of SOURCE_REGISTRY
+	keychain    authn.Keychain
+	destination Destination
+	options     Options
+}
+
+// Docker is only used with SOURCE_ENGINE and may be nil otherwise
+func NewExporter(docker DockerClient, keychain authn.Keychain, destination Destination, options Options) *Exporter {
+	return &Exporter{docker, keychain, destination, options}
+}
+
+func (this *Exporter) Destination() Destination {
+	return this.destination
+}
+
+// Source of the images, SOURCE_ENGINE takes local images and SOURCE_REGISTRY pushed ones
+func (this *Exporter) Source() string {
+	return this.options.Source
+}
+
+// Export the images of the buildid, then remove the archives of all but the newest keep buildids. Failing to remove
+// an archive is only logged.
+func (this *Exporter) Export(ctx context.Context, buildid int, images []string) (Result, error) {
+	name := ArchiveName(buildid, this.options.Format, this.options.Compression)
+	result := Result{Archive: this.destination.Location(name)}
+	archive, err := this.archive(ctx, images)
+	if err != nil {
+		return result, err
+	}
+	defer archive.Close()
+
+	var reader io.Reader = archive
+	if this.options.Compression == COMPRESSION_GZIP {
+		compressed, writer := io.Pipe()
+		go func() {
+			compressor := gzip.NewWriter(writer)
+			_, err := io.Copy(compressor, archive)
+			if closeErr := compressor.Close(); err == nil {
+				err = closeErr
+			}
+			writer.CloseWithError(err)
+		}()
+		// Stops the compressor if writing fails
+		defer compressed.Close()
+		reader = compressed
+	}
+	if result.Size, err = this.destination.Write(ctx, name, reader); err != nil {
+		return result, err
+	}
+	result.Removed = this.prune(ctx, buildid)
+	return result, nil
+}
+
+// The uncompressed archive of the images. Docker archives of the engine are streamed from docker save, the other
+// combinations are written in-process.
+func (this *Exporter) archive(ctx context.Context, images []string) (io.ReadCloser, error) {
+	if this.options.Source == SOURCE_ENGINE && this.options.Format == FORMAT_DOCKER {
+		saved, err := this.docker.ImageSave(ctx, images)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save images: %w", err)
+		}
+		return saved, nil
+	}
+
+	var set *imageSet
+	var err error
+	if this.options.Source == SOURCE_ENGINE {
+		set, err = this.engineImages(ctx, images)
+	} else {
+		set, err = registryImages(ctx, images, this.keychain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer set.cleanup()
+		if this.options.Format == FORMAT_OCI {
+			writer.CloseWithError(writeOCI(set, writer))
+		} else {
+			writer.CloseWithError(writeDocker(set, writer))
+		}
+	}()
+	return reader, nil
+}
+
+// Remove the archives of all but the newest keep buildids, returns the removed names. The archive of exported, e.g.
+// of an older build rolled back to, is kept either way.
+func (this *Exporter) prune(ctx context.Context, exported int) []string {
+	if this.options.Keep <= 0 {
+		return nil
+	}
+	archives, err := List(ctx, this.destination)
+	if err != nil {
+		log.Err(err).Str("destination", this.destination.String()).Msg("Failed to list archives, not removing old ones")
+		return nil
+	}
+	buildids := []int{}
+	for buildid := range archives {
+		buildids = append(buildids, buildid)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(buildids)))
+	removed := []string{}
+	for i, buildid := range buildids {
+		if i < this.options.Keep || buildid == exported {
+			continue
+		}
+		for _, name := range archives[buildid] {
+			if err := this.destination.Remove(ctx, name); err != nil {
+				log.Err(err).Str("archive", name).Msg("Failed to remove old archive")
+				continue
+			}
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// The archives of the destination by buildid, a buildid may have one of each format and compression
+func List(ctx context.Context, destination Destination) (map[int][]string, error) {
+	names, err := destination.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archives of %s: %w", destination, err)
+	}
+	archives := map[int][]string{}
+	for _, name := range names {
+		if buildid, ok := ParseArchiveName(name); ok {
+			archives[buildid] = append(archives[buildid], name)
+		}
+	}
+	for _, names := range archives {
+		sort.Strings(names)
+	}
+	return archives, nil
+}
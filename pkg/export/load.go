@@ -0,0 +1,65 @@
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"io"
+	"strings"
+)
+
+// Lines of the output of docker load naming a loaded image, untagged ones are named by ID instead
+const loadedImage = "Loaded image: "
+
+// Loads archives into the engine, implemented by the docker and podman clients
+type Loader interface {
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+}
+
+// Load an archive of the destination into the engine, gzip compressed archives are decompressed on the way. OCI
+// archives need an engine that loads them, e.g. docker 25 or later. Returns the references of the loaded images.
+func Load(ctx context.Context, loader Loader, destination Destination, name string) ([]string, error) {
+	archive, err := destination.Open(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", destination.Location(name), err)
+	}
+	defer archive.Close()
+
+	var reader io.Reader = archive
+	if strings.HasSuffix(name, ".gz") {
+		decompressor, err := gzip.NewReader(archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", destination.Location(name), err)
+		}
+		defer decompressor.Close()
+		reader = decompressor
+	}
+	response, err := loader.ImageLoad(ctx, reader, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", destination.Location(name), err)
+	}
+	defer response.Body.Close()
+
+	images := []string{}
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read output of loading %s: %w", destination.Location(name), err)
+		}
+		if message.Error != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", destination.Location(name), message.Error)
+		}
+		for _, line := range strings.Split(message.Stream, "\n") {
+			if strings.HasPrefix(line, loadedImage) {
+				images = append(images, strings.TrimSpace(strings.TrimPrefix(line, loadedImage)))
+			}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,170 @@
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Annotations naming the images of an OCI layout, read by ctr import and skopeo
+const (
+	refNameAnnotation        = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+)
+
+// The images of a build for formats written in-process, read from a docker archive of the engine or pulled from
+// the registry
+type imageSet struct {
+	references []name.Reference
+	images     map[name.Reference]v1.Image
+	// Removes the spooled docker archive
+	cleanup func()
+}
+
+// Spool a docker archive of the engine to a temporary file for random access
+func (this *Exporter) engineImages(ctx context.Context, images []string) (*imageSet, error) {
+	saved, err := this.docker.ImageSave(ctx, images)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save images: %w", err)
+	}
+	defer saved.Close()
+	spool, err := ioutil.TempFile("", "csgo-export-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.Remove(spool.Name()) }
+	_, err = io.Copy(spool, saved)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to save images: %w", err)
+	}
+
+	set := &imageSet{images: map[name.Reference]v1.Image{}, cleanup: cleanup}
+	for _, image := range images {
+		tag, err := name.NewTag(image)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("invalid tag %s: %w", image, err)
+		}
+		img, err := tarball.ImageFromPath(spool.Name(), &tag)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to read saved image %s: %w", image, err)
+		}
+		set.references = append(set.references, tag)
+		set.images[tag] = img
+	}
+	return set, nil
+}
+
+// Pull the images from the registry, layers are only fetched while writing the archive
+func registryImages(ctx context.Context, images []string, keychain authn.Keychain) (*imageSet, error) {
+	set := &imageSet{images: map[name.Reference]v1.Image{}, cleanup: func() {}}
+	for _, image := range images {
+		reference, err := name.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %w", image, err)
+		}
+		img, err := remote.Image(reference, remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", image, err)
+		}
+		set.references = append(set.references, reference)
+		set.images[reference] = img
+	}
+	return set, nil
+}
+
+// Write the images as a docker archive
+func writeDocker(set *imageSet, writer io.Writer) error {
+	return tarball.MultiRefWrite(set.images, writer)
+}
+
+// Write the images as a tar of an OCI image layout, every image named by its reference
+func writeOCI(set *imageSet, writer io.Writer) error {
+	dir, err := ioutil.TempDir("", "csgo-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+	for _, reference := range set.references {
+		annotations := map[string]string{
+			refNameAnnotation:        reference.Identifier(),
+			containerdNameAnnotation: containerdName(reference),
+		}
+		if err := path.AppendImage(set.images[reference], layout.WithAnnotations(annotations)); err != nil {
+			return fmt.Errorf("failed to write %s to OCI layout: %w", reference, err)
+		}
+	}
+	return tarDirectory(dir, writer)
+}
+
+// Fully qualified like containerd names images, e.g. docker.io/library/csgo-watched:get5-buildid-123
+func containerdName(reference name.Reference) string {
+	registry := reference.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = "docker.io"
+	}
+	separator := ":"
+	if _, ok := reference.(name.Digest); ok {
+		separator = "@"
+	}
+	return registry + "/" + reference.Context().RepositoryStr() + separator + reference.Identifier()
+}
+
+// Write the files below dir as a tar with paths relative to dir
+func tarDirectory(dir string, writer io.Writer) error {
+	archive := tar.NewWriter(writer)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relative)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(archive, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
@@ -0,0 +1,201 @@
+package fleet
+
+import (
+	"crypto/subtle"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/rollout"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type pullRequest struct {
+	Image string `json:"image"`
+}
+
+type restartRequest struct {
+	Server rollout.Server `json:"server"`
+	Image  string         `json:"image"`
+	// Repositories managed by the coordinator, the server and image must belong to one of them
+	Repositories []string `json:"repositories"`
+	// Refuse the restart if the server is in a live match
+	CheckMatch bool `json:"check_match,omitempty"`
+}
+
+// Agent executes the coordinator's commands on a single docker host. It does not watch Steam or build anything.
+type Agent struct {
+	host        string
+	dockerCli   rollout.DockerClient
+	credentials rollout.Credentials
+	// Fallback for containers without an RCON_PASSWORD
+	rconPassword string
+	// Only containers labelled io.csgo-watcher.update=true are reported and restarted
+	labelled bool
+
+	mutex  sync.RWMutex
+	tokens []string
+}
+
+// Any of the tokens is accepted, so the coordinator's token can be rotated without downtime
+func NewAgent(host string, tokens []string, dockerCli rollout.DockerClient, credentials rollout.Credentials, rconPassword string) *Agent {
+	return &Agent{host: host, dockerCli: dockerCli, credentials: credentials, rconPassword: rconPassword, tokens: tokens}
+}
+
+func (this *Agent) OnlyLabelled(enabled bool) {
+	this.labelled = enabled
+}
+
+func (this *Agent) SetTokens(tokens []string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.tokens = tokens
+}
+
+func (this *Agent) authorized(token string) bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	authorized := false
+	for _, accepted := range this.tokens {
+		if accepted != "" && subtle.ConstantTimeCompare([]byte(token), []byte(accepted)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// HTTP API used by the coordinator, every request must carry one of the shared tokens
+func (this *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/report", this.handleReport)
+	mux.HandleFunc("/v1/pull", this.handlePull)
+	mux.HandleFunc("/v1/restart", this.handleRestart)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !this.authorized(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (this *Agent) target(repositories []string) *rollout.DockerTarget {
+	target := rollout.NewDockerTarget(this.host, this.dockerCli, this.credentials, repositories)
+	target.OnlyLabelled(this.labelled)
+	return target
+}
+
+// GET /v1/report?repository=<repository>&repository=...&players=true&matches=true
+func (this *Agent) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	target := this.target(r.URL.Query()["repository"])
+	target.QueryPlayers(r.URL.Query().Get("players") == "true")
+	target.QueryMatches(r.URL.Query().Get("matches") == "true", this.rconPassword)
+	report, err := newReport(r.Context(), target)
+	if err != nil {
+		log.Err(err).Msg("Failed to create report for coordinator")
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, report)
+}
+
+// POST /v1/pull {"image": "..."}
+func (this *Agent) handlePull(w http.ResponseWriter, r *http.Request) {
+	var request pullRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+
+	log.Info().Str("image", request.Image).Msg("Pulling image for coordinator")
+	if err := this.target(nil).Pull(r.Context(), request.Image); err != nil {
+		log.Err(err).Str("image", request.Image).Msg("Failed to pull image")
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /v1/restart {"server": {...}, "image": "...", "repositories": [...], "check_match": true}
+func (this *Agent) handleRestart(w http.ResponseWriter, r *http.Request) {
+	var request restartRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+	target := this.target(request.Repositories)
+	target.QueryMatches(request.CheckMatch, this.rconPassword)
+
+	// Only ever touch containers and images the coordinator manages
+	if !contains(request.Repositories, registry.RepositoryOf(request.Image)) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("image %s is not in a managed repository", request.Image))
+		return
+	}
+	servers, err := target.Servers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var server *rollout.Server
+	for i := range servers {
+		if servers[i].ID == request.Server.ID {
+			server = &servers[i]
+		}
+	}
+	if server == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no managed server %s", request.Server.Name))
+		return
+	}
+
+	log.Info().Str("server", server.Name).Str("image", request.Image).Msg("Restarting server for coordinator")
+	if err := target.Restart(r.Context(), *server, request.Image); errors.Is(err, rollout.ErrMatchLive) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		log.Err(err).Str("server", server.Name).Msg("Failed to restart server")
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Err(err).Msg("Failed to write agent response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
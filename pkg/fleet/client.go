@@ -0,0 +1,152 @@
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"csgo-update-watcher/pkg/rollout"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Reports are small, pulls and restarts are bounded by the caller's context instead
+const reportTimeout = 30 * time.Second
+
+// Client controls a remote agent, it is the coordinator's rollout target for that host
+type Client struct {
+	name         string
+	url          string
+	token        string
+	repositories []string
+	httpClient   *http.Client
+	queryPlayers bool
+	queryMatches bool
+}
+
+// With tlsConfig set the agent is expected to serve https with a certificate of the fleet CA
+func NewClient(name string, url string, token string, repositories []string, tlsConfig *tls.Config) *Client {
+	httpClient := &http.Client{}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+
+	return &Client{
+		name:         name,
+		url:          strings.TrimSuffix(url, "/"),
+		token:        token,
+		repositories: repositories,
+		httpClient:   httpClient,
+	}
+}
+
+func (this *Client) Name() string {
+	return this.name
+}
+
+// Let the agent query the player count of every server when listing servers for a rollout
+func (this *Client) QueryPlayers(enabled bool) {
+	this.queryPlayers = enabled
+}
+
+// Let the agent query the match state of every server when listing servers, and refuse restarts of servers in a
+// live match. Agents use the RCON password of their own configuration.
+func (this *Client) QueryMatches(enabled bool) {
+	this.queryMatches = enabled
+}
+
+func (this *Client) Report(ctx context.Context) (*Report, error) {
+	return this.report(ctx, false, false)
+}
+
+func (this *Client) report(ctx context.Context, players bool, matches bool) (*Report, error) {
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+
+	query := url.Values{"repository": this.repositories}
+	if players {
+		query.Set("players", "true")
+	}
+	if matches {
+		query.Set("matches", "true")
+	}
+	report := &Report{}
+	if err := this.do(ctx, http.MethodGet, "/v1/report?"+query.Encode(), nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (this *Client) Servers(ctx context.Context) ([]rollout.Server, error) {
+	report, err := this.report(ctx, this.queryPlayers, this.queryMatches)
+	if err != nil {
+		return nil, err
+	}
+	return report.Servers, nil
+}
+
+func (this *Client) Pull(ctx context.Context, image string) error {
+	return this.do(ctx, http.MethodPost, "/v1/pull", pullRequest{Image: image}, nil)
+}
+
+func (this *Client) Restart(ctx context.Context, server rollout.Server, image string) error {
+	return this.do(ctx, http.MethodPost, "/v1/restart", restartRequest{
+		Server:       server,
+		Image:        image,
+		Repositories: this.repositories,
+		CheckMatch:   this.queryMatches,
+	}, nil)
+}
+
+func (this *Client) do(ctx context.Context, method string, path string, body interface{}, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode agent request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, this.url+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create agent request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+this.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := this.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach agent %s: %w", this.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var agentError struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&agentError); err != nil || agentError.Error == "" {
+			return fmt.Errorf("agent %s responded with %s", this.name, resp.Status)
+		}
+		// Only restarts are refused for a live match
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("agent %s: %w", this.name, rollout.ErrMatchLive)
+		}
+		return fmt.Errorf("agent %s: %s", this.name, agentError.Error)
+	}
+
+	if response != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return fmt.Errorf("failed to decode response of agent %s: %w", this.name, err)
+		}
+	}
+	return nil
+}
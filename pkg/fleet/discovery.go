@@ -0,0 +1,220 @@
+package fleet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A docker host expected to run an agent
+type Host struct {
+	Name string `json:"name"`
+	// Agent API, e.g. http://gameserver-01:8081
+	URL string `json:"url"`
+	// Where the host was found: config, docker-context, ssh-config or inventory
+	Source string `json:"source"`
+}
+
+// How agents are reached on discovered hosts
+type Endpoint struct {
+	// http, or https with mutual TLS
+	Scheme string
+	Port   int
+}
+
+func newHost(name string, address string, endpoint Endpoint, source string) Host {
+	return Host{
+		Name:   name,
+		URL:    endpoint.Scheme + "://" + net.JoinHostPort(address, strconv.Itoa(endpoint.Port)),
+		Source: source,
+	}
+}
+
+type contextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host string `json:"Host"`
+	} `json:"Endpoints"`
+}
+
+// Hosts of the docker CLI contexts in dockerConfigDir (e.g. ~/.docker). Contexts pointing at a local socket are skipped,
+// only ssh:// and tcp:// endpoints name another host.
+func DiscoverDockerContexts(dockerConfigDir string, endpoint Endpoint) ([]Host, error) {
+	metaFiles, err := filepath.Glob(filepath.Join(dockerConfigDir, "contexts", "meta", "*", "meta.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list docker contexts: %w", err)
+	}
+
+	hosts := []Host{}
+	for _, file := range metaFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read docker context: %w", err)
+		}
+		var meta contextMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to parse docker context %s: %w", file, err)
+		}
+
+		dockerHost, err := url.Parse(meta.Endpoints["docker"].Host)
+		if err != nil || (dockerHost.Scheme != "ssh" && dockerHost.Scheme != "tcp") || dockerHost.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, newHost(meta.Name, dockerHost.Hostname(), endpoint, "docker-context"))
+	}
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
+
+// Hosts declared in an OpenSSH client config. Host patterns with wildcards or negations are skipped, HostName is used
+// as the address if set.
+func DiscoverSSHConfig(path string, endpoint Endpoint) ([]Host, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh config: %w", err)
+	}
+	defer file.Close()
+
+	names := []string{}
+	addresses := map[string]string{}
+	current := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.ReplaceAll(scanner.Text(), "=", " "))
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "host":
+			current = []string{}
+			for _, pattern := range fields[1:] {
+				if strings.ContainsAny(pattern, "*?!") {
+					continue
+				}
+				if _, ok := addresses[pattern]; !ok {
+					names = append(names, pattern)
+					addresses[pattern] = pattern
+				}
+				current = append(current, pattern)
+			}
+		case "match":
+			current = []string{}
+		case "hostname":
+			for _, name := range current {
+				addresses[name] = fields[1]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ssh config: %w", err)
+	}
+
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		hosts = append(hosts, newHost(name, addresses[name], endpoint, "ssh-config"))
+	}
+	return hosts, nil
+}
+
+// Hosts of an Ansible INI inventory, limited to a group (including its children) unless group is empty.
+// ansible_host is used as the address if set.
+func DiscoverInventory(path string, group string, endpoint Endpoint) ([]Host, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory: %w", err)
+	}
+	defer file.Close()
+
+	groupHosts := map[string][]string{}
+	children := map[string][]string{}
+	addresses := map[string]string{}
+	section, kind := "ungrouped", ""
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = strings.Trim(line, "[]"), ""
+			if index := strings.Index(section, ":"); index >= 0 {
+				section, kind = section[:index], section[index+1:]
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch kind {
+		case "children":
+			children[section] = append(children[section], fields[0])
+		case "":
+			name := fields[0]
+			groupHosts[section] = append(groupHosts[section], name)
+			if _, ok := addresses[name]; !ok {
+				addresses[name] = name
+			}
+			for _, variable := range fields[1:] {
+				if strings.HasPrefix(variable, "ansible_host=") {
+					addresses[name] = strings.TrimPrefix(variable, "ansible_host=")
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+
+	var names []string
+	if group == "" {
+		for name := range addresses {
+			names = append(names, name)
+		}
+	} else {
+		if _, ok := groupHosts[group]; !ok {
+			if _, ok := children[group]; !ok {
+				return nil, fmt.Errorf("inventory %s has no group %s", path, group)
+			}
+		}
+		seen := map[string]bool{}
+		collectGroup(group, groupHosts, children, map[string]bool{}, func(name string) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		})
+	}
+	sort.Strings(names)
+
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		hosts = append(hosts, newHost(name, addresses[name], endpoint, "inventory"))
+	}
+	return hosts, nil
+}
+
+func collectGroup(group string, groupHosts map[string][]string, children map[string][]string, visited map[string]bool, add func(string)) {
+	if visited[group] {
+		return
+	}
+	visited[group] = true
+
+	for _, name := range groupHosts[group] {
+		add(name)
+	}
+	for _, child := range children[group] {
+		collectGroup(child, groupHosts, children, visited, add)
+	}
+}
@@ -0,0 +1,57 @@
+package fleet
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"time"
+)
+
+// What an agent knows about its docker host
+type Report struct {
+	Host    string           `json:"host"`
+	Time    time.Time        `json:"time"`
+	Images  []string         `json:"images"`
+	Servers []rollout.Server `json:"servers"`
+}
+
+// Implemented by targets that can describe their host beyond the list of servers
+type Reporter interface {
+	Report(ctx context.Context) (*Report, error)
+}
+
+// Local is the docker host the coordinator itself runs on
+type Local struct {
+	*rollout.DockerTarget
+}
+
+func (this Local) Report(ctx context.Context) (*Report, error) {
+	return newReport(ctx, this.DockerTarget)
+}
+
+// DockerHost is a remote docker host the coordinator restarts the game servers of through its docker API, without an
+// agent
+type DockerHost struct {
+	*rollout.DockerTarget
+}
+
+func (this DockerHost) Report(ctx context.Context) (*Report, error) {
+	return newReport(ctx, this.DockerTarget)
+}
+
+func newReport(ctx context.Context, target *rollout.DockerTarget) (*Report, error) {
+	images, err := target.Images(ctx)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := target.Servers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Report{
+		Host:    target.Name(),
+		Time:    time.Now(),
+		Images:  images,
+		Servers: servers,
+	}, nil
+}
@@ -0,0 +1,92 @@
+package fleet
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Last known state of a rollout target
+type HostStatus struct {
+	Name    string `json:"name"`
+	Source  string `json:"source,omitempty"`
+	Healthy bool   `json:"healthy"`
+	// Last time the host answered
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	Error     string    `json:"error,omitempty"`
+	Report    *Report   `json:"report,omitempty"`
+}
+
+// Monitor periodically asks every target for a report and remembers the outcome
+type Monitor struct {
+	mutex    sync.RWMutex
+	statuses map[string]*HostStatus
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{statuses: map[string]*HostStatus{}}
+}
+
+// Check every target, sources maps target names to where they were discovered. Hosts that are no longer targets
+// are forgotten.
+func (this *Monitor) Check(ctx context.Context, targets []rollout.Target, sources map[string]string) {
+	checked := make([]*HostStatus, len(targets))
+	var wait sync.WaitGroup
+	for i, target := range targets {
+		wait.Add(1)
+		go func(i int, target rollout.Target) {
+			defer wait.Done()
+			checked[i] = this.check(ctx, target, sources[target.Name()])
+		}(i, target)
+	}
+	wait.Wait()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	statuses := map[string]*HostStatus{}
+	for _, status := range checked {
+		if previous, ok := this.statuses[status.Name]; ok && !status.Healthy {
+			status.LastSeen = previous.LastSeen
+		}
+		statuses[status.Name] = status
+	}
+	this.statuses = statuses
+}
+
+func (this *Monitor) check(ctx context.Context, target rollout.Target, source string) *HostStatus {
+	status := &HostStatus{Name: target.Name(), Source: source, LastCheck: time.Now()}
+
+	var err error
+	if reporter, ok := target.(Reporter); ok {
+		status.Report, err = reporter.Report(ctx)
+	} else {
+		var servers []rollout.Server
+		servers, err = target.Servers(ctx)
+		status.Report = &Report{Host: target.Name(), Time: time.Now(), Servers: servers}
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+		status.Report = nil
+		return status
+	}
+	status.Healthy = true
+	status.LastSeen = status.LastCheck
+	return status
+}
+
+// Statuses of all known hosts, sorted by name
+func (this *Monitor) Statuses() []HostStatus {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	statuses := make([]HostStatus, 0, len(this.statuses))
+	for _, status := range this.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
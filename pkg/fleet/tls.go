@@ -0,0 +1,241 @@
+package fleet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity          = 10 * 365 * 24 * time.Hour
+	certificateValidity = 2 * 365 * 24 * time.Hour
+)
+
+// PEM files of a certificate signed by the fleet CA
+type TLSFiles struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// TLS configuration of the coordinator: agents must present a certificate of the fleet CA and the coordinator
+// authenticates itself with a client certificate
+func ClientTLSConfig(files TLSFiles) (*tls.Config, error) {
+	pool, err := loadCAPool(files.CA)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load coordinator certificate: %w", err)
+	}
+
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ServerTLS is the TLS configuration of an agent, only clients with a certificate of the fleet CA are accepted.
+// It can be reloaded to rotate certificates without restarting the agent.
+type ServerTLS struct {
+	mutex  sync.RWMutex
+	config *tls.Config
+}
+
+func NewServerTLS(files TLSFiles) (*ServerTLS, error) {
+	serverTLS := &ServerTLS{}
+	if err := serverTLS.Reload(files); err != nil {
+		return nil, err
+	}
+	return serverTLS, nil
+}
+
+func (this *ServerTLS) Reload(files TLSFiles) error {
+	pool, err := loadCAPool(files.CA)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load agent certificate: %w", err)
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.config = &tls.Config{
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// Configuration for http.Server, every handshake uses the most recently loaded certificates
+func (this *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			this.mutex.RLock()
+			defer this.mutex.RUnlock()
+			return this.config, nil
+		},
+	}
+}
+
+// Generate the certificates for a fleet in dir: a CA (reused if dir already has one), a client certificate for the
+// coordinator (also reused) and a server certificate for an agent reachable under the given host names and addresses.
+// Returns the files written.
+func GenerateCertificates(dir string, agentHosts []string) ([]string, error) {
+	if len(agentHosts) == 0 {
+		return nil, fmt.Errorf("at least one agent host is required")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	written := []string{}
+
+	caCertPath, caKeyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	caCert, caKey, err := loadCertificate(caCertPath, caKeyPath)
+	if os.IsNotExist(err) {
+		template := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "csgo-update-watcher fleet CA"},
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caCert, caKey, err = createCertificate(template, caValidity, nil, nil, caCertPath, caKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, caCertPath, caKeyPath)
+	} else if err != nil {
+		return nil, err
+	}
+
+	coordinatorCertPath, coordinatorKeyPath := filepath.Join(dir, "coordinator.pem"), filepath.Join(dir, "coordinator-key.pem")
+	if _, err := os.Stat(coordinatorCertPath); os.IsNotExist(err) {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "coordinator"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if _, _, err := createCertificate(template, certificateValidity, caCert, caKey, coordinatorCertPath, coordinatorKeyPath); err != nil {
+			return nil, err
+		}
+		written = append(written, coordinatorCertPath, coordinatorKeyPath)
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: agentHosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range agentHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	agentCertPath, agentKeyPath := filepath.Join(dir, "agent-"+agentHosts[0]+".pem"), filepath.Join(dir, "agent-"+agentHosts[0]+"-key.pem")
+	if _, _, err := createCertificate(template, certificateValidity, caCert, caKey, agentCertPath, agentKeyPath); err != nil {
+		return nil, err
+	}
+	written = append(written, agentCertPath, agentKeyPath)
+
+	return written, nil
+}
+
+func loadCertificate(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("invalid PEM in %s or %s", certPath, keyPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", certPath, err)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+	}
+	return cert, key, nil
+}
+
+// Create a certificate signed by parent, or self-signed if parent is nil, and write it and its key as PEM
+func createCertificate(template *x509.Certificate, validity time.Duration, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validity)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate %s: %w", template.Subject.CommonName, err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, nil, fmt.Errorf("failed to write key: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse created certificate: %w", err)
+	}
+	return cert, key, nil
+}
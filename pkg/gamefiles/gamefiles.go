@@ -0,0 +1,354 @@
+// Package gamefiles delivers the game files installed in a build's image to servers that do not run containers from
+// a registry: into a docker volume mounted by the servers, as a tarball in object storage or with rsync to hosts.
+package gamefiles
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where the files are mounted while a volume is replaced
+const volumeMount = "/volume"
+
+// How long an upload of a tarball may take, the game files are tens of gigabytes
+const uploadTimeout = 2 * time.Hour
+
+// Copies files out of and into containers, implemented by the docker client. nerdctl has no archive API.
+type DockerClient interface {
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error
+	ContainerWait(ctx context.Context, container string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	ContainerRemove(ctx context.Context, container string, options types.ContainerRemoveOptions) error
+	CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
+	CopyToContainer(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error
+}
+
+// Files of an image, read from a container that is never started
+type Export struct {
+	io.Reader
+	client    DockerClient
+	container string
+	archive   io.ReadCloser
+}
+
+// Tar of the contents of dir in image, with paths relative to dir. Close removes the container it is read from.
+func ExportDir(ctx context.Context, client DockerClient, image string, dir string) (*Export, error) {
+	created, err := client.ContainerCreate(ctx, &container.Config{Image: image}, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container of %s: %w", image, err)
+	}
+	archive, _, err := client.CopyFromContainer(ctx, created.ID, dir)
+	if err != nil {
+		client.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+		return nil, fmt.Errorf("failed to read %s from %s: %w", dir, image, err)
+	}
+	return &Export{stripTop(archive), client, created.ID, archive}, nil
+}
+
+func (this *Export) Close() error {
+	this.archive.Close()
+	return this.client.ContainerRemove(context.Background(), this.container, types.ContainerRemoveOptions{Force: true})
+}
+
+// The archive API names every entry after the copied directory, drop it
+func stripTop(archive io.Reader) io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(func() error {
+			tr := tar.NewReader(archive)
+			tw := tar.NewWriter(writer)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					return tw.Close()
+				}
+				if err != nil {
+					return err
+				}
+				parts := strings.SplitN(strings.TrimPrefix(header.Name, "/"), "/", 2)
+				if len(parts) < 2 || parts[1] == "" {
+					continue
+				}
+				header.Name = parts[1]
+				if header.Typeflag == tar.TypeLink {
+					if link := strings.SplitN(strings.TrimPrefix(header.Linkname, "/"), "/", 2); len(link) == 2 {
+						header.Linkname = link[1]
+					}
+				}
+				if err := tw.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+		}())
+	}()
+	return reader
+}
+
+// Replace the contents of a docker volume with the files, created if it does not exist. The files are copied with a
+// container of image, which has to provide /bin/sh and find. Servers mounting the volume keep the files they loaded
+// until they are restarted.
+func UpdateVolume(ctx context.Context, client DockerClient, image string, volume string, files io.Reader) error {
+	created, err := client.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		User:       "root",
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"find " + volumeMount + " -mindepth 1 -delete"},
+	}, &container.HostConfig{Binds: []string{volume + ":" + volumeMount}}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container for volume %s: %w", volume, err)
+	}
+	defer client.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := client.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to clear volume %s: %w", volume, err)
+	}
+	wait, errs := client.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("failed to clear volume %s: %w", volume, err)
+	case status := <-wait:
+		if status.StatusCode != 0 {
+			return fmt.Errorf("failed to clear volume %s: exit code %d", volume, status.StatusCode)
+		}
+	}
+
+	// Owned by the user of the image, like the files in it
+	if err := client.CopyToContainer(ctx, created.ID, volumeMount, files, types.CopyToContainerOptions{CopyUIDGID: true}); err != nil {
+		return fmt.Errorf("failed to copy files into volume %s: %w", volume, err)
+	}
+	return nil
+}
+
+// PUT the files as a gzipped tarball to the URL, e.g. a presigned object storage URL. The tarball is written to a
+// temporary file first, object storage refuses uploads without a length.
+func Upload(ctx context.Context, url string, headers map[string]string, files io.Reader) error {
+	temp, err := ioutil.TempFile("", "csgo-watcher-files-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create tarball: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	compressed := gzip.NewWriter(temp)
+	if _, err := io.Copy(compressed, files); err != nil {
+		return fmt.Errorf("failed to write tarball: %w", err)
+	}
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("failed to write tarball: %w", err)
+	}
+	size, err := temp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, url, temp)
+	if err != nil {
+		return fmt.Errorf("invalid tarball url: %w", err)
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/gzip")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := (&http.Client{Timeout: uploadTimeout}).Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to upload tarball: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("failed to upload tarball: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// How rsync reaches the hosts
+type SSHOptions struct {
+	// Private key, the ssh defaults if empty
+	Key string
+	// known_hosts file, unknown hosts are accepted on first use if empty
+	KnownHosts string
+}
+
+// Mirror the files to every destination like user@host:/srv/csgo with rsync over ssh, deleting files the build no
+// longer has. Every destination is tried, the error lists those that failed.
+func Rsync(ctx context.Context, destinations []string, options SSHOptions, files io.Reader) error {
+	dir, err := ioutil.TempDir("", "csgo-watcher-files-")
+	if err != nil {
+		return fmt.Errorf("failed to create directory for files: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := Extract(files, dir); err != nil {
+		return fmt.Errorf("failed to extract files: %w", err)
+	}
+
+	ssh := []string{"ssh", "-o", "BatchMode=yes"}
+	if options.Key != "" {
+		ssh = append(ssh, "-i", options.Key, "-o", "IdentitiesOnly=yes")
+	}
+	if options.KnownHosts != "" {
+		ssh = append(ssh, "-o", "UserKnownHostsFile="+options.KnownHosts, "-o", "StrictHostKeyChecking=yes")
+	} else {
+		ssh = append(ssh, "-o", "StrictHostKeyChecking=accept-new")
+	}
+
+	failed := []string{}
+	for _, destination := range destinations {
+		cmd := exec.CommandContext(ctx, "rsync", "--archive", "--delete", "--compress", "-e", strings.Join(ssh, " "), dir+"/", destination)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			if message := strings.TrimSpace(string(output)); message != "" {
+				err = fmt.Errorf("%s", message)
+			}
+			failed = append(failed, fmt.Sprintf("%s: %s", destination, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to rsync to %d of %d destinations: %s", len(failed), len(destinations), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Extract writes the tar into dir, refusing entries outside of it. Links must stay within dir and nothing is
+// written through a symlink, so links of earlier entries cannot redirect later ones.
+func Extract(files io.Reader, dir string) error {
+	tr := tar.NewReader(files)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if clean := path.Clean(header.Name); clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("%s is outside the archive", header.Name)
+		}
+		name := path.Clean("/" + header.Name)
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		mode := os.FileMode(header.Mode).Perm()
+		if err := belowSymlink(dir, name); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("%s would be written through a symlink", header.Name)
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// Hard links name another entry of the archive
+			linked, err := linkTarget(".", header.Linkname)
+			if err != nil {
+				return fmt.Errorf("hard link %s: %w", header.Name, err)
+			}
+			if err := belowSymlink(dir, linked); err != nil {
+				return err
+			}
+			source := filepath.Join(dir, filepath.FromSlash(linked))
+			// A hard link to a symlink would move its relative target
+			if info, err := os.Lstat(source); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("hard link %s points to the symlink %s", header.Name, header.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if _, err := linkTarget(path.Dir(name), header.Linkname); err != nil {
+				return fmt.Errorf("symlink %s: %w", header.Name, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// Links are mirrored as they are, rsync does not follow them
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Resolve the target of a link relative to base, both paths within the archive. Absolute targets and targets
+// leaving the archive are refused.
+func linkTarget(base string, linkname string) (string, error) {
+	if path.IsAbs(linkname) {
+		return "", fmt.Errorf("absolute target %s", linkname)
+	}
+	resolved := path.Join(strings.TrimPrefix(base, "/"), linkname)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", fmt.Errorf("target %s is outside the archive", linkname)
+	}
+	return "/" + resolved, nil
+}
+
+// Refuse entries whose parent directories are symlinks extracted earlier
+func belowSymlink(dir string, name string) error {
+	current := dir
+	for _, part := range strings.Split(path.Dir(name), "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is below the symlink %s", name, strings.TrimPrefix(current, dir))
+		}
+	}
+	return nil
+}
+
+// Parts of a URL that are safe to record, without the query of presigned URLs
+func Location(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
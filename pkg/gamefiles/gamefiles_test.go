@@ -0,0 +1,118 @@
+package gamefiles
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A tar of the given entries, regular files have the content "csgo"
+func archive(t *testing.T, headers ...tar.Header) *bytes.Buffer {
+	files := &bytes.Buffer{}
+	tw := tar.NewWriter(files)
+	for _, header := range headers {
+		header.Mode = 0644
+		if header.Typeflag == tar.TypeReg {
+			header.Size = 4
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte("csgo"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gamefiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := archive(t,
+		tar.Header{Name: "csgo/", Typeflag: tar.TypeDir},
+		tar.Header{Name: "csgo/cfg/server.cfg", Typeflag: tar.TypeReg},
+		tar.Header{Name: "csgo/cfg/default.cfg", Typeflag: tar.TypeSymlink, Linkname: "server.cfg"},
+		tar.Header{Name: "csgo/cfg/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		tar.Header{Name: "csgo/autoexec.cfg", Typeflag: tar.TypeLink, Linkname: "csgo/cfg/server.cfg"},
+	)
+	if err := Extract(files, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"csgo/cfg/server.cfg", "csgo/cfg/default.cfg", "csgo/autoexec.cfg"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(content) != "csgo" {
+			t.Errorf("%s holds %q, %v", name, content, err)
+		}
+	}
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+		err     string
+	}{
+		{"parent directory", []tar.Header{
+			{Name: "../x", Typeflag: tar.TypeReg},
+		}, "outside the archive"},
+		{"parent directory in the middle", []tar.Header{
+			{Name: "csgo/../../x", Typeflag: tar.TypeReg},
+		}, "outside the archive"},
+		{"absolute symlink", []tar.Header{
+			{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		}, "absolute target"},
+		{"symlink to the parent directory", []tar.Header{
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		}, "outside the archive"},
+		{"symlink leaving through a subdirectory", []tar.Header{
+			{Name: "csgo/up", Typeflag: tar.TypeSymlink, Linkname: "../../x"},
+		}, "outside the archive"},
+		{"file replacing a symlink", []tar.Header{
+			{Name: "cfg", Typeflag: tar.TypeSymlink, Linkname: "csgo"},
+			{Name: "cfg", Typeflag: tar.TypeReg},
+		}, "written through a symlink"},
+		{"file below a symlink", []tar.Header{
+			{Name: "csgo/", Typeflag: tar.TypeDir},
+			{Name: "cfg", Typeflag: tar.TypeSymlink, Linkname: "csgo"},
+			{Name: "cfg/server.cfg", Typeflag: tar.TypeReg},
+		}, "below the symlink"},
+		{"hard link outside", []tar.Header{
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../passwd"},
+		}, "outside the archive"},
+		{"hard link to a symlink", []tar.Header{
+			{Name: "csgo/", Typeflag: tar.TypeDir},
+			{Name: "csgo/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "up", Typeflag: tar.TypeLink, Linkname: "csgo/up"},
+		}, "points to the symlink"},
+	}
+	for _, test := range tests {
+		parent, err := ioutil.TempDir("", "gamefiles")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(parent)
+		dir := filepath.Join(parent, "dir")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		err = Extract(archive(t, test.headers...), dir)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: extracting returned %v, want an error containing %q", test.name, err, test.err)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "x")); err == nil {
+			t.Errorf("%s: x is written outside the directory", test.name)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Package gitops commits new image tags to git repositories, leaving the rollout to a GitOps controller like Argo CD
+// or Flux watching them. It uses the git CLI, so any remote git can clone from works.
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"csgo-update-watcher/pkg/registry"
+	"encoding/base64"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Tries of cloning, committing and pushing again when the branch moved in the meantime
+const pushAttempts = 3
+
+const (
+	DEFAULT_MESSAGE      = "Update {{.Repository}} to {{.Tag}}"
+	DEFAULT_AUTHOR_NAME  = "csgo-update-watcher"
+	DEFAULT_AUTHOR_EMAIL = "csgo-update-watcher@localhost"
+	// Username for token auth over https, accepted by GitHub. GitLab expects oauth2 and Bitbucket x-token-auth.
+	DEFAULT_USERNAME = "x-access-token"
+)
+
+// A git repository the image tags are committed to
+type Repository struct {
+	// Clone URL, ssh (git@host:org/repo.git) or https
+	URL string `yaml:"url"`
+	// Branch committed to, the remote's default branch if empty
+	Branch string `yaml:"branch"`
+	// Private key for ssh URLs, the ssh agent and keys of the user are used if empty
+	SSHKey string `yaml:"ssh_key"`
+	// known_hosts file for ssh URLs, unknown hosts are accepted on first use if empty
+	KnownHosts string `yaml:"known_hosts"`
+	// Token for https URLs, sent as the password of Username
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	// Template of the commit message, with the fields of the first file's Data
+	Message     string `yaml:"message"`
+	AuthorName  string `yaml:"author_name"`
+	AuthorEmail string `yaml:"author_email"`
+	Files       []File `yaml:"files"`
+}
+
+func (this Repository) String() string {
+	if this.Branch != "" {
+		return this.URL + "#" + this.Branch
+	}
+	return this.URL
+}
+
+// A file of the repository the new tag is written to, e.g. a kustomization.yaml, Helm values or compose file. Either
+// the whole file is rendered from Template, or every match of Pattern is replaced with the rendered Replacement.
+type File struct {
+	// Path in the repository
+	Path string `yaml:"path"`
+	// Image repository whose pushed images are written to the file
+	Image string `yaml:"image"`
+	// Local path of a template the file is rendered from
+	Template string `yaml:"template"`
+	// Regular expression of the text to replace, e.g. `newTag: .*`. $1 and ${name} in the rendered replacement
+	// expand to its groups.
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Fields available in file, replacement and message templates
+type Data struct {
+	BuildID int
+	// First pushed image of File.Image, e.g. registry.example.com/csgo:buildid-123
+	Image      string
+	Repository string
+	Tag        string
+	// Every pushed image of File.Image in the order of the build, the get5 image follows the plain one
+	Images []string
+}
+
+// Outcome of committing to a repository, unchanged repositories have no commit
+type Result struct {
+	Repository string `json:"repository"`
+	// Paths of the changed files
+	Files  []string `json:"files,omitempty"`
+	Commit string   `json:"commit,omitempty"`
+	Err    error    `json:"-"`
+	Error  string   `json:"error,omitempty"`
+}
+
+var templateFuncs = template.FuncMap{
+	"repository": registry.RepositoryOf,
+	"tag":        registry.TagOf,
+}
+
+// Publisher commits the images of new builds to the configured repositories
+type Publisher struct {
+	repositories []Repository
+}
+
+func NewPublisher(repositories []Repository) *Publisher {
+	return &Publisher{repositories}
+}
+
+// Check the templates and patterns of every file, so mistakes show up when starting instead of after a build
+func Validate(repository Repository) error {
+	if repository.URL == "" {
+		return fmt.Errorf("no url")
+	}
+	if len(repository.Files) == 0 {
+		return fmt.Errorf("no files")
+	}
+	if _, err := parseTemplate("message", repository.message()); err != nil {
+		return err
+	}
+	for _, file := range repository.Files {
+		if file.Path == "" || filepath.IsAbs(file.Path) || strings.HasPrefix(filepath.Clean(file.Path), "..") {
+			return fmt.Errorf("file %q is not a path inside the repository", file.Path)
+		}
+		if file.Image == "" {
+			return fmt.Errorf("file %s has no image", file.Path)
+		}
+		switch {
+		case file.Template != "" && file.Pattern != "":
+			return fmt.Errorf("file %s has both a template and a pattern", file.Path)
+		case file.Template != "":
+			text, err := ioutil.ReadFile(file.Template)
+			if err != nil {
+				return fmt.Errorf("failed to read template of %s: %w", file.Path, err)
+			}
+			if _, err := parseTemplate(file.Path, string(text)); err != nil {
+				return err
+			}
+		case file.Pattern != "":
+			if _, err := regexp.Compile(file.Pattern); err != nil {
+				return fmt.Errorf("invalid pattern of %s: %w", file.Path, err)
+			}
+			if _, err := parseTemplate(file.Path, file.Replacement); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("file %s has neither a template nor a pattern", file.Path)
+		}
+	}
+	return nil
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	parsed, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of %s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+func render(name string, text string, data Data) (string, error) {
+	parsed, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render template of %s: %w", name, err)
+	}
+	return rendered.String(), nil
+}
+
+func (this Repository) message() string {
+	if this.Message != "" {
+		return this.Message
+	}
+	return DEFAULT_MESSAGE
+}
+
+// Commit the images to every repository, one at a time. A failing repository does not stop the others, files whose
+// image repository has none of the images are left alone.
+func (this *Publisher) Publish(ctx context.Context, buildid int, images []string) ([]Result, error) {
+	return this.publishAll(ctx, buildid, images, false)
+}
+
+// The files Publish would change, the repositories are cloned but nothing is committed
+func (this *Publisher) DryRun(ctx context.Context, buildid int, images []string) ([]Result, error) {
+	return this.publishAll(ctx, buildid, images, true)
+}
+
+func (this *Publisher) publishAll(ctx context.Context, buildid int, images []string, dryRun bool) ([]Result, error) {
+	results := []Result{}
+	failed := []string{}
+	for _, repository := range this.repositories {
+		result := Result{Repository: repository.String()}
+		for attempt := 1; attempt <= pushAttempts; attempt++ {
+			var rejected bool
+			result.Files, result.Commit, rejected, result.Err = publish(ctx, repository, buildid, images, dryRun)
+			if !rejected {
+				break
+			}
+			log.Warn().Str("repository", result.Repository).Int("attempt", attempt).Msg("Push was rejected, the branch moved, committing again")
+		}
+		if result.Err != nil {
+			result.Error = result.Err.Error()
+			log.Err(result.Err).Str("repository", result.Repository).Msg("Failed to commit new build to git repository")
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Repository, result.Err))
+		} else if result.Commit != "" {
+			log.Info().Str("repository", result.Repository).Str("commit", result.Commit).Strs("files", result.Files).Msg("Committed new build to git repository")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to commit to %d of %d git repositories: %s", len(failed), len(this.repositories), strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// The images of the file's image repository, false if it has none
+func dataFor(file File, buildid int, images []string) (Data, bool) {
+	data := Data{BuildID: buildid, Repository: file.Image}
+	for _, image := range images {
+		if registry.RepositoryOf(image) == file.Image {
+			data.Images = append(data.Images, image)
+		}
+	}
+	if len(data.Images) == 0 {
+		return data, false
+	}
+	data.Image = data.Images[0]
+	data.Tag = registry.TagOf(data.Image)
+	return data, true
+}
+
+// Clone the repository, write the files and commit and push them. Returns whether the push was rejected because the
+// branch moved, publishing again from a new clone is expected to succeed then.
+func publish(ctx context.Context, repository Repository, buildid int, images []string, dryRun bool) (files []string, commit string, rejected bool, err error) {
+	dir, err := ioutil.TempDir("", "csgo-watcher-gitops-")
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to create clone directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := NewGit(repository)
+	clone := []string{"clone", "--depth", "1", "--single-branch"}
+	if repository.Branch != "" {
+		clone = append(clone, "--branch", repository.Branch)
+	}
+	if _, err := git.Run(ctx, "", append(clone, "--", repository.URL, dir)...); err != nil {
+		return nil, "", false, err
+	}
+
+	var messageData *Data
+	for _, file := range repository.Files {
+		data, ok := dataFor(file, buildid, images)
+		if !ok {
+			continue
+		}
+		changed, err := writeFile(filepath.Join(dir, filepath.Clean(file.Path)), file, data)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if changed {
+			files = append(files, file.Path)
+			if messageData == nil {
+				messageData = &data
+			}
+		}
+	}
+	if len(files) == 0 || dryRun {
+		return files, "", false, nil
+	}
+
+	message, err := render("message", repository.message(), *messageData)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if _, err := git.Run(ctx, dir, append([]string{"add", "--"}, files...)...); err != nil {
+		return nil, "", false, err
+	}
+	if _, err := git.Run(ctx, dir, "commit", "--quiet", "--message", message); err != nil {
+		return nil, "", false, err
+	}
+	commit, err = git.Run(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", false, err
+	}
+	if output, err := git.Run(ctx, dir, "push", "--porcelain", "origin", "HEAD"); err != nil {
+		// Someone else pushed after the clone, the files have to be written on top of their commit
+		return nil, "", strings.Contains(output, "[rejected]"), err
+	}
+	return files, commit, false, nil
+}
+
+// Render the new content of the file and write it if it changed
+func writeFile(path string, file File, data Data) (bool, error) {
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && file.Template != "") {
+		return false, fmt.Errorf("failed to read %s: %w", file.Path, err)
+	}
+
+	var content string
+	if file.Template != "" {
+		text, err := ioutil.ReadFile(file.Template)
+		if err != nil {
+			return false, fmt.Errorf("failed to read template of %s: %w", file.Path, err)
+		}
+		if content, err = render(file.Path, string(text), data); err != nil {
+			return false, err
+		}
+	} else {
+		pattern, err := regexp.Compile(file.Pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern of %s: %w", file.Path, err)
+		}
+		if !pattern.Match(old) {
+			return false, fmt.Errorf("pattern %q does not match anything in %s", file.Pattern, file.Path)
+		}
+		replacement, err := render(file.Path, file.Replacement, data)
+		if err != nil {
+			return false, err
+		}
+		content = pattern.ReplaceAllString(string(old), replacement)
+	}
+	if content == string(old) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", file.Path, err)
+	}
+	return true, nil
+}
+
+// Git runs git with the credentials and author of a repository
+type Git struct {
+	env []string
+}
+
+// Only the URL, credentials and author of the repository are used
+func NewGit(repository Repository) Git {
+	name, email := repository.AuthorName, repository.AuthorEmail
+	if name == "" {
+		name = DEFAULT_AUTHOR_NAME
+	}
+	if email == "" {
+		email = DEFAULT_AUTHOR_EMAIL
+	}
+	env := append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME="+name, "GIT_AUTHOR_EMAIL="+email,
+		"GIT_COMMITTER_NAME="+name, "GIT_COMMITTER_EMAIL="+email,
+	)
+
+	ssh := []string{"ssh", "-o", "BatchMode=yes"}
+	if repository.SSHKey != "" {
+		ssh = append(ssh, "-i", repository.SSHKey, "-o", "IdentitiesOnly=yes")
+	}
+	if repository.KnownHosts != "" {
+		ssh = append(ssh, "-o", "UserKnownHostsFile="+repository.KnownHosts, "-o", "StrictHostKeyChecking=yes")
+	} else {
+		ssh = append(ssh, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	env = append(env, "GIT_SSH_COMMAND="+strings.Join(ssh, " "))
+
+	if repository.Token != "" {
+		username := repository.Username
+		if username == "" {
+			username = DEFAULT_USERNAME
+		}
+		// Passed as config in the environment, so the token is neither in the remote URL nor in the process list
+		header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+repository.Token))
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0="+header)
+	}
+	return Git{env}
+}
+
+// Run git in dir, returning its trimmed output. Errors carry the output, which never contains the token.
+func (this Git) Run(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = this.env
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Run()
+	result := strings.TrimSpace(output.String())
+	if err != nil {
+		if result != "" {
+			return result, fmt.Errorf("git %s: %s", args[0], result)
+		}
+		return result, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return result, nil
+}
@@ -0,0 +1,4 @@
+// Package grpcapi holds the gRPC service controlling a running watcher and its generated client, see watcher.proto
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative watcher.proto
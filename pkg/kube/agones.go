@@ -0,0 +1,125 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"strconv"
+)
+
+// Agones Fleet of GameServers
+const KIND_FLEET = "Fleet"
+
+var (
+	FleetResource         = schema.GroupVersionResource{Group: "agones.dev", Version: "v1", Resource: "fleets"}
+	GameServerSetResource = schema.GroupVersionResource{Group: "agones.dev", Version: "v1", Resource: "gameserversets"}
+)
+
+// Label Agones puts on the GameServerSets of a Fleet
+const fleetLabel = "agones.dev/fleet"
+
+// Path of the pod template in a Fleet, below the GameServer template
+var fleetPodTemplate = []string{"spec", "template", "spec", "template"}
+
+func (this *Updater) fleetPodTemplate(ctx context.Context, workload Workload) (*corev1.PodTemplateSpec, error) {
+	fleet, err := this.dynamic.Resource(FleetResource).Namespace(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fleet: %w", err)
+	}
+	return podTemplateOf(fleet)
+}
+
+func podTemplateOf(resource *unstructured.Unstructured) (*corev1.PodTemplateSpec, error) {
+	raw, found, err := unstructured.NestedMap(resource.Object, fleetPodTemplate...)
+	if err != nil || !found {
+		return nil, fmt.Errorf("%s %s has no pod template", resource.GetKind(), resource.GetName())
+	}
+	template := &corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, template); err != nil {
+		return nil, fmt.Errorf("invalid pod template of %s %s: %w", resource.GetKind(), resource.GetName(), err)
+	}
+	return template, nil
+}
+
+// Custom resources do not support strategic merge patches, the containers are replaced by index instead. The names
+// are tested first so a concurrent change of the container list fails the patch rather than updating the wrong one.
+func (this *Updater) patchFleet(ctx context.Context, workload Workload, changes []containerChange, options metav1.PatchOptions) error {
+	operations := []map[string]interface{}{}
+	for _, change := range changes {
+		path := "/spec/template/spec/template/spec/containers/" + strconv.Itoa(change.Index)
+		operations = append(operations,
+			map[string]interface{}{"op": "test", "path": path + "/name", "value": change.Name},
+			map[string]interface{}{"op": "replace", "path": path + "/image", "value": change.Image},
+		)
+	}
+	patch, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	_, err = this.dynamic.Resource(FleetResource).Namespace(workload.Namespace).Patch(ctx, workload.Name, types.JSONPatchType, patch, options)
+	return err
+}
+
+// A Fleet rolled out once the GameServerSet of its current template is ready and the older GameServerSets have no
+// Ready GameServers left. Allocated GameServers of older sets keep running until their match ends, Agones removes
+// them afterwards.
+func (this *Updater) fleetRolledOut(ctx context.Context, workload Workload) (bool, error) {
+	fleet, err := this.dynamic.Resource(FleetResource).Namespace(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get fleet: %w", err)
+	}
+	template, err := podTemplateOf(fleet)
+	if err != nil {
+		return false, err
+	}
+
+	sets, err := this.dynamic.Resource(GameServerSetResource).Namespace(workload.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fleetLabel + "=" + workload.Name,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list gameserversets: %w", err)
+	}
+
+	current := false
+	for i := range sets.Items {
+		set := &sets.Items[i]
+		ready, _, _ := unstructured.NestedInt64(set.Object, "status", "readyReplicas")
+		setTemplate, err := podTemplateOf(set)
+		if err != nil {
+			return false, err
+		}
+		if !sameImages(template, setTemplate) {
+			if ready > 0 {
+				return false, nil
+			}
+			continue
+		}
+
+		current = true
+		replicas, _, _ := unstructured.NestedInt64(set.Object, "spec", "replicas")
+		allocated, _, _ := unstructured.NestedInt64(set.Object, "status", "allocatedReplicas")
+		reserved, _, _ := unstructured.NestedInt64(set.Object, "status", "reservedReplicas")
+		if ready+allocated+reserved < replicas {
+			return false, nil
+		}
+	}
+	return current, nil
+}
+
+func sameImages(a *corev1.PodTemplateSpec, b *corev1.PodTemplateSpec) bool {
+	if len(a.Spec.Containers) != len(b.Spec.Containers) {
+		return false
+	}
+	for i, container := range a.Spec.Containers {
+		if other := b.Spec.Containers[i]; container.Name != other.Name || container.Image != other.Image {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,526 @@
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"csgo-update-watcher/pkg/engine"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backends of build jobs
+const (
+	BACKEND_KANIKO  = "kaniko"
+	BACKEND_BUILDAH = "buildah"
+)
+
+// Pinned images of the backends, build jobs can use others with image
+var backendImages = map[string]string{
+	BACKEND_KANIKO:  "gcr.io/kaniko-project/executor:v1.9.2",
+	BACKEND_BUILDAH: "quay.io/buildah/stable:v1.29.1",
+}
+
+const (
+	// Where the secret with the build context and credentials is mounted
+	buildMount = "/build"
+	// Where buildah extracts the build context to
+	workspaceMount = "/workspace"
+	// The builders write the digest of the pushed image as termination message
+	digestFile = "/dev/termination-log"
+	// Kubernetes rejects larger secrets
+	maxSecretSize = 1 << 20
+	// How often the pod of a build job is checked until its containers started or finished
+	buildPollInterval = 2 * time.Second
+	// Finished jobs are removed by the watcher, or by Kubernetes this long after if the watcher stopped meanwhile
+	buildJobTTL = 3600
+)
+
+type BuildJobOptions struct {
+	// kaniko or buildah, empty builds with the engine
+	Backend   string `yaml:"backend"`
+	Namespace string `yaml:"namespace"`
+	// Repository the jobs push to and the engine pulls the built images from, e.g. registry.example.com/csgo-builds
+	Repository string `yaml:"repository"`
+	// Image of the backend, a pinned release of its official image if empty
+	Image          string            `yaml:"image"`
+	ServiceAccount string            `yaml:"service_account"`
+	NodeSelector   map[string]string `yaml:"node_selector"`
+	// Run buildah privileged, needed unless the nodes let unprivileged pods use user namespaces
+	Privileged bool `yaml:"privileged"`
+}
+
+func (this BuildJobOptions) Enabled() bool {
+	return this.Backend != ""
+}
+
+func (this BuildJobOptions) Validate() error {
+	if !this.Enabled() {
+		return nil
+	}
+	if _, ok := backendImages[this.Backend]; !ok {
+		return fmt.Errorf("backend must be %s or %s", BACKEND_KANIKO, BACKEND_BUILDAH)
+	}
+	if this.Namespace == "" {
+		return fmt.Errorf("namespace is required")
+	}
+	if named, err := reference.ParseNormalizedNamed(this.Repository); err != nil || !reference.IsNameOnly(named) {
+		return fmt.Errorf("repository %q must be a repository without tag", this.Repository)
+	}
+	return nil
+}
+
+// Stages local images in the repository of the build jobs and pulls their results, implemented by the engine's
+// client
+type ImageClient interface {
+	ImagePull(ctx context.Context, ref string, options dockertypes.ImagePullOptions) (io.ReadCloser, error)
+	ImagePush(ctx context.Context, ref string, options dockertypes.ImagePushOptions) (io.ReadCloser, error)
+	ImageTag(ctx context.Context, image string, ref string) error
+}
+
+// JobBuilder builds images in Kubernetes jobs with Kaniko or Buildah, for clusters whose nodes have no docker socket
+// to mount. The build context, the registry credentials and the build secrets are handed to the job as a Secret, the
+// job pushes the image to the repository and reports its digest, which the engine then pulls and tags. Build args
+// naming images of the local repository, e.g. BASE_IMAGE, are pushed to the repository first, so the job can pull
+// them.
+type JobBuilder struct {
+	client  kubernetes.Interface
+	options BuildJobOptions
+	images  ImageClient
+	// Encoded credentials of the registry of an image, for ImagePull and ImagePush
+	auth func(image string) (string, error)
+	// Repository of the images only the engine has
+	localRepository string
+}
+
+// Connect with the kubeconfig at the given path and context, or with the service account of the pod the watcher runs
+// in if kubeconfig is empty
+func NewJobBuilder(kubeconfig string, context string, options BuildJobOptions, images ImageClient, auth func(image string) (string, error), localRepository string) (*JobBuilder, error) {
+	config, err := clientConfig(kubeconfig, context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return &JobBuilder{client, options, images, auth, localRepository}, nil
+}
+
+func (this *JobBuilder) ImageBuild(ctx context.Context, buildContext io.Reader, options dockertypes.ImageBuildOptions) (dockertypes.ImageBuildResponse, error) {
+	return this.ImageBuildWithSecrets(ctx, buildContext, options, nil)
+}
+
+// Build in a job, its logs are returned as a docker JSON message stream like Nerdctl's. Secrets are only supported
+// by buildah, kaniko has no secret mounts.
+func (this *JobBuilder) ImageBuildWithSecrets(ctx context.Context, buildContext io.Reader, options dockertypes.ImageBuildOptions, secrets map[string]string) (dockertypes.ImageBuildResponse, error) {
+	if len(options.Tags) == 0 {
+		return dockertypes.ImageBuildResponse{}, fmt.Errorf("build jobs need a tag to push to")
+	}
+	if len(secrets) > 0 && this.options.Backend == BACKEND_KANIKO {
+		return dockertypes.ImageBuildResponse{}, fmt.Errorf("%s cannot build with secrets", this.options.Backend)
+	}
+	buildArgs := map[string]string{}
+	for key, value := range options.BuildArgs {
+		if value == nil {
+			continue
+		}
+		buildArgs[key] = *value
+		if this.isLocal(*value) {
+			staged, err := this.stage(ctx, *value)
+			if err != nil {
+				return dockertypes.ImageBuildResponse{}, err
+			}
+			buildArgs[key] = staged
+		}
+	}
+	data, err := this.secretData(buildContext, options.AuthConfigs, secrets)
+	if err != nil {
+		return dockertypes.ImageBuildResponse{}, err
+	}
+
+	name := "csgo-build-" + uuid.New().String()[:8]
+	destination := this.options.Repository + ":" + tagOf(options.Tags[0])
+	job := this.job(name, destination, options, buildArgs, secrets)
+	jobs := this.client.BatchV1().Jobs(this.options.Namespace)
+	secretClient := this.client.CoreV1().Secrets(this.options.Namespace)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: job.Labels}, Data: data}
+	if _, err := secretClient.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return dockertypes.ImageBuildResponse{}, fmt.Errorf("failed to create secret of build job: %w", err)
+	}
+	removeSecret := func() {
+		if err := secretClient.Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+			log.Warn().Err(err).Str("secret", name).Msg("Failed to delete secret of build job")
+		}
+	}
+	if _, err := jobs.Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		removeSecret()
+		return dockertypes.ImageBuildResponse{}, fmt.Errorf("failed to create build job: %w", err)
+	}
+	// Also stops the build once the watcher gave up on it
+	cleanup := func() {
+		background := metav1.DeletePropagationBackground
+		if err := jobs.Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &background}); err != nil {
+			log.Warn().Err(err).Str("job", name).Msg("Failed to delete build job")
+		}
+		removeSecret()
+	}
+	log.Info().Str("job", this.options.Namespace+"/"+name).Str("destination", destination).Msg("Started build job")
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer cleanup()
+		encoder := json.NewEncoder(writer)
+		digest, err := this.follow(ctx, name, job, encoder)
+		if err == nil {
+			err = this.pull(ctx, digest, options.Tags, encoder)
+		}
+		if err != nil {
+			message := fmt.Sprintf("build job %s: %s", name, err)
+			encoder.Encode(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: message}, ErrorMessage: message})
+		}
+		writer.Close()
+	}()
+	return dockertypes.ImageBuildResponse{Body: reader}, nil
+}
+
+// Whether the image is of the local repository, e.g. csgo-watched:base
+func (this *JobBuilder) isLocal(image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	local, err := reference.ParseNormalizedNamed(this.localRepository)
+	return err == nil && named.Name() == local.Name()
+}
+
+// Push a local image to the repository of the jobs under its tag, returns the pushed reference
+func (this *JobBuilder) stage(ctx context.Context, image string) (string, error) {
+	staged := this.options.Repository + ":" + tagOf(image)
+	if err := this.images.ImageTag(ctx, image, staged); err != nil {
+		return "", fmt.Errorf("failed to tag %s as %s: %w", image, staged, err)
+	}
+	auth, err := this.auth(staged)
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry credentials for %s: %w", staged, err)
+	}
+	log.Debug().Str("image", image).Str("staged", staged).Msg("Pushing image for build job")
+	pushed, err := this.images.ImagePush(ctx, staged, dockertypes.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s for build job: %w", staged, err)
+	}
+	defer pushed.Close()
+	if err := jsonmessage.DisplayJSONMessagesStream(pushed, ioutil.Discard, 0, false, nil); err != nil {
+		return "", fmt.Errorf("failed to push %s for build job: %w", staged, err)
+	}
+	return staged, nil
+}
+
+// The gzip compressed build context, the registry credentials as config.json and the build secrets as secret-<id>
+func (this *JobBuilder) secretData(buildContext io.Reader, auths map[string]dockertypes.AuthConfig, secrets map[string]string) (map[string][]byte, error) {
+	var compressed bytes.Buffer
+	compressor := gzip.NewWriter(&compressed)
+	if _, err := io.Copy(compressor, buildContext); err != nil {
+		return nil, fmt.Errorf("failed to read build context: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{
+		"context.tar.gz": compressed.Bytes(),
+		"config.json":    engine.DockerConfig(auths),
+	}
+	for id, path := range secrets {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read build secret %s: %w", id, err)
+		}
+		data["secret-"+id] = secret
+	}
+	size := 0
+	for _, value := range data {
+		size += len(value)
+	}
+	if size > maxSecretSize {
+		return nil, fmt.Errorf("the compressed build context of %d bytes does not fit into a kubernetes secret", compressed.Len())
+	}
+	return data, nil
+}
+
+func (this *JobBuilder) job(name string, destination string, options dockertypes.ImageBuildOptions, buildArgs map[string]string, secrets map[string]string) *batchv1.Job {
+	image := this.options.Image
+	if image == "" {
+		image = backendImages[this.options.Backend]
+	}
+	dockerfile := options.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	labels := map[string]string{"app.kubernetes.io/managed-by": "csgo-update-watcher", "app.kubernetes.io/component": "build"}
+	mounts := []corev1.VolumeMount{{Name: "build", MountPath: buildMount, ReadOnly: true}}
+	volumes := []corev1.Volume{{Name: "build", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name}}}}
+
+	spec := corev1.PodSpec{
+		RestartPolicy:      corev1.RestartPolicyNever,
+		ServiceAccountName: this.options.ServiceAccount,
+		NodeSelector:       this.options.NodeSelector,
+	}
+	if this.options.Backend == BACKEND_KANIKO {
+		args := []string{"--context=tar://" + buildMount + "/context.tar.gz", "--dockerfile=" + dockerfile, "--destination=" + destination, "--digest-file=" + digestFile}
+		if options.Target != "" {
+			args = append(args, "--target="+options.Target)
+		}
+		if !options.NoCache {
+			args = append(args, "--cache=true", "--cache-repo="+this.cacheRepository())
+		}
+		for _, key := range sortedKeys(buildArgs) {
+			args = append(args, "--build-arg="+key+"="+buildArgs[key])
+		}
+		for _, key := range sortedKeys(options.Labels) {
+			args = append(args, "--label="+key+"="+options.Labels[key])
+		}
+		spec.Containers = []corev1.Container{{
+			Name:         "build",
+			Image:        image,
+			Args:         args,
+			Env:          []corev1.EnvVar{{Name: "DOCKER_CONFIG", Value: buildMount}},
+			VolumeMounts: mounts,
+			Resources:    buildResources(options),
+		}}
+	} else {
+		mounts = append(mounts, corev1.VolumeMount{Name: "workspace", MountPath: workspaceMount}, corev1.VolumeMount{Name: "storage", MountPath: "/var/lib/containers"})
+		emptyDir := corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+		volumes = append(volumes, corev1.Volume{Name: "workspace", VolumeSource: emptyDir}, corev1.Volume{Name: "storage", VolumeSource: emptyDir})
+		env := []corev1.EnvVar{{Name: "REGISTRY_AUTH_FILE", Value: buildMount + "/config.json"}, {Name: "BUILDAH_ISOLATION", Value: "chroot"}}
+		security := &corev1.SecurityContext{Privileged: &this.options.Privileged}
+
+		build := []string{"buildah", "build", "--storage-driver=vfs", "--file=" + workspaceMount + "/" + dockerfile, "--tag=" + destination}
+		if options.Target != "" {
+			build = append(build, "--target="+options.Target)
+		}
+		if options.NoCache {
+			build = append(build, "--no-cache")
+		} else {
+			build = append(build, "--layers", "--cache-from="+this.cacheRepository(), "--cache-to="+this.cacheRepository())
+		}
+		for _, key := range sortedKeys(buildArgs) {
+			build = append(build, "--build-arg="+key+"="+buildArgs[key])
+		}
+		for _, key := range sortedKeys(options.Labels) {
+			build = append(build, "--label="+key+"="+options.Labels[key])
+		}
+		for _, id := range sortedKeys(secrets) {
+			build = append(build, "--secret=id="+id+",src="+buildMount+"/secret-"+id)
+		}
+		build = append(build, workspaceMount)
+
+		spec.InitContainers = []corev1.Container{
+			{Name: "context", Image: image, Command: []string{"tar", "-xzf", buildMount + "/context.tar.gz", "-C", workspaceMount}, VolumeMounts: mounts},
+			{Name: "build", Image: image, Command: build, Env: env, VolumeMounts: mounts, SecurityContext: security, Resources: buildResources(options)},
+		}
+		spec.Containers = []corev1.Container{{
+			Name:            "push",
+			Image:           image,
+			Command:         []string{"buildah", "push", "--storage-driver=vfs", "--digestfile=" + digestFile, destination},
+			Env:             env,
+			VolumeMounts:    mounts,
+			SecurityContext: security,
+		}}
+	}
+	spec.Volumes = volumes
+
+	backoffLimit := int32(0)
+	ttl := int32(buildJobTTL)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template:                corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}, Spec: spec},
+		},
+	}
+}
+
+// Repository the jobs keep the layers of builds in, as the pods start without any
+func (this *JobBuilder) cacheRepository() string {
+	return this.options.Repository + "/cache"
+}
+
+// The CPU and memory limits of a build as the resources of its container
+func buildResources(options dockertypes.ImageBuildOptions) corev1.ResourceRequirements {
+	limits := corev1.ResourceList{}
+	if options.CPUQuota > 0 && options.CPUPeriod > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(options.CPUQuota*1000/options.CPUPeriod, resource.DecimalSI)
+	}
+	if options.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(options.Memory, resource.BinarySI)
+	}
+	return corev1.ResourceRequirements{Limits: limits}
+}
+
+// Stream the logs of the job pod's containers in the order they run, until the last one pushed the image. Returns
+// the digest it reported.
+func (this *JobBuilder) follow(ctx context.Context, name string, job *batchv1.Job, encoder *json.Encoder) (string, error) {
+	pod, err := this.waitForPod(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	spec := job.Spec.Template.Spec
+	containers := []string{}
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		containers = append(containers, container.Name)
+	}
+	digest := ""
+	for _, container := range containers {
+		if _, err := this.waitForContainer(ctx, pod, container, false); err != nil {
+			return "", err
+		}
+		if err := this.streamLogs(ctx, pod, container, encoder); err != nil {
+			return "", err
+		}
+		terminated, err := this.waitForContainer(ctx, pod, container, true)
+		if err != nil {
+			return "", err
+		}
+		if terminated.ExitCode != 0 {
+			return "", fmt.Errorf("container %s failed with exit code %d", container, terminated.ExitCode)
+		}
+		digest = strings.TrimSpace(terminated.Message)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("pushed without reporting a digest, got %q", digest)
+	}
+	return digest, nil
+}
+
+// The pod the job created
+func (this *JobBuilder) waitForPod(ctx context.Context, job string) (string, error) {
+	pods := this.client.CoreV1().Pods(this.options.Namespace)
+	for {
+		list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job})
+		if err != nil {
+			return "", fmt.Errorf("failed to get pod: %w", err)
+		}
+		if len(list.Items) > 0 {
+			return list.Items[0].Name, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(buildPollInterval):
+		}
+	}
+}
+
+// Wait until the container started, or with terminated until it exited. Containers that cannot start, e.g. as their
+// image cannot be pulled, fail right away.
+func (this *JobBuilder) waitForContainer(ctx context.Context, pod string, container string, terminated bool) (*corev1.ContainerStateTerminated, error) {
+	pods := this.client.CoreV1().Pods(this.options.Namespace)
+	for {
+		current, err := pods.Get(ctx, pod, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pod: %w", err)
+		}
+		for _, status := range append(current.Status.InitContainerStatuses, current.Status.ContainerStatuses...) {
+			if status.Name != container {
+				continue
+			}
+			state := status.State
+			if state.Terminated != nil {
+				return state.Terminated, nil
+			}
+			if state.Running != nil && !terminated {
+				return nil, nil
+			}
+			if waiting := state.Waiting; waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" && waiting.Reason != "PodInitializing" {
+				return nil, fmt.Errorf("container %s is not starting: %s: %s", container, waiting.Reason, waiting.Message)
+			}
+		}
+		if current.Status.Phase == corev1.PodFailed {
+			return nil, fmt.Errorf("pod %s failed before container %s ran: %s", pod, container, current.Status.Message)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(buildPollInterval):
+		}
+	}
+}
+
+func (this *JobBuilder) streamLogs(ctx context.Context, pod string, container string, encoder *json.Encoder) error {
+	logs, err := this.client.CoreV1().Pods(this.options.Namespace).GetLogs(pod, &corev1.PodLogOptions{Container: container, Follow: true}).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get logs of container %s: %w", container, err)
+	}
+	defer logs.Close()
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		if err := encoder.Encode(jsonmessage.JSONMessage{Stream: scanner.Text() + "\n"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pull the image the job pushed by the digest it reported and tag it with the tags of the build
+func (this *JobBuilder) pull(ctx context.Context, digest string, tags []string, encoder *json.Encoder) error {
+	pushed := this.options.Repository + "@" + digest
+	log.Info().Str("image", tags[0]).Str("digest", pushed).Msg("Build job pushed image")
+	encoder.Encode(jsonmessage.JSONMessage{Stream: "Pulling " + pushed + "\n"})
+
+	auth, err := this.auth(pushed)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", pushed, err)
+	}
+	pulled, err := this.images.ImagePull(ctx, pushed, dockertypes.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", pushed, err)
+	}
+	defer pulled.Close()
+	if err := jsonmessage.DisplayJSONMessagesStream(pulled, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", pushed, err)
+	}
+	for _, tag := range tags {
+		if err := this.images.ImageTag(ctx, pushed, tag); err != nil {
+			return fmt.Errorf("failed to tag %s as %s: %w", pushed, tag, err)
+		}
+	}
+	return nil
+}
+
+// Tag of an image reference, latest if it has none
+func tagOf(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "latest"
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return "latest"
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
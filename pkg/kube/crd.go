@@ -0,0 +1,93 @@
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	GROUP   = "csgo-watcher.io"
+	VERSION = "v1alpha1"
+	// Kind of the custom resource describing an image the operator keeps up to date
+	KIND_GAMESERVERIMAGE = "GameServerImage"
+)
+
+var GameServerImageResource = schema.GroupVersionResource{Group: GROUP, Version: VERSION, Resource: "gameserverimages"}
+
+// Definition of the GameServerImage custom resource, install it with `csgo-update-watcher crd | kubectl apply -f -`
+const GameServerImageCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: gameserverimages.csgo-watcher.io
+spec:
+  group: csgo-watcher.io
+  scope: Namespaced
+  names:
+    kind: GameServerImage
+    listKind: GameServerImageList
+    plural: gameserverimages
+    singular: gameserverimage
+    shortNames: [gsi]
+  versions:
+    - name: v1alpha1
+      served: true
+      storage: true
+      subresources:
+        status: {}
+      additionalPrinterColumns:
+        - name: Branch
+          type: string
+          jsonPath: .spec.branch
+        - name: Buildid
+          type: integer
+          jsonPath: .status.buildid
+        - name: Phase
+          type: string
+          jsonPath: .status.phase
+        - name: Checked
+          type: date
+          jsonPath: .status.lastChecked
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [repository]
+              properties:
+                appid:
+                  type: integer
+                  description: Steam appid of the dedicated server
+                  default: 740
+                branch:
+                  type: string
+                  description: Steam branch the server is installed from
+                  default: public
+                repository:
+                  type: string
+                  description: Repository the images are published to, e.g. ghcr.io/shootingrange/csgo
+                schedule:
+                  type: string
+                  description: Cron expression or @every <duration> of the checks for a new build
+                  default: "@every 5m"
+            status:
+              type: object
+              properties:
+                buildid:
+                  type: integer
+                image:
+                  type: string
+                  description: Reference of the get5 image of the build in the repository
+                digest:
+                  type: string
+                phase:
+                  type: string
+                  enum: [Ready, Failed]
+                message:
+                  type: string
+                lastChecked:
+                  type: string
+                  format: date-time
+                observedGeneration:
+                  type: integer
+                  format: int64
+`
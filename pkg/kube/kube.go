@@ -0,0 +1,325 @@
+// Package kube updates the images of game servers running as Kubernetes Deployments, StatefulSets or Agones Fleets
+// and waits for Kubernetes to roll them out.
+package kube
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"strings"
+	"time"
+)
+
+const (
+	KIND_DEPLOYMENT  = "Deployment"
+	KIND_STATEFULSET = "StatefulSet"
+)
+
+// How often the status of a workload is checked while waiting for its rollout
+const rolloutPollInterval = 5 * time.Second
+
+// A Deployment, StatefulSet or Agones Fleet of game servers
+type Workload struct {
+	// Deployment, StatefulSet or Fleet
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	// Only update this container, every container running a managed image if empty
+	Container string `yaml:"container"`
+}
+
+func (this Workload) String() string {
+	return this.Kind + " " + this.Namespace + "/" + this.Name
+}
+
+func (this Workload) Validate() error {
+	if this.Kind != KIND_DEPLOYMENT && this.Kind != KIND_STATEFULSET && this.Kind != KIND_FLEET {
+		return fmt.Errorf("kubernetes workload %s has unknown kind %q, expected %s, %s or %s", this.Name, this.Kind, KIND_DEPLOYMENT, KIND_STATEFULSET, KIND_FLEET)
+	}
+	if this.Name == "" || this.Namespace == "" {
+		return fmt.Errorf("kubernetes workload %q requires namespace and name", this.Name)
+	}
+	return nil
+}
+
+// Outcome of updating a workload, unchanged workloads have no images
+type Result struct {
+	Workload string `json:"workload"`
+	// Container name to the image it was updated to
+	Images map[string]string `json:"images,omitempty"`
+	Err    error             `json:"-"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// Updater points the containers of workloads at new images, matching them by variant like rollouts do
+type Updater struct {
+	client kubernetes.Interface
+	// Agones resources are not part of the typed client
+	dynamic dynamic.Interface
+	variant rollout.VariantFunc
+	timeout time.Duration
+}
+
+// Connect with the kubeconfig at the given path and context, or with the service account of the pod the watcher runs
+// in if kubeconfig is empty. timeout bounds how long the rollout of each workload is waited for.
+func NewUpdater(kubeconfig string, context string, variant rollout.VariantFunc, timeout time.Duration) (*Updater, error) {
+	config, err := clientConfig(kubeconfig, context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return &Updater{client, dynamicClient, variant, timeout}, nil
+}
+
+func clientConfig(kubeconfig string, context string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load in-cluster kubernetes config, set kubernetes.kubeconfig outside of a cluster: %w", err)
+		}
+		return config, nil
+	}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %w", kubeconfig, err)
+	}
+	return config, nil
+}
+
+// Update every workload running an older image of one of the images and wait for their rollouts, one workload at a
+// time. A failing workload does not stop the others.
+func (this *Updater) Update(ctx context.Context, workloads []Workload, images []string) ([]Result, error) {
+	return this.updateAll(ctx, workloads, images, false)
+}
+
+// The containers Update would change, the patches are validated by the API server without being applied
+func (this *Updater) DryRun(ctx context.Context, workloads []Workload, images []string) ([]Result, error) {
+	return this.updateAll(ctx, workloads, images, true)
+}
+
+func (this *Updater) updateAll(ctx context.Context, workloads []Workload, images []string, dryRun bool) ([]Result, error) {
+	replacements := map[string]string{}
+	for _, image := range images {
+		if variant, ok := this.variant(image); ok {
+			replacements[variant] = image
+		}
+	}
+
+	results := []Result{}
+	failed := []string{}
+	for _, workload := range workloads {
+		result := Result{Workload: workload.String()}
+		result.Images, result.Err = this.update(ctx, workload, replacements, dryRun)
+		if result.Err != nil {
+			result.Error = result.Err.Error()
+			log.Err(result.Err).Str("workload", result.Workload).Msg("Failed to update kubernetes workload")
+			failed = append(failed, fmt.Sprintf("%s: %s", workload, result.Err))
+		} else if len(result.Images) > 0 && !dryRun {
+			log.Info().Str("workload", result.Workload).Msg("Updated kubernetes workload")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to update %d of %d kubernetes workloads: %s", len(failed), len(workloads), strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+func (this *Updater) update(ctx context.Context, workload Workload, replacements map[string]string, dryRun bool) (map[string]string, error) {
+	template, err := this.podTemplate(ctx, workload)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := map[string]string{}
+	changes := []containerChange{}
+	for i, container := range template.Spec.Containers {
+		if workload.Container != "" && container.Name != workload.Container {
+			continue
+		}
+		variant, ok := this.variant(container.Image)
+		if !ok {
+			continue
+		}
+		if image, ok := replacements[variant]; ok && container.Image != image {
+			updated[container.Name] = image
+			changes = append(changes, containerChange{i, container.Name, image})
+		}
+	}
+	if len(updated) == 0 {
+		return nil, nil
+	}
+
+	options := metav1.PatchOptions{}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	} else {
+		log.Info().Str("workload", workload.String()).Interface("images", updated).Msg("Patching kubernetes workload")
+	}
+	if err := this.patch(ctx, workload, changes, options); err != nil {
+		return nil, fmt.Errorf("failed to patch images: %w", err)
+	}
+	if dryRun {
+		return updated, nil
+	}
+
+	return updated, this.waitForRollout(ctx, workload)
+}
+
+func (this *Updater) podTemplate(ctx context.Context, workload Workload) (*corev1.PodTemplateSpec, error) {
+	apps := this.client.AppsV1()
+	switch workload.Kind {
+	case KIND_DEPLOYMENT:
+		deployment, err := apps.Deployments(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		return &deployment.Spec.Template, nil
+	case KIND_STATEFULSET:
+		statefulSet, err := apps.StatefulSets(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		return &statefulSet.Spec.Template, nil
+	case KIND_FLEET:
+		return this.fleetPodTemplate(ctx, workload)
+	}
+	return nil, fmt.Errorf("unknown kind %q", workload.Kind)
+}
+
+// A container to point at a new image, by its index in the pod template
+type containerChange struct {
+	Index int
+	Name  string
+	Image string
+}
+
+func (this *Updater) patch(ctx context.Context, workload Workload, changes []containerChange, options metav1.PatchOptions) error {
+	if workload.Kind == KIND_FLEET {
+		return this.patchFleet(ctx, workload, changes, options)
+	}
+
+	// Containers are merged by name, everything else about them stays as it is
+	containers := []map[string]string{}
+	for _, change := range changes {
+		containers = append(containers, map[string]string{"name": change.Name, "image": change.Image})
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{"containers": containers},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	apps := this.client.AppsV1()
+	if workload.Kind == KIND_DEPLOYMENT {
+		_, err = apps.Deployments(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, options)
+	} else {
+		_, err = apps.StatefulSets(workload.Namespace).Patch(ctx, workload.Name, types.StrategicMergePatchType, patch, options)
+	}
+	return err
+}
+
+// Wait until every replica of the workload runs the new pod template, like `kubectl rollout status`
+func (this *Updater) waitForRollout(ctx context.Context, workload Workload) error {
+	ctx, cancel := context.WithTimeout(ctx, this.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(rolloutPollInterval)
+	defer ticker.Stop()
+	for {
+		done, err := this.rolledOut(ctx, workload)
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("rollout did not finish within %s: %w", this.timeout, ctx.Err())
+		}
+	}
+}
+
+func (this *Updater) rolledOut(ctx context.Context, workload Workload) (bool, error) {
+	apps := this.client.AppsV1()
+	switch workload.Kind {
+	case KIND_FLEET:
+		return this.fleetRolledOut(ctx, workload)
+	case KIND_DEPLOYMENT:
+		deployment, err := apps.Deployments(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		return deploymentRolledOut(deployment)
+	}
+
+	statefulSet, err := apps.StatefulSets(workload.Namespace).Get(ctx, workload.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get statefulset: %w", err)
+	}
+	return statefulSetRolledOut(statefulSet), nil
+}
+
+func deploymentRolledOut(deployment *appsv1.Deployment) (bool, error) {
+	status := deployment.Status
+	if status.ObservedGeneration < deployment.Generation {
+		return false, nil
+	}
+	for _, condition := range status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("deployment exceeded its progress deadline: %s", condition.Message)
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	// Old replicas are gone once every replica is updated and available
+	return status.UpdatedReplicas >= replicas && status.Replicas == status.UpdatedReplicas && status.AvailableReplicas == status.UpdatedReplicas, nil
+}
+
+func statefulSetRolledOut(statefulSet *appsv1.StatefulSet) bool {
+	status := statefulSet.Status
+	if status.ObservedGeneration < statefulSet.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		// Pods are only replaced when deleted by hand
+		return true
+	}
+	if partition := statefulSet.Spec.UpdateStrategy.RollingUpdate; partition != nil && partition.Partition != nil {
+		return status.UpdatedReplicas >= replicas-*partition.Partition && status.ReadyReplicas >= replicas
+	}
+	return status.UpdateRevision == status.CurrentRevision && status.UpdatedReplicas >= replicas && status.ReadyReplicas >= replicas
+}
@@ -0,0 +1,101 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"time"
+)
+
+// Renewals of a held lease, a standby takes over once it was not renewed for leaseDuration
+const (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+)
+
+// Lease elects a leader among watchers with a coordination.k8s.io Lease
+type Lease struct {
+	lock  *resourcelock.LeaseLock
+	retry time.Duration
+	// Stops renewing the lease and releases it
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Lease namespace/name held as identity, with the kubeconfig at the given path and context or the service account of
+// the pod the watcher runs in. Standbys try to take it every retry.
+func NewLease(kubeconfig string, context string, namespace string, name string, identity string, retry time.Duration) (*Lease, error) {
+	config, err := clientConfig(kubeconfig, context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	return &Lease{lock: lock, retry: retry}, nil
+}
+
+func (this *Lease) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	started := make(chan struct{})
+	lost := make(chan struct{})
+	electorCtx, cancel := context.WithCancel(context.Background())
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            this.lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseRenewDeadline,
+		RetryPeriod:     this.retry,
+		ReleaseOnCancel: true,
+		Name:            this.lock.LeaseMeta.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { close(started) },
+			// Also called if it never led
+			OnStoppedLeading: func() {},
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid lease: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		elector.Run(electorCtx)
+		// Renewing failed if it stopped leading without being released
+		select {
+		case <-started:
+			if electorCtx.Err() == nil {
+				close(lost)
+			}
+		default:
+		}
+	}()
+	select {
+	case <-started:
+		this.cancel, this.done = cancel, done
+		return lost, nil
+	case <-ctx.Done():
+		cancel()
+		<-done
+		return nil, ctx.Err()
+	}
+}
+
+func (this *Lease) Release() error {
+	if this.cancel == nil {
+		return nil
+	}
+	this.cancel()
+	<-this.done
+	this.cancel, this.done = nil, nil
+	return nil
+}
@@ -0,0 +1,253 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"sync"
+	"time"
+)
+
+const (
+	PHASE_READY  = "Ready"
+	PHASE_FAILED = "Failed"
+)
+
+// Resources are listed again this often in case a watch event was missed
+const operatorResync = 10 * time.Minute
+
+// Which image a GameServerImage keeps up to date
+type ImageSpec struct {
+	AppID      int    `json:"appid"`
+	Branch     string `json:"branch"`
+	Repository string `json:"repository"`
+	Schedule   string `json:"schedule"`
+}
+
+// What the operator last found, written to the status of the GameServerImage
+type ImageStatus struct {
+	Buildid            int    `json:"buildid,omitempty"`
+	Image              string `json:"image,omitempty"`
+	Digest             string `json:"digest,omitempty"`
+	Phase              string `json:"phase,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastChecked        string `json:"lastChecked,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+// Reconciler publishes the newest build of the spec's app and branch to its repository if it is not there yet
+type Reconciler interface {
+	Reconcile(ctx context.Context, spec ImageSpec) (ImageStatus, error)
+}
+
+type scheduled struct {
+	entry      cron.EntryID
+	generation int64
+}
+
+// Operator reconciles every GameServerImage on its schedule and whenever its spec changes, one at a time since
+// builds share the docker host
+type Operator struct {
+	client     dynamic.Interface
+	namespace  string
+	reconciler Reconciler
+	scheduler  *cron.Cron
+
+	mutex       sync.Mutex
+	schedules   map[string]scheduled
+	reconciling sync.Mutex
+}
+
+// Watch the GameServerImages of a namespace, or of all namespaces if empty. The kubeconfig is loaded like for
+// NewUpdater.
+func NewOperator(kubeconfig string, context string, namespace string, reconciler Reconciler) (*Operator, error) {
+	config, err := clientConfig(kubeconfig, context)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return &Operator{
+		client:     client,
+		namespace:  namespace,
+		reconciler: reconciler,
+		scheduler:  cron.New(),
+		schedules:  map[string]scheduled{},
+	}, nil
+}
+
+// Run reconciles until the context is done
+func (this *Operator) Run(ctx context.Context) error {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(this.client, operatorResync, this.namespace, nil)
+	informer := factory.ForResource(GameServerImageResource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { this.changed(ctx, obj) },
+		UpdateFunc: func(_ interface{}, obj interface{}) { this.changed(ctx, obj) },
+		DeleteFunc: this.deleted,
+	})
+
+	this.scheduler.Start()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		<-this.scheduler.Stop().Done()
+		return fmt.Errorf("failed to list %s, is the CRD installed? %w", GameServerImageResource.Resource, ctx.Err())
+	}
+	log.Info().Str("namespace", this.namespace).Msg("Watching GameServerImages")
+
+	<-ctx.Done()
+	<-this.scheduler.Stop().Done()
+	return nil
+}
+
+// Schedule the resource anew and reconcile it right away if its spec changed. Status updates leave the generation
+// as it is and are ignored.
+func (this *Operator) changed(ctx context.Context, obj interface{}) {
+	resource, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := resource.GetNamespace() + "/" + resource.GetName()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	previous, exists := this.schedules[key]
+	if exists && previous.generation == resource.GetGeneration() {
+		return
+	}
+	if exists {
+		this.scheduler.Remove(previous.entry)
+		delete(this.schedules, key)
+	}
+
+	namespace, name := resource.GetNamespace(), resource.GetName()
+	reconcile := func() { this.reconcile(ctx, namespace, name) }
+	spec, err := parseSpec(resource)
+	if err == nil {
+		var entry cron.EntryID
+		if entry, err = this.scheduler.AddFunc(spec.Schedule, reconcile); err == nil {
+			this.schedules[key] = scheduled{entry, resource.GetGeneration()}
+		} else {
+			err = fmt.Errorf("invalid schedule %q: %w", spec.Schedule, err)
+		}
+	}
+	if err != nil {
+		log.Err(err).Str("resource", key).Msg("Invalid GameServerImage")
+		go this.writeStatus(ctx, namespace, name, func(status *ImageStatus) {
+			status.Phase, status.Message = PHASE_FAILED, err.Error()
+		})
+		return
+	}
+	go reconcile()
+}
+
+func (this *Operator) deleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	resource, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := resource.GetNamespace() + "/" + resource.GetName()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if previous, ok := this.schedules[key]; ok {
+		this.scheduler.Remove(previous.entry)
+		delete(this.schedules, key)
+	}
+}
+
+func (this *Operator) reconcile(ctx context.Context, namespace string, name string) {
+	this.reconciling.Lock()
+	defer this.reconciling.Unlock()
+
+	resource, err := this.client.Resource(GameServerImageResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		log.Err(err).Str("resource", namespace+"/"+name).Msg("Failed to get GameServerImage")
+		return
+	}
+	spec, err := parseSpec(resource)
+	if err != nil {
+		return
+	}
+
+	log.Debug().Str("resource", namespace+"/"+name).Msg("Reconciling GameServerImage")
+	reconciled, err := this.reconciler.Reconcile(ctx, spec)
+	if err != nil {
+		log.Err(err).Str("resource", namespace+"/"+name).Msg("Failed to reconcile GameServerImage")
+	}
+	this.writeStatus(ctx, namespace, name, func(status *ImageStatus) {
+		// A failed check keeps the last known build
+		if err != nil {
+			status.Phase, status.Message = PHASE_FAILED, err.Error()
+			return
+		}
+		*status = reconciled
+		status.Phase, status.Message = PHASE_READY, ""
+	})
+}
+
+// Change the status of the current version of the resource
+func (this *Operator) writeStatus(ctx context.Context, namespace string, name string, update func(status *ImageStatus)) {
+	resources := this.client.Resource(GameServerImageResource).Namespace(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		resource, err := resources.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		status := ImageStatus{}
+		if current, ok := resource.Object["status"].(map[string]interface{}); ok {
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(current, &status); err != nil {
+				return err
+			}
+		}
+		update(&status)
+		status.LastChecked = time.Now().UTC().Format(time.RFC3339)
+		status.ObservedGeneration = resource.GetGeneration()
+
+		resource.Object["status"], err = runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return err
+		}
+		_, err = resources.UpdateStatus(ctx, resource, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		log.Err(err).Str("resource", namespace+"/"+name).Msg("Failed to update GameServerImage status")
+	}
+}
+
+func parseSpec(resource *unstructured.Unstructured) (ImageSpec, error) {
+	spec := ImageSpec{}
+	if raw, ok := resource.Object["spec"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &spec); err != nil {
+			return spec, fmt.Errorf("invalid spec: %w", err)
+		}
+	}
+	// Defaults of the CRD, in case the API server did not apply them
+	if spec.AppID == 0 {
+		spec.AppID = 740
+	}
+	if spec.Branch == "" {
+		spec.Branch = "public"
+	}
+	if spec.Schedule == "" {
+		spec.Schedule = "@every 5m"
+	}
+	if spec.Repository == "" {
+		return spec, fmt.Errorf("spec.repository is required")
+	}
+	return spec, nil
+}
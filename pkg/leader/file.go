@@ -0,0 +1,56 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Advisory lock on a file, for watchers on one host or sharing a filesystem with working locks like NFSv4
+type File struct {
+	path  string
+	retry time.Duration
+	file  *os.File
+}
+
+func NewFile(path string, retry time.Duration) *File {
+	return &File{path: path, retry: retry}
+}
+
+func (this *File) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	file, err := os.OpenFile(this.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", this.path, err)
+		}
+		select {
+		case <-time.After(this.retry):
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		}
+	}
+	this.file = file
+	// Only lost when the process dies, which takes the lock with it
+	return make(chan struct{}), nil
+}
+
+func (this *File) Release() error {
+	if this.file == nil {
+		return nil
+	}
+	// Closing the file drops the lock
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
@@ -0,0 +1,20 @@
+// Package leader elects one of several redundant watchers to check Steam and build, the others stand by until it
+// stops or loses its lock.
+package leader
+
+import (
+	"context"
+	"time"
+)
+
+// How often a standby tries to take a lock, and how often a held lock is checked by locks that can break
+const DEFAULT_RETRY = 5 * time.Second
+
+// Lock is held by at most one watcher at a time
+type Lock interface {
+	// Acquire blocks until the lock is held or ctx is done. The returned channel is closed if the lock is lost
+	// while it is held.
+	Acquire(ctx context.Context) (<-chan struct{}, error)
+	// Release lets a standby take over
+	Release() error
+}
@@ -0,0 +1,106 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"hash/fnv"
+	"time"
+)
+
+// Session level advisory lock of a postgres database, e.g. the one of the shared history. It is held by a connection
+// of its own and lost with it.
+type Postgres struct {
+	dsn   string
+	key   int64
+	retry time.Duration
+	db    *sql.DB
+	conn  *sql.Conn
+	stop  context.CancelFunc
+	// Closed once the watch of the connection returned
+	watching chan struct{}
+}
+
+// The lock is identified by name, watchers using the same name exclude each other
+func NewPostgres(dsn string, name string, retry time.Duration) *Postgres {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return &Postgres{dsn: dsn, key: int64(hash.Sum64()), retry: retry}
+}
+
+func (this *Postgres) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	db, err := sql.Open("postgres", this.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres lock: %w", err)
+	}
+	for {
+		conn, err := this.tryLock(ctx, db)
+		if err == nil && conn != nil {
+			this.db, this.conn = db, conn
+			break
+		}
+		// A database that is down only delays taking over
+		select {
+		case <-time.After(this.retry):
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	lost := make(chan struct{})
+	watchCtx, stop := context.WithCancel(context.Background())
+	this.stop = stop
+	this.watching = make(chan struct{})
+	go this.watch(watchCtx, this.conn, lost, this.watching)
+	return lost, nil
+}
+
+// The connection holding the lock if it was free
+func (this *Postgres) tryLock(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	locked := false
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, this.key).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close lost once the connection holding the lock breaks
+func (this *Postgres) watch(ctx context.Context, conn *sql.Conn, lost chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(this.retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, this.retry)
+			err := conn.PingContext(pingCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				close(lost)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (this *Postgres) Release() error {
+	if this.conn == nil {
+		return nil
+	}
+	this.stop()
+	<-this.watching
+	_, err := this.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, this.key)
+	this.conn.Close()
+	this.db.Close()
+	this.conn, this.db, this.stop, this.watching = nil, nil, nil, nil
+	return err
+}
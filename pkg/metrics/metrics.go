@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "csgo_watcher"
+
+var (
+	FleetHostUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fleet_host_up",
+		Help:      "Whether the last health check of a fleet host succeeded.",
+	}, []string{"host", "source"})
+	FleetHostLastSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fleet_host_last_seen_timestamp_seconds",
+		Help:      "Last time a fleet host answered a health check.",
+	}, []string{"host"})
+	FleetHostServers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fleet_host_servers",
+		Help:      "Game servers running a managed image on a fleet host.",
+	}, []string{"host"})
+	RolloutActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rollout_active",
+		Help:      "Whether a rollout or scheduled restart is in progress.",
+	})
+	RolloutPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rollout_paused",
+		Help:      "Whether the rollout in progress is paused.",
+	})
+	RolloutServers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rollout_servers",
+		Help:      "Servers of the current or last rollout by state: total, updated, failed, skipped, pending and draining.",
+	}, []string{"state"})
+	UpdateLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "update_latency_seconds",
+		Help:      "Percentiles of the latency of each update phase over the SLO window: detection, build, deploy and total.",
+	}, []string{"phase", "quantile"})
+	UpdateLatencyUpdates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "update_latency_updates",
+		Help:      "Updates within the SLO window that completed each phase.",
+	}, []string{"phase"})
+	UpdateObjectiveAttainment = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "update_slo_attainment_ratio",
+		Help:      "Share of the updates within the SLO window that met the latency objective of each phase.",
+	}, []string{"phase"})
+	BuildLimitReached = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_limit_reached",
+		Help:      "Whether builds of an app are refused since the build limit was reached.",
+	}, []string{"appid"})
+	BuildCacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_cache_bytes",
+		Help:      "Size of the engine's build cache after the last build: total and the share created or used by the watcher's builds.",
+	}, []string{"scope"})
+	ImageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "image_bytes",
+		Help:      "Size of each local image of the managed repository by tag, including the layers it shares with other images.",
+	}, []string{"image"})
+	RepositoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_bytes",
+		Help:      "Disk usage attributable to the local images of the managed repository, shared layers counted once where the engine reports them.",
+	})
+	RepositoryGrowthBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_growth_bytes",
+		Help:      "Change of the disk usage of the managed repository caused by the last build.",
+	})
+	ConsecutiveFailures = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consecutive_failures",
+		Help:      "Checks and builds that failed in a row since the last success.",
+	})
+	SteamLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "steam_last_success_timestamp_seconds",
+		Help:      "Last time Steam answered a version check.",
+	})
+	SteamStale = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "steam_stale",
+		Help:      "Whether Steam was not checked successfully for error_policy.stale_after.",
+	})
+	Degraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "degraded",
+		Help:      "Whether checks back off after error_policy.backoff_after consecutive failures.",
+	})
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this watcher holds the lock and builds, 0 while it stands by.",
+	})
+	BuildCacheReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "build_cache_reclaimed_bytes_total",
+		Help:      "Bytes of build cache removed by build_cache pruning.",
+	})
+	TriggerFires = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trigger_fires_total",
+		Help:      "Updates a trigger detected, each asking for a check or build.",
+	}, []string{"trigger"})
+	TriggerLastFire = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "trigger_last_fire_timestamp_seconds",
+		Help:      "Last time a trigger fired.",
+	}, []string{"trigger"})
+	TriggerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trigger_errors_total",
+		Help:      "Polls of a trigger that failed to reach what it watches.",
+	}, []string{"trigger"})
+	TriggerFailing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "trigger_failing",
+		Help:      "Whether the last poll of a trigger failed.",
+	}, []string{"trigger"})
+	NotificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Messages a notifier delivered, by event.",
+	}, []string{"notifier", "event"})
+	NotificationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notification_errors_total",
+		Help:      "Messages a notifier failed to deliver.",
+	}, []string{"notifier"})
+	StreamedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streamed_events_total",
+		Help:      "Events published to an event_stream broker, by type.",
+	}, []string{"sink", "type"})
+	StreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_errors_total",
+		Help:      "Events an event_stream broker failed to take.",
+	}, []string{"sink"})
+	StreamedEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streamed_events_dropped_total",
+		Help:      "Events dropped since the event_stream queue was full.",
+	})
+)
+
+// Prometheus exposition of all metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
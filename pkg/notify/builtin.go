@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("discord", newDiscord)
+	Register("slack", newSlack)
+	Register("webhook", newWebhook)
+	Register("email", newEmail)
+}
+
+// Shown as the sender of chat messages
+const username = "CS:GO update watcher"
+
+// Error bodies of webhooks are cut to this length
+const maxErrorBody = 512
+
+func validateWebhookURL(config Config) error {
+	if config.WebhookURL == "" {
+		return fmt.Errorf("webhook_url must not be empty")
+	}
+	parsed, err := url.Parse(config.WebhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook_url must be an http or https URL")
+	}
+	return nil
+}
+
+// Messages of a Discord webhook
+type discord struct {
+	url string
+}
+
+func newDiscord(config Config) (Notifier, error) {
+	if err := validateWebhookURL(config); err != nil {
+		return nil, err
+	}
+	return discord{config.WebhookURL}, nil
+}
+
+func (this discord) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, this.url, map[string]string{"username": username, "content": message.Text})
+}
+
+// Messages of a Slack incoming webhook
+type slack struct {
+	url string
+}
+
+func newSlack(config Config) (Notifier, error) {
+	if err := validateWebhookURL(config); err != nil {
+		return nil, err
+	}
+	return slack{config.WebhookURL}, nil
+}
+
+func (this slack) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, this.url, map[string]string{"username": username, "text": message.Text})
+}
+
+// The message as JSON, e.g. for a chat bot or CI job
+type webhook struct {
+	url string
+}
+
+func newWebhook(config Config) (Notifier, error) {
+	if err := validateWebhookURL(config); err != nil {
+		return nil, err
+	}
+	return webhook{config.WebhookURL}, nil
+}
+
+func (this webhook) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, this.url, message)
+}
+
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		// The URL is a credential of its own
+		return fmt.Errorf("failed to post notification: %w", scrubURL(err))
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		text, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return fmt.Errorf("webhook answered %s: %s", response.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
+
+func scrubURL(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
+
+// Mails over SMTP, with the event as subject
+type email struct {
+	config Config
+	host   string
+}
+
+func newEmail(config Config) (Notifier, error) {
+	host, _, err := net.SplitHostPort(config.SMTP)
+	if err != nil {
+		return nil, fmt.Errorf("smtp must be host:port: %w", err)
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("from must not be empty")
+	}
+	if len(config.To) == 0 {
+		return nil, fmt.Errorf("to must not be empty")
+	}
+	for _, address := range append([]string{config.From}, config.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	return email{config, host}, nil
+}
+
+func (this email) Notify(ctx context.Context, message Message) error {
+	var auth smtp.Auth
+	if this.config.Username != "" {
+		auth = smtp.PlainAuth("", this.config.Username, this.config.Password, this.host)
+	}
+	body := "From: " + this.config.From + "\r\n" +
+		"To: " + strings.Join(this.config.To, ", ") + "\r\n" +
+		"Subject: " + username + ": " + message.Event + "\r\n" +
+		"Date: " + message.Time.Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(message.Text, "\n", "\r\n") + "\r\n"
+	// net/smtp takes no context, the mail is sent in the background and given up on once ctx is done
+	sent := make(chan error, 1)
+	go func() {
+		sent <- smtp.SendMail(this.config.SMTP, auth, this.config.From, this.config.To, []byte(body))
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send mail: %w", ctx.Err())
+	}
+}
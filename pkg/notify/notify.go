@@ -0,0 +1,196 @@
+// Package notify tells people what the watcher did. Every notifier is created by the factory registered for its type,
+// built in are discord, slack, webhook and email, and is only sent the events it is configured for. Other types are
+// added with Register in init.
+package notify
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/metrics"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// Events notifiers are sent
+const (
+	// Steam released a new version, or a mod or repository of the images has a new release
+	EVENT_UPDATE_DETECTED = "update-detected"
+	// A build started
+	EVENT_BUILD_STARTED = "build-started"
+	// A build was published
+	EVENT_BUILD_SUCCEEDED = "build-succeeded"
+	// A build or the publishing of a build failed
+	EVENT_BUILD_FAILED = "build-failed"
+	// A rollout or scheduled restart restarted game servers
+	EVENT_SERVERS_RESTARTED = "servers-restarted"
+	// A build was deployed to Kubernetes, compose projects, gitops repositories, swarm services, exported, handed to
+	// CI pipelines, promoted or rolled back to
+	EVENT_DEPLOYED = "deployed"
+	// Failures in a row, Steam not answering, the disk budget or build limit exceeded and recoveries from them
+	EVENT_WARNING = "warning"
+)
+
+var events = []string{
+	EVENT_UPDATE_DETECTED,
+	EVENT_BUILD_STARTED,
+	EVENT_BUILD_SUCCEEDED,
+	EVENT_BUILD_FAILED,
+	EVENT_SERVERS_RESTARTED,
+	EVENT_DEPLOYED,
+	EVENT_WARNING,
+}
+
+// How long a notifier may take to deliver a message
+const sendTimeout = 10 * time.Second
+
+func EventNames() []string {
+	return append([]string{}, events...)
+}
+
+func validateEvent(name string) error {
+	for _, event := range events {
+		if name == event {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown notifier event %q, expected one of %v", name, events)
+}
+
+// A message about one event
+type Message struct {
+	Event string `json:"event"`
+	Text  string `json:"text"`
+	// Buildid the message is about, if any
+	Buildid int       `json:"buildid,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier delivers messages to one destination
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+// Config of a notifier. Besides type, name and events the built in types use the options they need, types
+// registered elsewhere read options.
+type Config struct {
+	// Registered type, e.g. discord
+	Type string `yaml:"type"`
+	// Used in logs and metrics, defaults to the type
+	Name string `yaml:"name"`
+	// Events the notifier is sent, every event if empty
+	Events []string `yaml:"events"`
+	// Incoming webhook of discord and slack, URL the webhook type posts to
+	WebhookURL string `yaml:"webhook_url"`
+	// SMTP server of email as host:port, STARTTLS is used when the server offers it
+	SMTP     string   `yaml:"smtp"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	// Options of types registered outside this package
+	Options map[string]string `yaml:"options"`
+}
+
+// Factory creates a notifier from its config, failing on missing or invalid options. It must not reach the
+// destination, the config is validated with it.
+type Factory func(config Config) (Notifier, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a notifier type available to New, the built in types register themselves in init
+func Register(kind string, factory Factory) {
+	if _, exists := factories[kind]; exists {
+		panic("notifier type registered twice: " + kind)
+	}
+	factories[kind] = factory
+}
+
+func Types() []string {
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+type subscriber struct {
+	name     string
+	events   map[string]bool
+	notifier Notifier
+}
+
+// Dispatcher sends every message to the notifiers configured for its event
+type Dispatcher struct {
+	subscribers []subscriber
+}
+
+// New creates the notifiers of configs, failing on unknown types or events and invalid options
+func New(configs []Config) (*Dispatcher, error) {
+	dispatcher := &Dispatcher{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			config.Name = config.Type
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("notifier %q is configured twice, give them distinct names", config.Name)
+		}
+		names[config.Name] = true
+
+		factory, ok := factories[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier type %q, expected one of %v", config.Type, Types())
+		}
+		subscribed := map[string]bool{}
+		for _, event := range config.Events {
+			if err := validateEvent(event); err != nil {
+				return nil, fmt.Errorf("notifier %s: %w", config.Name, err)
+			}
+			subscribed[event] = true
+		}
+		if len(subscribed) == 0 {
+			for _, event := range events {
+				subscribed[event] = true
+			}
+		}
+		notifier, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", config.Name, err)
+		}
+		dispatcher.subscribers = append(dispatcher.subscribers, subscriber{config.Name, subscribed, notifier})
+	}
+	return dispatcher, nil
+}
+
+// Names of the notifiers
+func (this *Dispatcher) Names() []string {
+	names := []string{}
+	for _, subscriber := range this.subscribers {
+		names = append(names, subscriber.name)
+	}
+	return names
+}
+
+// Send the message to every notifier of its event one after another. Failures are logged and do not keep the
+// message from the other notifiers.
+func (this *Dispatcher) Send(message Message) {
+	if message.Time.IsZero() {
+		message.Time = time.Now()
+	}
+	for _, subscriber := range this.subscribers {
+		if !subscriber.events[message.Event] {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := subscriber.notifier.Notify(ctx, message)
+		cancel()
+		if err != nil {
+			metrics.NotificationErrors.WithLabelValues(subscriber.name).Inc()
+			log.Err(err).Str("notifier", subscriber.name).Str("event", message.Event).Msg("Failed to send notification")
+			continue
+		}
+		metrics.NotificationsSent.WithLabelValues(subscriber.name, message.Event).Inc()
+	}
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Register("github", newGitHub)
+}
+
+const (
+	GITHUB_API         = "https://api.github.com"
+	DEFAULT_EVENT_TYPE = "csgo-build"
+	// Ref of workflows and GitLab pipelines
+	DEFAULT_REF = "main"
+)
+
+// Sends a repository_dispatch event to a repository, or starts a workflow with workflow_dispatch
+type github struct {
+	config Config
+}
+
+func newGitHub(config Config) (Pipeline, error) {
+	if config.URL == "" {
+		config.URL = GITHUB_API
+	}
+	if err := validateURL(config); err != nil {
+		return nil, err
+	}
+	if parts := strings.Split(config.Repository, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("repository must be owner/name")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("token must not be empty")
+	}
+	if config.EventType == "" {
+		config.EventType = DEFAULT_EVENT_TYPE
+	}
+	if config.Ref == "" {
+		config.Ref = DEFAULT_REF
+	}
+	return github{config}, nil
+}
+
+func (this github) Trigger(ctx context.Context, build Build) error {
+	image := build.Image()
+	endpoint := strings.TrimSuffix(this.config.URL, "/") + "/repos/" + this.config.Repository
+	var body interface{}
+	if this.config.Workflow != "" {
+		endpoint += "/actions/workflows/" + url.PathEscape(this.config.Workflow) + "/dispatches"
+		// Inputs are strings and have to be declared by the workflow
+		body = map[string]interface{}{
+			"ref": this.config.Ref,
+			"inputs": map[string]string{
+				"buildid": strconv.Itoa(build.Buildid),
+				"tag":     build.Tag(),
+				"image":   image.Reference,
+				"digest":  image.Digest,
+			},
+		}
+	} else {
+		endpoint += "/dispatches"
+		body = map[string]interface{}{
+			"event_type": this.config.EventType,
+			"client_payload": map[string]interface{}{
+				"buildid": build.Buildid,
+				"tag":     build.Tag(),
+				"image":   image.Reference,
+				"digest":  image.Digest,
+				"images":  build.Images,
+			},
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return send(ctx, http.MethodPost, endpoint, map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer " + this.config.Token,
+		"Content-Type":  "application/json",
+	}, data)
+}
@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	Register("gitlab", newGitLab)
+}
+
+const GITLAB_API = "https://gitlab.com/api/v4"
+
+// Runs a pipeline of a GitLab project with a pipeline trigger token, passing the build as CI/CD variables
+type gitlab struct {
+	config Config
+}
+
+func newGitLab(config Config) (Pipeline, error) {
+	if config.URL == "" {
+		config.URL = GITLAB_API
+	}
+	if err := validateURL(config); err != nil {
+		return nil, err
+	}
+	if config.Project == "" {
+		return nil, fmt.Errorf("project must not be empty")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("token must not be empty")
+	}
+	if config.Ref == "" {
+		config.Ref = DEFAULT_REF
+	}
+	return gitlab{config}, nil
+}
+
+func (this gitlab) Trigger(ctx context.Context, build Build) error {
+	form := url.Values{}
+	form.Set("token", this.config.Token)
+	form.Set("ref", this.config.Ref)
+	for name, value := range build.Variables() {
+		form.Set("variables["+name+"]", value)
+	}
+	endpoint := strings.TrimSuffix(this.config.URL, "/") + "/projects/" + url.PathEscape(this.config.Project) + "/trigger/pipeline"
+	return send(ctx, http.MethodPost, endpoint, map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}, []byte(form.Encode()))
+}
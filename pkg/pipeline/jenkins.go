@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	Register("jenkins", newJenkins)
+}
+
+// Builds a parameterized Jenkins job through its remote build token, the build is passed as the parameters BUILDID,
+// TAG, IMAGE and DIGEST
+type jenkins struct {
+	config Config
+}
+
+func newJenkins(config Config) (Pipeline, error) {
+	if err := validateURL(config); err != nil {
+		return nil, err
+	}
+	if strings.Trim(config.Job, "/") == "" {
+		return nil, fmt.Errorf("job must not be empty")
+	}
+	if config.Token == "" && config.Username == "" {
+		return nil, fmt.Errorf("token or username and password must be set")
+	}
+	return jenkins{config}, nil
+}
+
+func (this jenkins) Trigger(ctx context.Context, build Build) error {
+	path := ""
+	for _, folder := range strings.Split(strings.Trim(this.config.Job, "/"), "/") {
+		path += "/job/" + url.PathEscape(folder)
+	}
+	query := url.Values{}
+	if this.config.Token != "" {
+		query.Set("token", this.config.Token)
+	}
+	for name, value := range build.Variables() {
+		query.Set(name, value)
+	}
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	// API tokens are exempt from CSRF protection, no crumb is needed
+	if this.config.Username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(this.config.Username+":"+this.config.Password))
+	}
+	endpoint := strings.TrimSuffix(this.config.URL, "/") + path + "/buildWithParameters"
+	return send(ctx, http.MethodPost, endpoint, headers, []byte(query.Encode()))
+}
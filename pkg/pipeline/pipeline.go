@@ -0,0 +1,233 @@
+// Package pipeline starts CI pipelines of new builds, e.g. to scan, harden or sign the images downstream. Every
+// pipeline is started by the factory registered for its type, built in are github, gitlab and jenkins. Other types are
+// added with Register in init.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long starting a pipeline may take
+const triggerTimeout = 30 * time.Second
+
+// Error bodies of CI servers are cut to this length
+const maxErrorBody = 512
+
+// A published image of a build
+type Image struct {
+	Reference string `json:"image"`
+	// Digest of the manifest in the registry, empty for local images
+	Digest string `json:"digest,omitempty"`
+}
+
+// The build a pipeline is started for
+type Build struct {
+	Buildid int     `json:"buildid"`
+	Images  []Image `json:"images"`
+}
+
+// The first image with a digest, the first image if none was pushed
+func (this Build) Image() Image {
+	for _, image := range this.Images {
+		if image.Digest != "" {
+			return image
+		}
+	}
+	if len(this.Images) == 0 {
+		return Image{}
+	}
+	return this.Images[0]
+}
+
+// Tag of Image, e.g. get5-buildid-123
+func (this Build) Tag() string {
+	reference := strings.SplitN(this.Image().Reference, "@", 2)[0]
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return reference[i+1:]
+	}
+	return ""
+}
+
+// Variables of GitLab pipelines and parameters of Jenkins builds
+func (this Build) Variables() map[string]string {
+	return map[string]string{
+		"BUILDID": strconv.Itoa(this.Buildid),
+		"TAG":     this.Tag(),
+		"IMAGE":   this.Image().Reference,
+		"DIGEST":  this.Image().Digest,
+	}
+}
+
+// Pipeline starts one CI pipeline, job or workflow
+type Pipeline interface {
+	Trigger(ctx context.Context, build Build) error
+}
+
+// Config of a pipeline. Besides type and name the built in types use the options they need, types registered
+// elsewhere read options.
+type Config struct {
+	// Registered type, e.g. github
+	Type string `yaml:"type"`
+	// Used in logs and events, defaults to the type
+	Name string `yaml:"name"`
+	// API of the CI server, e.g. https://github.example.com/api/v3, defaults to the public one of the type. The
+	// Jenkins server for jenkins.
+	URL string `yaml:"url"`
+	// Access token of github, trigger token of gitlab, remote build token of the jenkins job
+	Token string `yaml:"token"`
+	// GitHub repository as owner/name
+	Repository string `yaml:"repository"`
+	// event_type of repository_dispatch events, csgo-build if empty
+	EventType string `yaml:"event_type"`
+	// File name or ID of a GitHub workflow started with workflow_dispatch instead of a repository_dispatch event
+	Workflow string `yaml:"workflow"`
+	// Branch or tag the workflow or GitLab pipeline runs on
+	Ref string `yaml:"ref"`
+	// GitLab project as ID or path, e.g. example/csgo-hardening
+	Project string `yaml:"project"`
+	// Jenkins job, with folders separated by slashes, e.g. images/csgo-hardening
+	Job string `yaml:"job"`
+	// Jenkins user and API token, if the server refuses anonymous builds
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Options of types registered outside this package
+	Options map[string]string `yaml:"options"`
+}
+
+// Factory creates a pipeline from its config, failing on missing or invalid options. It must not reach the CI
+// server, the config is validated with it.
+type Factory func(config Config) (Pipeline, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a pipeline type available to New, the built in types register themselves in init
+func Register(kind string, factory Factory) {
+	if _, exists := factories[kind]; exists {
+		panic("pipeline type registered twice: " + kind)
+	}
+	factories[kind] = factory
+}
+
+func Types() []string {
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Outcome of starting a pipeline
+type Result struct {
+	Pipeline string `json:"pipeline"`
+	Err      error  `json:"-"`
+	Error    string `json:"error,omitempty"`
+}
+
+type named struct {
+	name     string
+	pipeline Pipeline
+}
+
+// Runner starts every configured pipeline
+type Runner struct {
+	pipelines []named
+}
+
+// New creates the pipelines of configs, failing on unknown types and invalid options
+func New(configs []Config) (*Runner, error) {
+	runner := &Runner{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			config.Name = config.Type
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("pipeline %q is configured twice, give them distinct names", config.Name)
+		}
+		names[config.Name] = true
+
+		factory, ok := factories[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline type %q, expected one of %v", config.Type, Types())
+		}
+		pipeline, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", config.Name, err)
+		}
+		runner.pipelines = append(runner.pipelines, named{config.Name, pipeline})
+	}
+	return runner, nil
+}
+
+// Names of the pipelines
+func (this *Runner) Names() []string {
+	names := []string{}
+	for _, pipeline := range this.pipelines {
+		names = append(names, pipeline.name)
+	}
+	return names
+}
+
+// Start every pipeline for the build one after another. A failing pipeline does not keep the others from starting.
+func (this *Runner) Trigger(ctx context.Context, build Build) ([]Result, error) {
+	results := []Result{}
+	failed := []string{}
+	for _, pipeline := range this.pipelines {
+		triggerCtx, cancel := context.WithTimeout(ctx, triggerTimeout)
+		result := Result{Pipeline: pipeline.name, Err: pipeline.pipeline.Trigger(triggerCtx, build)}
+		cancel()
+		if result.Err != nil {
+			result.Error = result.Err.Error()
+			failed = append(failed, fmt.Sprintf("%s: %s", pipeline.name, result.Err))
+		}
+		results = append(results, result)
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to start %d of %d pipelines: %s", len(failed), len(results), strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+func validateURL(config Config) error {
+	parsed, err := url.Parse(config.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	return nil
+}
+
+// Send the request, failing on answers other than 2xx
+func send(ctx context.Context, method string, endpoint string, headers map[string]string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		// Some CI servers take the token in the URL
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to reach %s: %w", request.URL.Host, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		text, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return fmt.Errorf("%s answered %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
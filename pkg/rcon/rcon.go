@@ -0,0 +1,151 @@
+package rcon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Second
+
+const (
+	typeResponseValue = 0
+	typeExecCommand   = 2
+	typeAuthResponse  = 2
+	typeAuth          = 3
+)
+
+// Largest packet the Source RCON protocol allows
+const maxPacketSize = 4096
+
+var ErrAuthFailed = errors.New("rcon authentication failed")
+
+// Conn is an authenticated Source RCON connection, see
+// https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
+type Conn struct {
+	conn   net.Conn
+	nextID int32
+}
+
+// Connect to the RCON port of a game server, e.g. 127.0.0.1:27015, and authenticate. Without a deadline on ctx the
+// connection times out after five seconds.
+func Dial(ctx context.Context, address string, password string) (*Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	rcon := &Conn{conn: conn, nextID: 1}
+	if err := rcon.auth(password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rcon, nil
+}
+
+func (this *Conn) auth(password string) error {
+	id, err := this.write(typeAuth, password)
+	if err != nil {
+		return err
+	}
+
+	// The server sends an empty response value ahead of the auth response
+	for {
+		responseID, responseType, _, err := this.read()
+		if err != nil {
+			return err
+		}
+		if responseType != typeAuthResponse {
+			continue
+		}
+		// The ID is -1 for a wrong password
+		if responseID != id {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+}
+
+// Run a console command and return its output
+func (this *Conn) Execute(command string) (string, error) {
+	id, err := this.write(typeExecCommand, command)
+	if err != nil {
+		return "", err
+	}
+	// Long output is split into several packets, the server mirrors this empty packet after the last of them
+	end, err := this.write(typeResponseValue, "")
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	for {
+		responseID, responseType, body, err := this.read()
+		if err != nil {
+			return "", err
+		}
+		if responseID == end {
+			return output.String(), nil
+		}
+		if responseID == id && responseType == typeResponseValue {
+			output.WriteString(body)
+		}
+	}
+}
+
+func (this *Conn) Close() error {
+	return this.conn.Close()
+}
+
+func (this *Conn) write(packetType int32, body string) (int32, error) {
+	id := this.nextID
+	this.nextID++
+
+	var packet bytes.Buffer
+	// Size excludes the size field itself and includes the two terminating null bytes
+	binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	if _, err := this.conn.Write(packet.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to send rcon packet: %w", err)
+	}
+	return id, nil
+}
+
+func (this *Conn) read() (id int32, packetType int32, body string, err error) {
+	var size int32
+	if err := binary.Read(this.conn, binary.LittleEndian, &size); err != nil {
+		return 0, 0, "", fmt.Errorf("failed to read rcon packet: %w", err)
+	}
+	if size < 10 || size > maxPacketSize {
+		return 0, 0, "", fmt.Errorf("invalid rcon packet size %d", size)
+	}
+
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(this.conn, packet); err != nil {
+		return 0, 0, "", fmt.Errorf("failed to read rcon packet: %w", err)
+	}
+	id = int32(binary.LittleEndian.Uint32(packet[0:4]))
+	packetType = int32(binary.LittleEndian.Uint32(packet[4:8]))
+	return id, packetType, string(bytes.TrimRight(packet[8:], "\x00")), nil
+}
@@ -0,0 +1,281 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// Credential is an explicit override for a single registry, taking precedence over anything found in the
+// docker config.json. Token is sent to the registry as a bearer token instead of a username/password pair.
+type Credential struct {
+	Registry string `yaml:"registry"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+// Subset of the docker CLI config.json that is relevant for authentication
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// Resolver looks up registry credentials the same way the docker CLI does: explicit overrides first, then
+// per-registry credential helpers, the global credential store and finally the plain auths section of config.json.
+type Resolver struct {
+	config    dockerConfigFile
+	overrides map[string]Credential
+}
+
+// NewResolver reads the docker config.json at configPath. An empty path uses $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json. A missing config file is not an error, the overrides are still used.
+func NewResolver(configPath string, overrides []Credential) (*Resolver, error) {
+	if configPath == "" {
+		configPath = defaultDockerConfigPath()
+	}
+
+	resolver := &Resolver{
+		overrides: map[string]Credential{},
+	}
+	for _, override := range overrides {
+		resolver.overrides[normalizeRegistry(override.Registry)] = override
+	}
+
+	if configPath == "" {
+		return resolver, nil
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return resolver, nil
+		}
+		return nil, fmt.Errorf("failed to read docker config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &resolver.config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config %s: %w", configPath, err)
+	}
+
+	return resolver, nil
+}
+
+// Directory of the docker CLI config, which also holds the docker contexts
+func DockerConfigDir(configPath string) string {
+	if configPath == "" {
+		configPath = defaultDockerConfigPath()
+	}
+	return filepath.Dir(configPath)
+}
+
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// Resolve returns the credentials for a registry host (e.g. "ghcr.io"). If nothing is configured for the
+// registry an empty AuthConfig is returned, which results in an anonymous request.
+func (this *Resolver) Resolve(registry string) (types.AuthConfig, error) {
+	registry = normalizeRegistry(registry)
+	serverAddress := authKey(registry)
+
+	if override, ok := this.overrides[registry]; ok {
+		return types.AuthConfig{
+			ServerAddress: serverAddress,
+			Username:      override.Username,
+			Password:      override.Password,
+			RegistryToken: override.Token,
+		}, nil
+	}
+
+	if helper, ok := this.config.CredHelpers[registry]; ok {
+		return runCredentialHelper(helper, serverAddress)
+	}
+	if helper, ok := this.config.CredHelpers[serverAddress]; ok {
+		return runCredentialHelper(helper, serverAddress)
+	}
+
+	if this.config.CredsStore != "" {
+		auth, err := runCredentialHelper(this.config.CredsStore, serverAddress)
+		if err != nil {
+			return types.AuthConfig{}, err
+		}
+		if auth.Username != "" || auth.IdentityToken != "" {
+			return auth, nil
+		}
+	}
+
+	for key, entry := range this.config.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+
+		auth := types.AuthConfig{
+			ServerAddress: serverAddress,
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return types.AuthConfig{}, fmt.Errorf("failed to decode auth for %s in docker config: %w", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return types.AuthConfig{}, fmt.Errorf("invalid auth for %s in docker config", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+
+		return auth, nil
+	}
+
+	return types.AuthConfig{ServerAddress: serverAddress}, nil
+}
+
+// EncodedAuth returns the credentials for the registry of the given image reference, encoded for the
+// X-Registry-Auth header used by ImagePush and ImagePull.
+func (this *Resolver) EncodedAuth(image string) (string, error) {
+	auth, err := this.Resolve(RegistryOf(image))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode registry auth: %w", err)
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// AuthConfigs returns credentials for every registry known to the resolver, for use as
+// ImageBuildOptions.AuthConfigs so FROM instructions can pull from private registries.
+func (this *Resolver) AuthConfigs() (map[string]types.AuthConfig, error) {
+	registries := map[string]bool{}
+	for registry := range this.overrides {
+		registries[registry] = true
+	}
+	for registry := range this.config.CredHelpers {
+		registries[normalizeRegistry(registry)] = true
+	}
+	for key := range this.config.Auths {
+		registries[normalizeRegistry(key)] = true
+	}
+
+	configs := map[string]types.AuthConfig{}
+	for registry := range registries {
+		auth, err := this.Resolve(registry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve credentials for %s: %w", registry, err)
+		}
+		configs[authKey(registry)] = auth
+	}
+
+	return configs, nil
+}
+
+// Output of `docker-credential-<helper> get`
+type credentialHelperResponse struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func runCredentialHelper(helper string, serverAddress string) (types.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		// Helpers report missing credentials on stdout and exit non-zero
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return types.AuthConfig{ServerAddress: serverAddress}, nil
+		}
+		return types.AuthConfig{}, fmt.Errorf("credential helper %s failed: %w", helper, err)
+	}
+
+	var response credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("failed to parse output of credential helper %s: %w", helper, err)
+	}
+
+	auth := types.AuthConfig{ServerAddress: serverAddress}
+	// NOTE helpers store identity tokens with the magic username "<token>"
+	if response.Username == "<token>" {
+		auth.IdentityToken = response.Secret
+	} else {
+		auth.Username = response.Username
+		auth.Password = response.Secret
+	}
+
+	return auth, nil
+}
+
+// RegistryOf returns the registry host of an image reference, using the same rules as docker: the first path
+// component is a registry if it contains a dot or a port, or is localhost. Everything else lives on Docker Hub.
+func RegistryOf(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return "docker.io"
+	}
+
+	host := parts[0]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return normalizeRegistry(host)
+	}
+
+	return "docker.io"
+}
+
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry = strings.SplitN(registry, "/", 2)[0]
+
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "docker.io", "":
+		return "docker.io"
+	}
+
+	return registry
+}
+
+// Docker Hub credentials are keyed by the legacy v1 index URL, everything else by host
+func authKey(registry string) string {
+	if registry == "docker.io" {
+		return dockerHubAuthKey
+	}
+
+	return registry
+}
@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Keychain exposes the resolver to go-containerregistry, so registry to registry operations use the same
+// credentials as pushes through the docker daemon.
+func (this *Resolver) Keychain() authn.Keychain {
+	return keychain{this}
+}
+
+type keychain struct {
+	resolver *Resolver
+}
+
+func (this keychain) Resolve(resource authn.Resource) (authn.Authenticator, error) {
+	auth, err := this.resolver.Resolve(resource.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.Username == "" && auth.Password == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	}), nil
+}
+
+// Digest of the manifest a reference points to in the registry
+func Digest(ctx context.Context, image string, keychain authn.Keychain) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %s: %w", image, err)
+	}
+
+	desc, err := remote.Head(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return "", fmt.Errorf("failed to get manifest of %s: %w", image, err)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// Copy an image or image index from one registry reference to another without going through the docker daemon.
+// Blobs already present in the destination are skipped, and mounted across repositories on the same registry.
+// Returns the digest of the copied manifest.
+func Copy(ctx context.Context, src string, dst string, keychain authn.Keychain) (string, error) {
+	srcRef, err := name.ParseReference(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid source reference %s: %w", src, err)
+	}
+	dstRef, err := name.ParseReference(dst)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination reference %s: %w", dst, err)
+	}
+
+	options := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain)}
+
+	desc, err := remote.Get(srcRef, options...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %w", src, err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return "", fmt.Errorf("failed to read image index %s: %w", src, err)
+		}
+		if err := remote.WriteIndex(dstRef, index, options...); err != nil {
+			return "", fmt.Errorf("failed to write image index %s: %w", dst, err)
+		}
+	} else {
+		image, err := desc.Image()
+		if err != nil {
+			return "", fmt.Errorf("failed to read image %s: %w", src, err)
+		}
+		if err := remote.Write(dstRef, image, options...); err != nil {
+			return "", fmt.Errorf("failed to write image %s: %w", dst, err)
+		}
+	}
+
+	return desc.Digest.String(), nil
+}
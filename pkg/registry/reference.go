@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"strings"
+)
+
+// RepositoryOf strips the tag or digest of an image reference
+func RepositoryOf(image string) string {
+	if at := strings.Index(image, "@"); at >= 0 {
+		return image[:at]
+	}
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon]
+	}
+	return image
+}
+
+// TagOf returns the tag of an image reference, "latest" if it has none
+func TagOf(image string) string {
+	// Only look for the colon after the last slash, registries may contain a port
+	slash := strings.LastIndex(image, "/")
+	colon := strings.LastIndex(image, ":")
+	if colon <= slash {
+		return "latest"
+	}
+
+	return image[colon+1:]
+}
@@ -0,0 +1,388 @@
+package rollout
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/a2s"
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/jsonmessage"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a game server gets to shut down before it is killed
+const stopTimeout = 30 * time.Second
+
+// Address to query a game server's player count with, e.g. 10.0.0.5:27015. Without it the published or container
+// address of the default game port is used.
+const LABEL_QUERY_ADDRESS = "io.csgo-watcher.query-address"
+
+const defaultGamePort = 27015
+
+// Containers opt in to updates with io.csgo-watcher.update=true when a target only manages labelled containers
+const LABEL_UPDATE = "io.csgo-watcher.update"
+
+// The docker API calls of a DockerTarget, implemented by *client.Client
+type DockerClient interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, container string, timeout *time.Duration) error
+	ContainerRename(ctx context.Context, container string, newContainerName string) error
+	ContainerRemove(ctx context.Context, container string, options types.ContainerRemoveOptions) error
+	NetworkConnect(ctx context.Context, network string, container string, config *network.EndpointSettings) error
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+}
+
+// Supplies the X-Registry-Auth header for pulls, implemented by registry.Resolver
+type Credentials interface {
+	EncodedAuth(image string) (string, error)
+}
+
+// DockerTarget updates the game server containers on a docker host
+type DockerTarget struct {
+	name         string
+	dockerCli    DockerClient
+	credentials  Credentials
+	repositories map[string]bool
+	labelled     bool
+	queryPlayers bool
+	queryMatches bool
+	rconPassword string
+}
+
+// NewDockerTarget manages every container on the docker host started from one of the repositories
+func NewDockerTarget(name string, dockerCli DockerClient, credentials Credentials, repositories []string) *DockerTarget {
+	target := &DockerTarget{
+		name:         name,
+		dockerCli:    dockerCli,
+		credentials:  credentials,
+		repositories: map[string]bool{},
+	}
+	for _, repository := range repositories {
+		target.repositories[repository] = true
+	}
+	return target
+}
+
+func (this *DockerTarget) Name() string {
+	return this.name
+}
+
+// Only manage the containers of the repositories labelled LABEL_UPDATE=true, leaving the others alone
+func (this *DockerTarget) OnlyLabelled(enabled bool) {
+	this.labelled = enabled
+}
+
+// Query the player count of every running server over A2S when listing servers
+func (this *DockerTarget) QueryPlayers(enabled bool) {
+	this.queryPlayers = enabled
+}
+
+// Query the get5 match state of every running server over RCON when listing servers, and refuse to restart servers
+// in a live match. The RCON password is read from the container's RCON_PASSWORD, rconPassword is the fallback.
+func (this *DockerTarget) QueryMatches(enabled bool, rconPassword string) {
+	this.queryMatches = enabled
+	this.rconPassword = rconPassword
+}
+
+func (this *DockerTarget) Servers(ctx context.Context) ([]Server, error) {
+	containers, err := this.dockerCli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	servers := []Server{}
+	managed := []types.Container{}
+	for _, container := range containers {
+		if !this.repositories[registry.RepositoryOf(container.Image)] {
+			continue
+		}
+		if this.labelled && container.Labels[LABEL_UPDATE] != "true" {
+			continue
+		}
+		managed = append(managed, container)
+
+		name := container.ID[:12]
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		servers = append(servers, Server{
+			ID:     container.ID,
+			Name:   name,
+			Image:  container.Image,
+			State:  container.State,
+			Labels: container.Labels,
+		})
+	}
+
+	var wait sync.WaitGroup
+	for i := range servers {
+		if servers[i].State != "running" {
+			continue
+		}
+		if address := gameAddress(managed[i], LABEL_QUERY_ADDRESS, "udp"); this.queryPlayers && address != "" {
+			wait.Add(1)
+			go func(server *Server, address string) {
+				defer wait.Done()
+				info, err := a2s.QueryInfo(ctx, address)
+				if err != nil {
+					log.Debug().Err(err).Str("server", server.Name).Msg("Failed to query player count")
+					return
+				}
+				humans := info.Humans()
+				server.Players = &humans
+			}(&servers[i], address)
+		}
+		if this.queryMatches {
+			wait.Add(1)
+			go func(server *Server, container types.Container) {
+				defer wait.Done()
+				match, err := this.matchOf(ctx, container)
+				if err != nil {
+					log.Warn().Err(err).Str("server", server.Name).Msg("Failed to query match state")
+					return
+				}
+				server.Match = match
+			}(&servers[i], managed[i])
+		}
+	}
+	wait.Wait()
+
+	return servers, nil
+}
+
+// get5 game state of the container's game server
+func (this *DockerTarget) matchOf(ctx context.Context, container types.Container) (string, error) {
+	address := gameAddress(container, LABEL_RCON_ADDRESS, "tcp")
+	if address == "" {
+		return "", fmt.Errorf("no rcon address")
+	}
+
+	details, err := this.dockerCli.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container: %w", err)
+	}
+	password := this.rconPassword
+	if details.Config != nil {
+		for _, env := range details.Config.Env {
+			if strings.HasPrefix(env, ENV_RCON_PASSWORD+"=") {
+				password = strings.TrimPrefix(env, ENV_RCON_PASSWORD+"=")
+			}
+		}
+	}
+	if password == "" {
+		return "", fmt.Errorf("no rcon password")
+	}
+
+	return queryMatch(ctx, address, password)
+}
+
+// Address of the default game port for the protocol, the label takes precedence
+func gameAddress(container types.Container, label string, protocol string) string {
+	if address := container.Labels[label]; address != "" {
+		return address
+	}
+	for _, port := range container.Ports {
+		if port.Type == protocol && port.PrivatePort == defaultGamePort && port.PublicPort != 0 {
+			return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port.PublicPort)))
+		}
+	}
+	if container.HostConfig.NetworkMode == "host" {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(defaultGamePort))
+	}
+	if container.NetworkSettings != nil {
+		for _, endpoint := range container.NetworkSettings.Networks {
+			if endpoint.IPAddress != "" {
+				return net.JoinHostPort(endpoint.IPAddress, strconv.Itoa(defaultGamePort))
+			}
+		}
+	}
+	return ""
+}
+
+// Images of the managed repositories present on the host
+func (this *DockerTarget) Images(ctx context.Context) ([]string, error) {
+	images, err := this.dockerCli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	tags := []string{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if this.repositories[registry.RepositoryOf(tag)] {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags, nil
+}
+
+func (this *DockerTarget) Pull(ctx context.Context, image string) error {
+	// Locally built images do not have to be pulled
+	if _, _, err := this.dockerCli.ImageInspectWithRaw(ctx, image); err == nil {
+		return nil
+	}
+
+	auth, err := this.credentials.EncodedAuth(image)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", image, err)
+	}
+
+	pullReader, err := this.dockerCli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", image, err)
+	}
+	defer pullReader.Close()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(pullReader, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", image, err)
+	}
+
+	return nil
+}
+
+// Recreate the container with the same configuration and the new image. If the new container fails to start the
+// old one is restored.
+func (this *DockerTarget) Restart(ctx context.Context, server Server, image string) error {
+	// A match may have started since the servers were listed
+	if this.queryMatches {
+		if err := this.checkMatch(ctx, server); err != nil {
+			return err
+		}
+	}
+
+	old, err := this.dockerCli.ContainerInspect(ctx, server.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", server.Name, err)
+	}
+	name := strings.TrimPrefix(old.Name, "/")
+	wasRunning := old.State != nil && old.State.Running
+
+	config := *old.Config
+	config.Image = image
+	// A hostname docker generated from the old container ID would otherwise stick to the new container
+	if strings.HasPrefix(old.ID, config.Hostname) {
+		config.Hostname = ""
+	}
+
+	// Only a single network can be passed on create, the others are connected afterwards
+	endpoints := map[string]*network.EndpointSettings{}
+	if old.NetworkSettings != nil {
+		for networkName, endpoint := range old.NetworkSettings.Networks {
+			endpoints[networkName] = &network.EndpointSettings{
+				IPAMConfig: endpoint.IPAMConfig,
+				Links:      endpoint.Links,
+				Aliases:    withoutContainerID(endpoint.Aliases, old.ID),
+			}
+		}
+	}
+	primaryNetwork := string(old.HostConfig.NetworkMode)
+	networking := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	if endpoint, ok := endpoints[primaryNetwork]; ok {
+		networking.EndpointsConfig[primaryNetwork] = endpoint
+	}
+
+	timeout := stopTimeout
+	if err := this.dockerCli.ContainerStop(ctx, old.ID, &timeout); err != nil {
+		return fmt.Errorf("failed to stop container %s: %w", name, err)
+	}
+	backupName := name + "-replaced-" + old.ID[:12]
+	if err := this.dockerCli.ContainerRename(ctx, old.ID, backupName); err != nil {
+		return this.restore(ctx, old.ID, name, wasRunning, fmt.Errorf("failed to rename container %s: %w", name, err))
+	}
+
+	created, err := this.dockerCli.ContainerCreate(ctx, &config, old.HostConfig, networking, nil, name)
+	if err != nil {
+		return this.restore(ctx, old.ID, name, wasRunning, fmt.Errorf("failed to create container %s: %w", name, err))
+	}
+
+	for networkName, endpoint := range endpoints {
+		if networkName == primaryNetwork {
+			continue
+		}
+		if err := this.dockerCli.NetworkConnect(ctx, networkName, created.ID, endpoint); err != nil {
+			this.removeContainer(ctx, created.ID)
+			return this.restore(ctx, old.ID, name, wasRunning, fmt.Errorf("failed to connect container %s to network %s: %w", name, networkName, err))
+		}
+	}
+
+	if wasRunning {
+		if err := this.dockerCli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+			this.removeContainer(ctx, created.ID)
+			return this.restore(ctx, old.ID, name, wasRunning, fmt.Errorf("failed to start container %s: %w", name, err))
+		}
+	}
+
+	this.removeContainer(ctx, old.ID)
+
+	return nil
+}
+
+func (this *DockerTarget) checkMatch(ctx context.Context, server Server) error {
+	containers, err := this.dockerCli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("id", server.ID)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+	if len(containers) == 0 || containers[0].State != "running" {
+		return nil
+	}
+
+	match, err := this.matchOf(ctx, containers[0])
+	if err != nil {
+		log.Warn().Err(err).Str("server", server.Name).Msg("Failed to query match state before restart")
+		return nil
+	}
+	if contains(liveMatchStates, match) {
+		return fmt.Errorf("%w on %s, get5 game state %s", ErrMatchLive, server.Name, match)
+	}
+	return nil
+}
+
+// Put the old container back in place after a failed restart, returning the original error
+func (this *DockerTarget) restore(ctx context.Context, id string, name string, start bool, cause error) error {
+	if err := this.dockerCli.ContainerRename(ctx, id, name); err != nil {
+		log.Err(err).Str("container", name).Msg("Failed to restore name of replaced container")
+	}
+	if start {
+		if err := this.dockerCli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+			log.Err(err).Str("container", name).Msg("Failed to restart replaced container")
+		}
+	}
+	return cause
+}
+
+func (this *DockerTarget) removeContainer(ctx context.Context, id string) {
+	if err := this.dockerCli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+		log.Err(err).Str("container", id).Msg("Failed to remove container")
+	}
+}
+
+// Docker adds the short container ID as a network alias, it must not be copied to the new container
+func withoutContainerID(aliases []string, id string) []string {
+	filtered := []string{}
+	for _, alias := range aliases {
+		if !strings.HasPrefix(id, alias) {
+			filtered = append(filtered, alias)
+		}
+	}
+	return filtered
+}
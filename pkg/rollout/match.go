@@ -0,0 +1,58 @@
+package rollout
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rcon"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Address of a game server's RCON port, e.g. 10.0.0.5:27015. Without it the published or container address of the
+// default game port is used.
+const LABEL_RCON_ADDRESS = "io.csgo-watcher.rcon-address"
+
+// Environment variable of the game server containers holding their RCON password
+const ENV_RCON_PASSWORD = "RCON_PASSWORD"
+
+// Returned by Restart for a server in a live match, the orchestrator waits for the match to end
+var ErrMatchLive = errors.New("match in progress")
+
+// get5 game states of a match in progress. Warmup and veto are not included, players are still waiting there.
+var liveMatchStates = []string{"knife", "waiting_for_knife_decision", "going_live", "live"}
+
+// Whether the server is in a live match, according to its get5 game state
+func (this Server) InMatch() bool {
+	return contains(liveMatchStates, this.Match)
+}
+
+// Ask the server for its get5 game state over RCON. Servers without get5 report no state.
+func queryMatch(ctx context.Context, address string, password string) (string, error) {
+	conn, err := rcon.Dial(ctx, address, password)
+	if err != nil {
+		return "", fmt.Errorf("failed to query match state: %w", err)
+	}
+	defer conn.Close()
+
+	output, err := conn.Execute("get5_status")
+	if err != nil {
+		return "", fmt.Errorf("failed to query match state: %w", err)
+	}
+	if strings.HasPrefix(output, "Unknown command") {
+		return "", nil
+	}
+
+	// The JSON may be preceded by log lines of the server
+	start := strings.Index(output, "{")
+	if start < 0 {
+		return "", fmt.Errorf("unexpected get5_status output %q", output)
+	}
+	var status struct {
+		GameState string `json:"gamestate"`
+	}
+	if err := json.NewDecoder(strings.NewReader(output[start:])).Decode(&status); err != nil {
+		return "", fmt.Errorf("failed to decode get5_status output: %w", err)
+	}
+	return status.GameState, nil
+}
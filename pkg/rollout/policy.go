@@ -0,0 +1,142 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// Container labels overriding the rollout policy of a single server
+const (
+	// "false" excludes the server from rollouts and scheduled restarts
+	LABEL_AUTO_RESTART = "io.csgo-watcher.auto-restart"
+	// Daily window in local time the server may be restarted in, e.g. 03:00-07:00
+	LABEL_RESTART_WINDOW = "io.csgo-watcher.restart-window"
+	// "true" restarts the server ahead of all others, the rollout only continues if it still runs afterwards
+	LABEL_CANARY = "io.csgo-watcher.canary"
+)
+
+// How a server takes part in rollouts and scheduled restarts
+type Policy struct {
+	// Never restart the server automatically
+	Manual bool
+	// Only restart the server within this window, any time if nil
+	Window *Window
+	Canary bool
+}
+
+// Daily time window in local time, it may span midnight
+type Window struct {
+	// Since midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// Parse a window like 03:00-07:00 or 22:00-02:00
+func ParseWindow(value string) (Window, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", value)
+	}
+	window := Window{}
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", value)
+		}
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			window.Start = offset
+		} else {
+			window.End = offset
+		}
+	}
+	if window.Start == window.End {
+		return Window{}, fmt.Errorf("window %q is empty", value)
+	}
+	return window, nil
+}
+
+func (this Window) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if this.Start < this.End {
+		return offset >= this.Start && offset < this.End
+	}
+	return offset >= this.Start || offset < this.End
+}
+
+func (this Window) String() string {
+	format := func(offset time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+	}
+	return format(this.Start) + "-" + format(this.End)
+}
+
+// Apply the policy labels of the server on top of the policy. A server with an invalid window is never restarted
+// automatically.
+func LabelPolicy(server Server, policy Policy) Policy {
+	if value, ok := server.Labels[LABEL_AUTO_RESTART]; ok {
+		policy.Manual = value == "false"
+	}
+	if value, ok := server.Labels[LABEL_CANARY]; ok {
+		policy.Canary = value == "true"
+	}
+	if value, ok := server.Labels[LABEL_RESTART_WINDOW]; ok {
+		window, err := ParseWindow(value)
+		if err != nil {
+			log.Err(err).Str("server", server.Name).Msg("Invalid restart window label, excluding server from automatic restarts")
+			policy.Manual = true
+		} else {
+			policy.Window = &window
+		}
+	}
+	return policy
+}
+
+func (this *Orchestrator) policy(target Target, server Server) Policy {
+	if this.options.Policy != nil {
+		return this.options.Policy(target, server)
+	}
+	return LabelPolicy(server, Policy{})
+}
+
+// Wait for the restarted canaries to settle and check they are still running their new image. Nothing is checked if
+// the rollout was aborted in the meantime.
+func (this *Orchestrator) verifyCanaries(ctx context.Context, canaries []Step) error {
+	log.Info().Int("canaries", len(canaries)).Str("wait", this.options.CanaryWait.String()).Msg("Waiting before checking canaries")
+	deadline := time.After(this.options.CanaryWait)
+	for waiting := true; waiting; {
+		select {
+		case <-deadline:
+			waiting = false
+		case <-this.wakeup():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !this.proceed(ctx) {
+			return ctx.Err()
+		}
+	}
+
+	servers := map[Target]map[string]Server{}
+	for _, step := range canaries {
+		if _, ok := servers[step.target]; !ok {
+			current, err := step.target.Servers(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to check canaries on %s: %w", step.Target, err)
+			}
+			servers[step.target] = map[string]Server{}
+			for _, server := range current {
+				servers[step.target][server.Name] = server
+			}
+		}
+		// The container was recreated, only its name stays the same
+		server, ok := servers[step.target][step.Server.Name]
+		if !ok || server.State != "running" || server.Image != step.Image {
+			return fmt.Errorf("canary %s/%s is not running %s", step.Target, step.Server.Name, step.Image)
+		}
+	}
+	return nil
+}
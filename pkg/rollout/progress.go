@@ -0,0 +1,194 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// States of a rollout or restart
+const (
+	STATE_RUNNING = "running"
+	STATE_PAUSED  = "paused"
+	// Abort was requested, the restart in progress is finished first
+	STATE_ABORTING = "aborting"
+	STATE_FINISHED = "finished"
+	STATE_ABORTED  = "aborted"
+)
+
+// Kinds of runs
+const (
+	KIND_ROLLOUT = "rollout"
+	KIND_RESTART = "restart"
+)
+
+// Returned by Pause, Resume and Abort when no rollout or restart is running
+var ErrNoRollout = errors.New("no rollout in progress")
+
+// Returned by Rollout and Restart when they were aborted
+var ErrAborted = errors.New("rollout aborted")
+
+// State of the current or last rollout or restart. Counts are of servers, relays included.
+type Progress struct {
+	Kind       string    `json:"kind"`
+	State      string    `json:"state"`
+	Images     []string  `json:"images,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// Targets with servers to restart
+	Targets int `json:"targets"`
+	Total   int `json:"total"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+	// Not restarted because the rollout was aborted or their parent server failed
+	Skipped int `json:"skipped"`
+	// Not restarted yet, including the draining servers
+	Pending int `json:"pending"`
+	// Servers waiting at a gate until the end of the rollout
+	Draining []Step `json:"draining"`
+	// Server being restarted right now
+	Current *Step `json:"current,omitempty"`
+}
+
+func (this Progress) Active() bool {
+	return this.State == STATE_RUNNING || this.State == STATE_PAUSED || this.State == STATE_ABORTING
+}
+
+// The current or last rollout or restart, nil if there was none yet
+func (this *Orchestrator) Progress() *Progress {
+	this.control.Lock()
+	defer this.control.Unlock()
+	if this.progress == nil {
+		return nil
+	}
+	progress := this.snapshot()
+	return &progress
+}
+
+// Hold the rollout in progress before its next restart
+func (this *Orchestrator) Pause() error {
+	return this.transition(STATE_PAUSED, func() { this.paused = true })
+}
+
+// Continue a paused rollout
+func (this *Orchestrator) Resume() error {
+	return this.transition(STATE_RUNNING, func() { this.paused = false })
+}
+
+// Stop the rollout in progress after the restart currently running, the remaining servers are skipped
+func (this *Orchestrator) Abort() error {
+	return this.transition(STATE_ABORTING, func() { this.aborted = true })
+}
+
+func (this *Orchestrator) transition(state string, apply func()) error {
+	this.control.Lock()
+	defer this.control.Unlock()
+	if this.progress == nil || !this.progress.Active() || this.aborted {
+		return ErrNoRollout
+	}
+	apply()
+	this.progress.State = state
+	this.changed()
+	return nil
+}
+
+// Wakes up everything waiting on the control state and reports the progress. The control lock must be held.
+func (this *Orchestrator) changed() {
+	close(this.wake)
+	this.wake = make(chan struct{})
+	if this.options.OnProgress != nil {
+		this.options.OnProgress(this.snapshot())
+	}
+}
+
+func (this *Orchestrator) snapshot() Progress {
+	progress := *this.progress
+	progress.Images = append([]string{}, progress.Images...)
+	progress.Draining = append([]Step{}, progress.Draining...)
+	if progress.Current != nil {
+		current := *progress.Current
+		progress.Current = &current
+	}
+	progress.Pending = progress.Total - progress.Updated - progress.Failed - progress.Skipped
+	return progress
+}
+
+func (this *Orchestrator) begin(kind string, images []string, steps []Step) {
+	this.control.Lock()
+	defer this.control.Unlock()
+
+	progress := &Progress{Kind: kind, State: STATE_RUNNING, Images: images, StartedAt: time.Now(), Draining: []Step{}}
+	targets := map[string]bool{}
+	for _, step := range steps {
+		targets[step.Target] = true
+		progress.Total += 1 + len(step.Relays)
+	}
+	progress.Targets = len(targets)
+
+	this.progress = progress
+	this.paused = false
+	this.aborted = false
+	this.changed()
+}
+
+func (this *Orchestrator) finish() {
+	this.update(func(progress *Progress) {
+		progress.State = STATE_FINISHED
+		if this.aborted {
+			progress.State = STATE_ABORTED
+		}
+		progress.FinishedAt = time.Now()
+		progress.Current = nil
+	})
+}
+
+func (this *Orchestrator) update(apply func(progress *Progress)) {
+	this.control.Lock()
+	defer this.control.Unlock()
+	apply(this.progress)
+	this.changed()
+}
+
+// Count the steps and their relays as skipped
+func (this *Orchestrator) skip(steps []Step) {
+	if len(steps) == 0 {
+		return
+	}
+	this.update(func(progress *Progress) {
+		for _, step := range steps {
+			progress.Skipped += 1 + len(step.Relays)
+		}
+	})
+}
+
+func (this *Orchestrator) draining(waiting []Step) {
+	this.update(func(progress *Progress) { progress.Draining = append([]Step{}, waiting...) })
+}
+
+// Blocks while the rollout is paused. Returns false if it was aborted or the context is done.
+func (this *Orchestrator) proceed(ctx context.Context) bool {
+	for {
+		this.control.Lock()
+		aborted, paused, wake := this.aborted, this.paused, this.wake
+		this.control.Unlock()
+
+		if aborted {
+			return false
+		}
+		if !paused {
+			return true
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Closed on the next change of the progress, e.g. a pause, resume or abort
+func (this *Orchestrator) wakeup() <-chan struct{} {
+	this.control.Lock()
+	defer this.control.Unlock()
+	return this.wake
+}
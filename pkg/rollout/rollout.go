@@ -0,0 +1,575 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A game server container running one of the managed images
+type Server struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Image  string            `json:"image"`
+	State  string            `json:"state"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Humans on the server, nil if unknown
+	Players *int `json:"players,omitempty"`
+	// get5 game state, empty if unknown
+	Match string `json:"match,omitempty"`
+}
+
+// A host (or anything else) running game servers that can be updated
+type Target interface {
+	Name() string
+	// Game servers running one of the managed repositories
+	Servers(ctx context.Context) ([]Server, error)
+	// Make the image available on the target ahead of restarting servers
+	Pull(ctx context.Context, image string) error
+	// Recreate the server with the given image
+	Restart(ctx context.Context, server Server, image string) error
+}
+
+// Outcome of updating a single server
+type Result struct {
+	Target string `json:"target"`
+	Server Server `json:"server"`
+	Err    error  `json:"-"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Identifies which images replace each other, e.g. repository and tag without the buildid. Images it does not
+// recognize are never rolled out.
+type VariantFunc func(image string) (variant string, ok bool)
+
+type Options struct {
+	Variant VariantFunc
+	// Servers with more players are restarted last, once they drained to this many players. No limit if nil.
+	MaxPlayers *int
+	// How long to wait for busy servers to drain before giving up on them
+	DrainTimeout time.Duration
+	// How often the player count of busy servers is checked
+	DrainInterval time.Duration
+	// Policy of a server, only its labels are considered if nil
+	Policy func(target Target, server Server) Policy
+	// How long canaries have to keep running before the rest of the servers are restarted
+	CanaryWait time.Duration
+	// Called with the progress whenever it changes, it must not call back into the orchestrator
+	OnProgress func(progress Progress)
+}
+
+// Orchestrator rolls new images out to every server on its targets, one server at a time. Servers with the fewest
+// players are restarted first.
+type Orchestrator struct {
+	options Options
+	running sync.Mutex
+
+	control  sync.Mutex
+	progress *Progress
+	paused   bool
+	aborted  bool
+	wake     chan struct{}
+
+	mutex   sync.RWMutex
+	targets []Target
+}
+
+func NewOrchestrator(options Options, targets ...Target) *Orchestrator {
+	return &Orchestrator{options: options, targets: targets, wake: make(chan struct{})}
+}
+
+func (this *Orchestrator) Targets() []Target {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return append([]Target{}, this.targets...)
+}
+
+// Replace the targets, e.g. after discovering hosts. A rollout in progress keeps its targets.
+func (this *Orchestrator) SetTargets(targets []Target) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.targets = targets
+}
+
+// Servers of a target to restart, by the image each group is restarted with
+type plan map[string][]Server
+
+// Gates a restart waits for at the end of a rollout
+const (
+	GATE_PLAYERS = "players"
+	GATE_MATCH   = "match"
+	GATE_WINDOW  = "window"
+)
+
+// A single server restart of a rollout or scheduled restart
+type Step struct {
+	Target string `json:"target"`
+	Server Server `json:"server"`
+	Image  string `json:"image"`
+	// Why the restart waits until the end of the rollout (GATE_PLAYERS, GATE_MATCH or GATE_WINDOW), empty if it does not
+	Gate string `json:"gate,omitempty"`
+	// Restarted ahead of all other servers
+	Canary bool `json:"canary,omitempty"`
+	// Restart window of the server, e.g. 03:00-07:00
+	Window string `json:"window,omitempty"`
+	// GOTV relays restarted right after the server
+	Relays []Step `json:"relays,omitempty"`
+
+	target Target
+	policy Policy
+}
+
+// Pull the new images on every target and restart every server running another build of one of them. Servers are
+// only moved to the image of the same variant, e.g. a server running ghcr.io/shootingrange/csgo:get5-buildid-1
+// receives ghcr.io/shootingrange/csgo:get5-buildid-2 but never a preinstall image or an image of another repository.
+// A failing target or server does not stop the rollout, the returned error summarizes all failures.
+func (this *Orchestrator) Rollout(ctx context.Context, images []string) ([]Result, error) {
+	return this.execute(ctx, KIND_ROLLOUT, images, true, this.replacements(images))
+}
+
+// Restart the running servers the selector accepts with the image they are already running, e.g. for scheduled
+// restarts when there is no new build
+func (this *Orchestrator) Restart(ctx context.Context, selector func(target Target, server Server) bool) ([]Result, error) {
+	return this.execute(ctx, KIND_RESTART, nil, false, selection(selector))
+}
+
+// The restarts Rollout would perform right now in their order, without pulling or restarting anything
+func (this *Orchestrator) DryRun(ctx context.Context, images []string) ([]Step, error) {
+	return this.dryRun(ctx, images, this.replacements(images))
+}
+
+// The restarts Restart would perform right now in their order, without restarting anything
+func (this *Orchestrator) DryRunRestart(ctx context.Context, selector func(target Target, server Server) bool) ([]Step, error) {
+	return this.dryRun(ctx, nil, selection(selector))
+}
+
+func (this *Orchestrator) dryRun(ctx context.Context, images []string, planTarget func(Target, []Server) plan) ([]Step, error) {
+	steps, failed := this.steps(ctx, images, planTarget)
+	if len(failed) > 0 {
+		return steps, fmt.Errorf("failed to plan %d targets: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return steps, nil
+}
+
+func (this *Orchestrator) replacements(images []string) func(Target, []Server) plan {
+	replacements := map[string]string{}
+	for _, image := range images {
+		if variant, ok := this.options.Variant(image); ok {
+			replacements[variant] = image
+		}
+	}
+
+	return func(target Target, servers []Server) plan {
+		outdated := plan{}
+		for _, server := range servers {
+			variant, ok := this.options.Variant(server.Image)
+			if !ok {
+				continue
+			}
+			if image, ok := replacements[variant]; ok && server.Image != image {
+				outdated[image] = append(outdated[image], server)
+			}
+		}
+		return outdated
+	}
+}
+
+func selection(selector func(target Target, server Server) bool) func(Target, []Server) plan {
+	return func(target Target, servers []Server) plan {
+		selected := plan{}
+		for _, server := range servers {
+			if server.State == "running" && selector(target, server) {
+				selected[server.Image] = append(selected[server.Image], server)
+			}
+		}
+		return selected
+	}
+}
+
+// Marks a GOTV relay container, the value is the container name of the game server it relays
+const LABEL_RELAY_OF = "io.csgo-watcher.relay-of"
+
+// A relay restarted right after its parent server, with a new image if it had one planned
+type relay struct {
+	server Server
+	image  string
+}
+
+// Take the relays of planned servers out of the plan, so they are restarted right after their parent and reconnect
+// to the updated server. Relays of servers that are not restarted stay in the plan.
+func splitRelays(servers []Server, planned plan) map[string][]relay {
+	plannedNames := map[string]bool{}
+	for _, group := range planned {
+		for _, server := range group {
+			plannedNames[server.Name] = true
+		}
+	}
+
+	relays := map[string][]relay{}
+	for _, server := range servers {
+		parent := server.Labels[LABEL_RELAY_OF]
+		if parent == "" || parent == server.Name || !plannedNames[parent] {
+			continue
+		}
+
+		image := server.Image
+		for plannedImage, group := range planned {
+			for i := range group {
+				if group[i].ID == server.ID {
+					image = plannedImage
+					planned[plannedImage] = append(group[:i:i], group[i+1:]...)
+					break
+				}
+			}
+		}
+		relays[parent] = append(relays[parent], relay{server, image})
+	}
+	return relays
+}
+
+// Drop the servers excluded from automatic restarts from the plan, ahead of taking out the relays of the planned ones
+func (this *Orchestrator) withoutManual(target Target, planned plan) plan {
+	automatic := plan{}
+	for image, servers := range planned {
+		for _, server := range servers {
+			if this.policy(target, server).Manual {
+				log.Info().Str("target", target.Name()).Str("server", server.Name).Msg("Server is excluded from automatic restarts")
+				continue
+			}
+			automatic[image] = append(automatic[image], server)
+		}
+	}
+	return automatic
+}
+
+// Order the planned restarts: canaries first, then one target after another, images in the given order followed by
+// the images servers already run, emptiest servers first. Servers excluded from automatic restarts are left out.
+// Targets whose servers could not be listed are returned as failures.
+func (this *Orchestrator) steps(ctx context.Context, images []string, planTarget func(Target, []Server) plan) ([]Step, []string) {
+	steps := []Step{}
+	failed := []string{}
+
+	for _, target := range this.Targets() {
+		servers, err := target.Servers(ctx)
+		if err != nil {
+			log.Err(err).Str("target", target.Name()).Msg("Failed to list servers of rollout target")
+			failed = append(failed, fmt.Sprintf("%s: %s", target.Name(), err))
+			continue
+		}
+
+		planned := this.withoutManual(target, planTarget(target, servers))
+		relays := splitRelays(servers, planned)
+		if len(planned) == 0 {
+			log.Debug().Str("target", target.Name()).Msg("No servers to restart on rollout target")
+			continue
+		}
+
+		order := append([]string{}, images...)
+		remaining := []string{}
+		for image := range planned {
+			if !contains(order, image) {
+				remaining = append(remaining, image)
+			}
+		}
+		sort.Strings(remaining)
+		order = append(order, remaining...)
+
+		for _, image := range order {
+			servers := planned[image]
+			sortByPlayers(servers)
+			for _, server := range servers {
+				policy := this.policy(target, server)
+				step := Step{Target: target.Name(), Server: server, Image: image, Canary: policy.Canary, target: target, policy: policy}
+				if policy.Window != nil {
+					step.Window = policy.Window.String()
+				}
+				step.Gate = this.gate(server, policy)
+				for _, relay := range relays[server.Name] {
+					step.Relays = append(step.Relays, Step{Target: target.Name(), Server: relay.server, Image: relay.image, target: target})
+				}
+				steps = append(steps, step)
+			}
+		}
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Canary && !steps[j].Canary })
+	return steps, failed
+}
+
+// Restart the planned servers one at a time, canaries first. Gated servers are restarted at the end once they drained,
+// their match ended or their restart window opened. Only one rollout or restart runs at a time, it can be paused and aborted in between restarts.
+func (this *Orchestrator) execute(ctx context.Context, kind string, images []string, pull bool, planTarget func(Target, []Server) plan) ([]Result, error) {
+	this.running.Lock()
+	defer this.running.Unlock()
+
+	steps, failed := this.steps(ctx, images, planTarget)
+	this.begin(kind, images, steps)
+	defer this.finish()
+
+	results := []Result{}
+	// Returns whether the restart succeeded
+	record := func(step Step, err error) bool {
+		results = append(results, newResult(step.target, step.Server, err))
+		this.update(func(progress *Progress) {
+			if err != nil {
+				progress.Failed++
+			} else {
+				progress.Updated++
+			}
+		})
+		if err != nil {
+			log.Err(err).Str("target", step.Target).Str("server", step.Server.Name).Msg("Failed to restart server")
+			failed = append(failed, fmt.Sprintf("%s/%s: %s", step.Target, step.Server.Name, err))
+			return false
+		}
+		log.Info().Str("target", step.Target).Str("server", step.Server.Name).Str("image", step.Image).Msg("Restarted server")
+		return true
+	}
+	// Every image is pulled once per target, ahead of the first restart with it
+	pulls := map[Target]map[string]error{}
+	pullOnce := func(step Step) error {
+		if !pull {
+			return nil
+		}
+		if pulls[step.target] == nil {
+			pulls[step.target] = map[string]error{}
+		}
+		err, ok := pulls[step.target][step.Image]
+		if !ok {
+			if err = step.target.Pull(ctx, step.Image); err != nil {
+				log.Err(err).Str("target", step.Target).Str("image", step.Image).Msg("Failed to pull image on rollout target")
+			}
+			pulls[step.target][step.Image] = err
+		}
+		return err
+	}
+	// Returns false if the server is in a live match and has to wait for it to end
+	restart := func(step Step) bool {
+		this.update(func(progress *Progress) { progress.Current = &step })
+		defer this.update(func(progress *Progress) { progress.Current = nil })
+
+		err := step.target.Restart(ctx, step.Server, step.Image)
+		if errors.Is(err, ErrMatchLive) {
+			log.Info().Err(err).Str("target", step.Target).Str("server", step.Server.Name).Msg("Waiting for match to end")
+			return false
+		}
+		if !record(step, err) {
+			this.skip(step.Relays)
+			return true
+		}
+		for _, relay := range step.Relays {
+			if err := pullOnce(relay); err != nil {
+				record(relay, err)
+				continue
+			}
+			record(relay, relay.target.Restart(ctx, relay.Server, relay.Image))
+		}
+		return true
+	}
+
+	// Restart the steps, then drain the gated ones
+	run := func(steps []Step) {
+		waiting := []Step{}
+		for i, step := range steps {
+			// Only an abort stops here, a done context fails the remaining restarts instead
+			if !this.proceed(ctx) && ctx.Err() == nil {
+				this.skip(steps[i:])
+				this.skip(waiting)
+				this.draining(nil)
+				return
+			}
+			if err := pullOnce(step); err != nil {
+				record(step, err)
+				continue
+			}
+
+			switch step.Gate {
+			case GATE_MATCH:
+				log.Info().Str("target", step.Target).Str("server", step.Server.Name).Str("match", step.Server.Match).Msg("Waiting for match to end")
+				waiting = append(waiting, step)
+			case GATE_WINDOW:
+				log.Info().Str("target", step.Target).Str("server", step.Server.Name).Str("window", step.Window).Msg("Waiting for restart window")
+				waiting = append(waiting, step)
+			case GATE_PLAYERS:
+				log.Info().Str("target", step.Target).Str("server", step.Server.Name).Int("players", *step.Server.Players).Msg("Waiting for server to drain")
+				waiting = append(waiting, step)
+			default:
+				if !restart(step) {
+					step.Gate = GATE_MATCH
+					waiting = append(waiting, step)
+				}
+			}
+			this.draining(waiting)
+		}
+
+		if len(waiting) > 0 {
+			this.drain(ctx, waiting, restart, func(step Step, err error) { record(step, err) })
+		}
+	}
+
+	// Canaries go first, the other servers are only restarted if all of them made it
+	canaries := 0
+	for canaries < len(steps) && steps[canaries].Canary {
+		canaries++
+	}
+	if canaries > 0 {
+		failures := len(failed)
+		run(steps[:canaries])
+		err := fmt.Errorf("%d canaries failed", len(failed)-failures)
+		if len(failed) == failures {
+			err = this.verifyCanaries(ctx, steps[:canaries])
+		}
+		steps = steps[canaries:]
+		if err != nil {
+			log.Err(err).Msg("Canaries failed, not restarting the other servers")
+			failed = append(failed, err.Error())
+			this.skip(steps)
+			steps = nil
+		}
+	}
+	run(steps)
+
+	if progress := this.Progress(); progress.State == STATE_ABORTING {
+		err := fmt.Errorf("%w, %d servers were not restarted", ErrAborted, progress.Skipped)
+		if len(failed) > 0 {
+			err = fmt.Errorf("%w, %d failures: %s", err, len(failed), strings.Join(failed, "; "))
+		}
+		return results, err
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("rollout had %d failures: %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return results, nil
+}
+
+// Wait for busy servers to drain and restart them. Servers still busy after the drain timeout are given up on,
+// servers in a live match or outside their restart window are waited for until it ends or opens.
+func (this *Orchestrator) drain(ctx context.Context, waiting []Step, restart func(Step) bool, giveUp func(Step, error)) {
+	deadline := time.Now().Add(this.options.DrainTimeout)
+
+	for len(waiting) > 0 {
+		if time.Now().After(deadline) {
+			kept := []Step{}
+			for _, step := range waiting {
+				if step.Gate == GATE_MATCH || step.Gate == GATE_WINDOW {
+					kept = append(kept, step)
+					continue
+				}
+				giveUp(step, fmt.Errorf("still had %d players after waiting %s to drain", *step.Server.Players, this.options.DrainTimeout))
+			}
+			if waiting = kept; len(waiting) == 0 {
+				this.draining(nil)
+				return
+			}
+			this.draining(waiting)
+		}
+
+		select {
+		case <-time.After(this.options.DrainInterval):
+		case <-this.wakeup():
+		case <-ctx.Done():
+		}
+		if !this.proceed(ctx) || ctx.Err() != nil {
+			if ctx.Err() == nil {
+				this.skip(waiting)
+			} else {
+				for _, step := range waiting {
+					giveUp(step, ctx.Err())
+				}
+			}
+			this.draining(nil)
+			return
+		}
+
+		current := map[Target]map[string]Server{}
+		for _, step := range waiting {
+			if _, ok := current[step.target]; ok {
+				continue
+			}
+			servers, err := step.target.Servers(ctx)
+			if err != nil {
+				log.Err(err).Str("target", step.Target).Msg("Failed to check players of draining servers")
+			}
+			current[step.target] = map[string]Server{}
+			for _, server := range servers {
+				current[step.target][server.ID] = server
+			}
+		}
+
+		stillWaiting := []Step{}
+		for _, step := range waiting {
+			server, ok := current[step.target][step.Server.ID]
+			if !ok {
+				// Keep waiting if the target could not be reached, the server is gone otherwise
+				if len(current[step.target]) == 0 {
+					stillWaiting = append(stillWaiting, step)
+				} else {
+					giveUp(step, fmt.Errorf("server disappeared while waiting for it to drain"))
+				}
+				continue
+			}
+			step.Server = server
+			if step.Gate = this.gate(server, step.policy); step.Gate != "" {
+				stillWaiting = append(stillWaiting, step)
+				continue
+			}
+			if !restart(step) {
+				step.Gate = GATE_MATCH
+				stillWaiting = append(stillWaiting, step)
+			}
+		}
+		waiting = stillWaiting
+		this.draining(waiting)
+	}
+}
+
+// What a server has to wait for before it can be restarted, if anything
+func (this *Orchestrator) gate(server Server, policy Policy) string {
+	if server.InMatch() {
+		return GATE_MATCH
+	}
+	if policy.Window != nil && !policy.Window.Contains(time.Now()) {
+		return GATE_WINDOW
+	}
+	if this.busy(server) {
+		return GATE_PLAYERS
+	}
+	return ""
+}
+
+func (this *Orchestrator) busy(server Server) bool {
+	return this.options.MaxPlayers != nil && server.Players != nil && *server.Players > *this.options.MaxPlayers
+}
+
+// Emptiest servers first, servers with an unknown player count last
+func sortByPlayers(servers []Server) {
+	sort.SliceStable(servers, func(i, j int) bool {
+		if servers[i].Players == nil || servers[j].Players == nil {
+			return servers[i].Players != nil && servers[j].Players == nil
+		}
+		return *servers[i].Players < *servers[j].Players
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newResult(target Target, server Server, err error) Result {
+	result := Result{Target: target.Name(), Server: server, Err: err}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
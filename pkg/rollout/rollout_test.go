@@ -0,0 +1,58 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+)
+
+// Target with a fixed set of servers that records nothing
+type staticTarget struct {
+	servers []Server
+}
+
+func (this *staticTarget) Name() string {
+	return "static"
+}
+
+func (this *staticTarget) Servers(ctx context.Context) ([]Server, error) {
+	return this.servers, nil
+}
+
+func (this *staticTarget) Pull(ctx context.Context, image string) error {
+	return nil
+}
+
+func (this *staticTarget) Restart(ctx context.Context, server Server, image string) error {
+	return nil
+}
+
+func TestDryRunKeepsRelaysOfManualServers(t *testing.T) {
+	target := &staticTarget{servers: []Server{
+		{ID: "1", Name: "csgo-1", Image: "csgo:8100"},
+		{ID: "2", Name: "csgo-1-tv", Image: "csgo:8100", Labels: map[string]string{LABEL_RELAY_OF: "csgo-1"}},
+		{ID: "3", Name: "csgo-2", Image: "csgo:8100", Labels: map[string]string{LABEL_AUTO_RESTART: "false"}},
+		{ID: "4", Name: "csgo-2-tv", Image: "csgo:8100", Labels: map[string]string{LABEL_RELAY_OF: "csgo-2"}},
+	}}
+	orchestrator := NewOrchestrator(Options{Variant: func(image string) (string, bool) { return "csgo", true }}, target)
+
+	steps, err := orchestrator.DryRun(context.Background(), []string{"csgo:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := map[string]Step{}
+	for _, step := range steps {
+		restarted[step.Server.Name] = step
+	}
+	if len(steps) != 2 {
+		t.Fatalf("dry run planned %d restarts, want csgo-1 and csgo-2-tv: %+v", len(steps), steps)
+	}
+	if step, ok := restarted["csgo-1"]; !ok || len(step.Relays) != 1 || step.Relays[0].Server.Name != "csgo-1-tv" {
+		t.Errorf("csgo-1 is not restarted along with its relay: %+v", step)
+	}
+	if step, ok := restarted["csgo-2-tv"]; !ok || step.Image != "csgo:8200" {
+		t.Errorf("relay of the excluded csgo-2 is not restarted on its own: %+v", step)
+	}
+	if _, ok := restarted["csgo-2"]; ok {
+		t.Error("excluded csgo-2 is restarted")
+	}
+}
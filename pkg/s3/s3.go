@@ -0,0 +1,137 @@
+// Package s3 reads and writes objects of S3 compatible object storage, AWS S3 as well as MinIO, Ceph or R2
+package s3
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"strings"
+	"time"
+)
+
+const DEFAULT_ENDPOINT = "s3.amazonaws.com"
+
+// Parts of uploads of unknown size, each is buffered in memory
+const partSize = 64 << 20
+
+// A bucket and where in it the objects are
+type Config struct {
+	// host[:port] of the API, AWS S3 if empty
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Object key or prefix, depending on what is stored
+	Path string `yaml:"path"`
+	// Static credentials. Without them the AWS_ and MINIO_ environment variables, the AWS credentials file and the
+	// IAM role of the instance are tried.
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// Talk plain HTTP, e.g. to a MinIO on the same host
+	Insecure bool `yaml:"insecure"`
+}
+
+func (this Config) Enabled() bool {
+	return this.Bucket != ""
+}
+
+func (this Config) String() string {
+	return "s3://" + this.Bucket + "/" + strings.TrimPrefix(this.Path, "/")
+}
+
+// Validate the config without reaching the endpoint, prefix names the option in errors, e.g. state_export.s3
+func (this Config) Validate(prefix string) error {
+	if strings.Contains(this.Endpoint, "/") {
+		return fmt.Errorf("%s.endpoint must be host[:port] without a scheme, set insecure for plain HTTP", prefix)
+	}
+	if (this.AccessKey == "") != (this.SecretKey == "") {
+		return fmt.Errorf("%s.access_key and %s.secret_key must be set together", prefix, prefix)
+	}
+	return nil
+}
+
+// The objects of a bucket
+type Bucket struct {
+	client *minio.Client
+	name   string
+}
+
+// Open creates a client of the bucket, nothing is connected to
+func Open(config Config) (*Bucket, error) {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = DEFAULT_ENDPOINT
+	}
+	var creds *credentials.Credentials
+	if config.AccessKey != "" {
+		creds = credentials.NewStaticV4(config.AccessKey, config.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !config.Insecure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client of %s: %w", endpoint, err)
+	}
+	return &Bucket{client, config.Bucket}, nil
+}
+
+// Upload an object of size bytes, -1 if unknown, replacing an object of the same key
+func (this *Bucket) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	options := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		options.PartSize = partSize
+	}
+	_, err := this.client.PutObject(ctx, this.name, key, reader, size, options)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to bucket %s: %w", key, this.name, err)
+	}
+	return nil
+}
+
+// An object of a bucket
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// The objects whose key starts with prefix, also those in deeper "directories"
+func (this *Bucket) List(ctx context.Context, prefix string) ([]Object, error) {
+	// Stops the listing when returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := []Object{}
+	for info := range this.client.ListObjects(ctx, this.name, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %w", this.name, info.Err)
+		}
+		objects = append(objects, Object{info.Key, info.Size, info.LastModified})
+	}
+	return objects, nil
+}
+
+// Download an object, the caller closes it
+func (this *Bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := this.client.GetObject(ctx, this.name, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from bucket %s: %w", key, this.name, err)
+	}
+	return object, nil
+}
+
+func (this *Bucket) Remove(ctx context.Context, key string) error {
+	if err := this.client.RemoveObject(ctx, this.name, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove %s from bucket %s: %w", key, this.name, err)
+	}
+	return nil
+}
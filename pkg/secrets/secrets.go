@@ -0,0 +1,195 @@
+// Package secrets reads credentials from mounted files like Docker and Kubernetes secrets instead of the config file
+// or the environment, and redacts every credential it saw from the logs.
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Shown instead of a secret
+const REDACTED = "[redacted]"
+
+// Config keys holding credentials. Each can instead be given as <key>_file, the path of a file holding it. Lists
+// like accepted_tokens are read from files with one item per line.
+var Keys = []string{"password", "token", "rcon_password", "discord_hook", "webhook_url", "secret_key", "accepted_tokens", "hook_tokens", "admin_tokens"}
+
+// Keys of Keys holding lists
+var listKeys = map[string]bool{"accepted_tokens": true, "hook_tokens": true, "admin_tokens": true}
+
+var (
+	known      = map[string]bool{}
+	knownMutex sync.RWMutex
+)
+
+// Register a value to redact from logs
+func Register(value string) {
+	if len(value) < 4 {
+		// Redacting short values would garble the logs more than it protects
+		return
+	}
+	knownMutex.Lock()
+	defer knownMutex.Unlock()
+	known[value] = true
+	// As it appears in JSON logs
+	if quoted, err := json.Marshal(value); err == nil {
+		known[string(quoted[1:len(quoted)-1])] = true
+	}
+}
+
+// Redact replaces every registered secret in text
+func Redact(text []byte) []byte {
+	knownMutex.RLock()
+	defer knownMutex.RUnlock()
+	if len(known) == 0 {
+		return text
+	}
+	// Longest first, so a secret containing another one is replaced whole
+	values := make([]string, 0, len(known))
+	for value := range known {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		text = bytes.ReplaceAll(text, []byte(value), []byte(REDACTED))
+	}
+	return text
+}
+
+type writer struct {
+	out io.Writer
+}
+
+// Writer redacts the registered secrets from everything written to out. Every write is redacted on its own, which
+// fits loggers writing whole lines.
+func Writer(out io.Writer) io.Writer {
+	return writer{out}
+}
+
+func (this writer) Write(data []byte) (int, error) {
+	if _, err := this.out.Write(Redact(data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Read a secret file, without the trailing newline editors and kubectl leave
+func ReadFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	Register(value)
+	return value, nil
+}
+
+// Getenv reads the environment variable name, or the file named by name_FILE if that is set
+func Getenv(name string) (string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		value, err := ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		return value, nil
+	}
+	value := os.Getenv(name)
+	Register(value)
+	return value, nil
+}
+
+// Resolve replaces the <key>_file entries of a parsed YAML document with the contents of their files and registers
+// every credential of the document for redaction
+func Resolve(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := Resolve(child); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		keys := map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keys[node.Content[i].Value] = true
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if name := strings.TrimSuffix(key.Value, "_file"); name != key.Value && isKey(name) {
+				if keys[name] {
+					return fmt.Errorf("line %d: %s and %s are exclusive", key.Line, name, key.Value)
+				}
+				if err := resolveFile(key, value, name); err != nil {
+					return err
+				}
+			}
+			if isKey(key.Value) {
+				registerNode(value)
+			} else if err := Resolve(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isKey(name string) bool {
+	for _, key := range Keys {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn key: path into name: contents
+func resolveFile(key *yaml.Node, value *yaml.Node, name string) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: %s must be a path", key.Line, key.Value)
+	}
+	contents, err := ReadFile(expandHome(value.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: failed to read %s: %w", key.Line, key.Value, err)
+	}
+	key.Value = name
+	if listKeys[name] {
+		*value = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: value.Line, Column: value.Column}
+		for _, line := range strings.Split(contents, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: line})
+			}
+		}
+		return nil
+	}
+	*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: contents, Line: value.Line, Column: value.Column}
+	return nil
+}
+
+func registerNode(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		Register(node.Value)
+	}
+	for _, child := range node.Content {
+		registerNode(child)
+	}
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,68 @@
+package steam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What Steam currently offers of an app on a branch, from steamcmd's app_info_print
+type AppInfo struct {
+	AppID   int `json:"appid"`
+	Buildid int `json:"buildid"`
+	// When the branch was last updated, zero if Steam did not say
+	TimeUpdated time.Time `json:"time_updated,omitempty"`
+	// Manifest gid of every depot on the branch, by depot id
+	Manifests map[int]string `json:"manifests,omitempty"`
+}
+
+// ParseAppInfo extracts the branch from the output of `steamcmd +app_info_print <appid>`, which prints a status line
+// ahead of the KeyValues
+func ParseAppInfo(output string, appid int, branch string) (*AppInfo, error) {
+	start := strings.Index(output, "\""+strconv.Itoa(appid)+"\"")
+	if start < 0 {
+		return nil, fmt.Errorf("app info of %d missing in steamcmd output", appid)
+	}
+	kv, err := ParseKeyValues(output[start:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse app info: %w", err)
+	}
+	depots, ok := kv.Section(strconv.Itoa(appid), "depots")
+	if !ok {
+		return nil, fmt.Errorf("app info of %d has no depots", appid)
+	}
+
+	info := &AppInfo{AppID: appid, Manifests: map[int]string{}}
+	buildid, ok := depots.String("branches", branch, "buildid")
+	if !ok {
+		return nil, fmt.Errorf("app info of %d has no branch %s", appid, branch)
+	}
+	if info.Buildid, err = strconv.Atoi(buildid); err != nil {
+		return nil, fmt.Errorf("invalid buildid %q in app info", buildid)
+	}
+	if updated, ok := depots.String("branches", branch, "timeupdated"); ok {
+		if seconds, err := strconv.ParseInt(updated, 10, 64); err == nil {
+			info.TimeUpdated = time.Unix(seconds, 0).UTC()
+		}
+	}
+
+	for key, value := range depots {
+		depot, ok := value.(KeyValues)
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		// Older steamcmd versions print the gid directly, newer ones a section with gid and size
+		if gid, ok := depot.String("manifests", branch); ok {
+			info.Manifests[id] = gid
+		} else if gid, ok := depot.String("manifests", branch, "gid"); ok {
+			info.Manifests[id] = gid
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,63 @@
+package steam
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A depot as installed by steamcmd
+type Depot struct {
+	ID       int    `json:"id"`
+	Manifest string `json:"manifest"`
+	Size     int64  `json:"size"`
+}
+
+// The parts of an appmanifest_<appid>.acf file identifying exactly what is installed
+type AppManifest struct {
+	AppID           int     `json:"appid"`
+	Buildid         int     `json:"buildid"`
+	InstalledDepots []Depot `json:"installed_depots"`
+}
+
+func ParseAppManifest(text string) (*AppManifest, error) {
+	kv, err := ParseKeyValues(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse app manifest: %w", err)
+	}
+
+	manifest := &AppManifest{}
+	if appid, ok := kv.String("AppState", "appid"); ok {
+		manifest.AppID, _ = strconv.Atoi(appid)
+	}
+	buildid, ok := kv.String("AppState", "buildid")
+	if !ok {
+		return nil, fmt.Errorf("app manifest has no buildid")
+	}
+	if manifest.Buildid, err = strconv.Atoi(buildid); err != nil {
+		return nil, fmt.Errorf("invalid buildid %q in app manifest", buildid)
+	}
+
+	depots, _ := kv.Section("AppState", "InstalledDepots")
+	for key, value := range depots {
+		depot, ok := value.(KeyValues)
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		installed := Depot{ID: id}
+		installed.Manifest, _ = depot.String("manifest")
+		if size, ok := depot.String("size"); ok {
+			installed.Size, _ = strconv.ParseInt(size, 10, 64)
+		}
+		manifest.InstalledDepots = append(manifest.InstalledDepots, installed)
+	}
+	sort.Slice(manifest.InstalledDepots, func(i, j int) bool {
+		return manifest.InstalledDepots[i].ID < manifest.InstalledDepots[j].ID
+	})
+
+	return manifest, nil
+}
@@ -0,0 +1,37 @@
+package steam
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Characters of Steam Guard codes
+const guardAlphabet = "23456789BCDFGHJKMNPQRTVWXY"
+
+// GuardCode computes the Steam Guard code of a mobile authenticator at t from its base64 shared_secret, as the
+// Steam app shows it
+func GuardCode(sharedSecret string, t time.Time) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sharedSecret))
+	if err != nil {
+		return "", fmt.Errorf("invalid shared secret: %w", err)
+	}
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := make([]byte, 5)
+	for i := range code {
+		code[i] = guardAlphabet[value%uint32(len(guardAlphabet))]
+		value /= uint32(len(guardAlphabet))
+	}
+	return string(code), nil
+}
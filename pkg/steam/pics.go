@@ -0,0 +1,72 @@
+package steam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// What a PICS mirror knows of an app
+type PICSInfo struct {
+	// Steam's change number of the app info, bumped by every change to it
+	ChangeNumber int
+	// Buildid of the branch, 0 if the mirror did not say
+	Buildid int
+}
+
+// Response of PICS mirrors like api.steamcmd.net, which answer with the product info of `app_info_print` as JSON
+type picsResponse struct {
+	Status string `json:"status"`
+	Data   map[string]struct {
+		ChangeNumber json.Number `json:"_change_number"`
+		Depots       struct {
+			Branches map[string]struct {
+				Buildid json.Number `json:"buildid"`
+			} `json:"branches"`
+		} `json:"depots"`
+	} `json:"data"`
+}
+
+// FetchPICS gets the app info of appid from a PICS mirror at url
+func FetchPICS(ctx context.Context, client *http.Client, url string, appid int, branch string) (*PICSInfo, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PICS url: %w", err)
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query PICS mirror: %w", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query PICS mirror: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query PICS mirror: %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	var parsed picsResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("invalid PICS response: %w", err)
+	}
+	app, ok := parsed.Data[strconv.Itoa(appid)]
+	if !ok {
+		return nil, fmt.Errorf("PICS response has no app info of %d", appid)
+	}
+	info := &PICSInfo{}
+	if info.ChangeNumber, err = strconv.Atoi(app.ChangeNumber.String()); err != nil {
+		return nil, fmt.Errorf("PICS response has no change number of %d", appid)
+	}
+	if buildid := app.Depots.Branches[branch].Buildid; buildid != "" {
+		if info.Buildid, err = strconv.Atoi(buildid.String()); err != nil {
+			return nil, fmt.Errorf("invalid buildid %q in PICS response", buildid)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,151 @@
+package steam
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyValues is a parsed Valve KeyValues (VDF) text document. Values are either strings or nested KeyValues.
+type KeyValues map[string]interface{}
+
+// Get a nested section by path, e.g. kv.Section("AppState", "InstalledDepots")
+func (this KeyValues) Section(path ...string) (KeyValues, bool) {
+	current := this
+	for _, key := range path {
+		next, ok := current.lookup(key).(KeyValues)
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	return current, true
+}
+
+// Get a string value by path, the last element being the key
+func (this KeyValues) String(path ...string) (string, bool) {
+	section, ok := this.Section(path[:len(path)-1]...)
+	if !ok {
+		return "", false
+	}
+	value, ok := section.lookup(path[len(path)-1]).(string)
+	return value, ok
+}
+
+// Keys are case insensitive in KeyValues
+func (this KeyValues) lookup(key string) interface{} {
+	if value, ok := this[key]; ok {
+		return value
+	}
+	for k, value := range this {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+// ParseKeyValues parses the text format used by appmanifest_*.acf files and steamcmd's app_info_print
+func ParseKeyValues(text string) (KeyValues, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	root := KeyValues{}
+	position := 0
+	if err := parseSection(tokens, &position, root, false); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+type token struct {
+	value  string
+	quoted bool
+}
+
+func tokenize(text string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}':
+			tokens = append(tokens, token{value: string(c)})
+		case c == '"':
+			value := strings.Builder{}
+			i++
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+					switch text[i] {
+					case 'n':
+						value.WriteByte('\n')
+					case 't':
+						value.WriteByte('\t')
+					default:
+						value.WriteByte(text[i])
+					}
+					continue
+				}
+				value.WriteByte(text[i])
+			}
+			if i >= len(text) {
+				return nil, fmt.Errorf("unterminated string in keyvalues")
+			}
+			tokens = append(tokens, token{value: value.String(), quoted: true})
+		default:
+			start := i
+			for i < len(text) && !strings.ContainsRune(" \t\r\n{}\"", rune(text[i])) {
+				i++
+			}
+			tokens = append(tokens, token{value: text[start:i], quoted: true})
+			i--
+		}
+	}
+	return tokens, nil
+}
+
+func parseSection(tokens []token, position *int, section KeyValues, nested bool) error {
+	for *position < len(tokens) {
+		key := tokens[*position]
+		*position++
+
+		if !key.quoted {
+			if key.value == "}" && nested {
+				return nil
+			}
+			return fmt.Errorf("unexpected %q in keyvalues", key.value)
+		}
+
+		if *position >= len(tokens) {
+			return fmt.Errorf("missing value for key %q in keyvalues", key.value)
+		}
+		value := tokens[*position]
+		*position++
+
+		if value.quoted {
+			section[key.value] = value.value
+			continue
+		}
+		if value.value != "{" {
+			return fmt.Errorf("unexpected %q after key %q in keyvalues", value.value, key.value)
+		}
+
+		child := KeyValues{}
+		if err := parseSection(tokens, position, child, true); err != nil {
+			return err
+		}
+		section[key.value] = child
+	}
+
+	if nested {
+		return fmt.Errorf("unexpected end of keyvalues, missing }")
+	}
+	return nil
+}
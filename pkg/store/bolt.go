@@ -0,0 +1,360 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	checksBucket      = []byte("checks")
+	buildsBucket      = []byte("builds")
+	detectionsBucket  = []byte("detections")
+	deploymentsBucket = []byte("deployments")
+)
+
+func init() {
+	Register("bolt", openBolt)
+}
+
+// Local single file store, the default
+type boltStore struct {
+	db             *bbolt.DB
+	host           string
+	checkRetention time.Duration
+}
+
+func openBolt(options Options) (Store, error) {
+	db, err := bbolt.Open(options.DSN, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err == bbolt.ErrTimeout {
+		// NOTE bolt only allows a single process to open the file
+		return nil, fmt.Errorf("state store %s is locked by another process, query a running watcher through its API instead", options.DSN)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", options.DSN, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{checksBucket, buildsBucket, detectionsBucket, deploymentsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state store: %w", err)
+	}
+
+	return &boltStore{db, options.Host, options.CheckRetention}, nil
+}
+
+func (this *boltStore) Close() error {
+	return this.db.Close()
+}
+
+func (this *boltStore) RecordCheck(check Check) error {
+	check.Host = this.host
+
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(checksBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := putJson(bucket, itob(id), check); err != nil {
+			return err
+		}
+
+		// Checks are ordered by time, so old ones are at the start
+		if this.checkRetention > 0 {
+			cutoff := check.Time.Add(-this.checkRetention)
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				var old Check
+				if err := json.Unmarshal(value, &old); err == nil && old.Time.After(cutoff) {
+					break
+				}
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Detections used to be stored as the bare detection time
+type boltDetection struct {
+	DetectedAt time.Time `json:"detected_at"`
+	ReleasedAt time.Time `json:"released_at,omitempty"`
+}
+
+func decodeDetection(value []byte) (boltDetection, error) {
+	var detection boltDetection
+	if err := json.Unmarshal(value, &detection.DetectedAt); err == nil {
+		return detection, nil
+	}
+	err := json.Unmarshal(value, &detection)
+	return detection, err
+}
+
+func (this *boltStore) RecordDetection(buildid int, at time.Time, releasedAt time.Time) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(detectionsBucket)
+		key := []byte(strconv.Itoa(buildid))
+		if bucket.Get(key) != nil {
+			return nil
+		}
+		return putJson(bucket, key, boltDetection{DetectedAt: at, ReleasedAt: releasedAt})
+	})
+}
+
+func (this *boltStore) DetectedAt(buildid int) (time.Time, error) {
+	var at time.Time
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(detectionsBucket).Get([]byte(strconv.Itoa(buildid)))
+		if value == nil {
+			return nil
+		}
+		detection, err := decodeDetection(value)
+		at = detection.DetectedAt
+		return err
+	})
+	return at, err
+}
+
+func (this *boltStore) RecordDeployment(buildid int, at time.Time) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(deploymentsBucket)
+		key := []byte(strconv.Itoa(buildid))
+		if bucket.Get(key) != nil {
+			return nil
+		}
+		return putJson(bucket, key, at)
+	})
+}
+
+func (this *boltStore) Timelines(since time.Time) ([]Timeline, error) {
+	timelines := []Timeline{}
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		deployments := tx.Bucket(deploymentsBucket)
+		return tx.Bucket(detectionsBucket).ForEach(func(key []byte, value []byte) error {
+			detection, err := decodeDetection(value)
+			if err != nil {
+				return fmt.Errorf("corrupt detection record %s: %w", key, err)
+			}
+			if detection.DetectedAt.Before(since) {
+				return nil
+			}
+			buildid, err := strconv.Atoi(string(key))
+			if err != nil {
+				return fmt.Errorf("corrupt detection record %s: %w", key, err)
+			}
+			timeline := Timeline{Buildid: buildid, DetectedAt: detection.DetectedAt, ReleasedAt: detection.ReleasedAt}
+			if value := deployments.Get(key); value != nil {
+				if err := json.Unmarshal(value, &timeline.DeployedAt); err != nil {
+					return fmt.Errorf("corrupt deployment record %s: %w", key, err)
+				}
+			}
+			timelines = append(timelines, timeline)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	published := map[int]time.Time{}
+	err = this.eachOwnBuild(func(build Build) bool {
+		if build.Outcome != OutcomeFailed && !build.PushedAt.IsZero() {
+			// Iterated newest first, so the first build of a buildid is seen last
+			published[build.Buildid] = build.PushedAt
+		}
+		return true
+	})
+	for i := range timelines {
+		timelines[i].PublishedAt = published[timelines[i].Buildid]
+	}
+	sort.Slice(timelines, func(i, j int) bool { return timelines[i].DetectedAt.Before(timelines[j].DetectedAt) })
+	return timelines, err
+}
+
+func (this *boltStore) RecordBuild(build *Build) error {
+	build.Host = this.host
+
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(buildsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		build.ID = id
+		return putJson(bucket, itob(id), build)
+	})
+}
+
+func (this *boltStore) UpdateBuild(build Build) error {
+	build.Host = this.host
+
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(buildsBucket)
+		if bucket.Get(itob(build.ID)) == nil {
+			return fmt.Errorf("build %d is not recorded", build.ID)
+		}
+		return putJson(bucket, itob(build.ID), build)
+	})
+}
+
+func (this *boltStore) Builds(query BuildQuery) ([]Build, error) {
+	builds := []Build{}
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(buildsBucket).Cursor()
+
+		var key, value []byte
+		if query.Before == 0 {
+			key, value = cursor.Last()
+		} else if seek, _ := cursor.Seek(itob(query.Before)); seek == nil {
+			key, value = cursor.Last()
+		} else {
+			key, value = cursor.Prev()
+		}
+
+		for ; key != nil && len(builds) < query.Limit; key, value = cursor.Prev() {
+			var build Build
+			if err := json.Unmarshal(value, &build); err != nil {
+				return fmt.Errorf("corrupt build record %d: %w", btoi(key), err)
+			}
+			if query.Host != "" && build.Host != query.Host {
+				continue
+			}
+			builds = append(builds, build)
+		}
+		return nil
+	})
+	return builds, err
+}
+
+func (this *boltStore) BuildByBuildid(buildid int) (*Build, error) {
+	var found *Build
+	err := this.eachOwnBuild(func(build Build) bool {
+		if build.Buildid == buildid && build.Outcome != OutcomeFailed {
+			found = &build
+			return false
+		}
+		return true
+	})
+	return found, err
+}
+
+func (this *boltStore) NewestBuildid() (int, error) {
+	newest := -1
+	err := this.eachOwnBuild(func(build Build) bool {
+		if build.Outcome != OutcomeFailed && build.Buildid > newest {
+			newest = build.Buildid
+		}
+		return true
+	})
+	return newest, err
+}
+
+func (this *boltStore) Prune(before time.Time) (PruneResult, error) {
+	result := PruneResult{}
+	newest, err := this.NewestBuildid()
+	if err != nil {
+		return result, err
+	}
+
+	err = this.db.Update(func(tx *bbolt.Tx) error {
+		checks := tx.Bucket(checksBucket)
+		// Collected first, deleting while iterating skips keys
+		expired := [][]byte{}
+		cursor := checks.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var check Check
+			if err := json.Unmarshal(value, &check); err == nil && !check.Time.Before(before) {
+				break
+			}
+			expired = append(expired, key)
+		}
+		for _, key := range expired {
+			if err := checks.Delete(key); err != nil {
+				return err
+			}
+		}
+		result.Checks = len(expired)
+
+		builds := tx.Bucket(buildsBucket)
+		expired = [][]byte{}
+		err := builds.ForEach(func(key []byte, value []byte) error {
+			var build Build
+			if err := json.Unmarshal(value, &build); err != nil {
+				return fmt.Errorf("corrupt build record %d: %w", btoi(key), err)
+			}
+			if Prunable(build, this.host, newest, before) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := builds.Delete(key); err != nil {
+				return err
+			}
+		}
+		result.Builds = len(expired)
+		return nil
+	})
+	if err != nil {
+		return PruneResult{}, err
+	}
+	return result, nil
+}
+
+// Iterate the builds of this host from newest to oldest until fn returns false. Builds recorded before hosts were
+// tracked have no host and count as the own.
+func (this *boltStore) eachOwnBuild(fn func(Build) bool) error {
+	return this.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(buildsBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			var build Build
+			if err := json.Unmarshal(value, &build); err != nil {
+				return fmt.Errorf("corrupt build record %d: %w", btoi(key), err)
+			}
+			if build.Host != "" && build.Host != this.host {
+				continue
+			}
+			if !fn(build) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func putJson(bucket *bbolt.Bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// Big endian keys keep bbolt's byte ordering equal to the numeric ordering
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+func init() {
+	Register("postgres", openPostgres)
+}
+
+// Shared store for many watchers, every row carries the host that wrote it
+type postgresStore struct {
+	db             *sql.DB
+	host           string
+	checkRetention time.Duration
+}
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS watcher_checks (
+		id            BIGSERIAL PRIMARY KEY,
+		host          TEXT        NOT NULL,
+		time          TIMESTAMPTZ NOT NULL,
+		steam_buildid INTEGER     NOT NULL,
+		local_buildid INTEGER     NOT NULL,
+		error         TEXT        NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS watcher_checks_host_time ON watcher_checks (host, time)`,
+	`CREATE TABLE IF NOT EXISTS watcher_detections (
+		host        TEXT        NOT NULL,
+		buildid     INTEGER     NOT NULL,
+		detected_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (host, buildid)
+	)`,
+	`ALTER TABLE watcher_detections ADD COLUMN IF NOT EXISTS released_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS watcher_deployments (
+		host        TEXT        NOT NULL,
+		buildid     INTEGER     NOT NULL,
+		deployed_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (host, buildid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS watcher_builds (
+		id      BIGSERIAL PRIMARY KEY,
+		host    TEXT    NOT NULL,
+		buildid INTEGER NOT NULL,
+		outcome TEXT    NOT NULL,
+		data    JSONB   NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS watcher_builds_host_buildid ON watcher_builds (host, buildid)`,
+}
+
+func openPostgres(options Options) (Store, error) {
+	db, err := sql.Open("postgres", options.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres state store: %w", err)
+	}
+
+	for _, statement := range postgresSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create postgres schema: %w", err)
+		}
+	}
+
+	return &postgresStore{db, options.Host, options.CheckRetention}, nil
+}
+
+func (this *postgresStore) Close() error {
+	return this.db.Close()
+}
+
+func (this *postgresStore) RecordCheck(check Check) error {
+	_, err := this.db.Exec(
+		`INSERT INTO watcher_checks (host, time, steam_buildid, local_buildid, error) VALUES ($1, $2, $3, $4, $5)`,
+		this.host, check.Time, check.SteamBuildid, check.LocalBuildid, check.Error,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert check: %w", err)
+	}
+
+	if this.checkRetention > 0 {
+		_, err := this.db.Exec(
+			`DELETE FROM watcher_checks WHERE host = $1 AND time < $2`,
+			this.host, check.Time.Add(-this.checkRetention),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to prune checks: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (this *postgresStore) RecordDetection(buildid int, at time.Time, releasedAt time.Time) error {
+	released := sql.NullTime{Time: releasedAt, Valid: !releasedAt.IsZero()}
+	_, err := this.db.Exec(
+		`INSERT INTO watcher_detections (host, buildid, detected_at, released_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		this.host, buildid, at, released,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert detection: %w", err)
+	}
+	return nil
+}
+
+func (this *postgresStore) DetectedAt(buildid int) (time.Time, error) {
+	var at time.Time
+	err := this.db.QueryRow(
+		`SELECT detected_at FROM watcher_detections WHERE host = $1 AND buildid = $2`,
+		this.host, buildid,
+	).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+func (this *postgresStore) RecordDeployment(buildid int, at time.Time) error {
+	_, err := this.db.Exec(
+		`INSERT INTO watcher_deployments (host, buildid, deployed_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		this.host, buildid, at,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert deployment: %w", err)
+	}
+	return nil
+}
+
+func (this *postgresStore) Timelines(since time.Time) ([]Timeline, error) {
+	rows, err := this.db.Query(
+		`SELECT d.buildid, d.detected_at, d.released_at, p.deployed_at,
+		        (SELECT MIN((b.data->>'pushed_at')::timestamptz) FROM watcher_builds b
+		         WHERE b.host = d.host AND b.buildid = d.buildid AND b.outcome <> $3
+		           AND (b.data->>'pushed_at')::timestamptz > 'epoch')
+		 FROM watcher_detections d
+		 LEFT JOIN watcher_deployments p ON p.host = d.host AND p.buildid = d.buildid
+		 WHERE d.host = $1 AND d.detected_at >= $2
+		 ORDER BY d.detected_at`,
+		this.host, since, OutcomeFailed,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query timelines: %w", err)
+	}
+	defer rows.Close()
+
+	timelines := []Timeline{}
+	for rows.Next() {
+		var timeline Timeline
+		var released, deployed, published sql.NullTime
+		if err := rows.Scan(&timeline.Buildid, &timeline.DetectedAt, &released, &deployed, &published); err != nil {
+			return nil, err
+		}
+		timeline.ReleasedAt, timeline.DeployedAt, timeline.PublishedAt = released.Time, deployed.Time, published.Time
+		timelines = append(timelines, timeline)
+	}
+	return timelines, rows.Err()
+}
+
+func (this *postgresStore) RecordBuild(build *Build) error {
+	build.Host = this.host
+
+	data, err := json.Marshal(build)
+	if err != nil {
+		return err
+	}
+
+	err = this.db.QueryRow(
+		`INSERT INTO watcher_builds (host, buildid, outcome, data) VALUES ($1, $2, $3, $4) RETURNING id`,
+		this.host, build.Buildid, build.Outcome, data,
+	).Scan(&build.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert build: %w", err)
+	}
+	return nil
+}
+
+func (this *postgresStore) UpdateBuild(build Build) error {
+	build.Host = this.host
+
+	data, err := json.Marshal(build)
+	if err != nil {
+		return err
+	}
+
+	result, err := this.db.Exec(
+		`UPDATE watcher_builds SET outcome = $1, data = $2 WHERE id = $3 AND host = $4`,
+		build.Outcome, data, int64(build.ID), this.host,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update build: %w", err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return fmt.Errorf("build %d is not recorded", build.ID)
+	}
+	return nil
+}
+
+func (this *postgresStore) Builds(query BuildQuery) ([]Build, error) {
+	rows, err := this.db.Query(
+		`SELECT id, data FROM watcher_builds
+		 WHERE ($1 = 0 OR id < $1) AND ($2 = '' OR host = $2)
+		 ORDER BY id DESC LIMIT $3`,
+		int64(query.Before), query.Host, query.Limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query builds: %w", err)
+	}
+	return scanBuilds(rows)
+}
+
+func (this *postgresStore) BuildByBuildid(buildid int) (*Build, error) {
+	rows, err := this.db.Query(
+		`SELECT id, data FROM watcher_builds WHERE host = $1 AND buildid = $2 AND outcome <> $3 ORDER BY id DESC LIMIT 1`,
+		this.host, buildid, OutcomeFailed,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query builds: %w", err)
+	}
+
+	builds, err := scanBuilds(rows)
+	if err != nil || len(builds) == 0 {
+		return nil, err
+	}
+	return &builds[0], nil
+}
+
+func (this *postgresStore) NewestBuildid() (int, error) {
+	var newest sql.NullInt64
+	err := this.db.QueryRow(
+		`SELECT MAX(buildid) FROM watcher_builds WHERE host = $1 AND outcome <> $2`,
+		this.host, OutcomeFailed,
+	).Scan(&newest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query newest build: %w", err)
+	}
+	if !newest.Valid {
+		return -1, nil
+	}
+	return int(newest.Int64), nil
+}
+
+func (this *postgresStore) Prune(before time.Time) (PruneResult, error) {
+	newest, err := this.NewestBuildid()
+	if err != nil {
+		return PruneResult{}, err
+	}
+	rows, err := this.db.Query(`SELECT id, data FROM watcher_builds WHERE host = $1`, this.host)
+	if err != nil {
+		return PruneResult{}, fmt.Errorf("failed to query builds: %w", err)
+	}
+	builds, err := scanBuilds(rows)
+	if err != nil {
+		return PruneResult{}, err
+	}
+	expired := []int64{}
+	for _, build := range builds {
+		if Prunable(build, this.host, newest, before) {
+			expired = append(expired, int64(build.ID))
+		}
+	}
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return PruneResult{}, fmt.Errorf("failed to prune: %w", err)
+	}
+	defer tx.Rollback()
+	checks, err := tx.Exec(`DELETE FROM watcher_checks WHERE host = $1 AND time < $2`, this.host, before)
+	if err != nil {
+		return PruneResult{}, fmt.Errorf("failed to prune checks: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM watcher_builds WHERE host = $1 AND id = ANY($2)`, this.host, pq.Array(expired)); err != nil {
+		return PruneResult{}, fmt.Errorf("failed to prune builds: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return PruneResult{}, fmt.Errorf("failed to prune: %w", err)
+	}
+	result := PruneResult{Builds: len(expired)}
+	if deleted, err := checks.RowsAffected(); err == nil {
+		result.Checks = int(deleted)
+	}
+	return result, nil
+}
+
+func scanBuilds(rows *sql.Rows) ([]Build, error) {
+	defer rows.Close()
+
+	builds := []Build{}
+	for rows.Next() {
+		var id uint64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		var build Build
+		if err := json.Unmarshal(data, &build); err != nil {
+			return nil, fmt.Errorf("corrupt build record %d: %w", id, err)
+		}
+		build.ID = id
+		builds = append(builds, build)
+	}
+
+	return builds, rows.Err()
+}
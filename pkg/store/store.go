@@ -0,0 +1,201 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	OutcomeSuccess = "success"
+	// Built and published to some but not all targets
+	OutcomePartial = "partial"
+	OutcomeFailed  = "failed"
+)
+
+// States of the phases of a build
+const (
+	// Waiting for its schedule
+	PhasePending = "pending"
+	PhaseDone    = "done"
+	PhaseFailed  = "failed"
+	// A newer build was published before its schedule came
+	PhaseSkipped = "skipped"
+)
+
+// Progress of a phase of a build, like pushing to the first target or replicating to the others
+type Phase struct {
+	State string `json:"state"`
+	// When it finished or, while pending, when it was scheduled
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// A single comparison of the Steam buildid with the newest local build
+type Check struct {
+	Host         string    `json:"host"`
+	Time         time.Time `json:"time"`
+	SteamBuildid int       `json:"steam_buildid"`
+	LocalBuildid int       `json:"local_buildid"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// A build attempt, successful or not
+type Build struct {
+	ID         uint64    `json:"id"`
+	Host       string    `json:"host"`
+	Buildid    int       `json:"buildid"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	// Local image tags and the image ID (digest of the image config) of the final image
+	Images  []string `json:"images"`
+	ImageID string   `json:"image_id,omitempty"`
+	// Size of the final image in bytes, including the layers it shares with earlier builds
+	Size int64 `json:"size,omitempty"`
+	// Registry references of every pushed image, and the repository digests of the final image
+	Pushed   []string  `json:"pushed,omitempty"`
+	Digests  []string  `json:"digests,omitempty"`
+	PushedAt time.Time `json:"pushed_at,omitempty"`
+	// Phases of the build by name, phases scheduled for later are updated once they ran
+	Phases map[string]Phase `json:"phases,omitempty"`
+	// Digest of the build context's files the images were built from
+	ContextDigest string `json:"context_digest,omitempty"`
+	// Checks the build ran before it was published by name, e.g. verify and smoke-test
+	Validations map[string]Validation `json:"validations,omitempty"`
+}
+
+// Outcome of a check of a build
+type Validation struct {
+	Passed bool `json:"passed"`
+	// What was checked, e.g. the installed buildid
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Whether a phase of the build still waits for its schedule
+func (this Build) Pending() bool {
+	for _, phase := range this.Phases {
+		if phase.State == PhasePending {
+			return true
+		}
+	}
+	return false
+}
+
+func (this Build) Duration() time.Duration {
+	return this.FinishedAt.Sub(this.StartedAt)
+}
+
+// Milestones of a buildid from its release on Steam until the game servers run it, zero until reached
+type Timeline struct {
+	Buildid int `json:"buildid"`
+	// Steam does not tell when it released a build, this is the last check that still saw an older one. Zero if the
+	// watcher was not running before the detection.
+	ReleasedAt time.Time `json:"released_at,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+	// The first successful build of the buildid was published
+	PublishedAt time.Time `json:"published_at,omitempty"`
+	// The first rollout of the buildid finished
+	DeployedAt time.Time `json:"deployed_at,omitempty"`
+}
+
+// Selects a page of builds, newest first
+type BuildQuery struct {
+	Limit int
+	// Only builds with a lower ID, 0 to start at the newest build
+	Before uint64
+	// Only builds of this watcher host, empty for every host sharing the store
+	Host string
+}
+
+// Store records every check and build of a watcher. Writes are stamped with the host the store was opened for, so
+// several watchers can share a store. Lookups used for deciding what to build only see the own host.
+type Store interface {
+	RecordCheck(check Check) error
+	// Remember when a buildid was first seen on Steam and the last check before that still saw an older buildid
+	// (zero if unknown), later detections of the same buildid are ignored
+	RecordDetection(buildid int, at time.Time, releasedAt time.Time) error
+	// When a buildid was first seen on Steam, zero if never
+	DetectedAt(buildid int) (time.Time, error)
+	// Remember when a buildid was first rolled out, later rollouts of the same buildid are ignored
+	RecordDeployment(buildid int, at time.Time) error
+	// Timelines of the buildids detected since the given time, oldest first
+	Timelines(since time.Time) ([]Timeline, error)
+	// Record a build, assigning its ID
+	RecordBuild(build *Build) error
+	// Replace a recorded build of the own host, e.g. once a phase scheduled for later ran
+	UpdateBuild(build Build) error
+	Builds(query BuildQuery) ([]Build, error)
+	// Newest successful (or partially successful) build of a buildid, nil if there is none
+	BuildByBuildid(buildid int) (*Build, error)
+	// Highest buildid that was built successfully, -1 if there is none
+	NewestBuildid() (int, error)
+	// Delete the own checks and builds from before the given time, see Prunable
+	Prune(before time.Time) (PruneResult, error)
+	Close() error
+}
+
+// Records deleted by Prune
+type PruneResult struct {
+	Checks int `json:"checks"`
+	Builds int `json:"builds"`
+}
+
+// Whether Prune may delete a build started before the given time. Builds of other hosts, builds still waiting for a
+// phase and the successful builds of the newest buildid, which decide what to build next, are kept.
+func Prunable(build Build, host string, newest int, before time.Time) bool {
+	if build.Host != "" && build.Host != host {
+		return false
+	}
+	if build.Buildid == newest && build.Outcome != OutcomeFailed {
+		return false
+	}
+	return build.StartedAt.Before(before) && !build.Pending()
+}
+
+type Options struct {
+	// Name of a registered driver, "bolt" or "postgres"
+	Driver string
+	// Driver specific location: a file path for bolt, a connection string for postgres
+	DSN  string
+	Host string
+	// How long individual checks are kept, builds are kept forever
+	CheckRetention time.Duration
+}
+
+// Opens a store for the given options
+type Driver func(options Options) (Store, error)
+
+var drivers = map[string]Driver{}
+
+// Register makes a driver available to Open, drivers register themselves in init
+func Register(name string, driver Driver) {
+	if _, exists := drivers[name]; exists {
+		panic("store driver registered twice: " + name)
+	}
+	drivers[name] = driver
+}
+
+func Drivers() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Open(options Options) (Store, error) {
+	if options.Driver == "" {
+		options.Driver = "bolt"
+	}
+
+	driver, ok := drivers[options.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown state store driver %q, expected one of %v", options.Driver, Drivers())
+	}
+
+	return driver(options)
+}
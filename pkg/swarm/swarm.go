@@ -0,0 +1,133 @@
+// Package swarm updates Docker Swarm services to new builds: the image of every service running an older build of
+// the same variant is replaced and the rolling update left to the swarm, as configured by the update_config of the
+// service.
+package swarm
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/rollout"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// Lists and updates services, implemented by the docker client of a swarm manager
+type DockerClient interface {
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+}
+
+// Outcome of updating a service, unchanged services are left out
+type Result struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`
+	Err     error  `json:"-"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Encoded credentials for pulling an image, empty for anonymous pulls
+type AuthFunc func(image string) (string, error)
+
+// Updater points services at new images, matching them by variant like rollouts do
+type Updater struct {
+	docker DockerClient
+	// Only these services, every service with a managed image if empty
+	services []string
+	variant  rollout.VariantFunc
+	auth     AuthFunc
+}
+
+func NewUpdater(docker DockerClient, services []string, variant rollout.VariantFunc, auth AuthFunc) *Updater {
+	return &Updater{docker, services, variant, auth}
+}
+
+// Update every service running an older image of one of the images, one service at a time. A failing service does
+// not stop the others. The swarm rolls the tasks out on its own, Update returns once it accepted the new specs.
+func (this *Updater) Update(ctx context.Context, images []string) ([]Result, error) {
+	return this.updateAll(ctx, images, false)
+}
+
+// The services Update would change, nothing is updated
+func (this *Updater) DryRun(ctx context.Context, images []string) ([]Result, error) {
+	return this.updateAll(ctx, images, true)
+}
+
+func (this *Updater) updateAll(ctx context.Context, images []string, dryRun bool) ([]Result, error) {
+	replacements := map[string]string{}
+	for _, image := range images {
+		if variant, ok := this.variant(image); ok {
+			replacements[variant] = image
+		}
+	}
+
+	services, err := this.docker.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list swarm services: %w", err)
+	}
+	selected := map[string]bool{}
+	for _, name := range this.services {
+		selected[name] = true
+	}
+
+	results := []Result{}
+	failed := []string{}
+	for _, service := range services {
+		spec := service.Spec
+		if len(selected) > 0 && !selected[spec.Name] || spec.TaskTemplate.ContainerSpec == nil {
+			continue
+		}
+		// The swarm pins the image by digest, e.g. csgo:buildid-1-get5@sha256:...
+		current := strings.SplitN(spec.TaskTemplate.ContainerSpec.Image, "@", 2)[0]
+		variant, ok := this.variant(current)
+		if !ok {
+			continue
+		}
+		image, ok := replacements[variant]
+		if !ok || image == current {
+			continue
+		}
+
+		result := Result{Service: spec.Name, Image: image}
+		if !dryRun {
+			result.Err = this.update(ctx, service, image)
+		}
+		if result.Err != nil {
+			result.Error = result.Err.Error()
+			log.Err(result.Err).Str("service", result.Service).Msg("Failed to update swarm service")
+			failed = append(failed, fmt.Sprintf("%s: %s", spec.Name, result.Err))
+		} else if !dryRun {
+			log.Info().Str("service", result.Service).Str("image", image).Msg("Updated swarm service")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to update %d of %d swarm services: %s", len(failed), len(results), strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+func (this *Updater) update(ctx context.Context, service swarm.Service, image string) error {
+	auth, err := this.auth(image)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", image, err)
+	}
+	spec := service.Spec
+	containerSpec := *spec.TaskTemplate.ContainerSpec
+	containerSpec.Image = image
+	spec.TaskTemplate.ContainerSpec = &containerSpec
+	response, err := this.docker.ServiceUpdate(ctx, service.ID, service.Version, spec, types.ServiceUpdateOptions{
+		EncodedRegistryAuth: auth,
+		// Pins the tag to its digest on every node
+		QueryRegistry: true,
+	})
+	if err != nil {
+		return err
+	}
+	for _, warning := range response.Warnings {
+		log.Warn().Str("service", spec.Name).Str("warning", warning).Msg("Swarm warned about service update")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Package systemd speaks the sd_notify protocol of Type=notify services and their watchdog, without libsystemd
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent with Notify
+const (
+	READY    = "READY=1"
+	STOPPING = "STOPPING=1"
+	WATCHDOG = "WATCHDOG=1"
+)
+
+// Notify sends a state to the service manager. Returns false without an error when not run by systemd.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Names starting with @ are abstract sockets, which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval is how often systemd expects WATCHDOG=1 from this process, 0 if its watchdog is disabled
+func WatchdogInterval() (time.Duration, error) {
+	value := os.Getenv("WATCHDOG_USEC")
+	if value == "" {
+		return 0, nil
+	}
+	// Set for the main process only, children inheriting the environment must not feed the watchdog
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", value)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
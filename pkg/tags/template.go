@@ -0,0 +1,163 @@
+package tags
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Format of Data.Date
+const DATE_FORMAT = "20060102"
+
+// Fields available in tag templates
+type Data struct {
+	BuildID int
+	// Steam branch the build was installed from, e.g. public
+	Branch string
+	// Day the build started in UTC, e.g. 20220131
+	Date string
+	// Versions of MetaMod:Source and SourceMod in the get5 image, e.g. 1.11.0-git6911, if pinned or watched
+	MetaMod   string
+	SourceMod string
+	// Short commit of the build.repositories, with several a short digest of their commits
+	Commit string
+}
+
+func NewData(buildid int, branch string, date time.Time) Data {
+	return Data{BuildID: buildid, Branch: branch, Date: date.UTC().Format(DATE_FORMAT)}
+}
+
+// Patterns the fields are matched with when parsing a tag
+var fieldPatterns = map[string]string{
+	"BuildID":   `[0-9]+`,
+	"Branch":    `[A-Za-z0-9_.-]+?`,
+	"Date":      `[0-9]{8}`,
+	"MetaMod":   `[0-9]+\.[0-9]+\.[0-9]+-git[0-9]+`,
+	"SourceMod": `[0-9]+\.[0-9]+\.[0-9]+-git[0-9]+`,
+	"Commit":    `[0-9a-f]{7}`,
+}
+
+// What docker accepts as a tag, and the characters of the text around the fields
+var (
+	tagPattern     = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	literalPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+)
+
+// Template renders image tags like get5-buildid-{{.BuildID}} and parses them back
+type Template struct {
+	text     string
+	template *template.Template
+	pattern  *regexp.Regexp
+	// Field captured by each group of pattern
+	groups []string
+}
+
+// Parse a tag template. It must contain {{.BuildID}}, as tags of different builds would collide otherwise.
+func Parse(text string) (*Template, error) {
+	parsed, err := template.New("tag").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag template %q: %w", text, err)
+	}
+
+	// Render with a marker for every field to find where each field ends up in the tag
+	markers := map[string]interface{}{}
+	for field := range fieldPatterns {
+		markers[field] = "\x00" + field + "\x00"
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, markers); err != nil {
+		return nil, fmt.Errorf("invalid tag template %q: %w", text, err)
+	}
+
+	pattern := strings.Builder{}
+	pattern.WriteString("^")
+	groups := []string{}
+	for i, part := range strings.Split(rendered.String(), "\x00") {
+		if i%2 == 0 {
+			if !literalPattern.MatchString(part) || (i == 0 && strings.HasPrefix(part, ".")) || (i == 0 && strings.HasPrefix(part, "-")) {
+				return nil, fmt.Errorf("tag template %q contains %q, tags consist of letters, digits, _, . and - and do not start with . or -", text, part)
+			}
+			pattern.WriteString(regexp.QuoteMeta(part))
+			continue
+		}
+		pattern.WriteString("(" + fieldPatterns[part] + ")")
+		groups = append(groups, part)
+	}
+	pattern.WriteString("$")
+
+	hasBuildID := false
+	for _, group := range groups {
+		hasBuildID = hasBuildID || group == "BuildID"
+	}
+	if !hasBuildID {
+		return nil, fmt.Errorf("tag template %q must contain {{.BuildID}}", text)
+	}
+
+	compiled, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag template %q: %w", text, err)
+	}
+
+	return &Template{text, parsed, compiled, groups}, nil
+}
+
+func (this *Template) String() string {
+	return this.text
+}
+
+// Whether the template uses a field, e.g. Date which can not be reconstructed from the buildid
+func (this *Template) Uses(field string) bool {
+	for _, group := range this.groups {
+		if group == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Template) Render(data Data) (string, error) {
+	var rendered bytes.Buffer
+	if err := this.template.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render tag template %q: %w", this.text, err)
+	}
+	if !tagPattern.MatchString(rendered.String()) {
+		return "", fmt.Errorf("tag template %q rendered the invalid tag %q", this.text, rendered.String())
+	}
+	return rendered.String(), nil
+}
+
+// Extract the fields of a tag rendered by this template
+func (this *Template) Match(tag string) (Data, bool) {
+	match := this.pattern.FindStringSubmatch(tag)
+	if match == nil {
+		return Data{}, false
+	}
+
+	data := Data{}
+	for i, group := range this.groups {
+		value := match[i+1]
+		switch group {
+		case "BuildID":
+			buildid, err := strconv.Atoi(value)
+			if err != nil || (data.BuildID != 0 && data.BuildID != buildid) {
+				return Data{}, false
+			}
+			data.BuildID = buildid
+		case "Branch":
+			data.Branch = value
+		case "Date":
+			data.Date = value
+		case "MetaMod":
+			data.MetaMod = value
+		case "SourceMod":
+			data.SourceMod = value
+		case "Commit":
+			data.Commit = value
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,99 @@
+package tags
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		// Part of the error, empty if the template is valid
+		err string
+	}{
+		{"buildid-{{.BuildID}}", ""},
+		{"get5-{{.Branch}}-{{.BuildID}}-{{.Date}}", ""},
+		{"{{.BuildID}}", ""},
+		{"get5-{{.MetaMod}}_{{.SourceMod}}-{{.Commit}}-{{.BuildID}}", ""},
+		{"latest", "must contain {{.BuildID}}"},
+		{"", "must contain {{.BuildID}}"},
+		{"{{if false}}{{.BuildID}}{{end}}", "must contain {{.BuildID}}"},
+		{"buildid-{{.Buildid}}", "invalid tag template"},
+		{"buildid-{{.Version}}", "invalid tag template"},
+		{"buildid-{{.BuildID}", "invalid tag template"},
+		{"build id-{{.BuildID}}", "tags consist of"},
+		{"buildid:{{.BuildID}}", "tags consist of"},
+		{"buildid/{{.BuildID}}", "tags consist of"},
+		{".buildid-{{.BuildID}}", "do not start with"},
+		{"-{{.BuildID}}", "do not start with"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.text)
+		if test.err == "" && err != nil {
+			t.Errorf("Parse(%q) failed: %s", test.text, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Parse(%q) returned %v, want an error containing %q", test.text, err, test.err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := Data{BuildID: 1234, Branch: "public", Date: "20220131", MetaMod: "1.11.0-git1148", SourceMod: "1.11.0-git6911", Commit: "0123abc"}
+	tests := []struct {
+		text string
+		data Data
+		// Empty if rendering fails
+		tag string
+	}{
+		{"buildid-{{.BuildID}}", data, "buildid-1234"},
+		{"get5-{{.Branch}}-{{.BuildID}}-{{.Date}}", data, "get5-public-1234-20220131"},
+		{"get5-{{.MetaMod}}-{{.Commit}}-{{.BuildID}}", data, "get5-1.11.0-git1148-0123abc-1234"},
+		// Fields that are not known render empty
+		{"{{.Branch}}{{.BuildID}}", Data{BuildID: 1234}, "1234"},
+		{"{{.Branch}}-{{.BuildID}}", Data{BuildID: 1234}, ""},
+		{"{{.Branch}}-{{.BuildID}}", Data{BuildID: 1234, Branch: "beta branch"}, ""},
+		{"{{.Branch}}{{.BuildID}}", Data{BuildID: 1234, Branch: strings.Repeat("a", 128)}, ""},
+	}
+	for _, test := range tests {
+		template, err := Parse(test.text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %s", test.text, err)
+		}
+		tag, err := template.Render(test.data)
+		if test.tag == "" {
+			if err == nil {
+				t.Errorf("Render(%q) returned %q, want an error", test.text, tag)
+			}
+		} else if err != nil || tag != test.tag {
+			t.Errorf("Render(%q) returned %q, %v, want %q", test.text, tag, err, test.tag)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		text string
+		tag  string
+		data *Data
+	}{
+		{"buildid-{{.BuildID}}", "buildid-1234", &Data{BuildID: 1234}},
+		{"get5-{{.Branch}}-{{.BuildID}}-{{.Date}}", "get5-public-1234-20220131", &Data{BuildID: 1234, Branch: "public", Date: "20220131"}},
+		{"buildid-{{.BuildID}}", "get5-buildid-1234", nil},
+		{"buildid-{{.BuildID}}", "buildid-", nil},
+		{"{{.BuildID}}-{{.BuildID}}", "1234-1235", nil},
+	}
+	for _, test := range tests {
+		template, err := Parse(test.text)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %s", test.text, err)
+		}
+		data, ok := template.Match(test.tag)
+		if test.data == nil {
+			if ok {
+				t.Errorf("%q matched %q as %+v", test.text, test.tag, data)
+			}
+		} else if !ok || data != *test.data {
+			t.Errorf("%q matched %q as %+v, %t, want %+v", test.text, test.tag, data, ok, *test.data)
+		}
+	}
+}
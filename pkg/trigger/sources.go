@@ -0,0 +1,148 @@
+package trigger
+
+import (
+	"context"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"os"
+	"time"
+)
+
+// Reason of the events of an Interval
+const TICK_REASON = "tick"
+
+// Interval fires every interval, which is read again after every tick
+type Interval struct {
+	name     string
+	interval func() time.Duration
+}
+
+func NewInterval(name string, interval func() time.Duration) *Interval {
+	return &Interval{name, interval}
+}
+
+func (this *Interval) Name() string {
+	return this.name
+}
+
+func (this *Interval) Run(ctx context.Context, report Reporter) {
+	for {
+		timer := time.NewTimer(this.interval())
+		select {
+		case <-timer.C:
+			report.Fire(TICK_REASON, false)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Webhook fires for every notification pushed to it, e.g. by an HTTP handler. Notifications pushed while one is
+// pending are merged into it.
+type Webhook struct {
+	name    string
+	pushes  chan string
+	rebuild bool
+}
+
+func NewWebhook(name string, rebuild bool) *Webhook {
+	return &Webhook{name, make(chan string, 1), rebuild}
+}
+
+func (this *Webhook) Name() string {
+	return this.name
+}
+
+func (this *Webhook) Push(reason string) {
+	select {
+	case this.pushes <- reason:
+	default:
+	}
+}
+
+func (this *Webhook) Run(ctx context.Context, report Reporter) {
+	for {
+		select {
+		case reason := <-this.pushes:
+			report.Fire(reason, this.rebuild)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Schedule fires at the times of a cron expression in local time, e.g. 0 4 * * 1
+type Schedule struct {
+	spec     string
+	schedule cron.Schedule
+	rebuild  bool
+}
+
+func NewSchedule(spec string, rebuild bool) (*Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+	return &Schedule{spec, schedule, rebuild}, nil
+}
+
+func (this *Schedule) Name() string {
+	return "schedule:" + this.spec
+}
+
+func (this *Schedule) Run(ctx context.Context, report Reporter) {
+	for {
+		timer := time.NewTimer(time.Until(this.schedule.Next(time.Now())))
+		select {
+		case <-timer.C:
+			report.Fire("schedule "+this.spec, this.rebuild)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// FileWatch fires when a file is created or its modification time or size changes, e.g. a file touched by a deploy
+// script. Its removal does not fire.
+type FileWatch struct {
+	path     string
+	interval time.Duration
+	rebuild  bool
+}
+
+func NewFileWatch(path string, interval time.Duration, rebuild bool) *FileWatch {
+	return &FileWatch{path, interval, rebuild}
+}
+
+func (this *FileWatch) Name() string {
+	return "file:" + this.path
+}
+
+func (this *FileWatch) Run(ctx context.Context, report Reporter) {
+	ticker := time.NewTicker(this.interval)
+	defer ticker.Stop()
+
+	// The state when the watch starts is the baseline
+	var last os.FileInfo
+	first := true
+	for {
+		info, err := os.Stat(this.path)
+		if err != nil && !os.IsNotExist(err) {
+			report.Polled(err)
+		} else {
+			report.Polled(nil)
+			if info != nil && !first && (last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()) {
+				report.Fire("file "+this.path+" changed", this.rebuild)
+			}
+			last, first = info, false
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package trigger detects updates worth a check of Steam or a build: polls of Steam and its PICS mirror, webhooks,
+// schedules, watched files and whatever else the watcher composes. A Group runs any number of triggers, each of which
+// fires on its own, and keeps metrics per trigger.
+package trigger
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// An update a trigger detected
+type Event struct {
+	// Name of the trigger that fired
+	Trigger string
+	// What was detected, e.g. pics change 15034405
+	Reason string
+	// Build even if the newest build is up to date, for updates of what the images contain besides the game
+	Rebuild bool
+}
+
+// A Trigger watches one source of updates
+type Trigger interface {
+	// Kind and what it watches, e.g. file:/srv/csgo/rebuild, used in logs and metrics
+	Name() string
+	// Watch until ctx is done, reporting updates and the outcome of polls
+	Run(ctx context.Context, report Reporter)
+}
+
+// Reporter is handed to the Run of every trigger by the Group
+type Reporter interface {
+	Fire(reason string, rebuild bool)
+	// Outcome of a poll, nil if the trigger reached what it watches. Failures are logged once until a poll succeeds.
+	Polled(err error)
+}
+
+type funcTrigger struct {
+	name string
+	run  func(ctx context.Context, report Reporter)
+}
+
+// New wraps a function watching a source as a trigger
+func New(name string, run func(ctx context.Context, report Reporter)) Trigger {
+	return funcTrigger{name, run}
+}
+
+func (this funcTrigger) Name() string {
+	return this.name
+}
+
+func (this funcTrigger) Run(ctx context.Context, report Reporter) {
+	this.run(ctx, report)
+}
+
+// Group runs triggers side by side, every event of any of them is passed to the handler
+type Group struct {
+	triggers []Trigger
+	handler  func(Event)
+}
+
+func NewGroup(handler func(Event), triggers ...Trigger) *Group {
+	return &Group{triggers, handler}
+}
+
+func (this *Group) Names() []string {
+	names := []string{}
+	for _, trigger := range this.triggers {
+		names = append(names, trigger.Name())
+	}
+	return names
+}
+
+// Run every trigger until ctx is done, returning once all of them stopped
+func (this *Group) Run(ctx context.Context) {
+	var running sync.WaitGroup
+	for _, trigger := range this.triggers {
+		report := &reporter{ctx: ctx, name: trigger.Name(), handler: this.handler}
+		metrics.TriggerFailing.WithLabelValues(report.name).Set(0)
+		running.Add(1)
+		go func(trigger Trigger) {
+			defer running.Done()
+			trigger.Run(ctx, report)
+		}(trigger)
+	}
+	running.Wait()
+}
+
+// Reporter of a single trigger, only used by the goroutine running it
+type reporter struct {
+	ctx     context.Context
+	name    string
+	handler func(Event)
+	failing bool
+}
+
+func (this *reporter) Fire(reason string, rebuild bool) {
+	metrics.TriggerFires.WithLabelValues(this.name).Inc()
+	metrics.TriggerLastFire.WithLabelValues(this.name).Set(float64(time.Now().Unix()))
+	log.Debug().Str("trigger", this.name).Str("reason", reason).Bool("rebuild", rebuild).Msg("Trigger fired")
+	this.handler(Event{Trigger: this.name, Reason: reason, Rebuild: rebuild})
+}
+
+func (this *reporter) Polled(err error) {
+	if err != nil {
+		metrics.TriggerErrors.WithLabelValues(this.name).Inc()
+		metrics.TriggerFailing.WithLabelValues(this.name).Set(1)
+		// Errors of a poll cancelled on shutdown are no news
+		if !this.failing && this.ctx.Err() == nil {
+			log.Warn().Err(err).Str("trigger", this.name).Msg("Trigger failed to poll, relying on the other triggers")
+		}
+		this.failing = true
+		return
+	}
+	metrics.TriggerFailing.WithLabelValues(this.name).Set(0)
+	if this.failing {
+		log.Info().Str("trigger", this.name).Msg("Trigger polls again")
+	}
+	this.failing = false
+}
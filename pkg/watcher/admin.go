@@ -0,0 +1,179 @@
+package watcher
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"csgo-update-watcher/pkg/store"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TLS of both APIs, nil without api.tls. Clients may present a certificate of client_ca, which authenticates them to
+// the admin APIs, the rest of the API stays open to clients without one.
+func (this APITLSConfig) serverConfig() (*tls.Config, error) {
+	if this.Cert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(expandHome(this.Cert), expandHome(this.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if this.ClientCA != "" {
+		data, err := ioutil.ReadFile(expandHome(this.ClientCA))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", this.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Who an admin request is from: the common name of its verified client certificate or "token" for a bearer token
+// of api.admin_tokens. False if it is from neither.
+func (this *UpdateWatcher) adminClient(authorization string, state *tls.ConnectionState) (string, bool) {
+	if state != nil && len(state.VerifiedChains) > 0 && this.options.API.TLS.ClientCA != "" {
+		return "cert " + state.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if token := strings.TrimPrefix(authorization, "Bearer "); token != authorization && tokenAccepted(token, this.options.API.AdminTokens) {
+		return "token", true
+	}
+	return "", false
+}
+
+// Routes under /admin/ for admin panels, all of them require an admin token or client certificate
+func (this *UpdateWatcher) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/status", this.admin(http.MethodGet, this.handleAdminStatus))
+	mux.HandleFunc("/admin/builds", this.admin(http.MethodGet, this.handleBuilds))
+	mux.HandleFunc("/admin/check", this.admin(http.MethodPost, this.handleAdminTrigger))
+	mux.HandleFunc("/admin/build", this.admin(http.MethodPost, this.handleAdminTrigger))
+	mux.HandleFunc("/admin/pause", this.admin(http.MethodPost, this.handleAdminPause))
+	mux.HandleFunc("/admin/resume", this.admin(http.MethodPost, this.handleAdminPause))
+	mux.HandleFunc("/admin/prune", this.admin(http.MethodPost, this.handleAdminPrune))
+}
+
+func (this *UpdateWatcher) admin(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !this.options.API.AdminEnabled() {
+			writeError(w, http.StatusNotFound, "admin API is disabled")
+			return
+		}
+		client, ok := this.adminClient(r.Header.Get("Authorization"), r.TLS)
+		if !ok {
+			log.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("Refused unauthorized admin request")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if method != http.MethodGet {
+			log.Info().Str("client", client).Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("Admin request")
+		}
+		handler(w, r)
+	}
+}
+
+// Controls of rollouts and maintenance windows outside /admin/ need the admin credentials once they are configured,
+// and stay open without them
+func (this *UpdateWatcher) control(handler http.HandlerFunc) http.HandlerFunc {
+	authorized := this.admin(http.MethodPost, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !this.options.API.AdminEnabled() {
+			handler(w, r)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// Whether the request may use the controls
+func (this *UpdateWatcher) authorizedControl(r *http.Request) bool {
+	if !this.options.API.AdminEnabled() {
+		return true
+	}
+	_, ok := this.adminClient(r.Header.Get("Authorization"), r.TLS)
+	return ok
+}
+
+// GET /admin/status
+func (this *UpdateWatcher) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, this.Status())
+}
+
+// POST /admin/check or /admin/build, optionally with ?reason=
+func (this *UpdateWatcher) handleAdminTrigger(w http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "admin API"
+	}
+	var err error
+	if r.URL.Path == "/admin/build" {
+		err = this.TriggerBuild(reason)
+	} else {
+		err = this.TriggerCheck(reason)
+	}
+	if errors.Is(err, ErrNotWatching) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJson(w, http.StatusAccepted, this.Status())
+}
+
+// POST /admin/pause or /admin/resume
+func (this *UpdateWatcher) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.URL.Path == "/admin/pause" {
+		err = this.Pause()
+	} else {
+		err = this.Resume()
+	}
+	if errors.Is(err, ErrNotWatching) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, this.Status())
+}
+
+// POST /admin/prune?older_than=2160h
+func (this *UpdateWatcher) handleAdminPrune(w http.ResponseWriter, r *http.Request) {
+	value := r.URL.Query().Get("older_than")
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid older_than "+value)
+		return
+	}
+	result, err := this.Prune(age)
+	if errors.Is(err, ErrHistoryDisabled) {
+		writeError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to prune history")
+		writeError(w, http.StatusInternalServerError, "failed to prune history")
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]store.PruneResult{"pruned": result})
+}
+
+func tokenAccepted(token string, accepted []string) bool {
+	authorized := false
+	for _, candidate := range accepted {
+		if candidate != "" && subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
@@ -0,0 +1,101 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/attestation"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/steam"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"time"
+)
+
+// Locate and print the appmanifest of the dedicated server anywhere in the image
+var printAppManifestCommand = "cat \"$(find / -xdev -name appmanifest_" + strconv.Itoa(CSGO_APPID) + ".acf 2>/dev/null | head -n 1)\""
+
+// Read the app manifest from an image with the game installed
+func (this *UpdateWatcher) installedManifest(image string) (*steam.AppManifest, error) {
+	logs, err := this.runShell([]string{"-c", printAppManifestCommand}, image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app manifest: %w", err)
+	}
+
+	return steam.ParseAppManifest(logs)
+}
+
+// Attach SBOM and provenance to every published image. Failures are logged, the build itself already succeeded.
+func (this *UpdateWatcher) attest(installedImage string, buildid int, startedAt time.Time, results []PublishResult) {
+	build := attestation.BuildInfo{
+		AppID:          CSGO_APPID,
+		Buildid:        buildid,
+		Branch:         CSGO_BRANCH,
+		BaseImage:      this.baseTag(),
+		StartedAt:      startedAt,
+		FinishedAt:     time.Now(),
+		WatcherVersion: Version,
+	}
+
+	manifest, err := this.installedManifest(installedImage)
+	if err != nil {
+		log.Err(err).Msg("Failed to read installed depots, attestations will not list them")
+	} else {
+		build.Depots = manifest.InstalledDepots
+	}
+
+	if base, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, build.BaseImage); err == nil {
+		build.BaseImageDigest = base.ID
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+
+		for _, image := range result.Images {
+			// Same image as the get5 buildid tag
+			if latest := this.latestTag(); latest != "" && image == result.Target.Reference(latest) {
+				continue
+			}
+
+			digest, err := registry.Digest(this.ctx, image, this.registryAuth.Keychain())
+			if err != nil {
+				log.Err(err).Str("image", image).Msg("Failed to attach attestations")
+				continue
+			}
+
+			imageBuild := build
+			imageBuild.Image = registry.RepositoryOf(image) + "@" + digest
+			imageBuild.Dockerfile = this.options.Build.Preinstall.Dockerfile
+			if parsed, ok := this.parseTag(image); ok {
+				imageBuild.Dockerfile = this.options.Build.dockerfile(parsed.Variant)
+			}
+
+			if err := attestation.Attach(this.ctx, imageBuild, this.registryAuth.Keychain()); err != nil {
+				log.Err(err).Str("image", image).Msg("Failed to attach attestations")
+				continue
+			}
+			log.Debug().Str("image", imageBuild.Image).Msg("Attached SBOM and provenance")
+		}
+	}
+}
+
+// Copy the attestations of an image along with it, images without attestations are skipped
+func (this *UpdateWatcher) copyAttestations(src string, dst string) error {
+	digest, err := registry.Digest(this.ctx, src, this.registryAuth.Keychain())
+	if err != nil {
+		return err
+	}
+	tags, err := attestation.FallbackTags(digest)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err := registry.Copy(this.ctx, registry.RepositoryOf(src)+":"+tag, registry.RepositoryOf(dst)+":"+tag, this.registryAuth.Keychain())
+		if err != nil && !attestation.IsNotFound(err) {
+			return fmt.Errorf("failed to copy attestation %s: %w", tag, err)
+		}
+	}
+
+	return nil
+}
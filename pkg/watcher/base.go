@@ -0,0 +1,66 @@
+package watcher
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The base image every build and, with check_method base, every check runs on
+func (this *UpdateWatcher) baseTag() string {
+	return this.BaseImageName + ":" + this.options.Build.BaseTag
+}
+
+// Digest of what the base image is built from: the names, modes, link targets and contents of the build context
+// files, the Dockerfile and target, and the build args. Modification times are left out, so a fresh checkout of the
+// same files keeps the digest.
+func (this *UpdateWatcher) baseContextDigest(args map[string]*string) (string, error) {
+	hash := sha256.New()
+	if err := this.hashContext(hash); err != nil {
+		return "", err
+	}
+
+	build := this.options.Build.Base
+	fmt.Fprintf(hash, "dockerfile %q target %q\n", build.Dockerfile, build.Target)
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "arg %q=%q\n", key, *args[key])
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Digest of the files of the build context, recorded with every build
+func (this *UpdateWatcher) contextDigest() (string, error) {
+	hash := sha256.New()
+	if err := this.hashContext(hash); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Write the names, modes and contents of the build context's files to hash
+func (this *UpdateWatcher) hashContext(hash io.Writer) error {
+	contextTar := buildContext(this.contextFiles, this.options.Build.dockerfiles())
+	defer contextTar.Close()
+	reader := tar.NewReader(contextTar)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read build context: %w", err)
+		}
+		fmt.Fprintf(hash, "file %q %o %d %q\n", header.Name, header.Mode, header.Size, header.Linkname)
+		if _, err := io.Copy(hash, reader); err != nil {
+			return fmt.Errorf("failed to read build context: %w", err)
+		}
+	}
+}
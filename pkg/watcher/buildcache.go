@@ -0,0 +1,207 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"time"
+)
+
+// Builds of the history whose cache records count as the watcher's
+const buildCacheWindows = 50
+
+// Build arg of the preinstall Dockerfiles that differs for every install, so reused layers never hold an old game
+const installIDArg = "INSTALL_ID"
+
+// When a build ran, cache records created or used meanwhile are attributed to the watcher
+type buildWindow struct {
+	start, end time.Time
+}
+
+// Reuse the layers of earlier builds with build_cache.reuse, and of the images of cacheFrom
+func (this *UpdateWatcher) applyCache(options *types.ImageBuildOptions) {
+	options.NoCache = !this.options.BuildCache.Reuse
+	// Podman only takes repositories of cached layers and reuses the pulled images on its own
+	if this.options.Engine != engine.PODMAN || !this.buildsOnEngine() {
+		options.CacheFrom = this.cacheFrom
+	}
+}
+
+// The preinstall build, with a new INSTALL_ID if layers are reused
+func (this *UpdateWatcher) preinstallBuild(id string) ImageBuildConfig {
+	build := this.options.Build.Preinstall
+	if !this.options.BuildCache.Reuse {
+		return build
+	}
+	args := map[string]string{}
+	for key, value := range build.Args {
+		args[key] = value
+	}
+	args[installIDArg] = id
+	build.Args = args
+	return build
+}
+
+// Whether images are built by the docker or podman API, whose builders only reuse the layers of local images
+func (this *UpdateWatcher) buildsOnEngine() bool {
+	return this.buildkit == nil && this.buildJobs == nil && this.options.Engine != engine.CONTAINERD
+}
+
+// The images of the previous buildid in the first publish target with build_cache.from_registry. Engines building
+// from local images pull them first, returned as pulled to be removed after the build. Images that cannot be found
+// or pulled are left out, the build then reuses less.
+func (this *UpdateWatcher) cacheImages() (images []string, pulled []string) {
+	if !this.options.BuildCache.FromRegistry {
+		return nil, nil
+	}
+	buildid, err := this.newestBuildVersion()
+	if err != nil {
+		log.Err(err).Msg("Failed to get previous build, not reusing its layers")
+		return nil, nil
+	}
+	if buildid < 0 {
+		log.Debug().Msg("No previous build to reuse the layers of")
+		return nil, nil
+	}
+	localTags, err := this.imageTags(buildid)
+	if err != nil {
+		log.Err(err).Int("buildid", buildid).Msg("Failed to get images of previous build, not reusing their layers")
+		return nil, nil
+	}
+	target := this.options.Publish.AllTargets()[0]
+	for _, localTag := range localTags {
+		image := target.Reference(localTag)
+		if this.buildsOnEngine() {
+			present, err := this.cacheImagePresent(image)
+			if err != nil {
+				log.Err(err).Str("image", image).Msg("Failed to look up cache image, not reusing its layers")
+				continue
+			}
+			if !present {
+				if err := this.pullCacheImage(image); err != nil {
+					log.Err(err).Str("image", image).Msg("Failed to pull cache image, not reusing its layers")
+					continue
+				}
+				pulled = append(pulled, image)
+			}
+		}
+		images = append(images, image)
+	}
+	log.Debug().Strs("images", images).Int("buildid", buildid).Msg("Reusing layers of previous build")
+	return images, pulled
+}
+
+func (this *UpdateWatcher) cacheImagePresent(image string) (bool, error) {
+	images, err := this.dockerCli.ImageList(this.ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("reference", image))})
+	return len(images) > 0, err
+}
+
+func (this *UpdateWatcher) pullCacheImage(image string) error {
+	log.Info().Str("image", image).Msg("Pulling cache image")
+	auth, err := this.registryAuth.EncodedAuth(image)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", image, err)
+	}
+	pullReader, err := this.dockerCli.ImagePull(this.ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer pullReader.Close()
+	return jsonmessage.DisplayJSONMessagesStream(pullReader, ioutil.Discard, 0, false, nil)
+}
+
+// Measure the build cache and prune it according to build_cache after a build finished
+func (this *UpdateWatcher) collectBuildCache(build buildWindow) {
+	cache, ok := this.dockerCli.(engine.BuildCache)
+	if !ok {
+		log.Trace().Msg("Engine has no build cache to measure or prune")
+		return
+	}
+	this.buildWindows = append(this.buildWindows, build)
+	if len(this.buildWindows) > buildCacheWindows {
+		this.buildWindows = this.buildWindows[1:]
+	}
+
+	if config := this.options.BuildCache; config.Prune {
+		reclaimed := uint64(0)
+		prunes := []types.BuildCachePruneOptions{}
+		if config.MaxAge > 0 {
+			prunes = append(prunes, types.BuildCachePruneOptions{All: config.All, Filters: filters.NewArgs(filters.Arg("until", config.MaxAge.String()))})
+		}
+		if size, _ := units.FromHumanSize(config.MaxSize); size > 0 {
+			prunes = append(prunes, types.BuildCachePruneOptions{All: config.All, KeepStorage: size})
+		}
+		for _, prune := range prunes {
+			report, err := cache.BuildCachePrune(this.ctx, prune)
+			if err != nil {
+				log.Err(err).Msg("Failed to prune build cache")
+				break
+			}
+			reclaimed += report.SpaceReclaimed
+		}
+		metrics.BuildCacheReclaimed.Add(float64(reclaimed))
+		if reclaimed > 0 {
+			log.Info().Str("reclaimed", units.HumanSize(float64(reclaimed))).Msg("Pruned build cache")
+		}
+	}
+
+	usage, err := cache.DiskUsage(this.ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to measure build cache")
+		return
+	}
+	windows := this.buildCacheWindows()
+	total, watcher := int64(0), int64(0)
+	for _, record := range usage.BuildCache {
+		// Shared records are counted with the records they are shared with
+		if record.Shared {
+			continue
+		}
+		total += record.Size
+		if recordOfBuilds(record, windows) {
+			watcher += record.Size
+		}
+	}
+	metrics.BuildCacheBytes.WithLabelValues("total").Set(float64(total))
+	metrics.BuildCacheBytes.WithLabelValues("watcher").Set(float64(watcher))
+	log.Debug().Str("total", units.HumanSize(float64(total))).Str("watcher", units.HumanSize(float64(watcher))).Msg("Measured build cache")
+}
+
+// The builds of this run and of the history
+func (this *UpdateWatcher) buildCacheWindows() []buildWindow {
+	windows := append([]buildWindow{}, this.buildWindows...)
+	if this.history == nil {
+		return windows
+	}
+	builds, err := this.history.Builds(store.BuildQuery{Limit: buildCacheWindows, Host: this.options.State.Host})
+	if err != nil {
+		log.Err(err).Msg("Failed to read build history, only attributing build cache of this run")
+		return windows
+	}
+	for _, build := range builds {
+		if !build.FinishedAt.IsZero() {
+			windows = append(windows, buildWindow{build.StartedAt, build.FinishedAt})
+		}
+	}
+	return windows
+}
+
+func recordOfBuilds(record *types.BuildCache, windows []buildWindow) bool {
+	for _, window := range windows {
+		if within(record.CreatedAt, window) || record.LastUsedAt != nil && within(*record.LastUsedAt, window) {
+			return true
+		}
+	}
+	return false
+}
+
+func within(t time.Time, window buildWindow) bool {
+	return !t.Before(window.start) && !t.After(window.end)
+}
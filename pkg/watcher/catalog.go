@@ -0,0 +1,135 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/catalog"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/store"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Builds read from the history to find the current image of every target after a restart
+const catalogSeedBuilds = 50
+
+// Current images by catalog.Entry.Key, seeded from the history on first use
+type catalogState struct {
+	mutex   sync.Mutex
+	entries map[string]catalog.Entry
+}
+
+// The current image of every branch, variant and publish target
+func (this *UpdateWatcher) Catalog() catalog.Catalog {
+	this.catalog.mutex.Lock()
+	defer this.catalog.mutex.Unlock()
+	this.seedCatalog()
+	return catalog.New(CSGO_APPID, this.catalog.entries)
+}
+
+// Record the images of a publish and write the catalog to its destinations. Failing to do so does not fail the build.
+func (this *UpdateWatcher) updateCatalog(results []PublishResult) {
+	publishedAt := time.Now().UTC()
+	this.catalog.mutex.Lock()
+	this.seedCatalog()
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		for _, image := range result.Images {
+			if entry, ok := this.catalogEntry(result.Target, image, publishedAt); ok {
+				this.catalog.entries[entry.Key()] = entry
+			}
+		}
+	}
+	current := catalog.New(CSGO_APPID, this.catalog.entries)
+	this.catalog.mutex.Unlock()
+
+	if this.catalogPublisher == nil {
+		return
+	}
+	if err := this.catalogPublisher.Publish(this.ctx, current); err != nil {
+		log.Err(err).Msg("Failed to publish image catalog")
+		return
+	}
+	log.Debug().Int("entries", len(current.Entries)).Msg("Published image catalog")
+}
+
+// Entry of an image pushed to the target, false for tags of no variant like the moving latest tag
+func (this *UpdateWatcher) catalogEntry(target PublishTarget, image string, publishedAt time.Time) (catalog.Entry, bool) {
+	tag := registry.TagOf(image)
+	if !strings.HasPrefix(tag, target.TagPrefix) {
+		return catalog.Entry{}, false
+	}
+	for _, variant := range this.options.variantNames() {
+		data, ok := this.tags[variant].Match(strings.TrimPrefix(tag, target.TagPrefix))
+		if !ok {
+			continue
+		}
+		branch := data.Branch
+		if branch == "" {
+			branch = CSGO_BRANCH
+		}
+		return catalog.Entry{
+			Branch:      branch,
+			Variant:     variant,
+			Target:      target.String(),
+			Repository:  target.Repository,
+			Buildid:     data.BuildID,
+			Image:       image,
+			PublishedAt: publishedAt,
+		}, true
+	}
+	return catalog.Entry{}, false
+}
+
+// Fill the catalog from the newest builds in the history, only called with the mutex held
+func (this *UpdateWatcher) seedCatalog() {
+	if this.catalog.entries != nil {
+		return
+	}
+	this.catalog.entries = map[string]catalog.Entry{}
+	if this.history == nil {
+		return
+	}
+	builds, err := this.history.Builds(store.BuildQuery{Limit: catalogSeedBuilds, Host: this.options.State.Host})
+	if err != nil {
+		log.Err(err).Msg("Failed to read build history for the image catalog, it only lists new builds")
+		return
+	}
+
+	targets := append(this.options.Publish.AllTargets(), this.options.Publish.Production...)
+	// Newest first, so older builds only fill in targets the newer ones did not publish to
+	for _, build := range builds {
+		if build.Outcome == store.OutcomeFailed {
+			continue
+		}
+		for _, image := range build.Pushed {
+			parsed, ok := this.parseTag(image)
+			if !ok {
+				continue
+			}
+			for _, target := range targets {
+				if target.Repository != parsed.Repository || target.TagPrefix != parsed.TagPrefix {
+					continue
+				}
+				if entry, ok := this.catalogEntry(target, image, build.PushedAt.UTC()); ok {
+					if _, exists := this.catalog.entries[entry.Key()]; !exists {
+						this.catalog.entries[entry.Key()] = entry
+					}
+				}
+				break
+			}
+		}
+	}
+}
+
+// GET /catalog
+func (this *UpdateWatcher) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJson(w, http.StatusOK, this.Catalog())
+}
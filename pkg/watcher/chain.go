@@ -0,0 +1,181 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+// Steps of publish.chain, each registered by the file of what it deploys to
+const (
+	// Restart the game servers of the fleet
+	STEP_FLEET = "fleet"
+	// Update the Kubernetes workloads
+	STEP_KUBERNETES = "kubernetes"
+	// Redeploy the compose projects
+	STEP_COMPOSE = "compose"
+	// Commit to the gitops repositories
+	STEP_GITOPS = "gitops"
+	// Update the Docker Swarm services
+	STEP_SWARM = "swarm"
+	// Save the images into archives
+	STEP_EXPORT = "export"
+	// Start the CI pipelines
+	STEP_PIPELINES = "pipelines"
+)
+
+// The chain without publish.chain, of the steps that have something to deploy to
+var DefaultChain = []string{STEP_FLEET, STEP_KUBERNETES, STEP_COMPOSE, STEP_GITOPS, STEP_SWARM, STEP_EXPORT, STEP_PIPELINES}
+
+// What a failing step of publish.chain leads to
+const (
+	// Hand the images to the next step anyway, the default
+	ON_FAILURE_CONTINUE = "continue"
+	// Skip the remaining steps
+	ON_FAILURE_STOP = "stop"
+)
+
+// Name of the local images in ChainStep.Targets
+const LOCAL_TARGET = "local"
+
+// Step is a plugin handed the images of a published build, e.g. to point the servers or services running an older
+// build at them. It reports its own failures and returns whether the images run there now.
+type Step interface {
+	Deploy(images []string) bool
+}
+
+// A method of the watcher as a step
+type stepFunc func(images []string) bool
+
+func (this stepFunc) Deploy(images []string) bool {
+	return this(images)
+}
+
+type stepKind struct {
+	// Whether the config has something for the step to deploy to
+	configured func(options Options) bool
+	// The step of a watcher whose config has something to deploy to
+	create func(watcher *UpdateWatcher) Step
+}
+
+var stepKinds = map[string]stepKind{}
+
+// Make a step available to publish.chain, steps register themselves in init
+func registerStep(name string, configured func(options Options) bool, create func(watcher *UpdateWatcher) Step) {
+	if _, exists := stepKinds[name]; exists {
+		panic("publish step registered twice: " + name)
+	}
+	stepKinds[name] = stepKind{configured, create}
+}
+
+func ChainStepNames() []string {
+	names := make([]string, 0, len(stepKinds))
+	for name := range stepKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// publish.chain, or the configured steps of DefaultChain
+func (this Options) chain() []ChainStep {
+	if len(this.Publish.Chain) > 0 {
+		return this.Publish.Chain
+	}
+	chain := []ChainStep{}
+	for _, name := range DefaultChain {
+		if stepKinds[name].configured(this) {
+			chain = append(chain, ChainStep{Step: name, OnFailure: ON_FAILURE_CONTINUE})
+		}
+	}
+	return chain
+}
+
+// Every step is known and has something to deploy to, and its targets exist
+func (this *Options) validateChain() error {
+	targets := map[string]bool{LOCAL_TARGET: true}
+	for _, target := range append(this.Publish.AllTargets(), this.Publish.Production...) {
+		targets[target.String()] = true
+	}
+	for i := range this.Publish.Chain {
+		step := &this.Publish.Chain[i]
+		kind, ok := stepKinds[step.Step]
+		if !ok {
+			return fmt.Errorf("unknown publish.chain step %q, expected one of %v", step.Step, ChainStepNames())
+		}
+		if !kind.configured(*this) {
+			return fmt.Errorf("publish.chain step %s has nothing to deploy to, configure %s", step.Step, step.Step)
+		}
+		if step.OnFailure == "" {
+			step.OnFailure = ON_FAILURE_CONTINUE
+		}
+		if step.OnFailure != ON_FAILURE_CONTINUE && step.OnFailure != ON_FAILURE_STOP {
+			return fmt.Errorf("publish.chain step %s: on_failure must be %s or %s", step.Step, ON_FAILURE_CONTINUE, ON_FAILURE_STOP)
+		}
+		for _, target := range step.Targets {
+			if !targets[target] {
+				return fmt.Errorf("publish.chain step %s: unknown target %q, expected %s or the name of a publish target", step.Step, target, LOCAL_TARGET)
+			}
+		}
+	}
+	return nil
+}
+
+// A step of the chain of a watcher
+type chainStep struct {
+	ChainStep
+	step Step
+}
+
+func (this *UpdateWatcher) newChain() []chainStep {
+	chain := []chainStep{}
+	for _, config := range this.options.chain() {
+		chain = append(chain, chainStep{config, stepKinds[config.Step].create(this)})
+	}
+	return chain
+}
+
+// The images of a step's targets
+func (this *UpdateWatcher) stepImages(step ChainStep, images []string) []string {
+	if len(step.Targets) == 0 {
+		return images
+	}
+	repositories := map[string]string{}
+	for _, target := range append(this.options.Publish.AllTargets(), this.options.Publish.Production...) {
+		repositories[target.String()] = target.Repository
+	}
+	selected := []string{}
+	for _, image := range images {
+		repository := registry.RepositoryOf(image)
+		for _, target := range step.Targets {
+			if target == LOCAL_TARGET && repository == this.BaseImageName || target != LOCAL_TARGET && repository == repositories[target] {
+				selected = append(selected, image)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Hand the images to every step of the chain in order. Returns whether every step that got images deployed them.
+func (this *UpdateWatcher) runChain(images []string) bool {
+	deployed := true
+	for _, step := range this.chain {
+		stepImages := this.stepImages(step.ChainStep, images)
+		if len(stepImages) == 0 {
+			log.Debug().Str("step", step.Step).Strs("targets", step.Targets).Msg("No images of the targets of the publish step")
+			continue
+		}
+		if step.step.Deploy(stepImages) {
+			continue
+		}
+		deployed = false
+		// Dry runs of every step are reported
+		if step.OnFailure == ON_FAILURE_STOP && !this.options.Rollout.DryRun {
+			log.Warn().Str("step", step.Step).Msg("Publish step failed, skipping the rest of publish.chain")
+			break
+		}
+	}
+	return deployed
+}
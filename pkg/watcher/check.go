@@ -0,0 +1,37 @@
+package watcher
+
+import "fmt"
+
+// Outcome of a single comparison of Steam with the newest build, see CheckOnce
+type CheckResult struct {
+	SteamBuildid int `json:"steam_buildid"`
+	// Buildid of the newest build, -1 if there is none
+	LocalBuildid int `json:"local_buildid"`
+	// Whether the configured build strategy would build now
+	Outdated bool   `json:"outdated"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckOnce compares Steam with the newest build like every check of a running watcher, without building or
+// recording anything. The base or checker image the check runs in is built first if it is missing. Returns what was
+// found before an error too.
+func (this *UpdateWatcher) CheckOnce() (CheckResult, error) {
+	result := CheckResult{LocalBuildid: -1}
+	if this.checksNeedBase() {
+		if err := this.ensureBaseImage(); err != nil {
+			return result, fmt.Errorf("failed to ensure base image exists: %w", err)
+		}
+	}
+	if err := this.ensureCheckerImage(); err != nil {
+		return result, err
+	}
+	steamBuildid, err := this.latestVersion()
+	if err != nil {
+		return result, err
+	}
+	result.SteamBuildid = steamBuildid
+	if result.Outdated, result.LocalBuildid, err = this.outdated(steamBuildid); err != nil {
+		return result, err
+	}
+	return result, nil
+}
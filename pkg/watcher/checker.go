@@ -0,0 +1,119 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/steam"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net/http"
+)
+
+// Where checks get the buildid from Steam
+const (
+	// helper-latest-buildid.sh in the base image
+	CHECK_BASE = "base"
+	// helper-latest-buildid.sh in checker_image, by default a small image of steamcmd and the script only
+	CHECK_CHECKER = "checker"
+	// The PICS mirror of pics.url, without running a container
+	CHECK_HTTP = "http"
+)
+
+func CheckMethodNames() []string {
+	return []string{CHECK_BASE, CHECK_CHECKER, CHECK_HTTP}
+}
+
+func validateCheckMethod(name string) error {
+	for _, method := range CheckMethodNames() {
+		if name == method {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown check method %q, expected one of %v", name, CheckMethodNames())
+}
+
+// The image checks of Steam run steamcmd in. With check_method http only the build strategies reading the app info
+// run it, in the base image.
+func (this *UpdateWatcher) checkerImage() string {
+	if this.options.CheckMethod != CHECK_CHECKER {
+		return this.baseTag()
+	}
+	if this.options.CheckerImage != "" {
+		return this.options.CheckerImage
+	}
+	return this.BaseImageName + ":checker"
+}
+
+// Whether checks run a container of the base image
+func (this *UpdateWatcher) checksNeedBase() bool {
+	switch this.options.CheckMethod {
+	case CHECK_BASE:
+		return true
+	case CHECK_HTTP:
+		return this.options.buildStrategy(CSGO_APPID).NeedsAppInfo()
+	}
+	return false
+}
+
+// Make sure the checker image of check_method checker is on the docker host: checker_image is pulled, the default
+// one built from build.checker
+func (this *UpdateWatcher) ensureCheckerImage() error {
+	if this.options.CheckMethod != CHECK_CHECKER {
+		return nil
+	}
+	image := this.checkerImage()
+	_, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, image)
+	if err == nil {
+		log.Trace().Msg("Checker image already exists")
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("could not inspect checker image: %w", err)
+	}
+
+	if this.options.CheckerImage == "" {
+		log.Info().Str("image", image).Msg("Building checker image")
+		if err := this.fetchContext(); err != nil {
+			return err
+		}
+		build := this.options.Build.Checker
+		if err := this.buildPlainImage(image, build, this.options.Build.steamcmdArgs(build), nil); err != nil {
+			return fmt.Errorf("failed to build checker image: %w", err)
+		}
+		return nil
+	}
+
+	log.Info().Str("image", image).Msg("Pulling checker image")
+	auth, err := this.registryAuth.EncodedAuth(image)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", image, err)
+	}
+	pullReader, err := this.dockerCli.ImagePull(this.ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("failed to pull checker image %s: %w", image, err)
+	}
+	defer pullReader.Close()
+	if err := jsonmessage.DisplayJSONMessagesStream(pullReader, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to pull checker image %s: %w", image, err)
+	}
+	return nil
+}
+
+// The buildid of the branch on the PICS mirror, for check_method http
+func (this *UpdateWatcher) picsBuildid() (int, error) {
+	// Validated when loading the config
+	url, err := renderPICSURL(this.options.PICS.URL)
+	if err != nil {
+		return 0, err
+	}
+	info, err := steam.FetchPICS(this.ctx, &http.Client{Timeout: picsTimeout}, url, CSGO_APPID, CSGO_BRANCH)
+	if err != nil {
+		return 0, err
+	}
+	if info.Buildid == 0 {
+		return 0, fmt.Errorf("PICS mirror did not report the buildid of branch %s", CSGO_BRANCH)
+	}
+	return info.Buildid, nil
+}
@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/compose"
+	"csgo-update-watcher/pkg/notify"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerStep(STEP_COMPOSE, func(options Options) bool {
+		return len(options.Compose.Projects) > 0 || options.Compose.Discover
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.updateCompose)
+	})
+}
+
+// Rewrite the compose files of the projects running an older build of one of the images and recreate the changed
+// services. Returns whether every project runs the images now.
+func (this *UpdateWatcher) updateCompose(images []string) bool {
+	if this.options.Rollout.DryRun {
+		results, err := this.composeUpdater.DryRun(this.ctx, images)
+		lines := []string{}
+		for _, result := range results {
+			for service, image := range result.Images {
+				lines = append(lines, result.Project+" "+service+": "+image)
+			}
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to plan compose project updates")
+		}
+		log.Info().Strs("updates", lines).Msg("Dry run, not redeploying compose projects")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would recreate "+strconv.Itoa(len(lines))+" compose services:\n"+strings.Join(lines, "\n"))
+		return false
+	}
+
+	results, err := this.composeUpdater.Update(this.ctx, images)
+	buildid, _ := this.buildidOf(images[0])
+	this.emit(Event{Type: EVENT_COMPOSE, Buildid: buildid, Images: images, Compose: results, Err: err})
+
+	updated := 0
+	for _, result := range results {
+		if result.Err == nil && len(result.Images) > 0 {
+			updated++
+		}
+	}
+	if err != nil {
+		this.notify(notify.EVENT_DEPLOYED, 0, "Redeployed "+strconv.Itoa(updated)+" compose projects, "+err.Error())
+		return false
+	}
+	if updated > 0 {
+		log.Info().Int("updated", updated).Msg("Rolled out new build to compose projects")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Redeployed "+strconv.Itoa(updated)+" compose projects with the new build")
+	}
+	return true
+}
+
+func newComposeUpdater(config ComposeConfig, dockerCli DockerClient, variant func(string) (string, bool)) *compose.Updater {
+	if len(config.Projects) == 0 && !config.Discover {
+		return nil
+	}
+	var docker compose.DockerClient
+	if config.Discover {
+		docker = dockerCli
+	}
+	projects := make([]compose.Project, len(config.Projects))
+	for i, project := range config.Projects {
+		project.File = expandHome(project.File)
+		projects[i] = project
+	}
+	return compose.NewUpdater(config.Command, projects, docker, variant)
+}
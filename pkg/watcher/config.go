@@ -0,0 +1,1572 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/compose"
+	"csgo-update-watcher/pkg/contextsource"
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/eventstream"
+	"csgo-update-watcher/pkg/export"
+	"csgo-update-watcher/pkg/fleet"
+	"csgo-update-watcher/pkg/gitops"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/leader"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/pipeline"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/rollout"
+	"csgo-update-watcher/pkg/s3"
+	"csgo-update-watcher/pkg/secrets"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CONFIG_FILE = "config.yml"
+
+// Options of an UpdateWatcher, usually read from the YAML config file with LoadConfig. Programs embedding the watcher
+// should start from DefaultOptions.
+type Options struct {
+	BaseImageName  string        `yaml:"base_image_name"`
+	CheckFrequency time.Duration `yaml:"check_frequency"`
+	// Where checks get the buildid from Steam, one of CheckMethodNames
+	CheckMethod string `yaml:"check_method"`
+	// Image of check_method checker, pulled if the docker host lacks it. Empty builds <base_image_name>:checker from
+	// build.checker.
+	CheckerImage string `yaml:"checker_image"`
+	// Directory of Dockerfiles and helper scripts replacing or adding to the embedded build context, e.g. a checkout
+	// of csgo-container. Empty builds with the embedded files only.
+	ContainerFiles string `yaml:"container_files"`
+	// Git repository or OCI artifact fetched before every build instead of container_files
+	ContainerSource contextsource.Source `yaml:"container_source"`
+	// How a check decides that Steam offers a new build, one of BuildStrategyNames
+	BuildStrategy string `yaml:"build_strategy"`
+	// Strategies of individual appids, taking precedence over build_strategy
+	BuildStrategies map[int]string `yaml:"build_strategies"`
+	// What a lower buildid on Steam than the newest build leads to, one of RollbackPolicyNames
+	Rollback    string           `yaml:"rollback"`
+	BuildLimit  BuildLimitConfig `yaml:"build_limit"`
+	BuildCache  BuildCacheConfig `yaml:"build_cache"`
+	Build       BuildConfig      `yaml:"build"`
+	DiscordHook string           `yaml:"discord_hook"`
+	// Where to tell people what the watcher did, by event
+	Notifiers []notify.Config `yaml:"notifiers"`
+	// NATS and Kafka brokers every event is published to, for consumers the watcher does not know about
+	EventStream eventstream.Config `yaml:"event_stream"`
+	// Warnings when the images of base_image_name use more disk than planned
+	DiskBudget DiskBudgetConfig `yaml:"disk_budget"`
+	// Keeps the downloaded game between builds, so only changed depots are downloaded
+	SteamCMDCache SteamCMDCacheConfig `yaml:"steamcmd_cache"`
+	SmokeTest     SmokeTestConfig     `yaml:"smoke_test"`
+	Hooks         HooksConfig         `yaml:"hooks"`
+	SteamLogin    SteamLoginConfig    `yaml:"steam_login"`
+	PICS          PICSConfig          `yaml:"pics"`
+	// Further sources of updates besides pics, api.hook_tokens, build.plugins.watch and build.repositories
+	Triggers TriggersConfig `yaml:"triggers"`
+	// Container engine, docker, podman or containerd
+	Engine string `yaml:"engine"`
+	// How to reach containerd with the containerd engine
+	Containerd engine.ContainerdOptions `yaml:"containerd"`
+	// How to reach the docker or podman engine, DOCKER_HOST and the other docker CLI variables if empty
+	Docker engine.DockerOptions `yaml:"docker"`
+
+	// Path to a docker CLI config.json, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json
+	DockerConfig string `yaml:"docker_config"`
+	// Explicit credentials, taking precedence over the docker config
+	Registries []registry.Credential `yaml:"registries"`
+
+	Tags    TagsConfig    `yaml:"tags"`
+	Links   LinksConfig   `yaml:"links"`
+	Publish PublishConfig `yaml:"publish"`
+	State   StateConfig   `yaml:"state"`
+	API     APIConfig     `yaml:"api"`
+	Fleet   FleetConfig   `yaml:"fleet"`
+	Rollout RolloutConfig `yaml:"rollout"`
+	SLO     SLOConfig     `yaml:"slo"`
+	// Kubernetes workloads new builds are rolled out to, next to the fleet
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// docker compose projects new builds are rolled out to
+	Compose ComposeConfig `yaml:"compose"`
+	// git repositories the tags of new builds are committed to, for Argo CD or Flux to roll them out
+	GitOps GitOpsConfig `yaml:"gitops"`
+	// Docker Swarm services new builds are rolled out to, through the docker host of the watcher
+	Swarm SwarmConfig `yaml:"swarm"`
+	// CI pipelines started for new builds, e.g. to harden or scan the images
+	Pipelines []pipeline.Config `yaml:"pipelines"`
+	// Where the newest build is written to for scripts
+	StateExport StateExportConfig `yaml:"state_export"`
+	// Where archives of the images are written to for hosts without a registry
+	Export ExportConfig `yaml:"export"`
+	// Where the archives of another watcher's export are loaded from instead of checking Steam and building
+	Import ImportConfig `yaml:"import"`
+	// Where the current image of every branch, variant and target is published after each push
+	Catalog CatalogConfig `yaml:"catalog"`
+
+	// Path of a JSON file the shutdown report is written to on Stop, it is only logged if empty
+	ShutdownReport string `yaml:"shutdown_report"`
+	// Path of a JSON file the status is written to after every check, for the healthcheck command without the API
+	HealthFile string `yaml:"health_file"`
+	// How long the watch loop may stay busy with one check, build and deployment before the systemd watchdog is no
+	// longer fed, 0 only requires the engine to answer
+	WatchdogStall time.Duration `yaml:"watchdog_stall"`
+
+	// What consecutive failed checks and builds lead to
+	ErrorPolicy ErrorPolicyConfig `yaml:"error_policy"`
+	// Limits of the helper containers, builds and smoke test servers, so they cannot starve the game servers
+	Resources ResourcesConfig `yaml:"resources"`
+	// Limits of single operations, a stuck steamcmd or registry fails the check or build instead of blocking it
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	// Redundant watchers sharing a lock, only its holder checks Steam, builds and restarts servers
+	Lock LockConfig `yaml:"lock"`
+	// When new versions may be built and servers restarted, Steam is checked at any time
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	// Stop watching on the first failed check or build instead of trying again on the next check, like
+	// error_policy.exit_after 1. Not read from the config file.
+	StopOnError bool `yaml:"-"`
+	// Check Steam once, build and publish if needed and stop then, for cron jobs and timers. Failures stop it like
+	// StopOnError. Not read from the config file.
+	Once bool `yaml:"-"`
+}
+
+// Resource limits, each is unlimited if empty or 0
+type ResourcesConfig struct {
+	// e.g. 1.5
+	CPUs float64 `yaml:"cpus"`
+	// e.g. 2g
+	Memory string `yaml:"memory"`
+	// Processes per container, builds are not limited
+	PidsLimit int64 `yaml:"pids_limit"`
+}
+
+// Each operation is cancelled after its timeout, 0 disables it
+type TimeoutsConfig struct {
+	// Every helper container, e.g. checking Steam or reading the buildid of a build. It is killed and removed.
+	Helper time.Duration `yaml:"helper"`
+	// Every image build
+	Build time.Duration `yaml:"build"`
+	// Pushing an image or copying it between registries
+	Push time.Duration `yaml:"push"`
+}
+
+// Watchers waiting for the lock serve the API and watch the fleet, and take over within retry once it is released or
+// lost. A watcher losing the lock stops with an error.
+type LockConfig struct {
+	// "file", "postgres" or "kubernetes", disabled if empty
+	Driver string `yaml:"driver"`
+	// Lock file of the file driver
+	Path string `yaml:"path"`
+	// Database of the postgres driver, state.dsn if empty
+	DSN string `yaml:"dsn"`
+	// Namespace of the Lease of the kubernetes driver, using kubernetes.kubeconfig and kubernetes.context
+	Namespace string `yaml:"namespace"`
+	// Lease of the kubernetes driver, or the advisory lock of the postgres driver
+	Name string `yaml:"name"`
+	// Holder of the Lease, the hostname if empty
+	Identity string        `yaml:"identity"`
+	Retry    time.Duration `yaml:"retry"`
+}
+
+// Failures are counted in a row, a failed build counts like a failed check and any success starts over. Each
+// threshold is disabled with 0.
+type ErrorPolicyConfig struct {
+	// Notify once this many failed, and another one on recovery
+	NotifyAfter int `yaml:"notify_after"`
+	// Degrade: double the time between checks with every further failure, up to max_backoff
+	BackoffAfter int           `yaml:"backoff_after"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+	// Stop watching with the last error
+	ExitAfter int `yaml:"exit_after"`
+	// Warn once, apart from the failures above, when Steam was not checked successfully for this long, 0 to never
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// Daily windows in local time like 03:00-06:00, any time if empty. POST /maintenance/force ignores them for a while.
+type MaintenanceConfig struct {
+	// Builds of new versions wait for it, detection and announcements do not
+	Builds string `yaml:"builds"`
+	// Deployments of new builds wait for it, and servers without a restart window of their own are only restarted
+	// within it
+	Restarts string `yaml:"restarts"`
+}
+
+// How servers are restarted during rollouts and scheduled restarts
+type RolloutConfig struct {
+	// Query the player count of every server over A2S and restart the emptiest servers first
+	QueryPlayers bool `yaml:"query_players"`
+	// Servers with more players are restarted last, once they drained to this many. Requires query_players.
+	MaxPlayers *int `yaml:"max_players"`
+	// Servers still above max_players after this long are not restarted
+	DrainTimeout  time.Duration `yaml:"drain_timeout"`
+	DrainInterval time.Duration `yaml:"drain_interval"`
+	// Ask every server for its get5 match state over RCON and never restart a server during a live match
+	MatchState bool `yaml:"match_state"`
+	// Used for containers without an RCON_PASSWORD environment variable
+	RconPassword string `yaml:"rcon_password"`
+	// Only log and announce the restarts of rollouts and scheduled restarts instead of executing them
+	DryRun bool `yaml:"dry_run"`
+	// Policies of the selected servers, later entries and then the container labels take precedence
+	Overrides []RolloutOverride `yaml:"overrides"`
+	// How long canaries have to keep running before the other servers are restarted
+	CanaryWait time.Duration `yaml:"canary_wait"`
+}
+
+type KubernetesConfig struct {
+	// Path to a kubeconfig, the service account of the watcher's pod is used if empty
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Context of the kubeconfig, its current context if empty
+	Context string `yaml:"context"`
+	// Containers of these workloads running a managed image are pointed at the new build of their repository and
+	// variant
+	Workloads []kube.Workload `yaml:"workloads"`
+	// How long Kubernetes gets to roll out each workload
+	RolloutTimeout time.Duration  `yaml:"rollout_timeout"`
+	Operator       OperatorConfig `yaml:"operator"`
+	// Build in Kaniko or Buildah jobs instead of the engine, which pulls the built images
+	Build kube.BuildJobOptions `yaml:"build"`
+}
+
+// Services of compose projects running a managed image are pointed at the new build of their repository and variant
+// in the compose file, then recreated
+type ComposeConfig struct {
+	// The compose CLI, docker compose if empty, e.g. [docker-compose] for the standalone binary
+	Command  []string          `yaml:"command"`
+	Projects []compose.Project `yaml:"projects"`
+	// Also redeploy the projects of the running containers with a managed image, found by the labels compose puts on
+	// them. Their compose files have to be readable at the paths compose recorded.
+	Discover bool `yaml:"discover"`
+}
+
+type SwarmConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Only these services, every service running a managed image if empty
+	Services []string `yaml:"services"`
+}
+
+// Destinations of the catalog, it is only served as GET /catalog if all are empty
+type CatalogConfig struct {
+	// Registry reference the catalog is pushed to as an OCI artifact, e.g. registry.example.com/csgo:catalog
+	Registry string `yaml:"registry"`
+	// URL the catalog is PUT to, e.g. a presigned object storage URL, with extra headers like Authorization
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Local file, e.g. in a directory served by a web server
+	File string `yaml:"file"`
+}
+
+func (this CatalogConfig) Enabled() bool {
+	return this.Registry != "" || this.URL != "" || this.File != ""
+}
+
+// Where the newest build is written to after every successful build, for scripts that do not talk to the API
+type StateExportConfig struct {
+	// Local JSON file
+	File string `yaml:"file"`
+	// Object the JSON is uploaded to, s3.path is its key
+	S3 s3.Config `yaml:"s3"`
+}
+
+func (this StateExportConfig) Enabled() bool {
+	return this.File != "" || this.S3.Enabled()
+}
+
+// The images of every build are saved into an archive named after the buildid, e.g. csgo-buildid-123.tar.gz, in
+// a directory or a bucket
+type ExportConfig struct {
+	Directory string `yaml:"directory"`
+	// Bucket the archives are uploaded to instead, s3.path is the prefix of their keys
+	S3 s3.Config `yaml:"s3"`
+	// docker for docker load, oci for an OCI image layout read by ctr import or skopeo
+	Format string `yaml:"format"`
+	// gzip or none
+	Compression string `yaml:"compression"`
+	// engine saves the local images, registry copies the pushed images from the registry
+	Source string `yaml:"source"`
+	// Archives of this many buildids are kept, 0 keeps all
+	Keep int `yaml:"keep"`
+}
+
+func (this ExportConfig) Enabled() bool {
+	return this.Directory != "" || this.S3.Enabled()
+}
+
+func (this ExportConfig) options() export.Options {
+	return export.Options{Format: this.Format, Compression: this.Compression, Source: this.Source, Keep: this.Keep}
+}
+
+// Import mode for hosts without access to Steam or a registry: the newest archive, if newer than the newest local
+// build, is loaded into the engine, tagged like a build and deployed
+type ImportConfig struct {
+	Directory string `yaml:"directory"`
+	// Bucket the archives are downloaded from instead, s3.path is the prefix of their keys
+	S3 s3.Config `yaml:"s3"`
+}
+
+func (this ImportConfig) Enabled() bool {
+	return this.Directory != "" || this.S3.Enabled()
+}
+
+type GitOpsConfig struct {
+	Repositories []gitops.Repository `yaml:"repositories"`
+}
+
+// In operator mode GameServerImage resources decide when Steam is checked and which repositories receive the builds,
+// instead of check_frequency
+type OperatorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Only watch the GameServerImages of this namespace, all namespaces if empty
+	Namespace string `yaml:"namespace"`
+}
+
+// Safety limit against building and pushing in a loop, e.g. after a bug in detection or with a flapping version
+// source. Builds are counted per app, failed builds included.
+type BuildLimitConfig struct {
+	// Builds within any hour and any day, 0 for no limit
+	PerHour int `yaml:"per_hour"`
+	PerDay  int `yaml:"per_day"`
+}
+
+// BuildKit keeps the layers of every build, tens of gigabytes for the game, in its cache. With prune enabled the
+// cache is pruned after every build, first by age and then by size.
+type BuildCacheConfig struct {
+	// Reuse the layers of earlier builds whose instructions and files did not change, instead of building every image
+	// from scratch. The game is installed anew either way.
+	Reuse bool `yaml:"reuse"`
+	// Also reuse the layers of the previous buildid's images in the first publish target, for hosts that do not keep
+	// them locally
+	FromRegistry bool `yaml:"from_registry"`
+	Prune        bool `yaml:"prune"`
+	// Remove cache not used for this long, 0 for no age limit
+	MaxAge time.Duration `yaml:"max_age"`
+	// Remove the least recently used cache until at most this much is left, e.g. 50GB, empty for no size limit
+	MaxSize string `yaml:"max_size"`
+	// Remove any unused cache, not only cache no image refers to
+	All bool `yaml:"all"`
+}
+
+type DiskBudgetConfig struct {
+	// Warn when a build grows the disk usage of the repository by more than this, e.g. 5GB, empty for no limit
+	MaxGrowth string `yaml:"max_growth"`
+	// Warn when the repository uses more than this in total, e.g. 100GB, empty for no limit
+	MaxSize string `yaml:"max_size"`
+}
+
+// How the images are built from the build context
+type BuildConfig struct {
+	Base       ImageBuildConfig `yaml:"base"`
+	Preinstall ImageBuildConfig `yaml:"preinstall"`
+	Get5       ImageBuildConfig `yaml:"get5"`
+	Checker    ImageBuildConfig `yaml:"checker"`
+	// Further images of every build, e.g. game modes with configs of their own, built in order after get5
+	Variants []VariantConfig `yaml:"variants"`
+	// Build args of every image. BASE_IMAGE is set by the watcher to the image each one is built on.
+	Args     map[string]string `yaml:"args"`
+	Snapshot SnapshotConfig    `yaml:"snapshot"`
+	// Install the game again this often if it installed another buildid than Steam offered when the build started
+	VerifyRetries int `yaml:"verify_retries"`
+	// Tag of the base image in base_image_name
+	BaseTag string `yaml:"base_tag"`
+	// Image the base and checker images are built FROM, passed as the STEAMCMD_IMAGE build arg. Empty keeps the
+	// Dockerfile's.
+	BaseFrom string `yaml:"base_from"`
+	// Rebuild the base image before a build once its build context, base_from or build args changed, instead of only
+	// building it when it is missing
+	RebuildBase bool `yaml:"rebuild_base"`
+	// Pinned MetaMod:Source and SourceMod of the get5 image and the plugins added on top of it
+	Plugins PluginsConfig `yaml:"plugins"`
+	// Git repositories of server configs or plugins copied into the get5 image
+	Repositories RepositoriesConfig `yaml:"repositories"`
+	// Build on a remote buildkitd instead of the engine, the built images are loaded into the engine
+	BuildKit engine.BuildKitOptions `yaml:"buildkit"`
+}
+
+// Install the game once into a snapshot image and build the preinstall image of every buildid on top of it. Hosts
+// keep the large snapshot layer and only pull the layer of files that changed since.
+type SnapshotConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Install a new snapshot once the layer on top of it grows beyond this, e.g. 5GB, empty for no limit
+	MaxUpdateSize string `yaml:"max_update_size"`
+	// Install a new snapshot once it is this old, 0 for no limit
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// An image built for every buildid on top of the preinstall or get5 image, tagged and published like them
+type VariantConfig struct {
+	// Used in tags, logs, smoke_test.variants and publish.files.variant
+	Name string `yaml:"name"`
+	// Variant the image is built on, preinstall or get5
+	From string `yaml:"from"`
+	// Template of the tag like tags, <name>-buildid-{{.BuildID}} if empty
+	Tag              string `yaml:"tag"`
+	ImageBuildConfig `yaml:",inline"`
+}
+
+// Names of build.variants, valid in tags and container names
+var variantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func (this VariantConfig) tag() string {
+	if this.Tag != "" {
+		return this.Tag
+	}
+	return this.Name + "-buildid-{{.BuildID}}"
+}
+
+// The mods of the get5 image. Pinned versions replace the defaults of the get5 Dockerfile, plugins are downloaded
+// into a layer of their own built on the get5 image with the Dockerfile of this config.
+type PluginsConfig struct {
+	// e.g. 1.11.0-git1148, empty keeps the Dockerfile's
+	MetamodVersion string `yaml:"metamod_version"`
+	// e.g. 1.11.0-git6911, empty keeps the Dockerfile's
+	SourcemodVersion string         `yaml:"sourcemod_version"`
+	Plugins          []PluginConfig `yaml:"plugins"`
+	ImageBuildConfig `yaml:",inline"`
+	// Follow the newest builds of the mods without a pinned version and rebuild the newest buildid when one changes
+	Watch ModWatchConfig `yaml:"watch"`
+}
+
+// Polls the files naming the newest build of the AlliedModders drop branches, like smdrop/1.11/sourcemod-latest-linux
+type ModWatchConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Drop branches, e.g. 1.11
+	MetamodBranch   string `yaml:"metamod_branch"`
+	SourcemodBranch string `yaml:"sourcemod_branch"`
+}
+
+// Whether the get5 image of every build has a known version of a mod, pinned or watched
+func (this PluginsConfig) knows(version string) bool {
+	return version != "" || this.Watch.Enabled
+}
+
+// The files of git repositories are copied into a layer of their own on the get5 image, after the plugins, with the
+// Dockerfile of this config. Their heads are polled and the newest buildid is built again once one moved.
+type RepositoriesConfig struct {
+	Git              []RepositoryConfig `yaml:"git"`
+	Interval         time.Duration      `yaml:"interval"`
+	ImageBuildConfig `yaml:",inline"`
+}
+
+type RepositoryConfig struct {
+	// Used in labels and logs
+	Name string `yaml:"name"`
+	// Dir is the subdirectory of the repository whose files are copied
+	contextsource.Git `yaml:",inline"`
+	// Where the files go, relative to the game directory csgo, e.g. cfg or addons/sourcemod
+	Path string `yaml:"path"`
+}
+
+// A plugin downloaded during the build, a .smx file or a .tar.gz archive of the game directory
+type PluginConfig struct {
+	URL string `yaml:"url"`
+	// Hex sha256 the download has to match, recommended so the image does not change with the download
+	SHA256 string `yaml:"sha256"`
+}
+
+// MetaMod:Source and SourceMod versions, the drop branch is the major and minor version
+var modVersionPattern = regexp.MustCompile(`^(\d+\.\d+)\.\d+-git\d+$`)
+
+var modBranchPattern = regexp.MustCompile(`^\d+\.\d+$`)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type ImageBuildConfig struct {
+	// Relative to the build context
+	Dockerfile string `yaml:"dockerfile"`
+	// Stage to build, the last one if empty
+	Target string `yaml:"target"`
+	// Build args of this image, taking precedence over build.args
+	Args map[string]string `yaml:"args"`
+}
+
+// Watch the change number of the app on a PICS mirror and check Steam as soon as the buildid of the branch changes,
+// instead of waiting for check_frequency. The regular checks keep running in case the mirror lags or fails.
+type PICSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Template of the mirror's URL with .AppID, answering like api.steamcmd.net
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Any trigger firing checks Steam right away, triggers for updates besides the game build the newest buildid again
+type TriggersConfig struct {
+	// Check Steam every check_frequency, without it Steam is only checked when another trigger fires
+	SteamPoll bool                    `yaml:"steam_poll"`
+	Schedules []ScheduleTriggerConfig `yaml:"schedules"`
+	Files     []FileTriggerConfig     `yaml:"files"`
+}
+
+type ScheduleTriggerConfig struct {
+	// Cron expression in local time, e.g. 0 4 * * 1
+	Cron string `yaml:"cron"`
+	// Build the newest buildid again instead of only checking Steam
+	Rebuild bool `yaml:"rebuild"`
+}
+
+// Fires when the file is created or its modification time or size changes
+type FileTriggerConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	// Build the newest buildid again instead of only checking Steam
+	Rebuild bool `yaml:"rebuild"`
+}
+
+// Steam account steamcmd logs in with instead of anonymously, for apps that require it. Secrets are read from files,
+// e.g. Docker or Kubernetes secrets, whenever steamcmd runs and are passed to the checker containers as a mounted file
+// and to builds as a BuildKit secret mount, which keeps them out of layers and logs. Needs the containerd engine.
+type SteamLoginConfig struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	// shared_secret of a Steam Guard mobile authenticator, the current code is computed from it
+	GuardSecretFile string `yaml:"guard_secret_file"`
+}
+
+// Commands or one-shot containers run at the stages of a build, see the HOOK_ constants
+type HooksConfig struct {
+	PreCheck    []HookConfig `yaml:"pre_check"`
+	PreBuild    []HookConfig `yaml:"pre_build"`
+	PostBuild   []HookConfig `yaml:"post_build"`
+	PostPublish []HookConfig `yaml:"post_publish"`
+	OnFailure   []HookConfig `yaml:"on_failure"`
+}
+
+// The build metadata is passed as CSGO_WATCHER_* environment variables
+type HookConfig struct {
+	// Local command, run without a shell. With image the command of the container, the image's if empty.
+	Command []string `yaml:"command"`
+	// Image of a one-shot container to run instead of a local command
+	Image string            `yaml:"image"`
+	Env   map[string]string `yaml:"env"`
+	// Defaults to 10 minutes
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Boot the game server of a new build before it is published, failing the build if it never answers A2S_INFO
+type SmokeTestConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Variants to boot, get5 by default
+	Variants []string `yaml:"variants"`
+	// How long the server may take to answer
+	Timeout time.Duration `yaml:"timeout"`
+	// Arguments of srcds_run replacing the command of the image
+	Args []string `yaml:"args"`
+	// Host the port of the server is published on, for watchers that cannot reach the engine's 127.0.0.1
+	Host string `yaml:"host"`
+}
+
+// Where steamcmd keeps the installation it updates, at most one of volume and cache_mount
+type SteamCMDCacheConfig struct {
+	// Docker volume keeping an installation, updated and copied into the preinstall image before its build. Not
+	// supported by the containerd engine.
+	Volume string `yaml:"volume"`
+	// Keep the installation in a BuildKit cache mount of the preinstall build, with the embedded
+	// Dockerfile-preinstall-cache. Needs an engine building with BuildKit or buildah, containerd or podman.
+	CacheMount bool `yaml:"cache_mount"`
+}
+
+// The Dockerfile of a variant of variantNames
+func (this BuildConfig) dockerfile(variant string) string {
+	switch variant {
+	case VARIANT_PREINSTALL:
+		return this.Preinstall.Dockerfile
+	case VARIANT_GET5:
+		return this.Get5.Dockerfile
+	}
+	for _, extra := range this.Variants {
+		if extra.Name == variant {
+			return extra.Dockerfile
+		}
+	}
+	return ""
+}
+
+// The Dockerfiles of every image the watcher builds, as paths within the build context
+func (this BuildConfig) dockerfiles() []string {
+	dockerfiles := []string{this.Base.Dockerfile, this.Preinstall.Dockerfile, this.Get5.Dockerfile, this.Checker.Dockerfile, this.Plugins.Dockerfile, this.Repositories.Dockerfile}
+	for _, variant := range this.Variants {
+		dockerfiles = append(dockerfiles, variant.Dockerfile)
+	}
+	return dockerfiles
+}
+
+// Build args of the base or checker image, with base_from as STEAMCMD_IMAGE
+func (this BuildConfig) steamcmdArgs(image ImageBuildConfig) map[string]*string {
+	args := this.buildArgs(image, "")
+	if this.BaseFrom != "" {
+		from := this.BaseFrom
+		args["STEAMCMD_IMAGE"] = &from
+	}
+	return args
+}
+
+// The get5 image with the MetaMod:Source and SourceMod versions of a build. Their METAMOD_URL and SOURCEMOD_URL
+// follow the versions unless set in build.args or build.get5.args.
+func (this BuildConfig) get5(mods modVersions) ImageBuildConfig {
+	get5 := this.Get5
+	get5.Args = map[string]string{}
+	for key, value := range this.Get5.Args {
+		get5.Args[key] = value
+	}
+	pins := []struct {
+		mod     alliedMod
+		version string
+	}{{metamod, mods.MetaMod}, {sourcemod, mods.SourceMod}}
+	for _, pin := range pins {
+		match := modVersionPattern.FindStringSubmatch(pin.version)
+		if match == nil {
+			continue
+		}
+		get5.Args[pin.mod.arg+"_VERSION"] = pin.version
+		_, global := this.Args[pin.mod.arg+"_URL"]
+		_, own := this.Get5.Args[pin.mod.arg+"_URL"]
+		if !global && !own {
+			get5.Args[pin.mod.arg+"_URL"] = pin.mod.download(match[1], pin.version)
+		}
+	}
+	return get5
+}
+
+// The layer of build.plugins on the get5 image, with one plugin per line of the PLUGINS build arg
+func (this BuildConfig) pluginLayer() ImageBuildConfig {
+	layer := this.Plugins.ImageBuildConfig
+	layer.Args = map[string]string{}
+	for key, value := range this.Plugins.Args {
+		layer.Args[key] = value
+	}
+	lines := []string{}
+	for _, plugin := range this.Plugins.Plugins {
+		lines = append(lines, strings.TrimSpace(plugin.URL+" "+plugin.SHA256))
+	}
+	layer.Args["PLUGINS"] = strings.Join(lines, "\n")
+	return layer
+}
+
+// Build args of an image built on baseImage
+func (this BuildConfig) buildArgs(image ImageBuildConfig, baseImage string) map[string]*string {
+	args := map[string]*string{}
+	for _, values := range []map[string]string{this.Args, image.Args} {
+		for key, value := range values {
+			value := value
+			args[key] = &value
+		}
+	}
+	if baseImage != "" {
+		args["BASE_IMAGE"] = &baseImage
+	}
+	return args
+}
+
+// Latency tracking of updates from their release on Steam until the game servers run them
+type SLOConfig struct {
+	// Percentiles are computed over the updates detected within this long
+	Window     time.Duration     `yaml:"window"`
+	Objectives LatencyObjectives `yaml:"objectives"`
+}
+
+// Latency objectives of the update phases, phases without one are only measured
+type LatencyObjectives struct {
+	Detection time.Duration `yaml:"detection"`
+	Build     time.Duration `yaml:"build"`
+	Deploy    time.Duration `yaml:"deploy"`
+	Total     time.Duration `yaml:"total"`
+}
+
+// Servers on the given hosts with all of the given container labels
+type ServerSelector struct {
+	// Agent names, "local" for the coordinator's host, all hosts if empty
+	Hosts []string `yaml:"hosts"`
+	// All servers if empty
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Rollout policy of the selected servers, unset fields are left as they are
+type RolloutOverride struct {
+	ServerSelector `yaml:",inline"`
+	// False excludes the servers from rollouts and scheduled restarts
+	AutoRestart *bool `yaml:"auto_restart"`
+	// Daily window in local time the servers may be restarted in, e.g. 03:00-07:00
+	Window string `yaml:"window"`
+	// Restart the servers ahead of all others, the remaining servers are only restarted if they keep running
+	Canary *bool `yaml:"canary"`
+}
+
+// In fleet mode a single coordinator watches Steam and builds, agents on the docker hosts only pull images and
+// restart game servers when told to
+type FleetConfig struct {
+	// Shared secret between coordinator and agents
+	Token string `yaml:"token"`
+	// Further tokens agents accept. To rotate the token, add the new token here on every agent, switch the
+	// coordinator's token and then remove the old one.
+	AcceptedTokens []string `yaml:"accepted_tokens"`
+	// Mutual TLS between coordinator and agents, see the gen-certs command
+	TLS FleetTLSConfig `yaml:"tls"`
+	// Agents the coordinator rolls new builds out to
+	Agents []AgentConfig `yaml:"agents"`
+	// Docker hosts the coordinator rolls new builds out to itself, through their docker API
+	DockerHosts []DockerHostConfig `yaml:"docker_hosts"`
+	// Also restart the game servers on the coordinator's own docker host
+	Local bool `yaml:"local"`
+	// Restart only the game servers on the coordinator's own docker host labelled io.csgo-watcher.update=true, like
+	// watchtower. Implies local. On an agent it limits the agent's host the same way.
+	Labelled bool `yaml:"labelled"`
+	// Address the agent command listens on
+	Listen string `yaml:"listen"`
+	// Find agents instead of listing them all
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	// How often every agent is asked for a report
+	HealthInterval time.Duration `yaml:"health_interval"`
+	// Planned restarts of the game servers, independent of new builds
+	Restarts []ScheduledRestart `yaml:"restarts"`
+}
+
+// Restart the selected servers with the image they are running on a cron schedule
+type ScheduledRestart struct {
+	Name string `yaml:"name"`
+	// Standard cron expression in local time, e.g. "0 5 * * *", or a descriptor like @daily
+	Schedule       string `yaml:"schedule"`
+	ServerSelector `yaml:",inline"`
+}
+
+func (this ScheduledRestart) String() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return this.Schedule
+}
+
+// Every discovered host is expected to run an agent on AgentPort
+type DiscoveryConfig struct {
+	// Hosts of the ssh:// and tcp:// docker CLI contexts
+	DockerContexts bool `yaml:"docker_contexts"`
+	// Path to an OpenSSH client config, e.g. ~/.ssh/config
+	SSHConfig string `yaml:"ssh_config"`
+	// Path to an Ansible INI inventory, optionally limited to a group
+	Inventory      string `yaml:"inventory"`
+	InventoryGroup string `yaml:"inventory_group"`
+	AgentPort      int    `yaml:"agent_port"`
+	// How often the sources are read again
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (this DiscoveryConfig) Enabled() bool {
+	return this.DockerContexts || this.SSHConfig != "" || this.Inventory != ""
+}
+
+// Fleet mode is enabled if there is anything to roll builds out to
+func (this FleetConfig) Enabled() bool {
+	return this.Local || this.Labelled || len(this.Agents) > 0 || len(this.DockerHosts) > 0 || this.Discovery.Enabled()
+}
+
+// PEM files, the coordinator uses a client certificate and every agent a server certificate of the same CA
+type FleetTLSConfig struct {
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (this FleetTLSConfig) Enabled() bool {
+	return this.CA != "" || this.Cert != "" || this.Key != ""
+}
+
+func (this FleetTLSConfig) Files() fleet.TLSFiles {
+	return fleet.TLSFiles{CA: this.CA, Cert: this.Cert, Key: this.Key}
+}
+
+type AgentConfig struct {
+	// Used in logs, defaults to the URL
+	Name string `yaml:"name"`
+	// e.g. http://gameserver-01:8081, or https://gameserver-01:8081 with tls
+	URL string `yaml:"url"`
+}
+
+// The game servers of a docker host run images of the publish targets, which the host pulls from the registry
+type DockerHostConfig struct {
+	// Used in logs and fleet.restarts hosts, defaults to the host
+	Name                 string `yaml:"name"`
+	engine.DockerOptions `yaml:",inline"`
+}
+
+// Go templates of the tags of each build, with the fields {{.BuildID}}, {{.Branch}} and {{.Date}} (YYYYMMDD in UTC).
+// Every template must contain {{.BuildID}}.
+type TagsConfig struct {
+	Preinstall string `yaml:"preinstall"`
+	Get5       string `yaml:"get5"`
+}
+
+// Go templates of the links to the changes of a build in events, notifications and the dashboard, with the fields
+// {{.BuildID}}, {{.PreviousBuildID}} (0 if unknown), {{.AppID}} and {{.Branch}}. Empty templates are left out.
+type LinksConfig struct {
+	Build  string `yaml:"build"`
+	Branch string `yaml:"branch"`
+}
+
+type APIConfig struct {
+	// Address of the HTTP API, e.g. ":8080". The API is disabled if empty.
+	Listen string `yaml:"listen"`
+	// Tokens external systems notify the watcher of Steam updates with on POST /hooks/steam-update, the endpoint is
+	// disabled without
+	HookTokens []string `yaml:"hook_tokens"`
+	// Address of the gRPC control API of grpcapi.Watcher, e.g. ":9090". Disabled if empty.
+	GRPCListen string `yaml:"grpc_listen"`
+	// Tokens of the admin API under /admin/, sent as Authorization: Bearer <token>. They also protect the gRPC API.
+	AdminTokens []string `yaml:"admin_tokens"`
+	// Serves both APIs over TLS
+	TLS APITLSConfig `yaml:"tls"`
+}
+
+// PEM files of the API certificate and of the CA whose client certificates authenticate to the admin APIs
+type APITLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+// Whether the admin API is enabled and the gRPC API requires authentication
+func (this APIConfig) AdminEnabled() bool {
+	return len(this.AdminTokens) > 0 || this.TLS.ClientCA != ""
+}
+
+type StateConfig struct {
+	// "bolt" for a local file (the default) or "postgres" to share the history between watchers
+	Driver string `yaml:"driver"`
+	// Connection string for postgres, e.g. postgres://watcher:secret@db/watcher?sslmode=disable
+	DSN string `yaml:"dsn"`
+	// File used by the bolt driver. The history is disabled if neither path nor dsn are set.
+	Path string `yaml:"path"`
+	// Name this watcher's records are stored under, defaults to the hostname
+	Host string `yaml:"host"`
+	// How long individual checks are kept, builds are kept forever
+	CheckRetention time.Duration `yaml:"check_retention"`
+}
+
+type PublishConfig struct {
+	// How new builds are published, one of PublishMethodNames
+	Method string `yaml:"method"`
+	// Methods of individual appids, taking precedence over method
+	Methods map[int]string `yaml:"methods"`
+	// Game files delivered by the volume, tarball and rsync methods
+	Files FilesConfig `yaml:"files"`
+	// Repository newly built images are pushed to, e.g. ghcr.io/shootingrange/csgo. Shorthand for a single target.
+	Repository string `yaml:"repository"`
+	// Every target receives the same images, a failing target does not stop the others
+	Targets []PublishTarget `yaml:"targets"`
+	// Production targets never receive builds directly. Images are copied there registry to registry from the first
+	// publish target by the promote command, so only images that were validated in staging reach production.
+	Production []PublishTarget `yaml:"production"`
+	// Only push to the first target through the docker daemon and copy the images registry to registry to the
+	// remaining targets, instead of uploading every image from the docker host once per target
+	Replicate bool `yaml:"replicate"`
+	// Attach an SPDX SBOM and a SLSA provenance attestation to every pushed image
+	Attestations bool `yaml:"attestations"`
+	// Moving tag pointed at the get5 image of every new build, after its buildid tags were pushed. Empty disables it.
+	LatestTag string `yaml:"latest_tag"`
+	// Windows the push and replication of new builds wait for
+	Schedule PublishScheduleConfig `yaml:"schedule"`
+	// Steps the published images are handed to in order, by default every configured one of DefaultChain
+	Chain []ChainStep `yaml:"chain"`
+}
+
+// An entry of publish.chain
+type ChainStep struct {
+	// One of ChainStepNames
+	Step string `yaml:"step"`
+	// Names of the publish targets whose images the step is handed, local for the local images. All images if empty.
+	Targets []string `yaml:"targets"`
+	// What a failure of the step leads to, continue with the next step or stop the chain
+	OnFailure string `yaml:"on_failure"`
+}
+
+// The installed game of a variant, delivered to servers that do not pull images
+type FilesConfig struct {
+	// Variant whose game files are delivered
+	Variant string `yaml:"variant"`
+	// Directory of the game in the images
+	Dir string `yaml:"dir"`
+	// volume: docker volume the game servers mount, replaced with the game files
+	Volume string `yaml:"volume"`
+	// tarball: URL the tarball is PUT to, a template with {{.AppID}}, {{.BuildID}} and {{.Variant}}
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// rsync: destinations like steam@gameserver-01:/srv/csgo, mirrored over ssh
+	Destinations []string `yaml:"destinations"`
+	SSHKey       string   `yaml:"ssh_key"`
+	// Unknown hosts are accepted on first use without a known_hosts file
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// Windows like 01:00-06:00 in local time, empty to run the phase right after the build. A newer build replaces an
+// older one that still waits.
+type PublishScheduleConfig struct {
+	// Pushing to the first target
+	Push string `yaml:"push"`
+	// Publishing to the remaining targets, only after the push
+	Replicate string `yaml:"replicate"`
+}
+
+type PublishTarget struct {
+	// Optional name used in logs, defaults to the repository
+	Name       string `yaml:"name"`
+	Repository string `yaml:"repository"`
+	// Prepended to every tag, e.g. "candidate-" to keep staging builds in their own tag namespace
+	TagPrefix string `yaml:"tag_prefix"`
+}
+
+// Reference of a local image once published to this target
+func (this PublishTarget) Reference(localTag string) string {
+	return this.Repository + ":" + this.TagPrefix + registry.TagOf(localTag)
+}
+
+func (this PublishTarget) String() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return this.Repository
+}
+
+// All targets including the repository shorthand. Pushing is disabled if there are none.
+func (this PublishConfig) AllTargets() []PublishTarget {
+	targets := []PublishTarget{}
+	if this.Repository != "" {
+		targets = append(targets, PublishTarget{Repository: this.Repository})
+	}
+	return append(targets, this.Targets...)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		BaseImageName:  "csgo-watched",
+		Engine:         engine.DOCKER,
+		CheckFrequency: time.Second * 5,
+		BuildStrategy:  STRATEGY_BUILDID,
+		CheckMethod:    CHECK_BASE,
+		Rollback:       ROLLBACK_STRATEGY,
+		BuildLimit: BuildLimitConfig{
+			PerHour: 4,
+			PerDay:  12,
+		},
+		Build: BuildConfig{
+			Base:          ImageBuildConfig{Dockerfile: "Dockerfile"},
+			Preinstall:    ImageBuildConfig{Dockerfile: "Dockerfile-preinstall"},
+			Get5:          ImageBuildConfig{Dockerfile: "Dockerfile-get5"},
+			Checker:       ImageBuildConfig{Dockerfile: "Dockerfile-checker"},
+			Plugins:       PluginsConfig{ImageBuildConfig: ImageBuildConfig{Dockerfile: "Dockerfile-plugins"}, Watch: ModWatchConfig{Interval: time.Hour, MetamodBranch: "1.11", SourcemodBranch: "1.11"}},
+			Repositories:  RepositoriesConfig{ImageBuildConfig: ImageBuildConfig{Dockerfile: "Dockerfile-repositories"}, Interval: 5 * time.Minute},
+			Snapshot:      SnapshotConfig{MaxUpdateSize: "5GB", MaxAge: 30 * 24 * time.Hour},
+			VerifyRetries: 2,
+			BaseTag:       "base",
+		},
+		WatchdogStall: 12 * time.Hour,
+		Timeouts: TimeoutsConfig{
+			Helper: 15 * time.Minute,
+			Build:  4 * time.Hour,
+			Push:   2 * time.Hour,
+		},
+		Lock: LockConfig{
+			Namespace: "default",
+			Name:      "csgo-update-watcher",
+			Retry:     leader.DEFAULT_RETRY,
+		},
+		ErrorPolicy: ErrorPolicyConfig{
+			NotifyAfter:  3,
+			BackoffAfter: 5,
+			MaxBackoff:   time.Hour,
+			StaleAfter:   6 * time.Hour,
+		},
+		PICS: PICSConfig{
+			URL:      "https://api.steamcmd.net/v1/info/{{.AppID}}",
+			Interval: 10 * time.Second,
+		},
+		Triggers: TriggersConfig{SteamPoll: true},
+		SmokeTest: SmokeTestConfig{
+			Variants: []string{VARIANT_GET5},
+			Timeout:  5 * time.Minute,
+			Host:     "127.0.0.1",
+		},
+		BuildCache: BuildCacheConfig{
+			MaxAge:  time.Hour * 24 * 7,
+			MaxSize: "50GB",
+		},
+		DiscordHook: os.Getenv("DISCORD_HOOK"),
+		Export: ExportConfig{
+			Format:      export.FORMAT_DOCKER,
+			Compression: export.COMPRESSION_GZIP,
+			Source:      export.SOURCE_ENGINE,
+			Keep:        5,
+		},
+		EventStream: eventstream.Config{
+			NATS:   eventstream.NATSConfig{Subject: "csgo-update-watcher"},
+			Kafka:  eventstream.KafkaConfig{Topic: "csgo-update-watcher"},
+			Buffer: eventstream.DEFAULT_BUFFER,
+		},
+		Tags: TagsConfig{
+			Preinstall: "preinstall-buildid-{{.BuildID}}",
+			Get5:       "get5-buildid-{{.BuildID}}",
+		},
+		Publish: PublishConfig{
+			Method:    PUBLISH_REGISTRY,
+			LatestTag: "latest",
+			Files: FilesConfig{
+				Variant: VARIANT_GET5,
+				Dir:     "/home/steam/csgo-dedicated",
+			},
+		},
+		Links: LinksConfig{
+			Build:  "https://steamdb.info/patchnotes/{{.BuildID}}/",
+			Branch: "https://steamdb.info/app/{{.AppID}}/depots/?branch={{.Branch}}",
+		},
+		State: StateConfig{
+			Path:           "state.db",
+			CheckRetention: time.Hour * 24 * 30,
+		},
+		Rollout: RolloutConfig{
+			DrainTimeout:  time.Hour,
+			DrainInterval: time.Minute,
+			CanaryWait:    time.Minute * 5,
+		},
+		Kubernetes: KubernetesConfig{
+			RolloutTimeout: time.Minute * 15,
+		},
+		SLO: SLOConfig{
+			Window: time.Hour * 24 * 30,
+		},
+		Fleet: FleetConfig{
+			Listen:         ":8081",
+			HealthInterval: time.Second * 30,
+			Discovery: DiscoveryConfig{
+				AgentPort: 8081,
+				Interval:  time.Minute * 5,
+			},
+		},
+	}
+}
+
+// Load the config file at path on top of the defaults. If the file does not exist and mustExist is false the
+// defaults are returned.
+func LoadConfig(path string, mustExist bool) (Options, error) {
+	config := DefaultOptions()
+	discordHook, err := secrets.Getenv("DISCORD_HOOK")
+	if err != nil {
+		return config, err
+	}
+	config.DiscordHook = discordHook
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !mustExist {
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Credentials may be given as <key>_file instead
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return config, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := secrets.Resolve(&document); err != nil {
+		return config, fmt.Errorf("failed to read secrets of config file %s: %w", path, err)
+	}
+	if len(document.Content) > 0 {
+		if err := document.Decode(&config); err != nil {
+			return config, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := engine.Validate(config.Engine); err != nil {
+		return config, err
+	}
+	if config.Docker.Enabled() {
+		if config.Engine == engine.CONTAINERD {
+			return config, fmt.Errorf("docker is not used by the %s engine, see containerd", config.Engine)
+		}
+		config.Docker.TLS.CA = expandHome(config.Docker.TLS.CA)
+		config.Docker.TLS.Cert = expandHome(config.Docker.TLS.Cert)
+		config.Docker.TLS.Key = expandHome(config.Docker.TLS.Key)
+		if err := config.Docker.Validate(); err != nil {
+			return config, fmt.Errorf("docker.%w", err)
+		}
+	}
+	if config.CheckFrequency <= 0 {
+		return config, fmt.Errorf("check_frequency must be positive")
+	}
+	if err := validateBuildStrategy(config.BuildStrategy); err != nil {
+		return config, err
+	}
+	for appid, strategy := range config.BuildStrategies {
+		if err := validateBuildStrategy(strategy); err != nil {
+			return config, fmt.Errorf("build strategy of appid %d: %w", appid, err)
+		}
+	}
+	if err := validateRollbackPolicy(config.Rollback); err != nil {
+		return config, err
+	}
+	if config.Rollback == ROLLBACK_REBUILD && config.State.Path == "" && config.State.DSN == "" {
+		return config, fmt.Errorf("rollback %s needs the build history, set state.path or state.dsn", ROLLBACK_REBUILD)
+	}
+	if config.BuildLimit.PerHour < 0 || config.BuildLimit.PerDay < 0 {
+		return config, fmt.Errorf("build_limit must not be negative")
+	}
+	if config.BuildCache.MaxSize != "" {
+		if _, err := units.FromHumanSize(config.BuildCache.MaxSize); err != nil {
+			return config, fmt.Errorf("invalid build_cache.max_size: %w", err)
+		}
+	}
+	for key, value := range map[string]string{"max_growth": config.DiskBudget.MaxGrowth, "max_size": config.DiskBudget.MaxSize} {
+		if value == "" {
+			continue
+		}
+		if _, err := units.FromHumanSize(value); err != nil {
+			return config, fmt.Errorf("invalid disk_budget.%s: %w", key, err)
+		}
+	}
+	if config.BuildCache.MaxAge < 0 {
+		return config, fmt.Errorf("build_cache.max_age must not be negative")
+	}
+	if config.BuildCache.FromRegistry {
+		if !config.BuildCache.Reuse {
+			return config, fmt.Errorf("build_cache.from_registry requires build_cache.reuse")
+		}
+		if len(config.Publish.AllTargets()) == 0 {
+			return config, fmt.Errorf("build_cache.from_registry requires a publish target")
+		}
+	}
+
+	for image, build := range map[string]ImageBuildConfig{"base": config.Build.Base, VARIANT_PREINSTALL: config.Build.Preinstall, VARIANT_GET5: config.Build.Get5, "checker": config.Build.Checker, "plugins": config.Build.Plugins.ImageBuildConfig, "repositories": config.Build.Repositories.ImageBuildConfig} {
+		if build.Dockerfile == "" || filepath.IsAbs(build.Dockerfile) || strings.HasPrefix(filepath.Clean(build.Dockerfile), "..") {
+			return config, fmt.Errorf("build.%s.dockerfile must be a path within the build context", image)
+		}
+	}
+	names := map[string]bool{"base": true, "checker": true, VARIANT_PREINSTALL: true, VARIANT_GET5: true}
+	for i := range config.Build.Variants {
+		variant := &config.Build.Variants[i]
+		if !variantPattern.MatchString(variant.Name) {
+			return config, fmt.Errorf("invalid build.variants name %q, expected lowercase letters, digits and dashes", variant.Name)
+		}
+		if names[variant.Name] {
+			return config, fmt.Errorf("build.variants name %q is used twice or by the watcher itself", variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.From == "" {
+			variant.From = VARIANT_PREINSTALL
+		}
+		if variant.From != VARIANT_PREINSTALL && variant.From != VARIANT_GET5 {
+			return config, fmt.Errorf("build.variants %s: unknown from %q, expected %s or %s", variant.Name, variant.From, VARIANT_PREINSTALL, VARIANT_GET5)
+		}
+		if variant.Dockerfile == "" || filepath.IsAbs(variant.Dockerfile) || strings.HasPrefix(filepath.Clean(variant.Dockerfile), "..") {
+			return config, fmt.Errorf("build.variants %s: dockerfile must be a path within the build context", variant.Name)
+		}
+	}
+	plugins := config.Build.Plugins
+	for key, version := range map[string]string{"metamod_version": plugins.MetamodVersion, "sourcemod_version": plugins.SourcemodVersion} {
+		if version != "" && !modVersionPattern.MatchString(version) {
+			return config, fmt.Errorf("invalid build.plugins.%s %q, expected a version like 1.11.0-git1148", key, version)
+		}
+	}
+	for _, plugin := range plugins.Plugins {
+		parsed, err := url.Parse(plugin.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.ContainsAny(plugin.URL, " \t\n") {
+			return config, fmt.Errorf("invalid build.plugins url %q, expected an http or https URL", plugin.URL)
+		}
+		if !strings.HasSuffix(parsed.Path, ".smx") && !strings.HasSuffix(parsed.Path, ".tar.gz") && !strings.HasSuffix(parsed.Path, ".tgz") {
+			return config, fmt.Errorf("build.plugins url %q is neither a .smx file nor a .tar.gz archive", plugin.URL)
+		}
+		if plugin.SHA256 != "" && !sha256Pattern.MatchString(plugin.SHA256) {
+			return config, fmt.Errorf("invalid build.plugins sha256 %q of %s, expected 64 lowercase hex digits", plugin.SHA256, plugin.URL)
+		}
+	}
+	if watch := plugins.Watch; watch.Enabled {
+		if watch.Interval <= 0 {
+			return config, fmt.Errorf("build.plugins.watch.interval must be positive")
+		}
+		if plugins.MetamodVersion != "" && plugins.SourcemodVersion != "" {
+			return config, fmt.Errorf("build.plugins.watch needs metamod_version or sourcemod_version unpinned")
+		}
+		for key, branch := range map[string]string{"metamod_branch": watch.MetamodBranch, "sourcemod_branch": watch.SourcemodBranch} {
+			if !modBranchPattern.MatchString(branch) {
+				return config, fmt.Errorf("invalid build.plugins.watch.%s %q, expected a branch like 1.11", key, branch)
+			}
+		}
+	}
+	if repositories := config.Build.Repositories; len(repositories.Git) > 0 && repositories.Interval <= 0 {
+		return config, fmt.Errorf("build.repositories.interval must be positive")
+	}
+	repositoryNames := map[string]bool{}
+	for i := range config.Build.Repositories.Git {
+		repository := &config.Build.Repositories.Git[i]
+		if !variantPattern.MatchString(repository.Name) {
+			return config, fmt.Errorf("invalid build.repositories name %q, expected lowercase letters, digits and dashes", repository.Name)
+		}
+		if repositoryNames[repository.Name] {
+			return config, fmt.Errorf("build.repositories name %q is used twice", repository.Name)
+		}
+		repositoryNames[repository.Name] = true
+		if repository.URL == "" {
+			return config, fmt.Errorf("build.repositories %s: url is required", repository.Name)
+		}
+		if err := (contextsource.Source{Git: repository.Git}).Validate(); err != nil {
+			return config, fmt.Errorf("build.repositories %s: %w", repository.Name, err)
+		}
+		if filepath.IsAbs(repository.Path) || strings.HasPrefix(filepath.Clean(repository.Path), "..") {
+			return config, fmt.Errorf("build.repositories %s: path must be within the game directory", repository.Name)
+		}
+		repository.SSHKey = expandHome(repository.SSHKey)
+		repository.KnownHosts = expandHome(repository.KnownHosts)
+	}
+	if cache := config.SteamCMDCache; cache.Volume != "" {
+		if cache.CacheMount {
+			return config, fmt.Errorf("steamcmd_cache.volume and steamcmd_cache.cache_mount are exclusive")
+		}
+		if config.Engine == engine.CONTAINERD {
+			return config, fmt.Errorf("steamcmd_cache.volume is not supported by the %s engine", config.Engine)
+		}
+	} else if cache.CacheMount {
+		// The cache is copied over the whole installation, there would be no small layer on top of a snapshot
+		if config.Build.Snapshot.Enabled {
+			return config, fmt.Errorf("steamcmd_cache.cache_mount and build.snapshot are exclusive")
+		}
+		// The classic builder behind the docker API has no cache mounts
+		if config.Engine == engine.DOCKER && !config.Build.BuildKit.Enabled() {
+			return config, fmt.Errorf("steamcmd_cache.cache_mount is not supported by the %s engine", config.Engine)
+		}
+		if config.Build.Preinstall.Dockerfile == DefaultOptions().Build.Preinstall.Dockerfile {
+			config.Build.Preinstall.Dockerfile = cacheMountDockerfile
+		}
+	}
+	for stage, hooks := range map[string][]HookConfig{
+		HOOK_PRE_CHECK:    config.Hooks.PreCheck,
+		HOOK_PRE_BUILD:    config.Hooks.PreBuild,
+		HOOK_POST_BUILD:   config.Hooks.PostBuild,
+		HOOK_POST_PUBLISH: config.Hooks.PostPublish,
+		HOOK_ON_FAILURE:   config.Hooks.OnFailure,
+	} {
+		for i := range hooks {
+			if hooks[i].Image == "" && len(hooks[i].Command) == 0 {
+				return config, fmt.Errorf("%s hook %d has neither command nor image", stage, i)
+			}
+			if hooks[i].Timeout < 0 {
+				return config, fmt.Errorf("timeout of %s hook %d must not be negative", stage, i)
+			}
+			if hooks[i].Timeout == 0 {
+				hooks[i].Timeout = defaultHookTimeout
+			}
+		}
+	}
+	if login := &config.SteamLogin; login.Username != "" {
+		if login.PasswordFile == "" {
+			return config, fmt.Errorf("steam_login.username requires steam_login.password_file")
+		}
+		if config.Engine != engine.CONTAINERD && !config.Build.BuildKit.Enabled() && config.Kubernetes.Build.Backend != kube.BACKEND_BUILDAH {
+			return config, fmt.Errorf("steam_login needs BuildKit secret mounts, which only the %s engine, build.buildkit and %s jobs build with", engine.CONTAINERD, kube.BACKEND_BUILDAH)
+		}
+		login.PasswordFile = expandHome(login.PasswordFile)
+		login.GuardSecretFile = expandHome(login.GuardSecretFile)
+		if config.SteamCMDCache.CacheMount {
+			return config, fmt.Errorf("steam_login and steamcmd_cache.cache_mount are exclusive")
+		}
+		if config.Build.Preinstall.Dockerfile == DefaultOptions().Build.Preinstall.Dockerfile {
+			config.Build.Preinstall.Dockerfile = loginDockerfile
+		}
+	}
+	if policy := config.ErrorPolicy; policy.NotifyAfter < 0 || policy.BackoffAfter < 0 || policy.ExitAfter < 0 || policy.StaleAfter < 0 {
+		return config, fmt.Errorf("error_policy thresholds must not be negative")
+	}
+	if config.ErrorPolicy.BackoffAfter > 0 && config.ErrorPolicy.MaxBackoff < config.CheckFrequency {
+		return config, fmt.Errorf("error_policy.max_backoff must be at least check_frequency")
+	}
+	if config.ErrorPolicy.StaleAfter > 0 && config.ErrorPolicy.StaleAfter < config.CheckFrequency {
+		return config, fmt.Errorf("error_policy.stale_after must be at least check_frequency")
+	}
+	if resources := config.Resources; resources.CPUs < 0 || resources.PidsLimit < 0 {
+		return config, fmt.Errorf("resources must not be negative")
+	}
+	if memory := config.Resources.Memory; memory != "" {
+		if _, err := units.RAMInBytes(memory); err != nil {
+			return config, fmt.Errorf("invalid resources.memory: %w", err)
+		}
+	}
+	if timeouts := config.Timeouts; timeouts.Helper < 0 || timeouts.Build < 0 || timeouts.Push < 0 {
+		return config, fmt.Errorf("timeouts must not be negative")
+	}
+	if config.WatchdogStall < 0 {
+		return config, fmt.Errorf("watchdog_stall must not be negative")
+	}
+	if err := config.Lock.validate(config.State); err != nil {
+		return config, err
+	}
+	for key, window := range map[string]string{"builds": config.Maintenance.Builds, "restarts": config.Maintenance.Restarts} {
+		if window != "" {
+			if _, err := rollout.ParseWindow(window); err != nil {
+				return config, fmt.Errorf("maintenance.%s: %w", key, err)
+			}
+		}
+	}
+	if config.PICS.Enabled {
+		if config.PICS.Interval <= 0 {
+			return config, fmt.Errorf("pics.interval must be positive")
+		}
+		if _, err := renderPICSURL(config.PICS.URL); err != nil {
+			return config, err
+		}
+	}
+	if _, err := notify.New(config.notifierConfigs()); err != nil {
+		return config, err
+	}
+	if err := config.validateEventStream(); err != nil {
+		return config, err
+	}
+	if _, err := pipeline.New(config.Pipelines); err != nil {
+		return config, err
+	}
+	if err := config.StateExport.validate(); err != nil {
+		return config, err
+	}
+	if err := config.Export.validate(config.Engine); err != nil {
+		return config, err
+	}
+	if err := config.Import.validate(config); err != nil {
+		return config, err
+	}
+	for _, schedule := range config.Triggers.Schedules {
+		if _, err := cron.ParseStandard(schedule.Cron); err != nil {
+			return config, fmt.Errorf("invalid triggers.schedules cron %q: %w", schedule.Cron, err)
+		}
+	}
+	for i := range config.Triggers.Files {
+		file := &config.Triggers.Files[i]
+		if file.Path == "" {
+			return config, fmt.Errorf("triggers.files path must not be empty")
+		}
+		file.Path = expandHome(file.Path)
+		if file.Interval == 0 {
+			file.Interval = 10 * time.Second
+		}
+		if file.Interval < 0 {
+			return config, fmt.Errorf("triggers.files %s: interval must be positive", file.Path)
+		}
+	}
+	if config.SmokeTest.Enabled {
+		if config.SmokeTest.Timeout <= 0 {
+			return config, fmt.Errorf("smoke_test.timeout must be positive")
+		}
+		if config.SmokeTest.Host == "" {
+			return config, fmt.Errorf("smoke_test.host must not be empty")
+		}
+		for _, name := range config.SmokeTest.Variants {
+			validVariant := false
+			for _, variant := range config.variantNames() {
+				validVariant = validVariant || variant == name
+			}
+			if !validVariant {
+				return config, fmt.Errorf("unknown smoke_test variant %q, expected one of %v", name, config.variantNames())
+			}
+		}
+	}
+	if snapshot := config.Build.Snapshot; snapshot.MaxUpdateSize != "" {
+		if _, err := units.FromHumanSize(snapshot.MaxUpdateSize); err != nil {
+			return config, fmt.Errorf("invalid build.snapshot.max_update_size: %w", err)
+		}
+	}
+	if config.Build.Snapshot.MaxAge < 0 {
+		return config, fmt.Errorf("build.snapshot.max_age must not be negative")
+	}
+	if config.Build.VerifyRetries < 0 {
+		return config, fmt.Errorf("build.verify_retries must not be negative")
+	}
+	if buildkit := &config.Build.BuildKit; buildkit.Enabled() {
+		if config.Engine == engine.CONTAINERD {
+			return config, fmt.Errorf("build.buildkit is not used by the %s engine, see containerd.buildkit_host", config.Engine)
+		}
+		// The volume is updated by a container on the watcher's host
+		if config.SteamCMDCache.Volume != "" {
+			return config, fmt.Errorf("build.buildkit and steamcmd_cache.volume are exclusive, see steamcmd_cache.cache_mount")
+		}
+		buildkit.TLS.CA = expandHome(buildkit.TLS.CA)
+		buildkit.TLS.Cert = expandHome(buildkit.TLS.Cert)
+		buildkit.TLS.Key = expandHome(buildkit.TLS.Key)
+		if err := buildkit.Validate(); err != nil {
+			return config, fmt.Errorf("build.buildkit.%w", err)
+		}
+	}
+	if _, err := name.NewTag(config.BaseImageName + ":" + config.Build.BaseTag); err != nil || config.Build.BaseTag == "" {
+		return config, fmt.Errorf("invalid build.base_tag %q", config.Build.BaseTag)
+	}
+	if config.Build.BaseTag == "snapshot" || config.Build.BaseTag == "checker" || strings.HasPrefix(config.Build.BaseTag, "temp-") {
+		return config, fmt.Errorf("build.base_tag %q is used by the watcher itself", config.Build.BaseTag)
+	}
+	if err := validateCheckMethod(config.CheckMethod); err != nil {
+		return config, err
+	}
+	if config.CheckerImage != "" {
+		if config.CheckMethod != CHECK_CHECKER {
+			return config, fmt.Errorf("checker_image needs check_method %s", CHECK_CHECKER)
+		}
+		if _, err := name.ParseReference(config.CheckerImage); err != nil {
+			return config, fmt.Errorf("invalid checker_image: %w", err)
+		}
+	}
+	if config.CheckMethod == CHECK_HTTP {
+		if _, err := renderPICSURL(config.PICS.URL); err != nil {
+			return config, err
+		}
+	}
+	config.ContainerFiles = expandHome(config.ContainerFiles)
+	if source := &config.ContainerSource; source.Enabled() {
+		if config.ContainerFiles != "" {
+			return config, fmt.Errorf("container_files and container_source are exclusive")
+		}
+		if err := source.Validate(); err != nil {
+			return config, fmt.Errorf("container_source: %w", err)
+		}
+		source.Cache = expandHome(source.Cache)
+		source.Git.SSHKey = expandHome(source.Git.SSHKey)
+		source.Git.KnownHosts = expandHome(source.Git.KnownHosts)
+	}
+	if err := config.Publish.validateMethods(config.Engine, config.variantNames()); err != nil {
+		return config, err
+	}
+	for i, target := range config.Publish.Targets {
+		if target.Repository == "" {
+			return config, fmt.Errorf("publish target %d has no repository", i)
+		}
+	}
+	for i, target := range config.Publish.Production {
+		if target.Repository == "" {
+			return config, fmt.Errorf("production target %d has no repository", i)
+		}
+	}
+	for key, window := range map[string]string{"push": config.Publish.Schedule.Push, "replicate": config.Publish.Schedule.Replicate} {
+		if window != "" {
+			if _, err := rollout.ParseWindow(window); err != nil {
+				return config, fmt.Errorf("publish.schedule.%s: %w", key, err)
+			}
+		}
+	}
+	if len(config.Publish.Production) > 0 && len(config.Publish.AllTargets()) == 0 {
+		return config, fmt.Errorf("production targets require a publish target to promote from")
+	}
+
+	for i, agent := range config.Fleet.Agents {
+		if agent.URL == "" {
+			return config, fmt.Errorf("fleet agent %d has no url", i)
+		}
+		if config.Fleet.Agents[i].Name == "" {
+			config.Fleet.Agents[i].Name = agent.URL
+		}
+	}
+	hostNames := map[string]bool{"local": true}
+	for _, agent := range config.Fleet.Agents {
+		hostNames[agent.Name] = true
+	}
+	for i := range config.Fleet.DockerHosts {
+		host := &config.Fleet.DockerHosts[i]
+		if host.Host == "" {
+			return config, fmt.Errorf("fleet docker host %d has no host", i)
+		}
+		if host.Name == "" {
+			host.Name = host.Host
+		}
+		if hostNames[host.Name] {
+			return config, fmt.Errorf("fleet docker host %s is configured twice, named like an agent or named local", host.Name)
+		}
+		hostNames[host.Name] = true
+		host.TLS.CA = expandHome(host.TLS.CA)
+		host.TLS.Cert = expandHome(host.TLS.Cert)
+		host.TLS.Key = expandHome(host.TLS.Key)
+		if err := host.Validate(); err != nil {
+			return config, fmt.Errorf("fleet docker host %s: %w", host.Name, err)
+		}
+	}
+	if (len(config.Fleet.Agents) > 0 || config.Fleet.Discovery.Enabled()) && config.Fleet.Token == "" {
+		return config, fmt.Errorf("fleet agents require fleet.token")
+	}
+	if tls := config.API.TLS; (tls.Cert == "") != (tls.Key == "") || (tls.ClientCA != "" && tls.Cert == "") {
+		return config, fmt.Errorf("api.tls requires cert and key, also with client_ca")
+	}
+	if tls := config.Fleet.TLS; tls.Enabled() && (tls.CA == "" || tls.Cert == "" || tls.Key == "") {
+		return config, fmt.Errorf("fleet.tls requires ca, cert and key")
+	}
+	if config.Rollout.MaxPlayers != nil && !config.Rollout.QueryPlayers {
+		return config, fmt.Errorf("rollout.max_players requires rollout.query_players")
+	}
+	if config.Rollout.DrainInterval <= 0 {
+		return config, fmt.Errorf("rollout.drain_interval must be positive")
+	}
+	for i, override := range config.Rollout.Overrides {
+		if override.Window != "" {
+			if _, err := rollout.ParseWindow(override.Window); err != nil {
+				return config, fmt.Errorf("rollout override %d: %w", i, err)
+			}
+		}
+	}
+
+	for _, workload := range config.Kubernetes.Workloads {
+		if err := workload.Validate(); err != nil {
+			return config, err
+		}
+	}
+	if len(config.Kubernetes.Workloads) > 0 && config.Kubernetes.RolloutTimeout <= 0 {
+		return config, fmt.Errorf("kubernetes.rollout_timeout must be positive")
+	}
+	if build := config.Kubernetes.Build; build.Enabled() {
+		if err := build.Validate(); err != nil {
+			return config, fmt.Errorf("kubernetes.build.%w", err)
+		}
+		if config.Build.BuildKit.Enabled() {
+			return config, fmt.Errorf("kubernetes.build and build.buildkit are exclusive")
+		}
+		// Every job starts without the installation of the last one
+		if config.SteamCMDCache.Volume != "" || config.SteamCMDCache.CacheMount {
+			return config, fmt.Errorf("steamcmd_cache is not supported by kubernetes.build")
+		}
+	}
+	for i, project := range config.Compose.Projects {
+		if project.File == "" {
+			return config, fmt.Errorf("compose project %d has no file", i)
+		}
+	}
+	for i := range config.GitOps.Repositories {
+		repository := &config.GitOps.Repositories[i]
+		repository.SSHKey = expandHome(repository.SSHKey)
+		repository.KnownHosts = expandHome(repository.KnownHosts)
+		for j := range repository.Files {
+			file := &repository.Files[j]
+			file.Template = expandHome(file.Template)
+			if targets := config.Publish.AllTargets(); file.Image == "" && len(targets) > 0 {
+				file.Image = targets[0].Repository
+			}
+		}
+		if err := gitops.Validate(*repository); err != nil {
+			return config, fmt.Errorf("gitops repository %d: %w", i, err)
+		}
+	}
+	if config.Swarm.Enabled && config.Engine != engine.DOCKER {
+		return config, fmt.Errorf("swarm services can only be updated through the %s engine", engine.DOCKER)
+	}
+	if err := config.validateChain(); err != nil {
+		return config, err
+	}
+	if config.SLO.Window <= 0 {
+		return config, fmt.Errorf("slo.window must be positive")
+	}
+
+	for _, restart := range config.Fleet.Restarts {
+		if _, err := cron.ParseStandard(restart.Schedule); err != nil {
+			return config, fmt.Errorf("invalid schedule of restart %s: %w", restart, err)
+		}
+	}
+	if len(config.Fleet.Restarts) > 0 && !config.Fleet.Enabled() {
+		return config, fmt.Errorf("fleet.restarts require fleet agents, docker hosts or fleet.local")
+	}
+	if config.Fleet.Enabled() && (config.Fleet.HealthInterval <= 0 || config.Fleet.Discovery.Interval <= 0) {
+		return config, fmt.Errorf("fleet.health_interval and fleet.discovery.interval must be positive")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/store"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// The operator reconciles GameServerImages instead of checking Steam, there are no checks to trigger or pause
+var ErrNotWatching = errors.New("the operator does not check Steam on its own")
+
+// What a running watcher is doing, for the control APIs
+type Status struct {
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"started_at"`
+	// Paused watchers skip checks and builds
+	Paused bool `json:"paused"`
+	// Whether this watcher holds the lock, always true without lock.driver
+	Leading bool `json:"leading"`
+	// The last check of Steam, zero before the first
+	LastCheck store.Check `json:"last_check"`
+	// Buildid detected on Steam that was not built yet, 0 if none
+	Detected int `json:"detected"`
+	// A build was requested with TriggerBuild and did not start yet
+	BuildRequested bool `json:"build_requested"`
+	// Time until the next check, longer while degraded. Empty if the watcher does not check on a schedule.
+	CheckInterval string `json:"check_interval,omitempty"`
+	// Work in progress by kind, with when it started
+	InFlight     map[string]time.Time `json:"in_flight"`
+	Checks       int                  `json:"checks"`
+	FailedChecks int                  `json:"failed_checks"`
+	Builds       int                  `json:"builds"`
+	FailedBuilds int                  `json:"failed_builds"`
+}
+
+// Status of the watcher, safe to call while it runs
+func (this *UpdateWatcher) Status() Status {
+	this.stats.mutex.Lock()
+	status := Status{
+		Version:      Version,
+		StartedAt:    this.stats.startedAt,
+		Leading:      this.lock == nil || this.stats.leading,
+		LastCheck:    this.stats.lastCheck,
+		Detected:     this.stats.detected,
+		InFlight:     map[string]time.Time{},
+		Checks:       this.stats.checks,
+		FailedChecks: this.stats.failedChecks,
+		Builds:       this.stats.builds,
+		FailedBuilds: this.stats.failedBuilds,
+	}
+	for kind, startedAt := range this.stats.inFlight {
+		status.InFlight[kind] = startedAt
+	}
+	if this.stats.interval > 0 {
+		status.CheckInterval = this.stats.interval.String()
+	}
+	this.stats.mutex.Unlock()
+
+	this.controlMutex.Lock()
+	status.Paused, status.BuildRequested = this.paused, this.buildRequested
+	this.controlMutex.Unlock()
+	return status
+}
+
+// TriggerCheck checks Steam right away, unless paused or a check is already pending
+func (this *UpdateWatcher) TriggerCheck(reason string) error {
+	if this.operator != nil {
+		return ErrNotWatching
+	}
+	log.Info().Str("reason", reason).Msg("Check requested")
+	this.requestCheck(reason)
+	return nil
+}
+
+// TriggerBuild builds on the next check even if the newest build is up to date, and checks right away. The build
+// still waits for maintenance.builds and the build limits.
+func (this *UpdateWatcher) TriggerBuild(reason string) error {
+	if this.operator != nil {
+		return ErrNotWatching
+	}
+	log.Info().Str("reason", reason).Msg("Build requested")
+	this.requestBuild(reason)
+	return nil
+}
+
+// Build on the next check even if the newest build is up to date, and check right away
+func (this *UpdateWatcher) requestBuild(reason string) {
+	this.controlMutex.Lock()
+	this.buildRequested = true
+	this.controlMutex.Unlock()
+	this.requestCheck("build requested: " + reason)
+}
+
+// Pause skips checks and builds until Resume is called. A build in progress finishes, rollouts have a pause of
+// their own.
+func (this *UpdateWatcher) Pause() error {
+	if this.operator != nil {
+		return ErrNotWatching
+	}
+	this.controlMutex.Lock()
+	defer this.controlMutex.Unlock()
+	if !this.paused {
+		log.Warn().Msg("Paused checks and builds")
+	}
+	this.paused = true
+	return nil
+}
+
+// Resume checks right away after Pause
+func (this *UpdateWatcher) Resume() error {
+	if this.operator != nil {
+		return ErrNotWatching
+	}
+	this.controlMutex.Lock()
+	wasPaused := this.paused
+	this.paused = false
+	this.controlMutex.Unlock()
+	if wasPaused {
+		log.Info().Msg("Resumed checks and builds")
+		this.requestCheck("resumed")
+	}
+	return nil
+}
+
+func (this *UpdateWatcher) isPaused() bool {
+	this.controlMutex.Lock()
+	defer this.controlMutex.Unlock()
+	return this.paused
+}
+
+// Whether a build was requested with TriggerBuild and did not start yet
+func (this *UpdateWatcher) buildPending() bool {
+	this.controlMutex.Lock()
+	defer this.controlMutex.Unlock()
+	return this.buildRequested
+}
+
+// The requested build started
+func (this *UpdateWatcher) clearBuildRequest() {
+	this.controlMutex.Lock()
+	defer this.controlMutex.Unlock()
+	this.buildRequested = false
+}
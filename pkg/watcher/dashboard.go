@@ -0,0 +1,153 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/fleet"
+	"csgo-update-watcher/pkg/rollout"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": formatTime,
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CS:GO update watcher</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.healthy { color: #080; }
+.unhealthy { color: #c00; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>CS:GO update watcher</h1>
+
+{{if .FleetEnabled}}
+<h2>Fleet</h2>
+<table>
+<tr><th>Host</th><th>Source</th><th>Status</th><th>Last seen</th><th>Servers</th><th>Error</th></tr>
+{{range .Hosts}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Source}}</td>
+{{if .Healthy}}<td class="healthy">healthy</td>{{else}}<td class="unhealthy">unhealthy</td>{{end}}
+<td>{{ago .LastSeen}}</td>
+<td>{{if .Report}}{{len .Report.Servers}}{{end}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{else}}
+<tr><td colspan="6">No hosts</td></tr>
+{{end}}
+</table>
+{{end}}
+
+{{with .Rollout}}
+<h2>{{if eq .Kind "restart"}}Restart{{else}}Rollout{{end}}</h2>
+<p>
+{{.State}}, started {{time .StartedAt}}{{if not .FinishedAt.IsZero}}, finished {{time .FinishedAt}}{{end}}
+{{if and .Active $.Controls}}
+{{if eq .State "paused"}}<form method="post" action="/rollout/resume"><button>Resume</button></form>{{else if eq .State "running"}}<form method="post" action="/rollout/pause"><button>Pause</button></form>{{end}}
+{{if ne .State "aborting"}}<form method="post" action="/rollout/abort"><button>Abort</button></form>{{end}}
+{{end}}
+</p>
+<table>
+<tr><th>Targets</th><th>Servers</th><th>Updated</th><th>Pending</th><th>Draining</th><th>Failed</th><th>Skipped</th></tr>
+<tr>
+<td>{{.Targets}}</td>
+<td>{{.Total}}</td>
+<td class="healthy">{{.Updated}}</td>
+<td>{{.Pending}}</td>
+<td>{{len .Draining}}</td>
+<td{{if .Failed}} class="unhealthy"{{end}}>{{.Failed}}</td>
+<td>{{.Skipped}}</td>
+</tr>
+</table>
+{{with .Current}}<p>Restarting {{.Server.Name}} on {{.Target}} with {{.Image}}</p>{{end}}
+{{if .Draining}}
+<table>
+<tr><th>Target</th><th>Server</th><th>Waiting for</th><th>Players</th></tr>
+{{range .Draining}}
+<tr>
+<td>{{.Target}}</td>
+<td>{{.Server.Name}}</td>
+<td>{{if eq .Gate "match"}}match to end ({{.Server.Match}}){{else if eq .Gate "window"}}restart window {{.Window}}{{else}}players to leave{{end}}</td>
+<td>{{if .Server.Players}}{{.Server.Players}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+
+{{if .HistoryEnabled}}
+<h2>Recent builds</h2>
+<table>
+<tr><th>Buildid</th><th>Host</th><th>Detected</th><th>Finished</th><th>Outcome</th><th>Error</th></tr>
+{{range .Builds}}
+<tr>
+<td>{{$buildid := .Buildid}}{{with .Links}}{{if .Build}}<a href="{{.Build}}">{{$buildid}}</a>{{else}}{{$buildid}}{{end}}{{with .Branch}} (<a href="{{.}}">depots</a>){{end}}{{else}}{{$buildid}}{{end}}</td>
+<td>{{.Host}}</td>
+<td>{{time .DetectedAt}}</td>
+<td>{{time .FinishedAt}}</td>
+<td>{{.Outcome}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{else}}
+<tr><td colspan="6">No builds</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+type dashboardData struct {
+	FleetEnabled   bool
+	Hosts          []fleet.HostStatus
+	Rollout        *rollout.Progress
+	HistoryEnabled bool
+	Builds         []HistoryEntry
+	// Whether the rollout buttons work, browsers only send the admin credentials of client certificates
+	Controls bool
+}
+
+// GET /
+func (this *UpdateWatcher) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := dashboardData{
+		FleetEnabled:   this.orchestrator != nil,
+		HistoryEnabled: this.history != nil,
+		Controls:       this.authorizedControl(r),
+	}
+	if data.FleetEnabled {
+		data.Hosts = this.fleetMonitor.Statuses()
+		data.Rollout = this.orchestrator.Progress()
+	}
+	if data.HistoryEnabled {
+		builds, err := this.History(20, 0, "")
+		if err != nil {
+			log.Err(err).Msg("Failed to read build history")
+		}
+		data.Builds = builds
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Err(err).Msg("Failed to render dashboard")
+	}
+}
@@ -0,0 +1,105 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/notify"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-units"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// The local images tagged with base_image_name. Engines measuring disk usage report the bytes each image shares
+// with others, the others leave SharedSize at -1.
+func (this *UpdateWatcher) repositoryImages() ([]types.ImageSummary, error) {
+	var images []types.ImageSummary
+	if cache, ok := this.dockerCli.(engine.BuildCache); ok {
+		usage, err := cache.DiskUsage(this.ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range usage.Images {
+			images = append(images, *image)
+		}
+	} else {
+		listed, err := this.dockerCli.ImageList(this.ctx, types.ImageListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		images = listed
+	}
+
+	repository := []types.ImageSummary{}
+	for _, image := range images {
+		if len(this.repositoryTags(image)) > 0 {
+			repository = append(repository, image)
+		}
+	}
+	return repository, nil
+}
+
+func (this *UpdateWatcher) repositoryTags(image types.ImageSummary) []string {
+	tags := []string{}
+	for _, tag := range image.RepoTags {
+		if strings.HasPrefix(tag, this.BaseImageName+":") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Disk usage of images: the bytes of each image only it uses, plus the shared bytes once. Layers shared by the
+// images build on the same snapshot or base image, so the largest share is what they have in common. Without
+// shared sizes every image counts in full.
+func diskUsage(images []types.ImageSummary) int64 {
+	usage, shared := int64(0), int64(0)
+	for _, image := range images {
+		if image.SharedSize <= 0 {
+			usage += image.Size
+			continue
+		}
+		usage += image.Size - image.SharedSize
+		if image.SharedSize > shared {
+			shared = image.SharedSize
+		}
+	}
+	return usage + shared
+}
+
+// Measure the images of the repository after a build and warn when they use more than disk_budget allows
+func (this *UpdateWatcher) measureImages() {
+	images, err := this.repositoryImages()
+	if err != nil {
+		log.Err(err).Msg("Failed to measure images")
+		return
+	}
+	metrics.ImageBytes.Reset()
+	for _, image := range images {
+		for _, tag := range this.repositoryTags(image) {
+			metrics.ImageBytes.WithLabelValues(tag).Set(float64(image.Size))
+		}
+	}
+	usage := diskUsage(images)
+	metrics.RepositoryBytes.Set(float64(usage))
+	previous := this.repositoryBytes
+	this.repositoryBytes = usage
+	log.Debug().Int("images", len(images)).Str("usage", units.HumanSize(float64(usage))).Msg("Measured images")
+
+	budget := this.options.DiskBudget
+	// Validated when loading the config
+	if maxSize, _ := units.FromHumanSize(budget.MaxSize); maxSize > 0 && usage > maxSize {
+		log.Warn().Str("usage", units.HumanSize(float64(usage))).Str("budget", budget.MaxSize).Msg("Images exceed disk budget")
+		this.notifyInBackground(notify.EVENT_WARNING, 0, fmt.Sprintf("Images of %s use %s, more than the disk budget of %s", this.BaseImageName, units.HumanSize(float64(usage)), budget.MaxSize))
+	}
+	if previous < 0 {
+		return
+	}
+	growth := usage - previous
+	metrics.RepositoryGrowthBytes.Set(float64(growth))
+	if maxGrowth, _ := units.FromHumanSize(budget.MaxGrowth); maxGrowth > 0 && growth > maxGrowth {
+		log.Warn().Str("growth", units.HumanSize(float64(growth))).Str("budget", budget.MaxGrowth).Msg("Build grew images beyond disk budget")
+		this.notifyInBackground(notify.EVENT_WARNING, 0, fmt.Sprintf("The last build grew the images of %s by %s, more than the budget of %s", this.BaseImageName, units.HumanSize(float64(growth)), budget.MaxGrowth))
+	}
+}
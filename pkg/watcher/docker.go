@@ -0,0 +1,14 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+)
+
+// The mock for tests is generated with mockgen v1.6.0 (go install github.com/golang/mock/mockgen@v1.6.0)
+//go:generate mockgen -destination=mocks/docker.go -package=mocks csgo-update-watcher/pkg/watcher DockerClient
+
+// DockerClient is every docker API call the watcher makes, implemented by the clients of engine.Connect. The calls of
+// the local rollout target are included, so the same client can restart the game servers on the watcher's host.
+type DockerClient interface {
+	engine.Client
+}
@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/docker/docker/pkg/fileutils"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Read the .dockerignore of the context directory like the docker CLI, nil without one
+func readDockerignore(dir string) (*fileutils.PatternMatcher, error) {
+	file, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+	defer file.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		exclusion := strings.HasPrefix(pattern, "!")
+		if exclusion {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		// Patterns are relative to the context, with or without a leading slash
+		pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "/")
+		if pattern == "" || pattern == "." {
+			continue
+		}
+		if exclusion {
+			pattern = "!" + pattern
+		}
+		patterns = append(patterns, filepath.FromSlash(pattern))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+	matcher, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid .dockerignore: %w", err)
+	}
+	return matcher, nil
+}
+
+// Whether a path of the context directory is left out of the build context. The .dockerignore and the Dockerfiles,
+// the configured ones along with the directories they are in, are always sent, the engine needs them.
+func ignored(matcher *fileutils.PatternMatcher, dockerfiles []string, name string) (bool, error) {
+	if matcher == nil || name == ".dockerignore" || (!strings.Contains(name, "/") && strings.HasPrefix(name, "Dockerfile")) {
+		return false, nil
+	}
+	for _, dockerfile := range dockerfiles {
+		dockerfile = strings.TrimPrefix(path.Clean(filepath.ToSlash(dockerfile)), "/")
+		if name == dockerfile || strings.HasPrefix(dockerfile, name+"/") {
+			return false, nil
+		}
+	}
+	return matcher.Matches(name)
+}
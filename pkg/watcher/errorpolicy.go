@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/notify"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"time"
+)
+
+// Count a failed check or build. Returns err if the watcher should stop on it.
+func (this *UpdateWatcher) failed(err error) error {
+	policy := this.options.ErrorPolicy
+	this.failures++
+	metrics.ConsecutiveFailures.Set(float64(this.failures))
+	if this.options.StopOnError || this.options.Once || (policy.ExitAfter > 0 && this.failures >= policy.ExitAfter) {
+		log.Error().Int("failures", this.failures).Msg("Stopping after consecutive failures")
+		return err
+	}
+	if policy.NotifyAfter > 0 && this.failures == policy.NotifyAfter {
+		this.notifyInBackground(notify.EVENT_WARNING, 0, strconv.Itoa(this.failures)+" checks or builds failed in a row, the last with: "+err.Error())
+	}
+	if policy.BackoffAfter > 0 && this.failures == policy.BackoffAfter {
+		log.Warn().Int("failures", this.failures).Msg("Degraded, backing off between checks")
+		metrics.Degraded.Set(1)
+	}
+	return nil
+}
+
+// A check or build succeeded, the watcher recovered if it failed before
+func (this *UpdateWatcher) succeeded() {
+	policy := this.options.ErrorPolicy
+	if this.failures == 0 {
+		return
+	}
+	log.Info().Int("failures", this.failures).Msg("Recovered after consecutive failures")
+	if policy.NotifyAfter > 0 && this.failures >= policy.NotifyAfter {
+		this.notifyInBackground(notify.EVENT_WARNING, 0, "Recovered after "+strconv.Itoa(this.failures)+" failed checks or builds")
+	}
+	this.failures = 0
+	metrics.ConsecutiveFailures.Set(0)
+	metrics.Degraded.Set(0)
+}
+
+// Time until the next check, check_frequency unless degraded
+func (this *UpdateWatcher) checkInterval() time.Duration {
+	policy := this.options.ErrorPolicy
+	interval := this.checkFrequency
+	if policy.BackoffAfter == 0 || this.failures < policy.BackoffAfter {
+		return interval
+	}
+	for i := policy.BackoffAfter; i <= this.failures && interval < policy.MaxBackoff; i++ {
+		interval *= 2
+	}
+	if interval > policy.MaxBackoff {
+		interval = policy.MaxBackoff
+	}
+	return interval
+}
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/compose"
+	"csgo-update-watcher/pkg/export"
+	"csgo-update-watcher/pkg/gitops"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/pipeline"
+	"csgo-update-watcher/pkg/rollout"
+	"csgo-update-watcher/pkg/swarm"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Events buffered for a slow reader, further events are dropped until it caught up
+const eventBuffer = 64
+
+// Kinds of events
+const (
+	// Steam was checked for a new version
+	EVENT_CHECK = "check"
+	// Steam released a version newer than the newest build
+	EVENT_NEW_VERSION = "new-version"
+	// A build finished, successfully or not
+	EVENT_BUILD = "build"
+	// A rollout or scheduled restart finished
+	EVENT_ROLLOUT = "rollout"
+	// The Kubernetes workloads were updated to a new build
+	EVENT_KUBERNETES = "kubernetes"
+	// The compose projects were redeployed with a new build
+	EVENT_COMPOSE = "compose"
+	// The tags of a new build were committed to the gitops repositories
+	EVENT_GITOPS = "gitops"
+	// The swarm services were updated to a new build
+	EVENT_SWARM = "swarm"
+	// The images of a new build were exported
+	EVENT_EXPORT = "export"
+	// An archive of another watcher's export was loaded in import mode, successfully or not
+	EVENT_IMPORT = "import"
+	// The CI pipelines of a new build were started
+	EVENT_PIPELINES = "pipelines"
+	// Phases of a build that waited for their publish.schedule window were published
+	EVENT_PUBLISH = "publish"
+	// A build was refused since build_limit was reached
+	EVENT_BUILD_LIMIT = "build-limit"
+	// Steam was not checked successfully for error_policy.stale_after, or answered again after that
+	EVENT_STEAM_STALE = "steam-stale"
+)
+
+var eventTypes = []string{
+	EVENT_CHECK,
+	EVENT_NEW_VERSION,
+	EVENT_BUILD,
+	EVENT_ROLLOUT,
+	EVENT_KUBERNETES,
+	EVENT_COMPOSE,
+	EVENT_GITOPS,
+	EVENT_SWARM,
+	EVENT_EXPORT,
+	EVENT_IMPORT,
+	EVENT_PIPELINES,
+	EVENT_PUBLISH,
+	EVENT_BUILD_LIMIT,
+	EVENT_STEAM_STALE,
+}
+
+func EventTypes() []string {
+	return append([]string{}, eventTypes...)
+}
+
+func isEventType(name string) bool {
+	for _, kind := range eventTypes {
+		if name == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Something the watcher did, received from Events
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Steam buildid of a check or new version, the buildid of a build or rollout
+	Buildid int `json:"buildid,omitempty"`
+	// Newest buildid built so far, for checks and new versions
+	LocalBuildid int `json:"local_buildid,omitempty"`
+	// Where to look up the changes of Buildid
+	Links *Links `json:"links,omitempty"`
+	// Local and pushed images of a build, the images of a rollout
+	Images []string `json:"images,omitempty"`
+	// Restarted servers of a rollout
+	Results []rollout.Result `json:"results,omitempty"`
+	// Updated Kubernetes workloads
+	Workloads []kube.Result `json:"workloads,omitempty"`
+	// Redeployed compose projects
+	Compose []compose.Result `json:"compose,omitempty"`
+	// Commits to the gitops repositories
+	GitOps []gitops.Result `json:"gitops,omitempty"`
+	// Updated swarm services
+	Swarm []swarm.Result `json:"swarm,omitempty"`
+	// Archive of an export or import
+	Export *export.Result `json:"export,omitempty"`
+	// Started CI pipelines
+	Pipelines []pipeline.Result `json:"pipelines,omitempty"`
+	Err       error             `json:"-"`
+	// Message of Err, filled in on emit
+	Error string `json:"error,omitempty"`
+}
+
+// Events returns the channel of everything the watcher does. Reading it is optional: events are dropped instead of
+// blocking the watcher while the channel is full. It is closed by Stop.
+func (this *UpdateWatcher) Events() <-chan Event {
+	return this.events
+}
+
+func (this *UpdateWatcher) emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Links == nil {
+		event.Links = this.links(event.Buildid, event.LocalBuildid)
+	}
+	if event.Err != nil {
+		event.Error = event.Err.Error()
+	}
+	this.streamEvent(event)
+	select {
+	case this.events <- event:
+	default:
+		log.Debug().Str("event", event.Type).Msg("Dropped event, nobody is reading them")
+	}
+}
@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/eventstream"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+// How long Stop waits for the brokers to take the remaining events
+const streamCloseTimeout = 10 * time.Second
+
+// An event as published to event_stream
+type streamedEvent struct {
+	Event
+	// Tells the watchers sharing a subject or topic apart
+	Host string `json:"host"`
+}
+
+func (this Options) validateEventStream() error {
+	if err := this.EventStream.Validate(); err != nil {
+		return err
+	}
+	for _, kind := range this.EventStream.Events {
+		if !isEventType(kind) {
+			return fmt.Errorf("unknown event_stream.events type %q, expected one of %v", kind, eventTypes)
+		}
+	}
+	return nil
+}
+
+// Connect to the brokers of event_stream, nil without any
+func newEventStream(options Options) (*eventstream.Stream, string, error) {
+	if !options.EventStream.Enabled() {
+		return nil, "", nil
+	}
+	host := options.State.Host
+	if host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get hostname for the event stream, set state.host: %w", err)
+		}
+		host = hostname
+	}
+	stream, err := eventstream.Open(options.EventStream)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Info().Strs("sinks", stream.Names()).Msg("Streaming events")
+	return stream, host, nil
+}
+
+func (this *UpdateWatcher) streamEvent(event Event) {
+	if this.eventStream == nil {
+		return
+	}
+	data, err := json.Marshal(streamedEvent{event, this.streamHost})
+	if err != nil {
+		log.Err(err).Str("event", event.Type).Msg("Failed to encode streamed event")
+		return
+	}
+	this.eventStream.Send(eventstream.Message{Type: event.Type, Key: this.streamHost, Data: data})
+}
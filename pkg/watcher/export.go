@@ -0,0 +1,96 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/export"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/rs/zerolog/log"
+	"strconv"
+)
+
+// The docker API saves images, so does podman's
+var _ export.DockerClient = &client.Client{}
+
+func init() {
+	registerStep(STEP_EXPORT, func(options Options) bool {
+		return options.Export.Enabled()
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.exportImages)
+	})
+}
+
+// Save the images of the build into an archive of export, for hosts without a registry. The local images are saved
+// from the engine, the pushed ones are copied from the registry. Returns whether the archive was written.
+func (this *UpdateWatcher) exportImages(images []string) bool {
+	local := []string{}
+	for _, image := range images {
+		pushed := registry.RepositoryOf(image) != this.BaseImageName
+		if pushed == (this.exporter.Source() == export.SOURCE_REGISTRY) {
+			local = append(local, image)
+		}
+	}
+	if len(local) == 0 {
+		log.Debug().Strs("images", images).Str("source", this.exporter.Source()).Msg("No images to export")
+		return true
+	}
+	buildid, _ := this.buildidOf(local[0])
+	if this.options.Rollout.DryRun {
+		log.Info().Strs("images", local).Str("destination", this.exporter.Destination().String()).Msg("Dry run, not exporting images")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would export buildid "+strconv.Itoa(buildid)+" to "+this.exporter.Destination().String())
+		return false
+	}
+
+	result, err := this.exporter.Export(this.ctx, buildid, local)
+	if err != nil {
+		result.Err, result.Error = err, err.Error()
+	}
+	this.emit(Event{Type: EVENT_EXPORT, Buildid: buildid, Images: local, Export: &result, Err: err})
+	if err != nil {
+		log.Err(err).Int("buildid", buildid).Msg("Failed to export images")
+		this.notify(notify.EVENT_DEPLOYED, buildid, "Failed to export buildid "+strconv.Itoa(buildid)+": "+err.Error())
+		return false
+	}
+	log.Info().Str("archive", result.Archive).Str("size", units.HumanSize(float64(result.Size))).Strs("removed", result.Removed).Msg("Exported images")
+	this.notify(notify.EVENT_DEPLOYED, buildid, "Exported buildid "+strconv.Itoa(buildid)+" to "+result.Archive)
+	return true
+}
+
+func (this ExportConfig) validate(engineName string) error {
+	if !this.Enabled() {
+		return nil
+	}
+	if this.Directory != "" && this.S3.Enabled() {
+		return fmt.Errorf("export.directory and export.s3 cannot both be set")
+	}
+	if err := this.options().Validate(); err != nil {
+		return fmt.Errorf("export.%w", err)
+	}
+	if engineName == engine.CONTAINERD && this.Source == export.SOURCE_ENGINE {
+		return fmt.Errorf("export needs to save images, which the %s engine cannot, set export.source %s", engineName, export.SOURCE_REGISTRY)
+	}
+	return this.S3.Validate("export.s3")
+}
+
+func newExporter(config ExportConfig, dockerCli DockerClient, keychain authn.Keychain) (*export.Exporter, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	docker, ok := dockerCli.(export.DockerClient)
+	if !ok && config.Source == export.SOURCE_ENGINE {
+		return nil, fmt.Errorf("the container engine cannot save images for export")
+	}
+	var destination export.Destination = export.Directory(expandHome(config.Directory))
+	if config.S3.Enabled() {
+		bucket, err := export.NewBucket(config.S3)
+		if err != nil {
+			return nil, err
+		}
+		destination = bucket
+	}
+	return export.NewExporter(docker, keychain, destination, config.options()), nil
+}
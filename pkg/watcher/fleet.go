@@ -0,0 +1,474 @@
+package watcher
+
+import (
+	"crypto/tls"
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/fleet"
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/rollout"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrFleetDisabled = errors.New("fleet mode is disabled, configure fleet.local, fleet.agents, fleet.docker_hosts or fleet.discovery")
+
+// A client of a docker host of fleet.docker_hosts
+type dockerHost struct {
+	name   string
+	client engine.Client
+}
+
+// Create the clients of the docker hosts, nothing is connected to until the first rollout or health check
+func connectDockerHosts(configs []DockerHostConfig) ([]dockerHost, error) {
+	hosts := []dockerHost{}
+	for _, config := range configs {
+		client, err := engine.Connect(engine.DOCKER, engine.ContainerdOptions{}, config.DockerOptions)
+		if err != nil {
+			return nil, fmt.Errorf("fleet docker host %s: %w", config.Name, err)
+		}
+		hosts = append(hosts, dockerHost{config.Name, client})
+	}
+	return hosts, nil
+}
+
+// Repositories the watcher builds or publishes to, containers of any other image are never touched
+func managedRepositories(config Options) []string {
+	repositories := []string{config.BaseImageName}
+	seen := map[string]bool{config.BaseImageName: true}
+	targets := append(config.Publish.AllTargets(), config.Publish.Production...)
+	for _, target := range targets {
+		if !seen[target.Repository] {
+			seen[target.Repository] = true
+			repositories = append(repositories, target.Repository)
+		}
+	}
+	return repositories
+}
+
+// Rebuild the rollout targets from the configured agents and the discovery sources. A failing source is logged and
+// skipped, hosts configured explicitly take precedence over discovered ones with the same name.
+func (this *UpdateWatcher) refreshFleet() {
+	repositories := managedRepositories(this.options)
+	fleetConfig := this.options.Fleet
+
+	// Certificates are loaded again on every refresh, so renewed certificates are picked up
+	var tlsConfig *tls.Config
+	endpoint := fleet.Endpoint{Scheme: "http", Port: fleetConfig.Discovery.AgentPort}
+	if fleetConfig.TLS.Enabled() {
+		var err error
+		if tlsConfig, err = fleet.ClientTLSConfig(fleetConfig.TLS.Files()); err != nil {
+			log.Err(err).Msg("Failed to load fleet certificates, keeping the current fleet")
+			return
+		}
+		endpoint.Scheme = "https"
+	}
+
+	hosts := []fleet.Host{}
+	for _, agent := range fleetConfig.Agents {
+		hosts = append(hosts, fleet.Host{Name: agent.Name, URL: agent.URL, Source: "config"})
+	}
+
+	discovery := fleetConfig.Discovery
+	sources := []struct {
+		enabled  bool
+		name     string
+		discover func() ([]fleet.Host, error)
+	}{
+		{discovery.DockerContexts, "docker contexts", func() ([]fleet.Host, error) {
+			return fleet.DiscoverDockerContexts(registry.DockerConfigDir(this.options.DockerConfig), endpoint)
+		}},
+		{discovery.SSHConfig != "", "ssh config", func() ([]fleet.Host, error) {
+			return fleet.DiscoverSSHConfig(expandHome(discovery.SSHConfig), endpoint)
+		}},
+		{discovery.Inventory != "", "inventory", func() ([]fleet.Host, error) {
+			return fleet.DiscoverInventory(expandHome(discovery.Inventory), discovery.InventoryGroup, endpoint)
+		}},
+	}
+	for _, source := range sources {
+		if !source.enabled {
+			continue
+		}
+		discovered, err := source.discover()
+		if err != nil {
+			log.Err(err).Str("source", source.name).Msg("Failed to discover fleet hosts")
+			continue
+		}
+		hosts = append(hosts, discovered...)
+	}
+
+	targets := []rollout.Target{}
+	this.fleetSources = map[string]string{}
+	if fleetConfig.Local || fleetConfig.Labelled {
+		local := rollout.NewDockerTarget("local", this.dockerCli, this.registryAuth, repositories)
+		local.OnlyLabelled(fleetConfig.Labelled)
+		local.QueryPlayers(this.options.Rollout.QueryPlayers)
+		local.QueryMatches(this.options.Rollout.MatchState, this.options.Rollout.RconPassword)
+		targets = append(targets, fleet.Local{DockerTarget: local})
+		this.fleetSources["local"] = "local"
+	}
+	for _, host := range this.dockerHosts {
+		target := rollout.NewDockerTarget(host.name, host.client, this.registryAuth, repositories)
+		target.QueryPlayers(this.options.Rollout.QueryPlayers)
+		target.QueryMatches(this.options.Rollout.MatchState, this.options.Rollout.RconPassword)
+		targets = append(targets, fleet.DockerHost{DockerTarget: target})
+		this.fleetSources[host.name] = "docker"
+	}
+	for _, host := range hosts {
+		if _, ok := this.fleetSources[host.Name]; ok {
+			continue
+		}
+		client := fleet.NewClient(host.Name, host.URL, fleetConfig.Token, repositories, tlsConfig)
+		client.QueryPlayers(this.options.Rollout.QueryPlayers)
+		client.QueryMatches(this.options.Rollout.MatchState)
+		targets = append(targets, client)
+		this.fleetSources[host.Name] = host.Source
+	}
+
+	log.Debug().Int("hosts", len(targets)).Msg("Refreshed fleet")
+	this.orchestrator.SetTargets(targets)
+}
+
+// Periodically rediscover the fleet and check the health of every host
+func (this *UpdateWatcher) watchFleet() {
+	healthTicker := time.NewTicker(this.options.Fleet.HealthInterval)
+	defer healthTicker.Stop()
+	discoveryTicker := time.NewTicker(this.options.Fleet.Discovery.Interval)
+	defer discoveryTicker.Stop()
+
+	this.checkFleetHealth()
+	for {
+		select {
+		case <-healthTicker.C:
+			this.checkFleetHealth()
+		case <-discoveryTicker.C:
+			this.refreshFleet()
+		case <-this.ctx.Done():
+			return
+		}
+	}
+}
+
+func (this *UpdateWatcher) checkFleetHealth() {
+	this.fleetMonitor.Check(this.ctx, this.orchestrator.Targets(), this.fleetSources)
+
+	metrics.FleetHostUp.Reset()
+	metrics.FleetHostLastSeen.Reset()
+	metrics.FleetHostServers.Reset()
+	for _, status := range this.fleetMonitor.Statuses() {
+		up := 0.0
+		if status.Healthy {
+			up = 1
+		}
+		metrics.FleetHostUp.WithLabelValues(status.Name, status.Source).Set(up)
+		if !status.LastSeen.IsZero() {
+			metrics.FleetHostLastSeen.WithLabelValues(status.Name).Set(float64(status.LastSeen.Unix()))
+		}
+		if status.Report != nil {
+			metrics.FleetHostServers.WithLabelValues(status.Name).Set(float64(len(status.Report.Servers)))
+		}
+		if !status.Healthy {
+			log.Warn().Str("host", status.Name).Str("error", status.Error).Msg("Fleet host is unhealthy")
+		}
+	}
+}
+
+// Expand a leading ~/ to the home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+func init() {
+	registerStep(STEP_FLEET, func(options Options) bool {
+		return options.Fleet.Enabled()
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.rollout)
+	})
+}
+
+// Restart every game server in the fleet running an older build of one of the images. Returns whether the fleet
+// runs the images now.
+func (this *UpdateWatcher) rollout(images []string) bool {
+	if this.orchestrator == nil {
+		return false
+	}
+
+	if this.options.Rollout.DryRun {
+		steps, err := this.orchestrator.DryRun(this.ctx, images)
+		this.reportDryRun("new build", steps, err)
+		return false
+	}
+
+	results, err := this.orchestrator.Rollout(this.ctx, images)
+	buildid := 0
+	if len(images) > 0 {
+		buildid, _ = this.buildidOf(images[0])
+	}
+	this.emit(Event{Type: EVENT_ROLLOUT, Buildid: buildid, Images: images, Results: results, Err: err})
+	restarted := 0
+	for _, result := range results {
+		if result.Err == nil {
+			restarted++
+		}
+	}
+	hosts := rolloutHosts(results)
+
+	if err != nil {
+		log.Err(err).Int("restarted", restarted).Strs("hosts", hosts).Msg("Rollout failed")
+		this.notify(notify.EVENT_SERVERS_RESTARTED, 0, "Restarted "+strconv.Itoa(restarted)+" servers, "+err.Error()+"\n"+strings.Join(hosts, "\n"))
+		return false
+	}
+	if restarted > 0 {
+		log.Info().Int("restarted", restarted).Strs("hosts", hosts).Msg("Rolled out new build")
+		this.notify(notify.EVENT_SERVERS_RESTARTED, 0, "Restarted "+strconv.Itoa(restarted)+" servers with the new build:\n"+strings.Join(hosts, "\n"))
+	}
+	return true
+}
+
+// The outcome of a rollout by host, e.g. "gameserver-01: 3 restarted, 1 failed"
+func rolloutHosts(results []rollout.Result) []string {
+	names := []string{}
+	restarted, failed := map[string]int{}, map[string]int{}
+	for _, result := range results {
+		if restarted[result.Target]+failed[result.Target] == 0 {
+			names = append(names, result.Target)
+		}
+		if result.Err != nil {
+			failed[result.Target]++
+		} else {
+			restarted[result.Target]++
+		}
+	}
+	hosts := []string{}
+	for _, name := range names {
+		host := name + ": " + strconv.Itoa(restarted[name]) + " restarted"
+		if failed[name] > 0 {
+			host += ", " + strconv.Itoa(failed[name]) + " failed"
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// Run the scheduled restarts until the watcher stops
+func (this *UpdateWatcher) scheduleRestarts() {
+	scheduler := cron.New()
+	for _, restart := range this.options.Fleet.Restarts {
+		restart := restart
+		// Validated when loading the config
+		if _, err := scheduler.AddFunc(restart.Schedule, func() { this.scheduledRestart(restart) }); err != nil {
+			log.Err(err).Str("restart", restart.String()).Msg("Failed to schedule restart")
+		}
+	}
+
+	scheduler.Start()
+	<-this.ctx.Done()
+	<-scheduler.Stop().Done()
+}
+
+func (this *UpdateWatcher) scheduledRestart(restart ScheduledRestart) {
+	log.Info().Str("restart", restart.String()).Msg("Running scheduled restart")
+
+	if this.options.Rollout.DryRun {
+		steps, err := this.orchestrator.DryRunRestart(this.ctx, restart.selector())
+		this.reportDryRun("scheduled restart "+restart.String(), steps, err)
+		return
+	}
+
+	results, err := this.orchestrator.Restart(this.ctx, restart.selector())
+	this.emit(Event{Type: EVENT_ROLLOUT, Results: results, Err: err})
+
+	restarted := 0
+	for _, result := range results {
+		if result.Err == nil {
+			restarted++
+		}
+	}
+	if err != nil {
+		log.Err(err).Str("restart", restart.String()).Int("restarted", restarted).Msg("Scheduled restart failed")
+		this.notify(notify.EVENT_SERVERS_RESTARTED, 0, "Scheduled restart "+restart.String()+" restarted "+strconv.Itoa(restarted)+" servers, "+err.Error())
+		return
+	}
+	log.Info().Str("restart", restart.String()).Int("restarted", restarted).Msg("Finished scheduled restart")
+	this.notify(notify.EVENT_SERVERS_RESTARTED, 0, "Scheduled restart "+restart.String()+" restarted "+strconv.Itoa(restarted)+" servers")
+}
+
+// The servers of the configured hosts with all of the labels
+func (this ServerSelector) selector() func(rollout.Target, rollout.Server) bool {
+	return this.matches
+}
+
+func (this ServerSelector) matches(target rollout.Target, server rollout.Server) bool {
+	if len(this.Hosts) > 0 && !contains(this.Hosts, target.Name()) {
+		return false
+	}
+	for key, value := range this.Labels {
+		if server.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// The configured overrides of the server, then its labels
+func (this *UpdateWatcher) rolloutPolicy(target rollout.Target, server rollout.Server) rollout.Policy {
+	policy := rollout.Policy{Window: this.maintenanceWindow()}
+	for _, override := range this.options.Rollout.Overrides {
+		if !override.matches(target, server) {
+			continue
+		}
+		if override.AutoRestart != nil {
+			policy.Manual = !*override.AutoRestart
+		}
+		if override.Window != "" {
+			// Validated when loading the config
+			window, _ := rollout.ParseWindow(override.Window)
+			policy.Window = &window
+		}
+		if override.Canary != nil {
+			policy.Canary = *override.Canary
+		}
+	}
+	return rollout.LabelPolicy(server, policy)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /fleet
+func (this *UpdateWatcher) handleFleet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if this.orchestrator == nil {
+		writeError(w, http.StatusNotFound, "fleet mode is disabled")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]fleet.HostStatus{"hosts": this.fleetMonitor.Statuses()})
+}
+
+// Progress of the current or last rollout or restart, nil if there was none since the watcher started
+func (this *UpdateWatcher) RolloutProgress() (*rollout.Progress, error) {
+	if this.orchestrator == nil {
+		return nil, ErrFleetDisabled
+	}
+	return this.orchestrator.Progress(), nil
+}
+
+// Hold the rollout or restart in progress before its next restart
+func (this *UpdateWatcher) PauseRollout() error {
+	if this.orchestrator == nil {
+		return ErrFleetDisabled
+	}
+	return this.orchestrator.Pause()
+}
+
+func (this *UpdateWatcher) ResumeRollout() error {
+	if this.orchestrator == nil {
+		return ErrFleetDisabled
+	}
+	return this.orchestrator.Resume()
+}
+
+// Stop the rollout or restart in progress once the current restart finished
+func (this *UpdateWatcher) AbortRollout() error {
+	if this.orchestrator == nil {
+		return ErrFleetDisabled
+	}
+	return this.orchestrator.Abort()
+}
+
+func reportRolloutProgress(progress rollout.Progress) {
+	active, paused := 0.0, 0.0
+	if progress.Active() {
+		active = 1
+	}
+	if progress.State == rollout.STATE_PAUSED {
+		paused = 1
+	}
+	metrics.RolloutActive.Set(active)
+	metrics.RolloutPaused.Set(paused)
+	metrics.RolloutServers.WithLabelValues("total").Set(float64(progress.Total))
+	metrics.RolloutServers.WithLabelValues("updated").Set(float64(progress.Updated))
+	metrics.RolloutServers.WithLabelValues("failed").Set(float64(progress.Failed))
+	metrics.RolloutServers.WithLabelValues("skipped").Set(float64(progress.Skipped))
+	metrics.RolloutServers.WithLabelValues("pending").Set(float64(progress.Pending))
+	metrics.RolloutServers.WithLabelValues("draining").Set(float64(len(progress.Draining)))
+}
+
+// GET /rollout
+func (this *UpdateWatcher) handleRollout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	progress, err := this.RolloutProgress()
+	if err != nil {
+		writeError(w, http.StatusNotFound, "fleet mode is disabled")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]*rollout.Progress{"rollout": progress})
+}
+
+// POST /rollout/pause, /rollout/resume and /rollout/abort
+func (this *UpdateWatcher) handleRolloutControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/rollout/") {
+	case "pause":
+		err = this.PauseRollout()
+	case "resume":
+		err = this.ResumeRollout()
+	case "abort":
+		err = this.AbortRollout()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case errors.Is(err, ErrFleetDisabled):
+		writeError(w, http.StatusNotFound, "fleet mode is disabled")
+		return
+	case errors.Is(err, rollout.ErrNoRollout):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Info().Str("action", strings.TrimPrefix(r.URL.Path, "/rollout/")).Str("remote", r.RemoteAddr).Msg("Rollout control requested")
+
+	// The buttons of the dashboard submit forms, send them back to it
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	progress, _ := this.RolloutProgress()
+	writeJson(w, http.StatusOK, map[string]*rollout.Progress{"rollout": progress})
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerStep(STEP_GITOPS, func(options Options) bool {
+		return len(options.GitOps.Repositories) > 0
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.updateGitOps)
+	})
+}
+
+// Commit the images to the gitops repositories, a GitOps controller rolls them out from there. Returns whether every
+// repository has them now.
+func (this *UpdateWatcher) updateGitOps(images []string) bool {
+	buildid, _ := this.buildidOf(images[0])
+	if this.options.Rollout.DryRun {
+		results, err := this.gitopsPublisher.DryRun(this.ctx, buildid, images)
+		lines := []string{}
+		for _, result := range results {
+			for _, file := range result.Files {
+				lines = append(lines, result.Repository+" "+file)
+			}
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to plan gitops commits")
+		}
+		log.Info().Strs("updates", lines).Msg("Dry run, not committing to gitops repositories")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would commit "+strconv.Itoa(len(lines))+" files to gitops repositories:\n"+strings.Join(lines, "\n"))
+		return false
+	}
+
+	results, err := this.gitopsPublisher.Publish(this.ctx, buildid, images)
+	this.emit(Event{Type: EVENT_GITOPS, Buildid: buildid, Images: images, GitOps: results, Err: err})
+
+	committed := []string{}
+	for _, result := range results {
+		if result.Err == nil && result.Commit != "" {
+			committed = append(committed, result.Repository+" "+result.Commit)
+		}
+	}
+	if err != nil {
+		this.notify(notify.EVENT_DEPLOYED, 0, "Committed to "+strconv.Itoa(len(committed))+" gitops repositories, "+err.Error())
+		return false
+	}
+	if len(committed) > 0 {
+		log.Info().Strs("commits", committed).Msg("Committed new build to gitops repositories")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Committed the new build to gitops repositories:\n"+strings.Join(committed, "\n"))
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package watcher
+
+import (
+	"context"
+	"crypto/tls"
+	"csgo-update-watcher/pkg/grpcapi"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
+	"time"
+)
+
+// Serves grpcapi.WatcherServer on api.grpc_listen
+type grpcServer struct {
+	grpcapi.UnimplementedWatcherServer
+	watcher *UpdateWatcher
+}
+
+func (this *UpdateWatcher) newGRPCServer(serverTLS *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(this.authorizeGRPC)}
+	if serverTLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	server := grpc.NewServer(options...)
+	grpcapi.RegisterWatcherServer(server, &grpcServer{watcher: this})
+	log.Info().Str("address", this.options.API.GRPCListen).Msg("Serving gRPC API")
+	return server
+}
+
+// With admin authentication configured every call needs an authorization metadata with an admin token or a client
+// certificate, like the admin API
+func (this *UpdateWatcher) authorizeGRPC(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !this.options.API.AdminEnabled() {
+		return handler(ctx, request)
+	}
+	authorization := ""
+	if incoming, ok := metadata.FromIncomingContext(ctx); ok && len(incoming.Get("authorization")) > 0 {
+		authorization = incoming.Get("authorization")[0]
+	}
+	var state *tls.ConnectionState
+	remote := ""
+	if client, ok := peer.FromContext(ctx); ok {
+		remote = client.Addr.String()
+		if info, ok := client.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	client, ok := this.adminClient(authorization, state)
+	if !ok {
+		log.Warn().Str("remote", remote).Str("method", info.FullMethod).Msg("Refused unauthorized gRPC call")
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if !strings.HasSuffix(info.FullMethod, "/Status") && !strings.HasSuffix(info.FullMethod, "/ListBuilds") {
+		log.Info().Str("client", client).Str("remote", remote).Str("method", info.FullMethod).Msg("gRPC call")
+	}
+	return handler(ctx, request)
+}
+
+// Stop the gRPC server, cancelling the calls still running after apiShutdownTimeout
+func (this *UpdateWatcher) stopGRPCServer() {
+	stopped := make(chan struct{})
+	go func() {
+		this.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(apiShutdownTimeout):
+		log.Warn().Msg("Failed to shut down gRPC server in time, cancelling calls")
+		this.grpcServer.Stop()
+	}
+}
+
+func (this *grpcServer) Status(context.Context, *grpcapi.StatusRequest) (*grpcapi.StatusResponse, error) {
+	current := this.watcher.Status()
+	response := &grpcapi.StatusResponse{
+		StartedAt:       timestamp(current.StartedAt),
+		Paused:          current.Paused,
+		Leading:         current.Leading,
+		DetectedBuildid: int32(current.Detected),
+		BuildRequested:  current.BuildRequested,
+		InFlight:        map[string]*timestamppb.Timestamp{},
+		Checks:          int64(current.Checks),
+		FailedChecks:    int64(current.FailedChecks),
+		Builds:          int64(current.Builds),
+		FailedBuilds:    int64(current.FailedBuilds),
+	}
+	if check := current.LastCheck; !check.Time.IsZero() {
+		response.LastCheck = &grpcapi.Check{
+			Time:         timestamp(check.Time),
+			SteamBuildid: int32(check.SteamBuildid),
+			LocalBuildid: int32(check.LocalBuildid),
+			Error:        check.Error,
+		}
+	}
+	for kind, startedAt := range current.InFlight {
+		response.InFlight[kind] = timestamp(startedAt)
+	}
+	return response, nil
+}
+
+func (this *grpcServer) TriggerCheck(_ context.Context, request *grpcapi.TriggerCheckRequest) (*grpcapi.TriggerCheckResponse, error) {
+	if err := this.watcher.TriggerCheck(reasonOr(request.Reason, "grpc")); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &grpcapi.TriggerCheckResponse{}, nil
+}
+
+func (this *grpcServer) TriggerBuild(_ context.Context, request *grpcapi.TriggerBuildRequest) (*grpcapi.TriggerBuildResponse, error) {
+	if err := this.watcher.TriggerBuild(reasonOr(request.Reason, "grpc")); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &grpcapi.TriggerBuildResponse{}, nil
+}
+
+func (this *grpcServer) ListBuilds(_ context.Context, request *grpcapi.ListBuildsRequest) (*grpcapi.ListBuildsResponse, error) {
+	limit := int(request.Limit)
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid limit")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	entries, err := this.watcher.History(limit, request.Before, request.Host)
+	if errors.Is(err, ErrHistoryDisabled) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to read build history")
+		return nil, status.Error(codes.Internal, "failed to read build history")
+	}
+
+	response := &grpcapi.ListBuildsResponse{Builds: make([]*grpcapi.Build, 0, len(entries))}
+	for _, entry := range entries {
+		response.Builds = append(response.Builds, buildMessage(entry))
+	}
+	if len(entries) == limit {
+		response.Next = entries[len(entries)-1].ID
+	}
+	return response, nil
+}
+
+func (this *grpcServer) Pause(context.Context, *grpcapi.PauseRequest) (*grpcapi.PauseResponse, error) {
+	if err := this.watcher.Pause(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &grpcapi.PauseResponse{}, nil
+}
+
+func (this *grpcServer) Resume(context.Context, *grpcapi.ResumeRequest) (*grpcapi.ResumeResponse, error) {
+	if err := this.watcher.Resume(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &grpcapi.ResumeResponse{}, nil
+}
+
+func buildMessage(entry HistoryEntry) *grpcapi.Build {
+	build := entry.Build
+	return &grpcapi.Build{
+		Id:         build.ID,
+		Host:       build.Host,
+		Buildid:    int32(build.Buildid),
+		StartedAt:  timestamp(build.StartedAt),
+		FinishedAt: timestamp(build.FinishedAt),
+		Outcome:    build.Outcome,
+		Error:      build.Error,
+		Images:     build.Images,
+		ImageId:    build.ImageID,
+		Pushed:     build.Pushed,
+		Digests:    build.Digests,
+		DetectedAt: timestamp(entry.DetectedAt),
+	}
+}
+
+// Unset for zero times
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func reasonOr(reason string, fallback string) string {
+	if reason == "" {
+		return fallback
+	}
+	return reason
+}
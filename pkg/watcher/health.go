@@ -0,0 +1,114 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Check intervals without a check until a watcher is unhealthy, unless told otherwise
+const DEFAULT_HEALTH_INTERVALS = 3
+
+// Healthy returns why the watcher is unhealthy: its last check, or its start before the first check, is older than
+// the given number of check intervals. Standbys, paused watchers, watchers building and the operator, which does
+// not check on a schedule, are healthy.
+func (this Status) Healthy(intervals int, now time.Time) error {
+	if !this.Leading || this.Paused || this.CheckInterval == "" {
+		return nil
+	}
+	if _, building := this.InFlight["build"]; building {
+		return nil
+	}
+	interval, err := time.ParseDuration(this.CheckInterval)
+	if err != nil {
+		return fmt.Errorf("invalid check interval %q", this.CheckInterval)
+	}
+	last, what := this.LastCheck.Time, "last check"
+	if last.IsZero() {
+		last, what = this.StartedAt, "start without a check"
+	}
+	if age := now.Sub(last); age > time.Duration(intervals)*interval {
+		return fmt.Errorf("%s was %s ago, more than %d check intervals of %s", what, age.Round(time.Second), intervals, interval)
+	}
+	return nil
+}
+
+// Remember the interval of the next check for Status
+func (this *UpdateWatcher) setCheckInterval(interval time.Duration) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.interval = interval
+}
+
+// The interval of the Steam poll, which the goroutine checking Steam backs off with the error policy
+func (this *UpdateWatcher) pollInterval() time.Duration {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	if this.stats.interval <= 0 {
+		return this.checkFrequency
+	}
+	return this.stats.interval
+}
+
+// Write the status to health_file for the healthcheck command, replacing the file at once so it is never read half
+// written
+func (this *UpdateWatcher) writeHealthFile() {
+	path := this.options.HealthFile
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(this.Status(), "", "  ")
+	if err != nil {
+		log.Err(err).Msg("Failed to encode health file")
+		return
+	}
+	// Unique, the build and the checks may write at once
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		log.Err(err).Str("path", path).Msg("Failed to write health file")
+		return
+	}
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		log.Err(err).Str("path", path).Msg("Failed to write health file")
+	}
+}
+
+// GET /health?intervals=3, 503 if unhealthy
+func (this *UpdateWatcher) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	intervals := DEFAULT_HEALTH_INTERVALS
+	if value := r.URL.Query().Get("intervals"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid intervals")
+			return
+		}
+		intervals = parsed
+	}
+	status := this.Status()
+	if err := status.Healthy(intervals, time.Now()); err != nil {
+		writeJson(w, http.StatusServiceUnavailable, map[string]interface{}{"error": err.Error(), "status": status})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"status": status})
+}
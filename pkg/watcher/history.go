@@ -0,0 +1,164 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/store"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+var ErrHistoryDisabled = errors.New("history is disabled, configure state.path or state.dsn")
+
+// Open the configured store, filling in the default host
+func openHistory(config *StateConfig) (store.Store, error) {
+	if config.Host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname for the history store, set state.host: %w", err)
+		}
+		config.Host = hostname
+	}
+
+	options := store.Options{
+		Driver:         config.Driver,
+		DSN:            config.DSN,
+		Host:           config.Host,
+		CheckRetention: config.CheckRetention,
+	}
+	if options.DSN == "" {
+		options.DSN = config.Path
+	}
+
+	return store.Open(options)
+}
+
+func (this *UpdateWatcher) recordCheck(check store.Check) {
+	if this.history == nil {
+		return
+	}
+
+	if err := this.history.RecordCheck(check); err != nil {
+		log.Err(err).Msg("Failed to record check in history")
+	}
+}
+
+func (this *UpdateWatcher) recordDetection(buildid int, releasedAt time.Time) {
+	this.countDetection(buildid)
+	if this.history == nil {
+		return
+	}
+
+	if err := this.history.RecordDetection(buildid, time.Now(), releasedAt); err != nil {
+		log.Err(err).Msg("Failed to record detection in history")
+	}
+	this.refreshSLO()
+}
+
+func (this *UpdateWatcher) recordDeployment(buildid int) {
+	if this.history == nil {
+		return
+	}
+
+	if err := this.history.RecordDeployment(buildid, time.Now()); err != nil {
+		log.Err(err).Msg("Failed to record deployment in history")
+	}
+	this.refreshSLO()
+}
+
+// Finish and store a build record, err being the outcome of the build
+func (this *UpdateWatcher) recordBuild(build *store.Build, err error) {
+	if this.history == nil {
+		return
+	}
+
+	build.FinishedAt = time.Now()
+	if err != nil {
+		build.Outcome = store.OutcomeFailed
+		build.Error = err.Error()
+	} else if build.Outcome == "" {
+		build.Outcome = store.OutcomeSuccess
+	}
+
+	if len(build.Images) > 0 {
+		image, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, finalImage(build.Images))
+		if err == nil {
+			build.ImageID = image.ID
+			build.Size = image.Size
+			build.Digests = image.RepoDigests
+		}
+	}
+
+	if err := this.history.RecordBuild(build); err != nil {
+		log.Err(err).Msg("Failed to record build in history")
+	}
+	this.refreshSLO()
+}
+
+// A build together with when its buildid was first seen on Steam
+type HistoryEntry struct {
+	store.Build
+	DetectedAt time.Time `json:"detected_at,omitempty"`
+	Links      *Links    `json:"links,omitempty"`
+}
+
+// A page of builds, newest first, optionally only of one watcher host. Detection times are only known for builds of
+// this host.
+func (this *UpdateWatcher) History(limit int, before uint64, host string) ([]HistoryEntry, error) {
+	if this.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	builds, err := this.history.Builds(store.BuildQuery{Limit: limit, Before: before, Host: host})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(builds))
+	for i, build := range builds {
+		previous := 0
+		if i+1 < len(builds) {
+			previous = builds[i+1].Buildid
+		}
+		entry := HistoryEntry{Build: build, Links: this.links(build.Buildid, previous)}
+		if build.Host == "" || build.Host == this.options.State.Host {
+			if entry.DetectedAt, err = this.history.DetectedAt(build.Buildid); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Prune deletes the checks and builds of this host older than the given age. The builds deciding what to build next
+// and those waiting for their publish schedule are kept.
+func (this *UpdateWatcher) Prune(age time.Duration) (store.PruneResult, error) {
+	if this.history == nil {
+		return store.PruneResult{}, ErrHistoryDisabled
+	}
+	result, err := this.history.Prune(time.Now().Add(-age))
+	if err != nil {
+		return result, fmt.Errorf("failed to prune history: %w", err)
+	}
+	log.Info().Dur("age", age).Int("checks", result.Checks).Int("builds", result.Builds).Msg("Pruned history")
+	return result, nil
+}
+
+// Format a timestamp for humans, empty times become "-"
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func pushedImages(results []PublishResult) []string {
+	pushed := []string{}
+	for _, result := range results {
+		pushed = append(pushed, result.Images...)
+	}
+	return pushed
+}
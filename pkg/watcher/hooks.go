@@ -0,0 +1,184 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Points of a build hooks run at. Failing hooks before a step abort it, failures after publishing are only logged.
+const (
+	// Before Steam is checked, a failure skips the check
+	HOOK_PRE_CHECK = "pre-check"
+	// Before a build, a failure fails it
+	HOOK_PRE_BUILD = "pre-build"
+	// After the images were built and before they are published, a failure fails the build
+	HOOK_POST_BUILD = "post-build"
+	// After the build was published
+	HOOK_POST_PUBLISH = "post-publish"
+	// After a build failed
+	HOOK_ON_FAILURE = "on-failure"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// Build metadata passed to hooks as environment variables
+type hookData struct {
+	// Buildid Steam offers, known from the last check
+	SteamBuildid int
+	// Installed buildid, once the game is installed
+	Buildid int
+	Images  []string
+	Pushed  []string
+	Err     error
+}
+
+func (this *UpdateWatcher) buildHookData(record *store.Build, err error) hookData {
+	return hookData{
+		SteamBuildid: this.lastSteamCheck.SteamBuildid,
+		Buildid:      record.Buildid,
+		Images:       record.Images,
+		Pushed:       record.Pushed,
+		Err:          err,
+	}
+}
+
+func (this HookConfig) String() string {
+	if this.Image != "" {
+		return this.Image
+	}
+	return strings.Join(this.Command, " ")
+}
+
+func (this HooksConfig) stage(stage string) []HookConfig {
+	switch stage {
+	case HOOK_PRE_CHECK:
+		return this.PreCheck
+	case HOOK_PRE_BUILD:
+		return this.PreBuild
+	case HOOK_POST_BUILD:
+		return this.PostBuild
+	case HOOK_POST_PUBLISH:
+		return this.PostPublish
+	case HOOK_ON_FAILURE:
+		return this.OnFailure
+	}
+	return nil
+}
+
+// Run the hooks of a stage in order, stopping at the first that fails
+func (this *UpdateWatcher) runHooks(stage string, data hookData) error {
+	hooks := this.options.Hooks.stage(stage)
+	if len(hooks) == 0 {
+		return nil
+	}
+	env := hookEnv(stage, data)
+	for _, hook := range hooks {
+		log.Debug().Str("hook", stage).Str("command", hook.String()).Msg("Running hook")
+		ctx, cancel := context.WithTimeout(this.ctx, hook.Timeout)
+		var err error
+		if hook.Image != "" {
+			err = this.runHookContainer(ctx, hook, env)
+		} else {
+			err = runHookCommand(ctx, hook, env)
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s hook %s failed: %w", stage, hook, err)
+		}
+	}
+	return nil
+}
+
+// Log failures of hooks that cannot abort anything anymore
+func (this *UpdateWatcher) notifyHooks(stage string, data hookData) {
+	if err := this.runHooks(stage, data); err != nil {
+		log.Err(err).Str("hook", stage).Msg("Hook failed")
+	}
+}
+
+func hookEnv(stage string, data hookData) []string {
+	env := []string{
+		"CSGO_WATCHER_HOOK=" + stage,
+		"CSGO_WATCHER_APPID=" + strconv.Itoa(CSGO_APPID),
+		"CSGO_WATCHER_BRANCH=" + CSGO_BRANCH,
+	}
+	if data.SteamBuildid != 0 {
+		env = append(env, "CSGO_WATCHER_STEAM_BUILDID="+strconv.Itoa(data.SteamBuildid))
+	}
+	if data.Buildid != 0 {
+		env = append(env, "CSGO_WATCHER_BUILDID="+strconv.Itoa(data.Buildid))
+	}
+	if len(data.Images) > 0 {
+		env = append(env, "CSGO_WATCHER_IMAGES="+strings.Join(data.Images, " "))
+	}
+	if len(data.Pushed) > 0 {
+		env = append(env, "CSGO_WATCHER_PUSHED="+strings.Join(data.Pushed, " "))
+	}
+	if data.Err != nil {
+		env = append(env, "CSGO_WATCHER_ERROR="+data.Err.Error())
+	}
+	return env
+}
+
+// The configured env of a hook, sorted so hooks see the same order every run
+func (this HookConfig) env(env []string) []string {
+	keys := make([]string, 0, len(this.Env))
+	for key := range this.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+this.Env[key])
+	}
+	return env
+}
+
+func runHookCommand(ctx context.Context, hook HookConfig, env []string) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = hook.env(append(os.Environ(), env...))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// Run a one-shot container of the hook's image, removed after
+func (this *UpdateWatcher) runHookContainer(ctx context.Context, hook HookConfig, env []string) error {
+	created, err := this.dockerCli.ContainerCreate(ctx, &container.Config{
+		Image:  hook.Image,
+		Cmd:    hook.Command,
+		Env:    hook.env(env),
+		Labels: this.helperLabels(HELPER_HOOK),
+	}, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	defer this.dockerCli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+	if err := this.dockerCli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	wait, errs := this.dockerCli.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("error while waiting for container: %w", err)
+	case status := <-wait:
+		if status.StatusCode != 0 {
+			return fmt.Errorf("exit code %d: %s", status.StatusCode, this.containerOutput(created.ID))
+		}
+	}
+	return nil
+}
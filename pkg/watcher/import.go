@@ -0,0 +1,224 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/export"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/store"
+	"csgo-update-watcher/pkg/trigger"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The docker API loads images, so does podman's
+var _ export.Loader = &client.Client{}
+
+// Loads the archives another watcher exported, on hosts without access to Steam or a registry
+type importer struct {
+	loader      export.Loader
+	destination export.Destination
+}
+
+func newImporter(config ImportConfig, dockerCli DockerClient) (*importer, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	loader, ok := dockerCli.(export.Loader)
+	if !ok {
+		return nil, fmt.Errorf("the container engine cannot load images for import")
+	}
+	var destination export.Destination = export.Directory(expandHome(config.Directory))
+	if config.S3.Enabled() {
+		bucket, err := export.NewBucket(config.S3)
+		if err != nil {
+			return nil, err
+		}
+		destination = bucket
+	}
+	return &importer{loader, destination}, nil
+}
+
+func (this ImportConfig) validate(options Options) error {
+	if !this.Enabled() {
+		return nil
+	}
+	if this.Directory != "" && this.S3.Enabled() {
+		return fmt.Errorf("import.directory and import.s3 cannot both be set")
+	}
+	if options.Engine == engine.CONTAINERD {
+		return fmt.Errorf("import needs to load images, which the %s engine cannot", options.Engine)
+	}
+	// Everything that reaches Steam or the internet on its own
+	conflicts := []struct {
+		option string
+		set    bool
+	}{
+		{"export", options.Export.Enabled()},
+		{"kubernetes.operator", options.Kubernetes.Operator.Enabled},
+		{"pics", options.PICS.Enabled},
+		{"build.plugins.watch", options.Build.Plugins.Watch.Enabled},
+		{"build.repositories.git", len(options.Build.Repositories.Git) > 0},
+	}
+	for _, conflict := range conflicts {
+		if conflict.set {
+			return fmt.Errorf("import loads the builds of another watcher and cannot be combined with %s", conflict.option)
+		}
+	}
+	return this.S3.Validate("import.s3")
+}
+
+// The watch loop of import mode. Every check imports the newest archive of import instead of checking Steam, if it
+// holds a newer buildid than the engine has, and deploys it like a build.
+func (this *UpdateWatcher) watchAndImport() error {
+	interval := this.checkFrequency
+	this.requestCheck("startup")
+	this.setCheckInterval(interval)
+	for checks := 0; ; checks++ {
+		if this.options.Once && checks == 1 {
+			log.Info().Msg("Checked once, stopping")
+			return nil
+		}
+		if next := this.checkInterval(); next != interval {
+			interval = next
+			this.setCheckInterval(interval)
+		}
+		this.loopWorking(false)
+		select {
+		case reason := <-this.checkRequests:
+			if reason != trigger.TICK_REASON {
+				log.Info().Str("reason", reason).Msg("Looking for archives ahead of schedule")
+			}
+		case <-this.ctx.Done():
+			return nil
+		}
+		this.loopWorking(true)
+
+		if this.isPaused() {
+			log.Debug().Msg("Paused, skipping import")
+			continue
+		}
+		this.deployPending()
+		if err := this.importNewest(); err != nil {
+			log.Err(err).Msg("Failed to import archive")
+			if err := this.failed(err); err != nil {
+				return err
+			}
+			continue
+		}
+		this.succeeded()
+	}
+}
+
+// Import the newest archive if its buildid is newer than the newest local build
+func (this *UpdateWatcher) importNewest() error {
+	archives, err := export.List(this.ctx, this.importer.destination)
+	if err != nil {
+		return err
+	}
+	buildid := -1
+	for archived := range archives {
+		if archived > buildid {
+			buildid = archived
+		}
+	}
+	if buildid < 0 {
+		log.Debug().Str("source", this.importer.destination.String()).Msg("No archives to import")
+		return nil
+	}
+	newestBuildVersion, err := this.newestBuildVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get newest local build: %w", err)
+	}
+	if buildid <= newestBuildVersion {
+		log.Debug().Int("archived-version", buildid).Int("newest-build-version", newestBuildVersion).Msg("No newer archive to import")
+		return nil
+	}
+
+	// Docker archives load on every engine, OCI ones only on recent docker
+	name := archives[buildid][0]
+	for _, archive := range archives[buildid] {
+		if !strings.Contains(archive, ".oci.") {
+			name = archive
+			break
+		}
+	}
+	return this.importBuild(buildid, name)
+}
+
+// Load the archive of a buildid in place of a build, then deploy its images
+func (this *UpdateWatcher) importBuild(buildid int, name string) (err error) {
+	this.buildMutex.Lock()
+	defer this.buildMutex.Unlock()
+	defer this.track("import")()
+	location := this.importer.destination.Location(name)
+	log.Info().Str("archive", location).Int("buildid", buildid).Msg("Importing new CS:GO build")
+
+	record := &store.Build{StartedAt: time.Now(), Buildid: buildid}
+	record.Images, err = this.loadArchive(buildid, name)
+	this.countBuild(buildid, err)
+	this.recordBuild(record, err)
+	this.measureImages()
+	this.emit(Event{Type: EVENT_IMPORT, Buildid: buildid, Images: record.Images, Export: &export.Result{Archive: location}, Err: err})
+	if err != nil {
+		this.notifyInBackground(notify.EVENT_BUILD_FAILED, buildid, "Failed to import CS:GO buildid "+strconv.Itoa(buildid)+": "+err.Error())
+		return err
+	}
+	this.notifyInBackground(notify.EVENT_BUILD_SUCCEEDED, buildid, "Imported CS:GO buildid "+strconv.Itoa(buildid)+":\n"+strings.Join(record.Images, "\n"))
+
+	this.deployInWindow(record.Images)
+	return nil
+}
+
+// Load the archive and tag its images like the watcher tags its builds, in base_image_name and with the tags of
+// the build's variants. Images pushed to a publish target are recognized by the target's repository and tag prefix.
+// Returns the local images in build order.
+func (this *UpdateWatcher) loadArchive(buildid int, name string) ([]string, error) {
+	loaded, err := export.Load(this.ctx, this.importer.loader, this.importer.destination, name)
+	if err != nil {
+		return nil, err
+	}
+	names := this.options.variantNames()
+	images := make([]string, len(names))
+	for _, image := range loaded {
+		parsed, ok := this.parseTag(image)
+		if !ok {
+			parsed, ok = this.parseTag(this.BaseImageName + ":" + registry.TagOf(image))
+		}
+		if !ok || parsed.BuildID != buildid {
+			log.Warn().Str("image", image).Int("buildid", buildid).Msg("Imported image that is not of the buildid, not tagging it")
+			continue
+		}
+		tag, err := this.tags[parsed.Variant].Render(parsed.Data)
+		if err != nil {
+			return nil, err
+		}
+		local := this.BaseImageName + ":" + tag
+		if local != image {
+			if err := this.dockerCli.ImageTag(this.ctx, image, local); err != nil {
+				return nil, fmt.Errorf("failed to tag %s as %s: %w", image, local, err)
+			}
+		}
+		for i, variant := range names {
+			if variant == parsed.Variant {
+				images[i] = local
+			}
+		}
+	}
+	for i, image := range images {
+		if image == "" {
+			return nil, fmt.Errorf("%s has no %s image of buildid %d, tags and build.variants must match the exporting watcher", name, names[i], buildid)
+		}
+	}
+
+	if latest := this.latestTag(); latest != "" {
+		if err := this.dockerCli.ImageTag(this.ctx, finalImage(images), latest); err != nil {
+			return nil, fmt.Errorf("failed to tag %s as %s: %w", finalImage(images), latest, err)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,141 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/attestation"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/steam"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everything the watcher knows about a built image
+type ImageProvenance struct {
+	Image            string            `json:"image"`
+	ImageID          string            `json:"image_id"`
+	Buildid          int               `json:"buildid,omitempty"`
+	Created          time.Time         `json:"created"`
+	Size             int64             `json:"size"`
+	Tags             []string          `json:"tags"`
+	Digests          []string          `json:"digests"`
+	PushedRegistries []string          `json:"pushed_registries"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	// From the labels, the build context the image was built from
+	ContextDigest   string `json:"context_digest,omitempty"`
+	ContextRevision string `json:"context_revision,omitempty"`
+
+	// From the attestations attached to the pushed image
+	Branch        string        `json:"branch,omitempty"`
+	Depots        []steam.Depot `json:"depots,omitempty"`
+	BuildStarted  time.Time     `json:"build_started,omitempty"`
+	BuildFinished time.Time     `json:"build_finished,omitempty"`
+	AttestedIn    []string      `json:"attested_in,omitempty"`
+
+	// From the history store, the build with its validations
+	DetectedAt time.Time    `json:"detected_at,omitempty"`
+	Build      *store.Build `json:"build,omitempty"`
+}
+
+// Fill in the build details from the first pushed image that has attestations
+func (this *UpdateWatcher) addAttestations(provenance *ImageProvenance) {
+	for _, digest := range provenance.Digests {
+		sbom, statement, err := attestation.Fetch(this.ctx, digest, this.registryAuth.Keychain())
+		if err != nil {
+			log.Warn().Err(err).Str("image", digest).Msg("Failed to fetch attestations")
+			continue
+		}
+		if sbom == nil && statement == nil {
+			continue
+		}
+		provenance.AttestedIn = append(provenance.AttestedIn, digest)
+
+		if statement != nil && provenance.BuildFinished.IsZero() {
+			provenance.BuildStarted = statement.Predicate.Metadata.BuildStartedOn
+			provenance.BuildFinished = statement.Predicate.Metadata.BuildFinishedOn
+			if branch, ok := statement.Predicate.Invocation.Parameters["branch"].(string); ok {
+				provenance.Branch = branch
+			}
+		}
+
+		if sbom != nil && provenance.Depots == nil {
+			for _, pkg := range sbom.Packages {
+				if !strings.HasPrefix(pkg.Name, "steam-depot-") {
+					continue
+				}
+				id, err := strconv.Atoi(strings.TrimPrefix(pkg.Name, "steam-depot-"))
+				if err != nil {
+					continue
+				}
+				provenance.Depots = append(provenance.Depots, steam.Depot{ID: id, Manifest: pkg.VersionInfo})
+			}
+		}
+	}
+}
+
+// Collect the provenance of an image. A reference without repository (e.g. get5-buildid-1234) is looked up in the
+// base image repository.
+func (this *UpdateWatcher) Inspect(image string) (*ImageProvenance, error) {
+	if !strings.ContainsAny(image, ":/@") {
+		image = this.BaseImageName + ":" + image
+	}
+
+	inspect, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %s: %w", image, err)
+	}
+
+	provenance := &ImageProvenance{
+		Image:   image,
+		ImageID: inspect.ID,
+		Size:    inspect.Size,
+		Tags:    inspect.RepoTags,
+		Digests: inspect.RepoDigests,
+	}
+	if inspect.Config != nil {
+		provenance.Labels = inspect.Config.Labels
+	}
+	provenance.ContextDigest = provenance.Labels[LABEL_CONTEXT_DIGEST]
+	provenance.ContextRevision = provenance.Labels[LABEL_CONTEXT_REVISION]
+	if created, err := time.Parse(time.RFC3339Nano, inspect.Created); err == nil {
+		provenance.Created = created
+	}
+
+	if buildid, ok := labeledBuildid(provenance.Labels); ok {
+		provenance.Buildid = buildid
+	}
+	for _, tag := range append([]string{image}, inspect.RepoTags...) {
+		if provenance.Buildid != 0 {
+			break
+		}
+		if buildid, ok := this.buildidOf(tag); ok {
+			provenance.Buildid = buildid
+		}
+	}
+
+	// Repo digests only exist for images that were pushed to (or pulled from) a registry
+	registries := map[string]bool{}
+	for _, digest := range inspect.RepoDigests {
+		registries[registry.RegistryOf(digest)] = true
+	}
+	for registry := range registries {
+		provenance.PushedRegistries = append(provenance.PushedRegistries, registry)
+	}
+	sort.Strings(provenance.PushedRegistries)
+
+	this.addAttestations(provenance)
+
+	if this.history != nil && provenance.Buildid != 0 {
+		if provenance.Build, err = this.history.BuildByBuildid(provenance.Buildid); err != nil {
+			return nil, fmt.Errorf("failed to read build history: %w", err)
+		}
+		if provenance.DetectedAt, err = this.history.DetectedAt(provenance.Buildid); err != nil {
+			return nil, fmt.Errorf("failed to read build history: %w", err)
+		}
+	}
+
+	return provenance, nil
+}
@@ -0,0 +1,88 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Validations of a build recorded in its history entry
+const (
+	// The installed buildid is the one Steam offered
+	VALIDATION_VERIFY = "verify"
+	// The images booted, see smoke_test
+	VALIDATION_SMOKE_TEST = "smoke-test"
+)
+
+// Record the outcome of a validation of the build
+func recordValidation(record *store.Build, name string, detail string, err error) {
+	if record.Validations == nil {
+		record.Validations = map[string]store.Validation{}
+	}
+	validation := store.Validation{Passed: err == nil, Detail: detail}
+	if err != nil {
+		validation.Error = err.Error()
+	}
+	record.Validations[name] = validation
+}
+
+// Build the preinstall image on baseImage as a temporary image and read the buildid it installed. When Steam updated
+// during the download the buildid is not the target, the game is installed again up to build.verify_retries times,
+// each time for the buildid Steam offers by then. Target 0 accepts any buildid.
+// Returns the temporary image and the installed buildid, the outcome of the verification is recorded in record.
+func (this *UpdateWatcher) installGame(baseImage string, labels map[string]string, target int, record *store.Build) (string, int, error) {
+	for attempt := 1; ; attempt++ {
+		id := uuid.NewString()
+		tempTag := this.BaseImageName + ":temp-" + id
+		err := this.buildContainer(
+			baseImage,
+			tempTag,
+			this.preinstallBuild(id),
+			labels,
+		)
+		if err != nil {
+			return "", 0, err
+		}
+
+		// run build container to determine buildid of installed version, use helper-installed-buildid.sh
+		buildid, err := this.getImageBuildid(tempTag)
+		if err != nil {
+			return "", 0, err
+		}
+		if target == 0 {
+			return tempTag, buildid, nil
+		}
+		detail := fmt.Sprintf("installed buildid %d for %d, %d attempts", buildid, target, attempt)
+		if buildid == target {
+			recordValidation(record, VALIDATION_VERIFY, detail, nil)
+			return tempTag, buildid, nil
+		}
+
+		this.removeTempImage(tempTag)
+		if attempt > this.options.Build.VerifyRetries {
+			err := fmt.Errorf("installed buildid %d instead of %d offered by Steam, %d attempts", buildid, target, attempt)
+			recordValidation(record, VALIDATION_VERIFY, detail, err)
+			return "", 0, err
+		}
+		log.Warn().Int("installed", buildid).Int("target", target).Int("attempt", attempt).Msg("Installed buildid does not match Steam, installing again")
+		latest, err := this.latestVersion()
+		if err != nil {
+			log.Err(err).Int("target", target).Msg("Failed to get latest version from Steam, installing for the same buildid")
+			continue
+		}
+		target = latest
+	}
+}
+
+// Remove a temporary image right away instead of leaving it to the orphan sweep
+func (this *UpdateWatcher) removeTempImage(image string) {
+	remover, ok := this.dockerCli.(imageRemover)
+	if !ok {
+		return
+	}
+	if _, err := remover.ImageRemove(this.ctx, image, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+		log.Err(err).Str("image", image).Msg("Failed to remove temporary image")
+	}
+}
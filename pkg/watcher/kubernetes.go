@@ -0,0 +1,95 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/notify"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Build jobs build like BuildKit, with secrets on buildah
+var _ engine.SecretBuilder = &kube.JobBuilder{}
+
+func init() {
+	registerStep(STEP_KUBERNETES, func(options Options) bool {
+		return len(options.Kubernetes.Workloads) > 0
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.updateKubernetes)
+	})
+}
+
+// Whether new builds are rolled out anywhere
+func (this *UpdateWatcher) deploys() bool {
+	return len(this.chain) > 0
+}
+
+// Hand the images to the steps of publish.chain, by default the fleet, the Kubernetes workloads, the compose
+// projects, the gitops repositories and the swarm services. The deployment of the build is recorded once all of them
+// run it.
+func (this *UpdateWatcher) deploy(images []string) {
+	if !this.deploys() || len(images) == 0 {
+		return
+	}
+	defer this.track("deploy")()
+
+	if buildid, ok := this.buildidOf(images[0]); this.runChain(images) && ok {
+		this.recordDeployment(buildid)
+	}
+}
+
+// Point the containers of the Kubernetes workloads running an older build of one of the images at it and wait for
+// Kubernetes to roll them out. Returns whether every workload runs the images now.
+func (this *UpdateWatcher) updateKubernetes(images []string) bool {
+	workloads := this.options.Kubernetes.Workloads
+	if this.options.Rollout.DryRun {
+		results, err := this.kubeUpdater.DryRun(this.ctx, workloads, images)
+		lines := []string{}
+		for _, result := range results {
+			for container, image := range result.Images {
+				lines = append(lines, result.Workload+" "+container+": "+image)
+			}
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to plan kubernetes workload updates")
+		}
+		log.Info().Strs("updates", lines).Msg("Dry run, not updating kubernetes workloads")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would update "+strconv.Itoa(len(lines))+" kubernetes containers:\n"+strings.Join(lines, "\n"))
+		return false
+	}
+
+	results, err := this.kubeUpdater.Update(this.ctx, workloads, images)
+	buildid, _ := this.buildidOf(images[0])
+	this.emit(Event{Type: EVENT_KUBERNETES, Buildid: buildid, Images: images, Workloads: results, Err: err})
+
+	updated := 0
+	for _, result := range results {
+		if result.Err == nil && len(result.Images) > 0 {
+			updated++
+		}
+	}
+	if err != nil {
+		this.notify(notify.EVENT_DEPLOYED, 0, "Updated "+strconv.Itoa(updated)+" kubernetes workloads, "+err.Error())
+		return false
+	}
+	if updated > 0 {
+		log.Info().Int("updated", updated).Msg("Rolled out new build to kubernetes")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Updated "+strconv.Itoa(updated)+" kubernetes workloads with the new build")
+	}
+	return true
+}
+
+func newKubeUpdater(config KubernetesConfig, variant func(string) (string, bool)) (*kube.Updater, error) {
+	if len(config.Workloads) == 0 {
+		return nil, nil
+	}
+	return kube.NewUpdater(expandHome(config.Kubeconfig), config.Context, variant, config.RolloutTimeout)
+}
+
+func newBuildJobs(config KubernetesConfig, dockerCli DockerClient, auth func(image string) (string, error), baseImageName string) (*kube.JobBuilder, error) {
+	if !config.Build.Enabled() {
+		return nil, nil
+	}
+	return kube.NewJobBuilder(expandHome(config.Kubeconfig), config.Context, config.Build, dockerCli, auth, baseImageName)
+}
@@ -0,0 +1,117 @@
+package watcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Labels stamped on every built image
+const (
+	LABEL_CREATED     = "org.opencontainers.image.created"
+	LABEL_BASE_NAME   = "org.opencontainers.image.base.name"
+	LABEL_BASE_DIGEST = "org.opencontainers.image.base.digest"
+	LABEL_BUILDID     = "io.csgo-watcher.buildid"
+	LABEL_BRANCH      = "io.csgo-watcher.branch"
+	// timeupdated of the branch on Steam when the build was installed, in Unix seconds
+	LABEL_TIMEUPDATED     = "io.csgo-watcher.timeupdated"
+	LABEL_WATCHER_VERSION = "io.csgo-watcher.version"
+	// Commit or artifact digest of the build context, with container_source
+	LABEL_CONTEXT_REVISION = "io.csgo-watcher.context-revision"
+	// Digest of the files of the build context
+	LABEL_CONTEXT_DIGEST = "io.csgo-watcher.context-digest"
+	// ID of the snapshot image the game was updated on, with build.snapshot
+	LABEL_SNAPSHOT = "io.csgo-watcher.snapshot"
+	// Digest of the build context and build args of the base image, with build.rebuild_base
+	LABEL_BASE_CONTEXT = "io.csgo-watcher.base-context"
+	// Versions of MetaMod:Source and SourceMod in the get5 image, if pinned or watched with build.plugins
+	LABEL_METAMOD   = "io.csgo-watcher.metamod"
+	LABEL_SOURCEMOD = "io.csgo-watcher.sourcemod"
+	// Followed by the name of a build.repositories, the commit of its files in the get5 image
+	LABEL_REPOSITORY_PREFIX = "io.csgo-watcher.repository."
+)
+
+// Labels of the containers the watcher runs itself, see sweepOrphans
+const (
+	// What the container is for, one of the HELPER_ kinds
+	LABEL_HELPER = "io.csgo-watcher.helper"
+	// Base image name of the watcher that created it, watchers of other base images leave it alone
+	LABEL_OWNER = "io.csgo-watcher.owner"
+)
+
+// Labels of a build that are known before the game is installed
+func (this *UpdateWatcher) buildLabels(baseImage string) (map[string]string, error) {
+	base, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, baseImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect base image: %w", err)
+	}
+
+	labels := map[string]string{
+		LABEL_CREATED:         time.Now().UTC().Format(time.RFC3339),
+		LABEL_BASE_NAME:       baseImage,
+		LABEL_BASE_DIGEST:     base.ID,
+		LABEL_BRANCH:          CSGO_BRANCH,
+		LABEL_WATCHER_VERSION: Version,
+	}
+	if this.contextRevision != "" {
+		labels[LABEL_CONTEXT_REVISION] = this.contextRevision
+	}
+	digest, err := this.contextDigest()
+	if err != nil {
+		return nil, err
+	}
+	labels[LABEL_CONTEXT_DIGEST] = digest
+	return labels, nil
+}
+
+// Add labels to an image by building a new image from it without any further layers
+func (this *UpdateWatcher) labelImage(image string, resultTag string, labels map[string]string) error {
+	dockerfile := []byte("FROM " + image + "\n")
+
+	var context bytes.Buffer
+	tw := tar.NewWriter(&context)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return fmt.Errorf("failed to create label build context: %w", err)
+	}
+	if _, err := tw.Write(dockerfile); err != nil {
+		return fmt.Errorf("failed to create label build context: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to create label build context: %w", err)
+	}
+
+	buildResp, err := this.dockerCli.ImageBuild(this.ctx, &context, types.ImageBuildOptions{
+		Tags:       []string{resultTag},
+		Dockerfile: "Dockerfile",
+		Labels:     labels,
+		Remove:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to label %s: %w", image, err)
+	}
+	defer buildResp.Body.Close()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(buildResp.Body, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to label %s: %w", image, err)
+	}
+
+	return nil
+}
+
+// Buildid stamped on an image, images built before labels were added only have it in their tag
+func labeledBuildid(labels map[string]string) (int, bool) {
+	value, ok := labels[LABEL_BUILDID]
+	if !ok {
+		return 0, false
+	}
+	buildid, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return buildid, true
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/leader"
+	"csgo-update-watcher/pkg/metrics"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+var ErrLockLost = errors.New("lost the watcher lock, another watcher may build now")
+
+func (this *LockConfig) validate(state StateConfig) error {
+	switch this.Driver {
+	case "":
+		return nil
+	case "file":
+		if this.Path == "" {
+			return fmt.Errorf("lock.path is required by the file lock")
+		}
+		this.Path = expandHome(this.Path)
+	case "postgres":
+		if this.DSN == "" && state.Driver == "postgres" {
+			this.DSN = state.DSN
+		}
+		if this.DSN == "" {
+			return fmt.Errorf("lock.dsn is required by the postgres lock without a postgres state store")
+		}
+	case "kubernetes":
+		if this.Namespace == "" {
+			return fmt.Errorf("lock.namespace is required by the kubernetes lock")
+		}
+	default:
+		return fmt.Errorf("unknown lock driver %q, expected file, postgres or kubernetes", this.Driver)
+	}
+	if this.Name == "" {
+		return fmt.Errorf("lock.name must not be empty")
+	}
+	if this.Retry <= 0 {
+		return fmt.Errorf("lock.retry must be positive")
+	}
+	return nil
+}
+
+// The configured lock, nil if the watcher runs alone
+func newLock(options Options) (leader.Lock, error) {
+	config := options.Lock
+	switch config.Driver {
+	case "file":
+		return leader.NewFile(config.Path, config.Retry), nil
+	case "postgres":
+		return leader.NewPostgres(config.DSN, config.Name, config.Retry), nil
+	case "kubernetes":
+		identity := config.Identity
+		if identity == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get hostname for the lease, set lock.identity: %w", err)
+			}
+			identity = hostname
+		}
+		return kube.NewLease(expandHome(options.Kubernetes.Kubeconfig), options.Kubernetes.Context, config.Namespace, config.Name, identity, config.Retry)
+	}
+	return nil, nil
+}
+
+// Run lead once this watcher holds the lock, then release it. Returns ErrLockLost if the lock was lost in between,
+// lead is stopped by cancelling the watcher then.
+func (this *UpdateWatcher) whileLeading(lead func() error) error {
+	if this.lock == nil {
+		return lead()
+	}
+	log.Info().Str("driver", this.options.Lock.Driver).Msg("Standing by until the watcher lock is free")
+	lost, err := this.lock.Acquire(this.ctx)
+	if err != nil {
+		if this.ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to acquire watcher lock: %w", err)
+	}
+	log.Info().Str("driver", this.options.Lock.Driver).Msg("Acquired watcher lock, watching Steam")
+	metrics.Leader.Set(1)
+	this.setLeading(true)
+
+	stopped := make(chan struct{})
+	wasLost := make(chan struct{})
+	go func() {
+		select {
+		case <-lost:
+			log.Error().Msg("Lost the watcher lock, stopping")
+			close(wasLost)
+			this.cancel()
+		case <-stopped:
+		}
+	}()
+	err = lead()
+	close(stopped)
+	// Whatever lead started stops before a standby takes over
+	this.cancel()
+	metrics.Leader.Set(0)
+	this.setLeading(false)
+	if err := this.lock.Release(); err != nil {
+		log.Err(err).Msg("Failed to release watcher lock")
+	}
+
+	select {
+	case <-wasLost:
+		return ErrLockLost
+	default:
+		return err
+	}
+}
+
+func (this *UpdateWatcher) setLeading(leading bool) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.leading = leading
+}
@@ -0,0 +1,92 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"time"
+)
+
+// Builds started within the last day by appid, guarding against building in a tight loop
+type buildLimiter struct {
+	starts map[int][]time.Time
+	// Apps whose limit was already alerted, until a build is allowed again
+	alerted map[int]bool
+}
+
+// Count a build of the app about to start, unless it would exceed build_limit. The first refusal of a limited period
+// is alerted to the notifiers and in the events.
+func (this *UpdateWatcher) reserveBuild(appid int) error {
+	limits := this.options.BuildLimit
+	if limits.PerHour == 0 && limits.PerDay == 0 {
+		return nil
+	}
+	if this.buildLimiter.starts == nil {
+		this.buildLimiter = buildLimiter{starts: this.recentBuildStarts(appid), alerted: map[int]bool{}}
+	}
+
+	now := time.Now()
+	starts := []time.Time{}
+	lastHour := 0
+	for _, start := range this.buildLimiter.starts[appid] {
+		if now.Sub(start) < time.Hour*24 {
+			starts = append(starts, start)
+			if now.Sub(start) < time.Hour {
+				lastHour++
+			}
+		}
+	}
+	this.buildLimiter.starts[appid] = starts
+
+	var err error
+	if limits.PerHour > 0 && lastHour >= limits.PerHour {
+		err = fmt.Errorf("build limit of %d builds per hour reached for appid %d", limits.PerHour, appid)
+	} else if limits.PerDay > 0 && len(starts) >= limits.PerDay {
+		err = fmt.Errorf("build limit of %d builds per day reached for appid %d", limits.PerDay, appid)
+	}
+	if err != nil {
+		metrics.BuildLimitReached.WithLabelValues(strconv.Itoa(appid)).Set(1)
+		if !this.buildLimiter.alerted[appid] {
+			this.buildLimiter.alerted[appid] = true
+			log.Err(err).Int("appid", appid).Msg("Refusing to build, is detection broken or the version source flapping?")
+			this.emit(Event{Type: EVENT_BUILD_LIMIT, Err: err})
+			this.notifyInBackground(notify.EVENT_WARNING, 0, "Stopped building: "+err.Error()+". Builds resume once older builds leave the window.")
+		}
+		return err
+	}
+
+	metrics.BuildLimitReached.WithLabelValues(strconv.Itoa(appid)).Set(0)
+	if this.buildLimiter.alerted[appid] {
+		delete(this.buildLimiter.alerted, appid)
+		log.Info().Int("appid", appid).Msg("Build limit no longer reached, building again")
+	}
+	this.buildLimiter.starts[appid] = append(starts, now)
+	return nil
+}
+
+// Builds of the last day from the history, so restarting the watcher does not reset the limit
+func (this *UpdateWatcher) recentBuildStarts(appid int) map[int][]time.Time {
+	starts := map[int][]time.Time{}
+	if this.history == nil || appid != CSGO_APPID {
+		return starts
+	}
+
+	limit := this.options.BuildLimit.PerDay
+	if limit < this.options.BuildLimit.PerHour {
+		limit = this.options.BuildLimit.PerHour
+	}
+	builds, err := this.history.Builds(store.BuildQuery{Limit: limit, Host: this.options.State.Host})
+	if err != nil {
+		log.Err(err).Msg("Failed to read recent builds for the build limit, only counting builds from now on")
+		return starts
+	}
+	for _, build := range builds {
+		if time.Since(build.StartedAt) < time.Hour*24 {
+			starts[appid] = append(starts[appid], build.StartedAt)
+		}
+	}
+	return starts
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// Fields available in link templates
+type linkData struct {
+	BuildID int
+	// Build the version replaces, 0 if unknown
+	PreviousBuildID int
+	AppID           int
+	Branch          string
+}
+
+// Where admins can look up what Valve changed in a build
+type Links struct {
+	// Patch notes and changed files of the build
+	Build string `json:"build,omitempty"`
+	// Depots and manifests of the branch
+	Branch string `json:"branch,omitempty"`
+}
+
+type linkTemplates struct {
+	build  *template.Template
+	branch *template.Template
+}
+
+func newLinkTemplates(config LinksConfig) (linkTemplates, error) {
+	templates := linkTemplates{}
+	for _, link := range []struct {
+		name     string
+		text     string
+		template **template.Template
+	}{
+		{"build", config.Build, &templates.build},
+		{"branch", config.Branch, &templates.branch},
+	} {
+		if link.text == "" {
+			continue
+		}
+		parsed, err := template.New(link.name).Option("missingkey=error").Parse(link.text)
+		if err != nil {
+			return templates, fmt.Errorf("invalid %s link template: %w", link.name, err)
+		}
+		// Catch unknown fields now instead of on the first new version
+		if err := parsed.Execute(&bytes.Buffer{}, linkData{}); err != nil {
+			return templates, fmt.Errorf("invalid %s link template: %w", link.name, err)
+		}
+		*link.template = parsed
+	}
+	return templates, nil
+}
+
+// Links of the build, nil if there are none
+func (this *UpdateWatcher) links(buildid int, previous int) *Links {
+	if buildid <= 0 || (this.linkTemplates.build == nil && this.linkTemplates.branch == nil) {
+		return nil
+	}
+
+	data := linkData{BuildID: buildid, PreviousBuildID: previous, AppID: CSGO_APPID, Branch: CSGO_BRANCH}
+	render := func(tmpl *template.Template) string {
+		if tmpl == nil {
+			return ""
+		}
+		var rendered bytes.Buffer
+		// Checked with the same fields by newLinkTemplates
+		_ = tmpl.Execute(&rendered, data)
+		return rendered.String()
+	}
+	return &Links{Build: render(this.linkTemplates.build), Branch: render(this.linkTemplates.branch)}
+}
+
+// The link of the build to append to a message
+func (this *UpdateWatcher) buildLink(buildid int) string {
+	if links := this.links(buildid, 0); links != nil && links.Build != "" {
+		return " " + links.Build
+	}
+	return ""
+}
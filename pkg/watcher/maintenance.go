@@ -0,0 +1,104 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/rollout"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+// How long POST /maintenance/force ignores the maintenance windows without ?for=
+const defaultMaintenanceForce = time.Hour
+
+// Whether the maintenance window is open now. No window is always open, and so are all of them while forced.
+func (this *UpdateWatcher) maintenanceOpen(window string) bool {
+	if window == "" || this.maintenanceForced() {
+		return true
+	}
+	// Validated when loading the config
+	parsed, err := rollout.ParseWindow(window)
+	return err != nil || parsed.Contains(time.Now())
+}
+
+func (this *UpdateWatcher) maintenanceForced() bool {
+	this.maintenanceMutex.Lock()
+	defer this.maintenanceMutex.Unlock()
+	return time.Now().Before(this.forcedUntil)
+}
+
+// ForceMaintenance ignores the maintenance windows for the duration: a waiting build starts on the next check and
+// waiting deployments and restarts run right away
+func (this *UpdateWatcher) ForceMaintenance(duration time.Duration) {
+	this.maintenanceMutex.Lock()
+	this.forcedUntil = time.Now().Add(duration)
+	this.maintenanceMutex.Unlock()
+	log.Warn().Dur("duration", duration).Msg("Ignoring maintenance windows")
+	this.requestCheck("forced maintenance")
+}
+
+// Deploy the images now if server restarts are allowed, otherwise once maintenance.restarts opens. A newer build
+// replaces the images waiting, they are not kept across restarts of the watcher.
+func (this *UpdateWatcher) deployInWindow(images []string) {
+	if !this.deploys() || len(images) == 0 {
+		return
+	}
+	if this.maintenanceOpen(this.options.Maintenance.Restarts) {
+		this.deploy(images)
+		return
+	}
+	this.maintenanceMutex.Lock()
+	this.pendingDeploy = images
+	this.maintenanceMutex.Unlock()
+	log.Info().Strs("images", images).Str("window", this.options.Maintenance.Restarts).Msg("Deployment waits for maintenance window")
+}
+
+// Deploy the images waiting for maintenance.restarts once it opened, called on every check
+func (this *UpdateWatcher) deployPending() {
+	if !this.maintenanceOpen(this.options.Maintenance.Restarts) {
+		return
+	}
+	this.maintenanceMutex.Lock()
+	images := this.pendingDeploy
+	this.pendingDeploy = nil
+	this.maintenanceMutex.Unlock()
+	if len(images) > 0 {
+		log.Info().Strs("images", images).Msg("Maintenance window opened, deploying")
+		this.deploy(images)
+	}
+}
+
+// The policy of servers without an override or label of their own restart window, nil while forced
+func (this *UpdateWatcher) maintenanceWindow() *rollout.Window {
+	if this.options.Maintenance.Restarts == "" || this.maintenanceForced() {
+		return nil
+	}
+	// Validated when loading the config
+	window, err := rollout.ParseWindow(this.options.Maintenance.Restarts)
+	if err != nil {
+		return nil
+	}
+	return &window
+}
+
+// POST /maintenance/force, optionally with ?for=30m
+func (this *UpdateWatcher) handleMaintenanceForce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	duration := defaultMaintenanceForce
+	if value := r.URL.Query().Get("for"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid duration "+value)
+			return
+		}
+		duration = parsed
+	}
+	log.Info().Str("remote", r.RemoteAddr).Msg("Forced maintenance requested")
+	this.ForceMaintenance(duration)
+	this.maintenanceMutex.Lock()
+	until := this.forcedUntil
+	this.maintenanceMutex.Unlock()
+	writeJson(w, http.StatusOK, map[string]time.Time{"forced_until": until})
+}
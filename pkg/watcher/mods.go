@@ -0,0 +1,223 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/trigger"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout of a query of an AlliedModders drop
+const modWatchTimeout = 10 * time.Second
+
+// Largest latest file of a drop branch
+const maxLatestFile = 1024
+
+// A mod of the get5 image built by AlliedModders
+type alliedMod struct {
+	name string
+	// Prefix of its build args of the get5 image, e.g. SOURCEMOD_VERSION
+	arg string
+	// URL of the drop holding a directory of builds per branch, and the prefix of their files
+	drop string
+	file string
+}
+
+var (
+	metamod   = alliedMod{"MetaMod:Source", "METAMOD", "https://mms.alliedmods.net/mmsdrop/", "mmsource"}
+	sourcemod = alliedMod{"SourceMod", "SOURCEMOD", "https://sm.alliedmods.net/smdrop/", "sourcemod"}
+)
+
+// The Linux archive of a build
+func (this alliedMod) download(branch string, version string) string {
+	return this.drop + branch + "/" + this.file + "-" + version + "-linux.tar.gz"
+}
+
+// The file naming the archive of the newest build of a branch
+func (this alliedMod) latest(branch string) string {
+	return this.drop + branch + "/" + this.file + "-latest-linux"
+}
+
+// Versions of the mods in the get5 image of a build, empty if neither pinned nor watched
+type modVersions struct {
+	MetaMod   string
+	SourceMod string
+}
+
+func (this modVersions) labels() map[string]string {
+	labels := map[string]string{}
+	if this.MetaMod != "" {
+		labels[LABEL_METAMOD] = this.MetaMod
+	}
+	if this.SourceMod != "" {
+		labels[LABEL_SOURCEMOD] = this.SourceMod
+	}
+	return labels
+}
+
+// Read the newest version of a drop branch from its latest file, e.g. sourcemod-1.11.0-git6911-linux.tar.gz
+func fetchLatestMod(ctx context.Context, client *http.Client, mod alliedMod, branch string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, mod.latest(branch), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch newest %s: %w", mod.name, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch newest %s: %s", mod.name, response.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxLatestFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch newest %s: %w", mod.name, err)
+	}
+
+	name := strings.TrimSpace(string(body))
+	prefix, suffix := mod.file+"-", "-linux.tar.gz"
+	version := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || !modVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("unexpected newest %s %q", mod.name, name)
+	}
+	return version, nil
+}
+
+// The pinned versions of build.plugins, and with build.plugins.watch the newest builds of the others
+func (this *UpdateWatcher) fetchModVersions(client *http.Client) (modVersions, error) {
+	plugins := this.options.Build.Plugins
+	mods := modVersions{MetaMod: plugins.MetamodVersion, SourceMod: plugins.SourcemodVersion}
+	if !plugins.Watch.Enabled {
+		return mods, nil
+	}
+	var err error
+	if mods.MetaMod == "" {
+		if mods.MetaMod, err = fetchLatestMod(this.ctx, client, metamod, plugins.Watch.MetamodBranch); err != nil {
+			return modVersions{}, err
+		}
+	}
+	if mods.SourceMod == "" {
+		if mods.SourceMod, err = fetchLatestMod(this.ctx, client, sourcemod, plugins.Watch.SourcemodBranch); err != nil {
+			return modVersions{}, err
+		}
+	}
+	return mods, nil
+}
+
+// Versions of the mods of the next build. Watched mods are fetched right away, if the drops fail to answer the build
+// gets the versions of the last poll.
+func (this *UpdateWatcher) buildMods() (modVersions, error) {
+	mods, err := this.fetchModVersions(&http.Client{Timeout: modWatchTimeout})
+	if err == nil {
+		return mods, nil
+	}
+	this.modsMutex.Lock()
+	watched := this.watchedMods
+	this.modsMutex.Unlock()
+	if watched == (modVersions{}) {
+		return modVersions{}, fmt.Errorf("failed to get the mod versions of the build: %w", err)
+	}
+	log.Warn().Err(err).Str("metamod", watched.MetaMod).Str("sourcemod", watched.SourceMod).Msg("Failed to get newest mods, building the versions of the last poll")
+	return watched, nil
+}
+
+// Poll the drop branches of build.plugins.watch and fire a rebuild of the newest buildid once a mod has a newer build
+// than its get5 image. Releases while the watcher was down are picked up by the first poll. While the drops fail,
+// builds of new buildids get the versions of the last poll.
+func (this *UpdateWatcher) watchMods(ctx context.Context, report trigger.Reporter) {
+	client := &http.Client{Timeout: modWatchTimeout}
+	ticker := time.NewTicker(this.options.Build.Plugins.Watch.Interval)
+	defer ticker.Stop()
+
+	var last modVersions
+	for {
+		mods, err := this.fetchModVersions(client)
+		report.Polled(err)
+		if err == nil {
+			this.modsMutex.Lock()
+			this.watchedMods = mods
+			this.modsMutex.Unlock()
+			if mods != last {
+				last = mods
+				if reason := this.modsChanged(mods); reason != "" {
+					report.Fire(reason, true)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// The reason to rebuild if the newest get5 image has other mods, empty otherwise. Images without mod labels, built
+// before the mods were watched, are not compared.
+func (this *UpdateWatcher) modsChanged(mods modVersions) string {
+	labels, buildid, err := this.newestLabels(LABEL_METAMOD, LABEL_SOURCEMOD)
+	if err != nil {
+		log.Err(err).Msg("Failed to read the mods of the newest build")
+		return ""
+	}
+	if buildid < 0 {
+		log.Debug().Msg("No build with mod labels to compare the newest mods with")
+		return ""
+	}
+
+	built := modVersions{MetaMod: labels[LABEL_METAMOD], SourceMod: labels[LABEL_SOURCEMOD]}
+	releases := []string{}
+	if mods.MetaMod != built.MetaMod {
+		releases = append(releases, metamod.name+" "+mods.MetaMod)
+	}
+	if mods.SourceMod != built.SourceMod {
+		releases = append(releases, sourcemod.name+" "+mods.SourceMod)
+	}
+	if len(releases) == 0 {
+		return ""
+	}
+	log.Info().Int("buildid", buildid).Strs("releases", releases).Msg("New mod release, rebuilding the newest buildid")
+	this.notifyInBackground(notify.EVENT_UPDATE_DETECTED, buildid, fmt.Sprintf("New release of %s, rebuilding buildid %d", strings.Join(releases, " and "), buildid))
+	return "new " + strings.Join(releases, ", ")
+}
+
+// The labels of the newest image of the repository by buildid and creation that has a label starting with one of the
+// prefixes, and its buildid, -1 without one. Only the get5 image and the variants built on it carry the labels of
+// its mods and repositories.
+func (this *UpdateWatcher) newestLabels(prefixes ...string) (map[string]string, int, error) {
+	images, err := this.dockerCli.ImageList(this.ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list images on docker host: %w", err)
+	}
+	labels, newest, created := map[string]string{}, -1, int64(0)
+	for _, image := range images {
+		buildid, ok := labeledBuildid(image.Labels)
+		if !ok || len(this.repositoryTags(image)) == 0 || !hasLabelPrefix(image.Labels, prefixes) {
+			continue
+		}
+		if buildid < newest || (buildid == newest && image.Created <= created) {
+			continue
+		}
+		labels, newest, created = image.Labels, buildid, image.Created
+	}
+	return labels, newest, nil
+}
+
+func hasLabelPrefix(labels map[string]string, prefixes []string) bool {
+	for key := range labels {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
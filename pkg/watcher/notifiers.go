@@ -0,0 +1,31 @@
+package watcher
+
+import "csgo-update-watcher/pkg/notify"
+
+// Notifier of discord_hook
+const discordHookNotifier = "discord_hook"
+
+// The notifiers configured, and discord_hook as a Discord notifier sent every event but the start and success of
+// builds, what it was sent before there were notifiers
+func (this Options) notifierConfigs() []notify.Config {
+	configs := append([]notify.Config{}, this.Notifiers...)
+	if this.DiscordHook != "" {
+		events := []string{}
+		for _, event := range notify.EventNames() {
+			if event != notify.EVENT_BUILD_STARTED && event != notify.EVENT_BUILD_SUCCEEDED {
+				events = append(events, event)
+			}
+		}
+		configs = append(configs, notify.Config{Type: "discord", Name: discordHookNotifier, Events: events, WebhookURL: this.DiscordHook})
+	}
+	return configs
+}
+
+// Tell the notifiers of the event, buildid is 0 if the message is about no build in particular
+func (this *UpdateWatcher) notify(event string, buildid int, text string) {
+	this.notifiers.Send(notify.Message{Event: event, Text: text, Buildid: buildid})
+}
+
+func (this *UpdateWatcher) notifyInBackground(event string, buildid int, text string) {
+	this.background(func() { this.notify(event, buildid, text) })
+}
@@ -0,0 +1,77 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Reconcile publishes the newest build of the GameServerImage's branch to its repository, building it first if the
+// docker host has none. Builds are published to the configured targets as usual and rolled out.
+func (this *UpdateWatcher) Reconcile(ctx context.Context, spec kube.ImageSpec) (kube.ImageStatus, error) {
+	if spec.AppID != CSGO_APPID || spec.Branch != CSGO_BRANCH {
+		return kube.ImageStatus{}, fmt.Errorf("only appid %d on branch %s can be built, not appid %d on branch %s", CSGO_APPID, CSGO_BRANCH, spec.AppID, spec.Branch)
+	}
+	target := PublishTarget{Name: spec.Repository, Repository: spec.Repository}
+	this.publishPending()
+	this.deployPending()
+
+	if err := this.runHooks(HOOK_PRE_CHECK, hookData{SteamBuildid: this.lastSteamCheck.SteamBuildid}); err != nil {
+		return kube.ImageStatus{}, err
+	}
+	latest, err := this.latestVersion()
+	if err != nil {
+		this.checked(store.Check{Time: time.Now(), Error: err.Error()}, err)
+		this.steamFailed(err)
+		return kube.ImageStatus{}, fmt.Errorf("failed to get latest version from Steam: %w", err)
+	}
+	releasedAt := this.steamChecked(latest)
+	status := kube.ImageStatus{Buildid: latest}
+	if imageTags, err := this.imageTags(latest); err == nil {
+		status.Image = target.Reference(imageTags[1])
+		if status.Digest, err = registry.Digest(ctx, status.Image, this.registryAuth.Keychain()); err == nil {
+			return status, nil
+		}
+	}
+
+	outdated, newest, err := this.outdated(latest)
+	if err != nil {
+		this.checked(store.Check{Time: time.Now(), SteamBuildid: latest, Error: err.Error()}, err)
+		return status, err
+	}
+	this.checked(store.Check{Time: time.Now(), SteamBuildid: latest, LocalBuildid: newest}, nil)
+	if outdated {
+		if !this.maintenanceOpen(this.options.Maintenance.Builds) {
+			return status, fmt.Errorf("buildid %d waits for the maintenance window %s", latest, this.options.Maintenance.Builds)
+		}
+		this.recordDetection(latest, releasedAt)
+		if err := this.reserveBuild(CSGO_APPID); err != nil {
+			return status, err
+		}
+		this.emit(Event{Type: EVENT_NEW_VERSION, Buildid: latest, LocalBuildid: newest})
+		this.background(func() { this.announceNewVersion(latest, newest) })
+		if _, status.Buildid, err = this.buildContainerAndPublish(latest); err != nil {
+			return status, err
+		}
+	}
+
+	imageTags, err := this.imageTags(status.Buildid)
+	if err != nil {
+		return status, err
+	}
+	log.Info().Str("repository", spec.Repository).Int("buildid", status.Buildid).Msg("Publishing build for GameServerImage")
+	result := this.publishToTarget(target, imageTags)
+	if result.Err != nil {
+		return status, result.Err
+	}
+	this.updateCatalog([]PublishResult{result})
+	status.Image = target.Reference(imageTags[1])
+	if status.Digest, err = registry.Digest(ctx, status.Image, this.registryAuth.Keychain()); err != nil {
+		return status, fmt.Errorf("failed to get digest of %s: %w", status.Image, err)
+	}
+	return status, nil
+}
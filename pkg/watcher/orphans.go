@@ -0,0 +1,91 @@
+package watcher
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix of the temporary files and directories of the watcher and its engines
+const tempFilePrefix = "csgo-watcher-"
+
+// Temporary files this old are left over from a crash, younger ones may belong to another watcher on the host
+const staleTempAge = 24 * time.Hour
+
+// Kinds of containers in LABEL_HELPER
+const (
+	HELPER_SHELL          = "shell"
+	HELPER_STEAMCMD_CACHE = "steamcmd-cache"
+	HELPER_SMOKE_TEST     = "smoke-test"
+	HELPER_HOOK           = "hook"
+)
+
+type imageRemover interface {
+	ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+}
+
+// Labels of a container the watcher runs itself, so a crash does not leak it
+func (this *UpdateWatcher) helperLabels(kind string) map[string]string {
+	return map[string]string{LABEL_HELPER: kind, LABEL_OWNER: this.BaseImageName}
+}
+
+// Remove the helper containers, temporary images and temporary files a previous run left behind when it crashed.
+// Called once the watcher holds the lock, so a standby never removes what the leader still uses.
+func (this *UpdateWatcher) sweepOrphans() {
+	containers, err := this.dockerCli.ContainerList(this.ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LABEL_OWNER+"="+this.BaseImageName)),
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to list orphaned helper containers")
+	}
+	for _, container := range containers {
+		if err := this.dockerCli.ContainerRemove(this.ctx, container.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Err(err).Str("container", container.ID).Msg("Failed to remove orphaned helper container")
+			continue
+		}
+		log.Info().Str("container", container.ID).Str("helper", container.Labels[LABEL_HELPER]).Msg("Removed orphaned helper container")
+	}
+
+	if remover, ok := this.dockerCli.(imageRemover); ok {
+		images, err := this.dockerCli.ImageList(this.ctx, types.ImageListOptions{})
+		if err != nil {
+			log.Err(err).Msg("Failed to list orphaned temporary images")
+		}
+		for _, image := range images {
+			for _, tag := range image.RepoTags {
+				if !strings.HasPrefix(tag, this.BaseImageName+":temp-") {
+					continue
+				}
+				if _, err := remover.ImageRemove(this.ctx, tag, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+					log.Err(err).Str("image", tag).Msg("Failed to remove orphaned temporary image")
+					continue
+				}
+				log.Info().Str("image", tag).Msg("Removed orphaned temporary image")
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		log.Err(err).Msg("Failed to list orphaned temporary files")
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) || time.Since(entry.ModTime()) < staleTempAge {
+			continue
+		}
+		path := filepath.Join(os.TempDir(), entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			log.Err(err).Str("path", path).Msg("Failed to remove orphaned temporary file")
+			continue
+		}
+		log.Info().Str("path", path).Msg("Removed orphaned temporary file")
+	}
+}
@@ -0,0 +1,247 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/rollout"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of a build after PHASE_BUILD, tracked in store.Build.Phases. Each can wait for a window of publish.schedule.
+const (
+	// Pushing to the first publish target
+	PHASE_PUSH = "push"
+	// Publishing to the other targets, copied from the first one with publish.replicate
+	PHASE_REPLICATE = "replicate"
+)
+
+// A build whose push or replication waits for its window
+type pendingPublish struct {
+	record *store.Build
+	// Local tags to publish, including the moving tag
+	tags []string
+}
+
+// Publish a new build right away or, for phases with a window in publish.schedule, once their window opens. A build
+// still waiting for a phase replaces the pending phases of an older build. Returns an error if the build was not
+// published to any target and nothing is left to try.
+func (this *UpdateWatcher) schedulePublish(record *store.Build, tags []string) error {
+	targets := this.options.Publish.AllTargets()
+	now := time.Now()
+	record.Phases = map[string]store.Phase{PHASE_BUILD: {State: store.PhaseDone, At: now}}
+	if len(targets) > 0 {
+		record.Phases[PHASE_PUSH] = store.Phase{State: store.PhasePending, At: now}
+	} else {
+		record.PushedAt = now
+	}
+	if len(targets) > 1 {
+		record.Phases[PHASE_REPLICATE] = store.Phase{State: store.PhasePending, At: now}
+	}
+
+	this.publishMutex.Lock()
+	defer this.publishMutex.Unlock()
+	this.pendingLoaded = true
+	if previous := this.pendingPublish; previous != nil {
+		this.skipPending(previous, record.Buildid)
+		this.pendingPublish = nil
+	}
+
+	pending := &pendingPublish{record, tags}
+	results, _ := this.runDuePhases(pending)
+	err := this.finishPhases(pending, results, len(targets) == 0)
+	if record.Pending() {
+		this.pendingPublish = pending
+		log.Info().Int("buildid", record.Buildid).Strs("phases", pendingPhases(*record)).Msg("Publishing of the build waits for its schedule")
+	}
+	return err
+}
+
+// Run the phases of the pending build whose window is open, called on every check. The history is updated with
+// their outcome.
+func (this *UpdateWatcher) publishPending() {
+	this.publishMutex.Lock()
+	defer this.publishMutex.Unlock()
+	if !this.pendingLoaded {
+		this.pendingPublish = this.loadPendingPublish()
+		this.pendingLoaded = true
+	}
+	pending := this.pendingPublish
+	if pending == nil {
+		return
+	}
+
+	results, ran := this.runDuePhases(pending)
+	if !ran {
+		return
+	}
+	err := this.finishPhases(pending, results, false)
+	if err != nil {
+		pending.record.Outcome = store.OutcomeFailed
+		pending.record.Error = err.Error()
+	}
+	this.emit(Event{Type: EVENT_PUBLISH, Buildid: pending.record.Buildid, Images: pushedImages(results), Err: err})
+	if !pending.record.Pending() {
+		this.pendingPublish = nil
+	}
+	this.updateRecordedBuild(pending.record)
+}
+
+// Run every pending phase whose window is open, returns whether any ran
+func (this *UpdateWatcher) runDuePhases(pending *pendingPublish) ([]PublishResult, bool) {
+	record := pending.record
+	targets := this.options.Publish.AllTargets()
+	results := []PublishResult{}
+	ran := false
+	for _, phase := range []string{PHASE_PUSH, PHASE_REPLICATE} {
+		if record.Phases[phase].State != store.PhasePending || !this.phaseDue(phase, *record, time.Now()) {
+			continue
+		}
+		ran = true
+
+		var phaseResults []PublishResult
+		var err error
+		if phase == PHASE_PUSH {
+			phaseResults, err = this.publish(pending.tags, targets[:1], nil)
+		} else {
+			// Copied from the first target only if it has the images
+			var primary *PublishTarget
+			if record.Phases[PHASE_PUSH].State == store.PhaseDone {
+				primary = &targets[0]
+			}
+			phaseResults, err = this.publish(pending.tags, targets[1:], primary)
+		}
+
+		state := store.Phase{State: store.PhaseDone, At: time.Now()}
+		if err != nil {
+			state.Error = err.Error()
+			if len(pushedImages(phaseResults)) == 0 {
+				state.State = store.PhaseFailed
+			}
+			this.notifyInBackground(notify.EVENT_BUILD_FAILED, record.Buildid, "Failed to publish buildid "+strconv.Itoa(record.Buildid)+": "+err.Error())
+		}
+		record.Phases[phase] = state
+		results = append(results, phaseResults...)
+	}
+	return results, ran
+}
+
+// Record what the phases published, then attest, catalog and deploy it. Nothing is deployed with production targets,
+// their servers are only updated once the build is promoted. Builds without publish targets only deploy the local
+// images.
+func (this *UpdateWatcher) finishPhases(pending *pendingPublish, results []PublishResult, local bool) error {
+	record := pending.record
+	pushed := pushedImages(results)
+	if len(pushed) > 0 && record.PushedAt.IsZero() {
+		record.PushedAt = time.Now()
+	}
+	record.Pushed = append(record.Pushed, pushed...)
+
+	failures := []string{}
+	for _, phase := range []string{PHASE_PUSH, PHASE_REPLICATE} {
+		if state := record.Phases[phase]; state.Error != "" {
+			failures = append(failures, state.Error)
+		}
+	}
+	if len(record.Pushed) == 0 && !record.Pending() && !local {
+		return fmt.Errorf("failed to push newly build cs:go container to registry: %s", strings.Join(failures, "; "))
+	}
+	if len(failures) > 0 {
+		// A partial failure still leaves a usable build
+		record.Outcome = store.OutcomePartial
+		record.Error = strings.Join(failures, "; ")
+	}
+
+	if len(results) > 0 {
+		this.updateCatalog(results)
+		if this.options.Publish.Attestations {
+			this.attest(record.Images[0], record.Buildid, record.StartedAt, results)
+		}
+	}
+	if len(this.options.Publish.Production) == 0 && (len(pushed) > 0 || local) {
+		this.deployInWindow(append(append([]string{}, record.Images...), pushed...))
+	}
+	return nil
+}
+
+// A phase is due once its window opens, replication only after the push
+func (this *UpdateWatcher) phaseDue(phase string, record store.Build, now time.Time) bool {
+	window := this.options.Publish.Schedule.Push
+	if phase == PHASE_REPLICATE {
+		if record.Phases[PHASE_PUSH].State == store.PhasePending {
+			return false
+		}
+		window = this.options.Publish.Schedule.Replicate
+	}
+	if window == "" {
+		return true
+	}
+	parsed, err := rollout.ParseWindow(window)
+	return err == nil && parsed.Contains(now)
+}
+
+// A newer build is published instead, the pending phases of the older one are given up
+func (this *UpdateWatcher) skipPending(pending *pendingPublish, buildid int) {
+	for _, phase := range pendingPhases(*pending.record) {
+		pending.record.Phases[phase] = store.Phase{State: store.PhaseSkipped, At: time.Now(), Error: "superseded by buildid " + strconv.Itoa(buildid)}
+	}
+	log.Info().Int("buildid", pending.record.Buildid).Int("superseded-by", buildid).Msg("Not publishing older build waiting for its schedule")
+	this.updateRecordedBuild(pending.record)
+}
+
+// The newest build of the own host if it still waits for a phase, e.g. after a restart
+func (this *UpdateWatcher) loadPendingPublish() *pendingPublish {
+	if this.history == nil {
+		return nil
+	}
+	builds, err := this.history.Builds(store.BuildQuery{Limit: 1, Host: this.options.State.Host})
+	if err != nil {
+		log.Err(err).Msg("Failed to read build history, not resuming scheduled publishing")
+		return nil
+	}
+	if len(builds) == 0 || !builds[0].Pending() || builds[0].Outcome == store.OutcomeFailed || len(builds[0].Images) < len(variants) {
+		return nil
+	}
+
+	record := builds[0]
+	tags := append([]string{}, record.Images...)
+	if latest := this.latestTag(); latest != "" {
+		get5 := record.Images[len(variants)-1]
+		if err := this.dockerCli.ImageTag(this.ctx, get5, latest); err != nil {
+			log.Err(err).Str("image", get5).Msg("Failed to tag scheduled build as latest, publishing it without")
+		} else {
+			tags = append(tags, latest)
+		}
+	}
+	log.Info().Int("buildid", record.Buildid).Strs("phases", pendingPhases(record)).Msg("Resuming scheduled publishing of build")
+	return &pendingPublish{&record, tags}
+}
+
+// Write the changed phases of a recorded build to the history
+func (this *UpdateWatcher) updateRecordedBuild(record *store.Build) {
+	if this.history == nil || record.ID == 0 {
+		return
+	}
+	if len(record.Images) > 0 {
+		if image, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, finalImage(record.Images)); err == nil {
+			record.Digests = image.RepoDigests
+		}
+	}
+	if err := this.history.UpdateBuild(*record); err != nil {
+		log.Err(err).Int("buildid", record.Buildid).Msg("Failed to update build in history")
+	}
+	this.refreshSLO()
+}
+
+func pendingPhases(record store.Build) []string {
+	phases := []string{}
+	for _, phase := range []string{PHASE_PUSH, PHASE_REPLICATE} {
+		if record.Phases[phase].State == store.PhasePending {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
@@ -0,0 +1,62 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"csgo-update-watcher/pkg/steam"
+	"csgo-update-watcher/pkg/trigger"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Timeout of a query of the PICS mirror
+const picsTimeout = 10 * time.Second
+
+func renderPICSURL(text string) (string, error) {
+	parsed, err := template.New("url").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid pics.url: %w", err)
+	}
+	var url bytes.Buffer
+	if err := parsed.Execute(&url, struct{ AppID int }{CSGO_APPID}); err != nil {
+		return "", fmt.Errorf("invalid pics.url: %w", err)
+	}
+	return url.String(), nil
+}
+
+// Poll the PICS mirror and fire whenever the buildid of the branch changes. Mirrors without buildids fire on every
+// change of the app.
+func (this *UpdateWatcher) watchPICS(ctx context.Context, report trigger.Reporter) {
+	config := this.options.PICS
+	url, err := renderPICSURL(config.URL)
+	if err != nil {
+		log.Err(err).Msg("Not watching PICS")
+		return
+	}
+	client := &http.Client{Timeout: picsTimeout}
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	var last *steam.PICSInfo
+	for {
+		info, err := steam.FetchPICS(ctx, client, url, CSGO_APPID, CSGO_BRANCH)
+		report.Polled(err)
+		if err == nil {
+			if last != nil && info.ChangeNumber != last.ChangeNumber && (info.Buildid == 0 || info.Buildid != last.Buildid) {
+				log.Info().Int("changenumber", info.ChangeNumber).Int("buildid", info.Buildid).Msg("PICS reported a change")
+				report.Fire("pics change "+strconv.Itoa(info.ChangeNumber), false)
+			}
+			last = info
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/pipeline"
+	"csgo-update-watcher/pkg/registry"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerStep(STEP_PIPELINES, func(options Options) bool {
+		return len(options.Pipelines) > 0
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.triggerPipelines)
+	})
+}
+
+// Start the CI pipelines for the build of the images, with the digests of the pushed ones. Returns whether every
+// pipeline started.
+func (this *UpdateWatcher) triggerPipelines(images []string) bool {
+	buildid, _ := this.buildidOf(images[0])
+	if this.options.Rollout.DryRun {
+		names := this.pipelines.Names()
+		log.Info().Strs("pipelines", names).Int("buildid", buildid).Msg("Dry run, not starting pipelines")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would start pipelines "+strings.Join(names, ", "))
+		return false
+	}
+
+	build := pipeline.Build{Buildid: buildid}
+	for _, image := range images {
+		published := pipeline.Image{Reference: image}
+		if registry.RepositoryOf(image) != this.BaseImageName {
+			digest, err := registry.Digest(this.ctx, image, this.registryAuth.Keychain())
+			if err != nil {
+				log.Warn().Err(err).Str("image", image).Msg("Failed to get digest of image, starting pipelines without it")
+			}
+			published.Digest = digest
+		}
+		build.Images = append(build.Images, published)
+	}
+
+	results, err := this.pipelines.Trigger(this.ctx, build)
+	this.emit(Event{Type: EVENT_PIPELINES, Buildid: buildid, Images: images, Pipelines: results, Err: err})
+	started := []string{}
+	for _, result := range results {
+		if result.Err == nil {
+			started = append(started, result.Pipeline)
+		}
+	}
+	if err != nil {
+		this.notify(notify.EVENT_DEPLOYED, buildid, "Started "+strings.Join(started, ", ")+", "+err.Error())
+		return false
+	}
+	log.Info().Strs("pipelines", started).Int("buildid", buildid).Msg("Started pipelines of new build")
+	this.notify(notify.EVENT_DEPLOYED, buildid, "Started pipelines "+strings.Join(started, ", ")+" for buildid "+strconv.Itoa(buildid))
+	return true
+}
@@ -0,0 +1,137 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/rollout"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Discord messages are limited to 2000 characters
+const dryRunMessageSteps = 20
+
+// DryRun returns the restarts a rollout of the build would perform right now, in order, without changing anything.
+// Buildid 0 is the newest build. With production the build's production images are included, as promote would roll
+// them out.
+func (this *UpdateWatcher) DryRun(buildid int, production bool) ([]rollout.Step, error) {
+	if this.orchestrator == nil {
+		return nil, ErrFleetDisabled
+	}
+
+	if buildid == 0 {
+		newest, err := this.newestBuildVersion()
+		if err != nil {
+			return nil, err
+		}
+		if newest < 0 {
+			return nil, fmt.Errorf("no build found")
+		}
+		buildid = newest
+	}
+
+	images, err := this.buildImages(buildid, production)
+	if err != nil {
+		return nil, err
+	}
+	return this.orchestrator.DryRun(this.ctx, images)
+}
+
+// DryRunRestart returns the restarts the scheduled restart with the name would perform right now, in order, without
+// changing anything
+func (this *UpdateWatcher) DryRunRestart(name string) ([]rollout.Step, error) {
+	if this.orchestrator == nil {
+		return nil, ErrFleetDisabled
+	}
+
+	for _, restart := range this.options.Fleet.Restarts {
+		if restart.String() == name {
+			return this.orchestrator.DryRunRestart(this.ctx, restart.selector())
+		}
+	}
+	return nil, fmt.Errorf("no scheduled restart %q", name)
+}
+
+// Every image a rollout of the build would use: the local images and their references in the publish targets, and
+// in production as well if production is set
+func (this *UpdateWatcher) buildImages(buildid int, production bool) ([]string, error) {
+	localTags, err := this.imageTags(buildid)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := this.options.Publish.AllTargets()
+	if production {
+		targets = append(targets, this.options.Publish.Production...)
+	}
+	images := append([]string{}, localTags...)
+	for _, target := range targets {
+		for _, localTag := range localTags {
+			images = append(images, target.Reference(localTag))
+		}
+	}
+	return images, nil
+}
+
+// Log and announce what an automated rollout or restart would have done with rollout.dry_run
+func (this *UpdateWatcher) reportDryRun(name string, steps []rollout.Step, err error) {
+	if err != nil {
+		log.Err(err).Str("rollout", name).Msg("Dry run could not plan every target")
+	}
+	for _, step := range steps {
+		log.Info().Str("rollout", name).Str("target", step.Target).Str("server", step.Server.Name).Str("image", step.Image).Str("gate", step.Gate).Int("relays", len(step.Relays)).Msg("Dry run, would restart server")
+	}
+	if len(steps) == 0 {
+		return
+	}
+
+	lines := this.FormatSteps(steps)
+	message := "Dry run of " + name + ", would restart " + strconv.Itoa(len(steps)) + " servers:\n"
+	if len(lines) > dryRunMessageSteps {
+		message += strings.Join(lines[:dryRunMessageSteps], "\n") + "\n... and " + strconv.Itoa(len(lines)-dryRunMessageSteps) + " more"
+	} else {
+		message += strings.Join(lines, "\n")
+	}
+	if err != nil {
+		message += "\n" + err.Error()
+	}
+	this.notify(notify.EVENT_SERVERS_RESTARTED, 0, message)
+}
+
+// FormatSteps describes a dry run for humans: one line per step in the order they are executed, relays indented
+// below their server
+func (this *UpdateWatcher) FormatSteps(steps []rollout.Step) []string {
+	config := this.options.Rollout
+	lines := []string{}
+	for i, step := range steps {
+		line := strconv.Itoa(i+1) + ". " + formatStep(step)
+		switch step.Gate {
+		case rollout.GATE_PLAYERS:
+			line += fmt.Sprintf(" (at the end once %d players drained to %d, giving up after %s)", *step.Server.Players, *config.MaxPlayers, config.DrainTimeout)
+		case rollout.GATE_MATCH:
+			line += fmt.Sprintf(" (at the end once the match ends, get5 game state %s)", step.Server.Match)
+		case rollout.GATE_WINDOW:
+			line += fmt.Sprintf(" (at the end once its restart window %s opens)", step.Window)
+		}
+		if step.Canary {
+			line += fmt.Sprintf(" (canary, the rest waits %s for it)", config.CanaryWait)
+		}
+		lines = append(lines, line)
+		for _, relay := range step.Relays {
+			lines = append(lines, "   relay "+formatStep(relay))
+		}
+	}
+	return lines
+}
+
+func formatStep(step rollout.Step) string {
+	players := ""
+	if step.Server.Players != nil {
+		players = ", " + strconv.Itoa(*step.Server.Players) + " players"
+	}
+	if step.Image == step.Server.Image {
+		return fmt.Sprintf("%s/%s%s: restart with %s", step.Target, step.Server.Name, players, step.Image)
+	}
+	return fmt.Sprintf("%s/%s%s: %s -> %s", step.Target, step.Server.Name, players, step.Server.Image, step.Image)
+}
@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// A layer built on the get5 image
+type get5Layer struct {
+	name     string
+	build    ImageBuildConfig
+	overlays []contextOverlay
+}
+
+// Build the get5 image on the preinstall image with the mods of the build, labelled with their versions and the
+// commits of the repositories. The plugins of build.plugins and the files of build.repositories are added in layers
+// of their own on top of it, so a change of them leaves the layers of MetaMod:Source, SourceMod and get5 alone.
+func (this *UpdateWatcher) buildGet5(preinstallImage string, tag string, labels map[string]string, mods modVersions, checkouts []repositoryCheckout) error {
+	get5Labels := mods.labels()
+	for key, value := range repositoryLabels(checkouts) {
+		get5Labels[key] = value
+	}
+	for key, value := range labels {
+		get5Labels[key] = value
+	}
+
+	layers := []get5Layer{}
+	if plugins := this.options.Build.Plugins.Plugins; len(plugins) > 0 {
+		layers = append(layers, get5Layer{fmt.Sprintf("%d plugins", len(plugins)), this.options.Build.pluginLayer(), nil})
+	}
+	if len(checkouts) > 0 {
+		layers = append(layers, get5Layer{fmt.Sprintf("%d repositories", len(checkouts)), this.options.Build.Repositories.ImageBuildConfig, repositoryOverlays(checkouts)})
+	}
+
+	// Every image but the last is temporary
+	image := tag
+	if len(layers) > 0 {
+		image = this.BaseImageName + ":temp-" + uuid.NewString()
+	}
+	if err := this.buildContainer(preinstallImage, image, this.options.Build.get5(mods), get5Labels); err != nil {
+		return err
+	}
+	for i, layer := range layers {
+		from := image
+		image = tag
+		if i < len(layers)-1 {
+			image = this.BaseImageName + ":temp-" + uuid.NewString()
+		}
+		// Only untags it, the get5 image keeps the layers
+		defer this.removeTempImage(from)
+
+		log.Info().Str("layer", layer.name).Msg("Adding layer to get5 image")
+		if err := this.buildContainer(from, image, layer.build, get5Labels, layer.overlays...); err != nil {
+			return fmt.Errorf("failed to add %s: %w", layer.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Promote copies a validated build from the first publish target to production, announces it and rolls it out to
+// the production servers
+func (this *UpdateWatcher) Promote(buildid int) error {
+	results, err := this.promote(buildid)
+	this.updateCatalog(results)
+	if err == nil {
+		this.notify(notify.EVENT_DEPLOYED, buildid, "Promoted buildid "+strconv.Itoa(buildid)+" to production"+this.buildLink(buildid))
+	}
+	this.deploy(pushedImages(results))
+	return err
+}
+
+// Copy copies any image between registries with the watcher's registry credentials and returns its digest
+func (this *UpdateWatcher) Copy(src string, dst string) (string, error) {
+	return registry.Copy(this.ctx, src, dst, this.registryAuth.Keychain())
+}
+
+// Local moving tag of the newest get5 image, empty if disabled
+func (this *UpdateWatcher) latestTag() string {
+	if this.options.Publish.LatestTag == "" {
+		return ""
+	}
+	return this.BaseImageName + ":" + this.options.Publish.LatestTag
+}
+
+// Copy the images of a build from the staging target (the first publish target) to every production target.
+// Nothing is rebuilt and the images never pass through the docker daemon.
+func (this *UpdateWatcher) promote(buildid int) ([]PublishResult, error) {
+	production := this.options.Publish.Production
+	if len(production) == 0 {
+		return nil, fmt.Errorf("no production targets configured")
+	}
+	staging := this.options.Publish.AllTargets()[0]
+	imageTags, err := this.imageTags(buildid)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]PublishResult, 0, len(production))
+	failed := []string{}
+	for _, target := range production {
+		result := this.replicateToTarget(staging, target, imageTags)
+		if result.Err == nil && this.options.Publish.Attestations {
+			for _, localTag := range imageTags {
+				if err := this.copyAttestations(staging.Reference(localTag), target.Reference(localTag)); err != nil {
+					result.Err = err
+					break
+				}
+			}
+		}
+		// Staging may already have a newer latest, so production's latest is pointed at the promoted build directly
+		if latest := this.latestTag(); result.Err == nil && latest != "" {
+			src, dst := target.Reference(imageTags[1]), target.Reference(latest)
+			if _, err := registry.Copy(this.ctx, src, dst, this.registryAuth.Keychain()); err != nil {
+				result.Err = fmt.Errorf("failed to tag %s as %s: %w", src, dst, err)
+			} else {
+				result.Images = append(result.Images, dst)
+			}
+		}
+		if result.Err != nil {
+			log.Err(result.Err).Str("target", target.String()).Msg("Failed to promote to production target")
+			failed = append(failed, fmt.Sprintf("%s: %s", target, result.Err))
+		} else {
+			log.Info().Str("target", target.String()).Int("buildid", buildid).Msg("Promoted build to production target")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to promote to %d of %d targets: %s", len(failed), len(production), strings.Join(failed, "; "))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,124 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"strings"
+)
+
+// Outcome of publishing a build to a single target
+type PublishResult struct {
+	Target PublishTarget
+	Images []string
+	Err    error
+}
+
+// Tag the local images into the publish targets and push them. Local tags look like <BaseImageName>:<tag> and
+// are pushed as <Repository>:<tag>. With replicate the targets are copied from primary if it is set, the first
+// target already holding the images. Targets are published independently, the returned error lists every target
+// that failed.
+func (this *UpdateWatcher) publish(localTags []string, targets []PublishTarget, primary *PublishTarget) ([]PublishResult, error) {
+	if len(targets) == 0 {
+		log.Trace().Msg("No publish targets configured, not pushing")
+		return nil, nil
+	}
+
+	results := make([]PublishResult, 0, len(targets))
+	failed := []string{}
+	for _, target := range targets {
+		var result PublishResult
+		if this.options.Publish.Replicate && primary != nil {
+			result = this.replicateToTarget(*primary, target, localTags)
+		} else {
+			// NOTE if the primary target failed the others are pushed from the daemon, so they do not fail with it
+			result = this.publishToTarget(target, localTags)
+		}
+		results = append(results, result)
+
+		if result.Err != nil {
+			log.Err(result.Err).Str("target", target.String()).Msg("Failed to publish to target")
+			failed = append(failed, fmt.Sprintf("%s: %s", target, result.Err))
+		} else {
+			log.Info().Str("target", target.String()).Strs("images", result.Images).Msg("Published to target")
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to publish to %d of %d targets: %s", len(failed), len(targets), strings.Join(failed, "; "))
+	}
+
+	return results, nil
+}
+
+func (this *UpdateWatcher) publishToTarget(target PublishTarget, localTags []string) PublishResult {
+	result := PublishResult{Target: target}
+
+	for _, localTag := range localTags {
+		remoteTag := target.Reference(localTag)
+
+		if err := this.dockerCli.ImageTag(this.ctx, localTag, remoteTag); err != nil {
+			result.Err = fmt.Errorf("failed to tag %s as %s: %w", localTag, remoteTag, err)
+			return result
+		}
+
+		if err := this.pushImage(remoteTag); err != nil {
+			result.Err = err
+			return result
+		}
+		log.Debug().Str("image", remoteTag).Msg("Pushed image")
+		result.Images = append(result.Images, remoteTag)
+	}
+
+	return result
+}
+
+// Copy the already published images from the primary target to another target without using the docker daemon
+func (this *UpdateWatcher) replicateToTarget(primary PublishTarget, target PublishTarget, localTags []string) PublishResult {
+	result := PublishResult{Target: target}
+
+	for _, localTag := range localTags {
+		src := primary.Reference(localTag)
+		dst := target.Reference(localTag)
+
+		timeout := this.options.Timeouts.Push
+		ctx, cancel := this.withTimeout(timeout)
+		digest, err := registry.Copy(ctx, src, dst, this.registryAuth.Keychain())
+		err = timedOut(ctx, "copy", timeout, err)
+		cancel()
+		if err != nil {
+			result.Err = fmt.Errorf("failed to replicate %s to %s: %w", src, dst, err)
+			return result
+		}
+		log.Debug().Str("source", src).Str("destination", dst).Str("digest", digest).Msg("Replicated image")
+		result.Images = append(result.Images, dst)
+	}
+
+	return result
+}
+
+func (this *UpdateWatcher) pushImage(image string) error {
+	auth, err := this.registryAuth.EncodedAuth(image)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for %s: %w", image, err)
+	}
+
+	timeout := this.options.Timeouts.Push
+	ctx, cancel := this.withTimeout(timeout)
+	defer cancel()
+	pushReader, err := this.dockerCli.ImagePush(ctx, image, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("failed to push %s: %w", image, timedOut(ctx, "push", timeout, err))
+	}
+	defer pushReader.Close()
+
+	// NOTE push errors are reported in the progress stream, not as an API error
+	if err := jsonmessage.DisplayJSONMessagesStream(pushReader, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to push %s: %w", image, timedOut(ctx, "push", timeout, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package watcher
+
+import (
+	"bytes"
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/gamefiles"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+	"io"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// How new builds are published, selected per app with publish.methods
+const (
+	// Push the images to the publish targets
+	PUBLISH_REGISTRY = "registry"
+	// Replace the contents of a docker volume the game servers mount with the game files
+	PUBLISH_VOLUME = "volume"
+	// Upload the game files as a gzipped tarball, e.g. to object storage
+	PUBLISH_TARBALL = "tarball"
+	// Mirror the game files to bare metal hosts with rsync
+	PUBLISH_RSYNC = "rsync"
+)
+
+var publishMethods = []string{PUBLISH_REGISTRY, PUBLISH_VOLUME, PUBLISH_TARBALL, PUBLISH_RSYNC}
+
+// Only the docker API can copy the game files out of images
+var _ gamefiles.DockerClient = &client.Client{}
+
+// Publisher delivers a new build to where the game servers run it from and records what it published in the build.
+// The build fails with its error.
+type Publisher interface {
+	Publish(record *store.Build, tags []string) error
+}
+
+func PublishMethodNames() []string {
+	names := append([]string{}, publishMethods...)
+	sort.Strings(names)
+	return names
+}
+
+func validatePublishMethod(name string) error {
+	for _, method := range publishMethods {
+		if name == method {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown publish method %q, expected one of %v", name, PublishMethodNames())
+}
+
+// Every configured method has what it delivers to
+func (this *PublishConfig) validateMethods(engineName string, variants []string) error {
+	methods := []string{this.Method}
+	for _, method := range this.Methods {
+		methods = append(methods, method)
+	}
+	for _, method := range methods {
+		if err := validatePublishMethod(method); err != nil {
+			return err
+		}
+		if method != PUBLISH_REGISTRY && engineName == engine.CONTAINERD {
+			return fmt.Errorf("publish method %s needs to copy files out of images, which the %s engine cannot", method, engineName)
+		}
+		switch method {
+		case PUBLISH_VOLUME:
+			if this.Files.Volume == "" {
+				return fmt.Errorf("publish method %s requires publish.files.volume", method)
+			}
+		case PUBLISH_TARBALL:
+			if this.Files.URL == "" {
+				return fmt.Errorf("publish method %s requires publish.files.url", method)
+			}
+			if _, err := renderFilesURL(this.Files.URL, filesURLData{CSGO_APPID, 0, this.Files.Variant}); err != nil {
+				return err
+			}
+		case PUBLISH_RSYNC:
+			if len(this.Files.Destinations) == 0 {
+				return fmt.Errorf("publish method %s requires publish.files.destinations", method)
+			}
+		}
+	}
+	validVariant := false
+	for _, variant := range variants {
+		validVariant = validVariant || variant == this.Files.Variant
+	}
+	if !validVariant {
+		return fmt.Errorf("unknown publish.files.variant %q, expected one of %v", this.Files.Variant, variants)
+	}
+	this.Files.SSHKey = expandHome(this.Files.SSHKey)
+	this.Files.KnownHosts = expandHome(this.Files.KnownHosts)
+	return nil
+}
+
+// The method configured for an app, publish.methods taking precedence over publish.method
+func (this PublishConfig) method(appid int) string {
+	if name, ok := this.Methods[appid]; ok {
+		return name
+	}
+	return this.Method
+}
+
+func (this *UpdateWatcher) publisher(appid int) Publisher {
+	switch this.options.Publish.method(appid) {
+	case PUBLISH_VOLUME:
+		return volumePublisher{this}
+	case PUBLISH_TARBALL:
+		return tarballPublisher{this}
+	case PUBLISH_RSYNC:
+		return rsyncPublisher{this}
+	default:
+		return registryPublisher{this}
+	}
+}
+
+// Pushes to the publish targets, in the phases of publish.schedule
+type registryPublisher struct {
+	watcher *UpdateWatcher
+}
+
+func (this registryPublisher) Publish(record *store.Build, tags []string) error {
+	return this.watcher.schedulePublish(record, tags)
+}
+
+type volumePublisher struct {
+	watcher *UpdateWatcher
+}
+
+func (this volumePublisher) Publish(record *store.Build, tags []string) error {
+	volume := this.watcher.options.Publish.Files.Volume
+	return this.watcher.publishFiles(record, PUBLISH_VOLUME, func(client gamefiles.DockerClient, image string, files io.Reader) ([]string, error) {
+		if err := gamefiles.UpdateVolume(this.watcher.ctx, client, image, volume, files); err != nil {
+			return nil, err
+		}
+		return []string{"volume:" + volume}, nil
+	})
+}
+
+type tarballPublisher struct {
+	watcher *UpdateWatcher
+}
+
+func (this tarballPublisher) Publish(record *store.Build, tags []string) error {
+	config := this.watcher.options.Publish.Files
+	return this.watcher.publishFiles(record, PUBLISH_TARBALL, func(client gamefiles.DockerClient, image string, files io.Reader) ([]string, error) {
+		url, err := renderFilesURL(config.URL, filesURLData{CSGO_APPID, record.Buildid, config.Variant})
+		if err != nil {
+			return nil, err
+		}
+		if err := gamefiles.Upload(this.watcher.ctx, url, config.Headers, files); err != nil {
+			return nil, err
+		}
+		return []string{gamefiles.Location(url)}, nil
+	})
+}
+
+type rsyncPublisher struct {
+	watcher *UpdateWatcher
+}
+
+func (this rsyncPublisher) Publish(record *store.Build, tags []string) error {
+	config := this.watcher.options.Publish.Files
+	return this.watcher.publishFiles(record, PUBLISH_RSYNC, func(client gamefiles.DockerClient, image string, files io.Reader) ([]string, error) {
+		options := gamefiles.SSHOptions{Key: config.SSHKey, KnownHosts: config.KnownHosts}
+		if err := gamefiles.Rsync(this.watcher.ctx, config.Destinations, options, files); err != nil {
+			return nil, err
+		}
+		return config.Destinations, nil
+	})
+}
+
+// Fields of the tarball URL template
+type filesURLData struct {
+	AppID   int
+	BuildID int
+	Variant string
+}
+
+func renderFilesURL(text string, data filesURLData) (string, error) {
+	parsed, err := template.New("url").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid publish.files.url: %w", err)
+	}
+	var url bytes.Buffer
+	if err := parsed.Execute(&url, data); err != nil {
+		return "", fmt.Errorf("invalid publish.files.url: %w", err)
+	}
+	return url.String(), nil
+}
+
+// Deliver the game directory of the configured variant's image. Without production targets the local images are
+// deployed after, like builds that are not pushed.
+func (this *UpdateWatcher) publishFiles(record *store.Build, method string, deliver func(client gamefiles.DockerClient, image string, files io.Reader) ([]string, error)) error {
+	config := this.options.Publish.Files
+	record.Phases = map[string]store.Phase{PHASE_BUILD: {State: store.PhaseDone, At: time.Now()}}
+
+	locations, err := func() ([]string, error) {
+		client, ok := this.dockerCli.(gamefiles.DockerClient)
+		if !ok {
+			return nil, fmt.Errorf("the %s engine cannot copy files out of images", this.options.Engine)
+		}
+		image := ""
+		for i, variant := range this.options.variantNames() {
+			if variant == config.Variant && i < len(record.Images) {
+				image = record.Images[i]
+			}
+		}
+		if image == "" {
+			return nil, fmt.Errorf("build has no %s image", config.Variant)
+		}
+
+		files, err := gamefiles.ExportDir(this.ctx, client, image, config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		defer files.Close()
+		return deliver(client, image, files)
+	}()
+	if err != nil {
+		record.Phases[PHASE_PUSH] = store.Phase{State: store.PhaseFailed, At: time.Now(), Error: err.Error()}
+		return fmt.Errorf("failed to publish game files of newly build cs:go container: %w", err)
+	}
+	record.Phases[PHASE_PUSH] = store.Phase{State: store.PhaseDone, At: time.Now()}
+	record.Pushed = locations
+	record.PushedAt = time.Now()
+	log.Info().Str("method", method).Int("buildid", record.Buildid).Strs("locations", locations).Msg("Published game files")
+
+	if len(this.options.Publish.Production) == 0 {
+		this.deployInWindow(record.Images)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/store"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long listing the leftovers of the shutdown report may take, the watcher's context is already cancelled
+const reportTimeout = 10 * time.Second
+
+// Tallies of a run of the watcher for the shutdown report
+type runStats struct {
+	mutex        sync.Mutex
+	startedAt    time.Time
+	checks       int
+	failedChecks int
+	builds       int
+	failedBuilds int
+	// Buildid detected on Steam that was not built yet, 0 if none
+	detected int
+	// Work in progress by kind, with when it started
+	inFlight map[string]time.Time
+	// The last check of Steam, for Status
+	lastCheck store.Check
+	// Whether the watcher holds the lock
+	leading bool
+	// Time until the next check of the watch loop, 0 until it runs
+	interval time.Duration
+	// When the watch loop started its current check, zero while it waits for the next one
+	loopBusy time.Time
+}
+
+// What a run of the watcher did and left unfinished, logged and optionally written to Options.ShutdownReport by Stop
+type ShutdownReport struct {
+	StartedAt    time.Time `json:"started_at"`
+	StoppedAt    time.Time `json:"stopped_at"`
+	Uptime       string    `json:"uptime"`
+	Checks       int       `json:"checks"`
+	FailedChecks int       `json:"failed_checks"`
+	Builds       int       `json:"builds"`
+	FailedBuilds int       `json:"failed_builds"`
+	// Work cancelled by the shutdown, by kind with when it started
+	Interrupted map[string]time.Time `json:"interrupted,omitempty"`
+	// Work still to do: a detected version that was not built, servers of a rollout that were not restarted
+	Pending []string `json:"pending,omitempty"`
+	// Images and containers the watcher created and did not remove
+	Leftovers []string `json:"leftovers,omitempty"`
+}
+
+// Nothing was left in-flight or behind
+func (this ShutdownReport) Clean() bool {
+	return len(this.Interrupted) == 0 && len(this.Pending) == 0 && len(this.Leftovers) == 0
+}
+
+// Mark work of a kind as in progress until the returned function is called
+func (this *UpdateWatcher) track(kind string) func() {
+	this.stats.mutex.Lock()
+	this.stats.inFlight[kind] = time.Now()
+	this.stats.mutex.Unlock()
+	// A long build does not make the watcher unhealthy
+	this.writeHealthFile()
+	return func() {
+		this.stats.mutex.Lock()
+		delete(this.stats.inFlight, kind)
+		this.stats.mutex.Unlock()
+		this.writeHealthFile()
+	}
+}
+
+func (this *UpdateWatcher) countCheck(check store.Check, err error) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.checks++
+	this.stats.lastCheck = check
+	if err != nil {
+		this.stats.failedChecks++
+	}
+}
+
+func (this *UpdateWatcher) countBuild(buildid int, err error) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.builds++
+	if err != nil {
+		this.stats.failedBuilds++
+	} else if buildid >= this.stats.detected {
+		this.stats.detected = 0
+	}
+}
+
+func (this *UpdateWatcher) countDetection(buildid int) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	this.stats.detected = buildid
+}
+
+// Start the report while the work in progress is still running, Stop cancels it right after
+func (this *UpdateWatcher) beginShutdownReport() ShutdownReport {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+
+	report := ShutdownReport{StartedAt: this.stats.startedAt, Interrupted: map[string]time.Time{}}
+	for kind, startedAt := range this.stats.inFlight {
+		report.Interrupted[kind] = startedAt
+	}
+	if this.orchestrator != nil {
+		if progress := this.orchestrator.Progress(); progress != nil && progress.Active() {
+			report.Pending = append(report.Pending, fmt.Sprintf("%s of %s: %d of %d servers not restarted", progress.Kind, strings.Join(progress.Images, ", "), progress.Pending, progress.Total))
+		}
+	}
+	return report
+}
+
+// Fill in the tallies and leftovers once everything stopped
+func (this *UpdateWatcher) finishShutdownReport(report ShutdownReport) ShutdownReport {
+	this.stats.mutex.Lock()
+	report.StoppedAt = time.Now()
+	if !report.StartedAt.IsZero() {
+		report.Uptime = report.StoppedAt.Sub(report.StartedAt).Round(time.Second).String()
+	}
+	report.Checks, report.FailedChecks = this.stats.checks, this.stats.failedChecks
+	report.Builds, report.FailedBuilds = this.stats.builds, this.stats.failedBuilds
+	if this.stats.detected != 0 {
+		report.Pending = append(report.Pending, "buildid "+strconv.Itoa(this.stats.detected)+" was detected on Steam but not built")
+	}
+	this.stats.mutex.Unlock()
+
+	this.publishMutex.Lock()
+	if pending := this.pendingPublish; pending != nil {
+		report.Pending = append(report.Pending, "buildid "+strconv.Itoa(pending.record.Buildid)+" waits for its publish schedule: "+strings.Join(pendingPhases(*pending.record), ", "))
+	}
+	this.publishMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	report.Leftovers = this.leftovers(ctx)
+	return report
+}
+
+// Temporary images of builds and helper containers that were not removed
+func (this *UpdateWatcher) leftovers(ctx context.Context) []string {
+	leftovers := []string{}
+	tempPrefix := this.BaseImageName + ":temp-"
+	images, err := this.dockerCli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		log.Err(err).Msg("Failed to list images for the shutdown report")
+	}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			if strings.HasPrefix(tag, tempPrefix) {
+				leftovers = append(leftovers, "image "+tag)
+			}
+		}
+	}
+
+	containers, err := this.dockerCli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		log.Err(err).Msg("Failed to list containers for the shutdown report")
+	}
+	for _, container := range containers {
+		if container.Image == this.baseTag() || strings.HasPrefix(container.Image, tempPrefix) || container.Labels[LABEL_OWNER] == this.BaseImageName {
+			id := container.ID
+			if len(id) > 12 {
+				id = id[:12]
+			}
+			leftovers = append(leftovers, "container "+id+" of "+container.Image)
+		}
+	}
+	sort.Strings(leftovers)
+	return leftovers
+}
+
+func (this *UpdateWatcher) writeShutdownReport(report ShutdownReport) {
+	interrupted := []string{}
+	for kind := range report.Interrupted {
+		interrupted = append(interrupted, kind)
+	}
+	sort.Strings(interrupted)
+	event := log.Info()
+	if !report.Clean() {
+		event = log.Warn()
+	}
+	event.
+		Time("started-at", report.StartedAt).
+		Str("uptime", report.Uptime).
+		Int("checks", report.Checks).
+		Int("failed-checks", report.FailedChecks).
+		Int("builds", report.Builds).
+		Int("failed-builds", report.FailedBuilds).
+		Strs("interrupted", interrupted).
+		Strs("pending", report.Pending).
+		Strs("leftovers", report.Leftovers).
+		Bool("clean", report.Clean()).
+		Msg("Shutdown report")
+
+	path := this.options.ShutdownReport
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Err(err).Msg("Failed to encode shutdown report")
+		return
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		log.Err(err).Str("path", path).Msg("Failed to write shutdown report")
+	}
+}
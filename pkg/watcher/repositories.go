@@ -0,0 +1,151 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"csgo-update-watcher/pkg/contextsource"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/trigger"
+	"encoding/hex"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// A repository of build.repositories with the fetcher of its checkout
+type gitRepository struct {
+	RepositoryConfig
+	fetcher *contextsource.Fetcher
+}
+
+// The files of a repository checked out for a build
+type repositoryCheckout struct {
+	gitRepository
+	dir      string
+	revision string
+}
+
+// Every repository keeps its checkout in a directory of its own, apart from container_source even with the same URL
+func newGitRepositories(config RepositoriesConfig) ([]gitRepository, error) {
+	if len(config.Git) == 0 {
+		return nil, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find cache directory of build.repositories: %w", err)
+	}
+	repositories := []gitRepository{}
+	for _, repository := range config.Git {
+		source := contextsource.Source{Git: repository.Git, Cache: filepath.Join(cache, "csgo-update-watcher", "repositories", repository.Name)}
+		repositories = append(repositories, gitRepository{repository, contextsource.NewFetcher(source, nil)})
+	}
+	return repositories, nil
+}
+
+// Fetch the newest commit of every repository for a build. If one fails to fetch, its last checkout is used.
+func (this *UpdateWatcher) checkoutRepositories() ([]repositoryCheckout, error) {
+	checkouts := []repositoryCheckout{}
+	for _, repository := range this.repositories {
+		dir, revision, err := repository.fetcher.Fetch(this.ctx)
+		if err != nil {
+			if dir == "" {
+				return nil, fmt.Errorf("failed to fetch repository %s: %w", repository.Name, err)
+			}
+			log.Err(err).Str("repository", repository.Name).Str("revision", revision).Msg("Failed to fetch repository, building with the cached files")
+		}
+		checkouts = append(checkouts, repositoryCheckout{repository, dir, revision})
+	}
+	return checkouts, nil
+}
+
+// The commit of a single repository, or a digest of the commits of several, shortened for tags
+func commitTag(checkouts []repositoryCheckout) string {
+	if len(checkouts) == 0 {
+		return ""
+	}
+	if len(checkouts) == 1 {
+		return shortCommit(checkouts[0].revision)
+	}
+	hash := sha256.New()
+	for _, checkout := range checkouts {
+		fmt.Fprintf(hash, "%s %s\n", checkout.Name, checkout.revision)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:7]
+}
+
+func shortCommit(revision string) string {
+	if len(revision) > 7 {
+		return revision[:7]
+	}
+	return revision
+}
+
+func repositoryLabels(checkouts []repositoryCheckout) map[string]string {
+	labels := map[string]string{}
+	for _, checkout := range checkouts {
+		labels[LABEL_REPOSITORY_PREFIX+checkout.Name] = checkout.revision
+	}
+	return labels
+}
+
+// The checkouts in the build context of the repositories layer, at their path within the game directory
+func repositoryOverlays(checkouts []repositoryCheckout) []contextOverlay {
+	overlays := []contextOverlay{}
+	for _, checkout := range checkouts {
+		prefix := "repositories"
+		if dir := path.Clean(filepath.ToSlash(checkout.Path)); dir != "." {
+			prefix += "/" + dir
+		}
+		overlays = append(overlays, contextOverlay{prefix, checkout.dir})
+	}
+	return overlays
+}
+
+// Poll the head of a repository and fire a rebuild of the newest buildid once it moved past the commit of its get5
+// image. Commits pushed while the watcher was down are picked up by the first poll.
+func (this *UpdateWatcher) watchRepository(repository gitRepository) func(context.Context, trigger.Reporter) {
+	return func(ctx context.Context, report trigger.Reporter) {
+		ticker := time.NewTicker(this.options.Build.Repositories.Interval)
+		defer ticker.Stop()
+
+		last := ""
+		for {
+			head, err := repository.fetcher.Head(ctx)
+			report.Polled(err)
+			if err == nil && head != last {
+				last = head
+				if reason := this.repositoryMoved(repository, head); reason != "" {
+					report.Fire(reason, true)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// The reason to rebuild if the newest get5 image has another commit of the repository, empty otherwise
+func (this *UpdateWatcher) repositoryMoved(repository gitRepository, head string) string {
+	built, buildid, err := this.newestLabels(LABEL_REPOSITORY_PREFIX)
+	if err != nil {
+		log.Err(err).Msg("Failed to read the repositories of the newest build")
+		return ""
+	}
+	if buildid < 0 {
+		log.Debug().Msg("No build with repository labels to compare the heads with")
+		return ""
+	}
+	if head == built[LABEL_REPOSITORY_PREFIX+repository.Name] {
+		return ""
+	}
+	log.Info().Int("buildid", buildid).Str("repository", repository.Name).Str("commit", head).Msg("Repository moved, rebuilding the newest buildid")
+	this.notifyInBackground(notify.EVENT_UPDATE_DETECTED, buildid, fmt.Sprintf("New commit %s in %s, rebuilding buildid %d", shortCommit(head), repository.Name, buildid))
+	return "new commit " + shortCommit(head) + " in " + repository.Name
+}
@@ -0,0 +1,36 @@
+package watcher
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// CFS period the build's CPU quota is given in
+const cpuPeriod = 100000
+
+// Limits of the containers the watcher runs, validated when loading the config
+func (this ResourcesConfig) containerResources() container.Resources {
+	resources := container.Resources{NanoCPUs: int64(this.CPUs * 1e9)}
+	if this.Memory != "" {
+		resources.Memory, _ = units.RAMInBytes(this.Memory)
+	}
+	if this.PidsLimit > 0 {
+		pids := this.PidsLimit
+		resources.PidsLimit = &pids
+	}
+	return resources
+}
+
+// Apply the limits to the containers of a build, engines building with BuildKit ignore them
+func (this ResourcesConfig) applyToBuild(options *types.ImageBuildOptions) {
+	if this.CPUs > 0 {
+		options.CPUPeriod = cpuPeriod
+		options.CPUQuota = int64(this.CPUs * cpuPeriod)
+	}
+	if this.Memory != "" {
+		options.Memory, _ = units.RAMInBytes(this.Memory)
+		// No swap on top of the limit
+		options.MemorySwap = options.Memory
+	}
+}
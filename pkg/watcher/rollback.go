@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/registry"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Rollback points the latest tag back at an earlier build and announces it. With restart the fleet's servers and the
+// Kubernetes workloads are moved to that build as well.
+func (this *UpdateWatcher) Rollback(buildid int, restart bool) error {
+	if restart && !this.deploys() {
+		return ErrFleetDisabled
+	}
+
+	if this.history != nil {
+		build, err := this.history.BuildByBuildid(buildid)
+		if err != nil {
+			return fmt.Errorf("failed to read build history: %w", err)
+		}
+		if build == nil {
+			log.Warn().Int("buildid", buildid).Msg("Buildid is not in the build history")
+		}
+	}
+
+	results, err := this.rollback(buildid)
+	if err == nil {
+		this.notify(notify.EVENT_DEPLOYED, buildid, "Rolled back "+this.options.Publish.LatestTag+" to buildid "+strconv.Itoa(buildid))
+	}
+
+	if restart {
+		images := pushedImages(results)
+		if imageTags, tagsErr := this.imageTags(buildid); tagsErr == nil {
+			if _, _, inspectErr := this.dockerCli.ImageInspectWithRaw(this.ctx, imageTags[1]); inspectErr == nil {
+				images = append(images, imageTags[1])
+			}
+		}
+		this.deploy(images)
+	}
+
+	return err
+}
+
+// Point the latest tag at the get5 image of an earlier build, on the docker host and in every publish and production
+// target. Registries are retagged in place, nothing is rebuilt or uploaded again.
+func (this *UpdateWatcher) rollback(buildid int) ([]PublishResult, error) {
+	if this.options.Publish.LatestTag == "" {
+		return nil, fmt.Errorf("publish.latest_tag is disabled")
+	}
+	imageTags, err := this.imageTags(buildid)
+	if err != nil {
+		return nil, err
+	}
+	get5Tag := imageTags[1]
+	localLatest := this.latestTag()
+	targets := append(this.options.Publish.AllTargets(), this.options.Publish.Production...)
+
+	results := []PublishResult{}
+	failed := []string{}
+
+	if _, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, get5Tag); err == nil {
+		if err := this.dockerCli.ImageTag(this.ctx, get5Tag, localLatest); err != nil {
+			return nil, fmt.Errorf("failed to tag %s as %s: %w", get5Tag, localLatest, err)
+		}
+		log.Info().Str("image", get5Tag).Str("tag", localLatest).Msg("Rolled back local image")
+	} else if len(targets) == 0 {
+		return nil, fmt.Errorf("no image of buildid %d on the docker host", buildid)
+	}
+
+	for _, target := range targets {
+		result := PublishResult{Target: target}
+		src, dst := target.Reference(get5Tag), target.Reference(localLatest)
+
+		digest, err := registry.Copy(this.ctx, src, dst, this.registryAuth.Keychain())
+		if err != nil {
+			result.Err = fmt.Errorf("failed to tag %s as %s: %w", src, dst, err)
+			log.Err(result.Err).Str("target", target.String()).Msg("Failed to roll back target")
+			failed = append(failed, fmt.Sprintf("%s: %s", target, result.Err))
+		} else {
+			result.Images = []string{src}
+			log.Info().Str("target", target.String()).Str("image", src).Str("digest", digest).Msg("Rolled back target")
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to roll back %d of %d targets: %s", len(failed), len(targets), strings.Join(failed, "; "))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/metrics"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Requests in flight get this long to finish when the watcher stops
+const apiShutdownTimeout = 10 * time.Second
+
+func (this *UpdateWatcher) newAPIServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/builds", this.handleBuilds)
+	mux.HandleFunc("/slo", this.handleSLO)
+	mux.HandleFunc("/fleet", this.handleFleet)
+	mux.HandleFunc("/catalog", this.handleCatalog)
+	mux.HandleFunc("/rollout", this.handleRollout)
+	mux.HandleFunc("/rollout/", this.control(this.handleRolloutControl))
+	mux.HandleFunc("/hooks/steam-update", this.handleSteamUpdateHook)
+	mux.HandleFunc("/maintenance/force", this.control(this.handleMaintenanceForce))
+	this.adminRoutes(mux)
+	mux.HandleFunc("/health", this.handleHealth)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/", this.handleDashboard)
+
+	log.Info().Str("address", this.options.API.Listen).Msg("Serving API")
+	return &http.Server{Addr: this.options.API.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Err(err).Msg("Failed to write API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+type buildsResponse struct {
+	Builds []HistoryEntry `json:"builds"`
+	// Pass as ?before= to get the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// GET /builds?limit=50&before=<id>&host=<host>
+func (this *UpdateWatcher) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if this.history == nil {
+		writeError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultPageSize
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	var before uint64
+	if value := query.Get("before"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid before")
+			return
+		}
+		before = parsed
+	}
+
+	entries, err := this.History(limit, before, query.Get("host"))
+	if err != nil {
+		log.Err(err).Msg("Failed to read build history")
+		writeError(w, http.StatusInternalServerError, "failed to read build history")
+		return
+	}
+
+	response := buildsResponse{Builds: entries}
+	if len(entries) == limit {
+		response.Next = strconv.FormatUint(entries[len(entries)-1].ID, 10)
+	}
+	writeJson(w, http.StatusOK, response)
+}
@@ -0,0 +1,213 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Phases of an update whose latency is tracked
+const (
+	// Release on Steam until the watcher noticed
+	PHASE_DETECTION = "detection"
+	// Detection until the build was published
+	PHASE_BUILD = "build"
+	// Publication until the rollout finished
+	PHASE_DEPLOY = "deploy"
+	// Release on Steam until the rollout finished, or until the build was published if nothing is deployed
+	PHASE_TOTAL = "total"
+)
+
+var quantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// Latency of a phase within the SLO window
+type PhaseReport struct {
+	Phase string `json:"phase"`
+	// Updates that completed the phase
+	Count int `json:"count"`
+	// Nearest rank percentiles and the maximum in seconds, 0 without updates
+	P50 float64 `json:"p50_seconds"`
+	P90 float64 `json:"p90_seconds"`
+	P95 float64 `json:"p95_seconds"`
+	P99 float64 `json:"p99_seconds"`
+	Max float64 `json:"max_seconds"`
+	// Objective in seconds, 0 if there is none
+	Objective float64 `json:"objective_seconds,omitempty"`
+	// Updates within the objective, and updates that took longer or are still overdue
+	Met    int `json:"met"`
+	Missed int `json:"missed"`
+}
+
+// Share of the updates that met the objective, false if nothing was measured against one
+func (this PhaseReport) Attainment() (float64, bool) {
+	if this.Objective == 0 || this.Met+this.Missed == 0 {
+		return 0, false
+	}
+	return float64(this.Met) / float64(this.Met+this.Missed), true
+}
+
+// Latencies of the updates detected within the SLO window
+type SLOReport struct {
+	Since   time.Time        `json:"since"`
+	Phases  []PhaseReport    `json:"phases"`
+	Updates []store.Timeline `json:"updates"`
+}
+
+type phase struct {
+	name      string
+	objective time.Duration
+	// Start and end of the phase, zero until reached
+	span func(store.Timeline) (time.Time, time.Time)
+}
+
+func (this *UpdateWatcher) phases() []phase {
+	objectives := this.options.SLO.Objectives
+	deployed := func(timeline store.Timeline) time.Time {
+		if !this.deploys() {
+			return timeline.PublishedAt
+		}
+		return timeline.DeployedAt
+	}
+	phases := []phase{
+		{PHASE_DETECTION, objectives.Detection, func(timeline store.Timeline) (time.Time, time.Time) {
+			return timeline.ReleasedAt, timeline.DetectedAt
+		}},
+		{PHASE_BUILD, objectives.Build, func(timeline store.Timeline) (time.Time, time.Time) {
+			return timeline.DetectedAt, timeline.PublishedAt
+		}},
+	}
+	// Nothing is deployed without a fleet or Kubernetes workloads
+	if this.deploys() {
+		phases = append(phases, phase{PHASE_DEPLOY, objectives.Deploy, func(timeline store.Timeline) (time.Time, time.Time) {
+			return timeline.PublishedAt, timeline.DeployedAt
+		}})
+	}
+	return append(phases, phase{PHASE_TOTAL, objectives.Total, func(timeline store.Timeline) (time.Time, time.Time) {
+		return timeline.ReleasedAt, deployed(timeline)
+	}})
+}
+
+// SLOReport computes the latency percentiles of the updates detected within the SLO window
+func (this *UpdateWatcher) SLOReport() (*SLOReport, error) {
+	if this.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	now := time.Now()
+	since := now.Add(-this.options.SLO.Window)
+	timelines, err := this.history.Timelines(since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read update timelines: %w", err)
+	}
+
+	report := &SLOReport{Since: since, Updates: timelines}
+	for _, phase := range this.phases() {
+		report.Phases = append(report.Phases, phase.report(timelines, now))
+	}
+	return report, nil
+}
+
+func (this phase) report(timelines []store.Timeline, now time.Time) PhaseReport {
+	report := PhaseReport{Phase: this.name, Objective: this.objective.Seconds()}
+	latencies := []time.Duration{}
+	for i, timeline := range timelines {
+		start, end := this.span(timeline)
+		if start.IsZero() {
+			continue
+		}
+		if end.IsZero() {
+			// A buildid replaced by a newer one before it got through the phase never will
+			if this.objective > 0 && now.Sub(start) > this.objective && !this.superseded(timelines[i+1:]) {
+				report.Missed++
+			}
+			continue
+		}
+		latency := end.Sub(start)
+		latencies = append(latencies, latency)
+		if this.objective > 0 {
+			if latency <= this.objective {
+				report.Met++
+			} else {
+				report.Missed++
+			}
+		}
+	}
+
+	report.Count = len(latencies)
+	if len(latencies) == 0 {
+		return report
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentiles := []*float64{&report.P50, &report.P90, &report.P95, &report.P99}
+	for i, quantile := range quantiles {
+		rank := int(math.Ceil(quantile*float64(len(latencies)))) - 1
+		*percentiles[i] = latencies[rank].Seconds()
+	}
+	report.Max = latencies[len(latencies)-1].Seconds()
+	return report
+}
+
+// Whether a later update already got through the phase
+func (this phase) superseded(later []store.Timeline) bool {
+	for _, timeline := range later {
+		if _, end := this.span(timeline); !end.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// Update the latency metrics from the history
+func (this *UpdateWatcher) refreshSLO() {
+	if this.history == nil {
+		return
+	}
+
+	report, err := this.SLOReport()
+	if err != nil {
+		log.Err(err).Msg("Failed to compute update latencies")
+		return
+	}
+	for _, phase := range report.Phases {
+		metrics.UpdateLatencyUpdates.WithLabelValues(phase.Phase).Set(float64(phase.Count))
+		for i, value := range []float64{phase.P50, phase.P90, phase.P95, phase.P99} {
+			quantile := strconv.FormatFloat(quantiles[i], 'f', -1, 64)
+			if phase.Count == 0 {
+				metrics.UpdateLatency.DeleteLabelValues(phase.Phase, quantile)
+			} else {
+				metrics.UpdateLatency.WithLabelValues(phase.Phase, quantile).Set(value)
+			}
+		}
+		if attainment, ok := phase.Attainment(); ok {
+			metrics.UpdateObjectiveAttainment.WithLabelValues(phase.Phase).Set(attainment)
+		} else {
+			metrics.UpdateObjectiveAttainment.DeleteLabelValues(phase.Phase)
+		}
+	}
+}
+
+// GET /slo
+func (this *UpdateWatcher) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if this.history == nil {
+		writeError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+
+	report, err := this.SLOReport()
+	if err != nil {
+		log.Err(err).Msg("Failed to compute update latencies")
+		writeError(w, http.StatusInternalServerError, "failed to compute update latencies")
+		return
+	}
+	writeJson(w, http.StatusOK, report)
+}
@@ -0,0 +1,110 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/a2s"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/rs/zerolog/log"
+	"net"
+	"time"
+)
+
+// Port srcds listens on in the smoke test container
+const smokeTestPort = "27015/udp"
+
+// How often the booting server is queried
+const smokeTestInterval = 2 * time.Second
+
+// Boot the configured variants of a new build one after another, images are in the order of variantNames
+func (this *UpdateWatcher) smokeTest(images []string) error {
+	config := this.options.SmokeTest
+	if !config.Enabled {
+		return nil
+	}
+	for i, variant := range this.options.variantNames() {
+		for _, tested := range config.Variants {
+			if tested == variant && i < len(images) {
+				if err := this.bootServer(images[i]); err != nil {
+					return fmt.Errorf("smoke test of %s failed: %w", images[i], err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Start a server from image with its port published on a random host port and wait until it answers A2S_INFO
+func (this *UpdateWatcher) bootServer(image string) error {
+	config := this.options.SmokeTest
+	log.Info().Str("image", image).Msg("Booting game server for smoke test")
+	startedAt := time.Now()
+
+	containerConfig := &container.Config{
+		Image:        image,
+		ExposedPorts: nat.PortSet{smokeTestPort: {}},
+		Labels:       this.helperLabels(HELPER_SMOKE_TEST),
+	}
+	if len(config.Args) > 0 {
+		containerConfig.Cmd = config.Args
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{smokeTestPort: {{HostIP: config.Host}}},
+		Resources:    this.options.Resources.containerResources(),
+	}
+	created, err := this.dockerCli.ContainerCreate(this.ctx, containerConfig, hostConfig, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	defer this.dockerCli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+	if err := this.dockerCli.ContainerStart(this.ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(this.ctx, config.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(smokeTestInterval)
+	defer ticker.Stop()
+	queryErr := fmt.Errorf("no query was sent")
+	for {
+		inspect, err := this.dockerCli.ContainerInspect(ctx, created.ID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		if inspect.State != nil && !inspect.State.Running {
+			return fmt.Errorf("server exited with code %d: %s", inspect.State.ExitCode, this.containerOutput(created.ID))
+		}
+		if address := publishedAddress(inspect, config.Host); address != "" {
+			info, err := a2s.QueryInfo(ctx, address)
+			if err == nil {
+				log.Info().Str("image", image).Str("map", info.Map).Dur("took", time.Since(startedAt)).Msg("Game server answered smoke test")
+				return nil
+			}
+			queryErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if this.ctx.Err() != nil {
+				return this.ctx.Err()
+			}
+			return fmt.Errorf("server did not answer A2S_INFO within %s: %v: %s", config.Timeout, queryErr, this.containerOutput(created.ID))
+		case <-ticker.C:
+		}
+	}
+}
+
+// Address the engine published the server's port on, empty until it is known
+func publishedAddress(inspect types.ContainerJSON, host string) string {
+	if inspect.NetworkSettings == nil {
+		return ""
+	}
+	for _, binding := range inspect.NetworkSettings.Ports[smokeTestPort] {
+		if binding.HostPort != "" {
+			return net.JoinHostPort(host, binding.HostPort)
+		}
+	}
+	return ""
+}
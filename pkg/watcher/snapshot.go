@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+func (this *UpdateWatcher) snapshotTag() string {
+	return this.BaseImageName + ":snapshot"
+}
+
+// The image to install the game on: the snapshot if it is still usable, the base image if a new snapshot has to be
+// installed. The ID of the snapshot is returned if it is used.
+func (this *UpdateWatcher) snapshotImage(labels map[string]string) (string, string, error) {
+	base := this.baseTag()
+	config := this.options.Build.Snapshot
+	if !config.Enabled {
+		return base, "", nil
+	}
+
+	snapshot, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, this.snapshotTag())
+	reason := ""
+	if err != nil {
+		reason = "there is none"
+	} else if this.snapshotStale {
+		reason = "the update layer outgrew " + config.MaxUpdateSize
+	} else if snapshot.Config == nil || snapshot.Config.Labels[LABEL_BASE_DIGEST] != labels[LABEL_BASE_DIGEST] {
+		reason = "the base image changed"
+	} else if created, err := time.Parse(time.RFC3339Nano, snapshot.Created); config.MaxAge > 0 && err == nil && time.Since(created) > config.MaxAge {
+		reason = "it is older than " + config.MaxAge.String()
+	}
+	if reason != "" {
+		log.Info().Str("reason", reason).Msg("Installing a new game snapshot")
+		return base, "", nil
+	}
+	return this.snapshotTag(), snapshot.ID, nil
+}
+
+// Make the freshly installed image the snapshot if there was none, otherwise measure the layer the update added on
+// top of snapshot
+func (this *UpdateWatcher) updateSnapshot(image string, snapshot string) error {
+	config := this.options.Build.Snapshot
+	if !config.Enabled {
+		return nil
+	}
+	if snapshot == "" {
+		if err := this.dockerCli.ImageTag(this.ctx, image, this.snapshotTag()); err != nil {
+			return fmt.Errorf("failed to tag %s as snapshot: %w", image, err)
+		}
+		this.snapshotStale = false
+		log.Info().Str("snapshot", this.snapshotTag()).Msg("Installed new game snapshot")
+		return nil
+	}
+
+	updated, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, image)
+	if err != nil {
+		return fmt.Errorf("failed to inspect newly build cs:go container: %w", err)
+	}
+	base, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to inspect snapshot: %w", err)
+	}
+	size := updated.Size - base.Size
+	log.Info().Str("size", units.HumanSize(float64(size))).Msg("Updated game snapshot")
+	// The snapshot is replaced by the next build, this one is published with the layer as it is
+	if maxSize, _ := units.FromHumanSize(config.MaxUpdateSize); maxSize > 0 && size > maxSize {
+		this.snapshotStale = true
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/metrics"
+	"csgo-update-watcher/pkg/notify"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Steam answered a check, after a staleness alarm this is the all-clear
+func (this *UpdateWatcher) steamAnswered() {
+	metrics.SteamLastSuccess.Set(float64(this.lastSteamCheck.Time.Unix()))
+	if !this.steamStale {
+		return
+	}
+	this.steamStale = false
+	metrics.SteamStale.Set(0)
+	log.Info().Msg("Steam answers version checks again")
+	this.emit(Event{Type: EVENT_STEAM_STALE})
+	this.notifyInBackground(notify.EVENT_WARNING, 0, "Steam answers version checks again")
+}
+
+// A check failed to reach Steam. Once the last successful check, or the start of the watcher if none succeeded, is
+// older than error_policy.stale_after the staleness is alerted once, whatever the other failures notified.
+func (this *UpdateWatcher) steamFailed(err error) {
+	staleAfter := this.options.ErrorPolicy.StaleAfter
+	if staleAfter == 0 || this.steamStale {
+		return
+	}
+	since := this.lastSteamCheck.Time
+	if since.IsZero() {
+		this.stats.mutex.Lock()
+		since = this.stats.startedAt
+		this.stats.mutex.Unlock()
+	}
+	if time.Since(since) < staleAfter {
+		return
+	}
+	this.steamStale = true
+	metrics.SteamStale.Set(1)
+	age := time.Since(since).Round(time.Minute)
+	log.Warn().Err(err).Dur("since", age).Msg("Steam has not answered a version check for too long")
+	this.emit(Event{Type: EVENT_STEAM_STALE, Err: err})
+	this.notifyInBackground(notify.EVENT_WARNING, 0, fmt.Sprintf("Warning: Steam has not answered a version check for %s, new versions go unnoticed. The last error: %s", age, err))
+}
@@ -0,0 +1,118 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/s3"
+	"csgo-update-watcher/pkg/store"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long uploading the state to S3 may take
+const stateExportTimeout = time.Minute
+
+func (this StateExportConfig) validate() error {
+	if !this.S3.Enabled() {
+		return nil
+	}
+	if this.S3.Path == "" || strings.HasSuffix(this.S3.Path, "/") {
+		return fmt.Errorf("state_export.s3.path must be the key of the object")
+	}
+	return this.S3.Validate("state_export.s3")
+}
+
+// The exported state
+type LatestBuild struct {
+	AppID   int `json:"appid"`
+	Buildid int `json:"buildid"`
+	// Local final image and its tag
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+	// Repository digest of the final image, empty if it was not pushed
+	Digest string `json:"digest,omitempty"`
+	// Registry references of every pushed image
+	Pushed    []string  `json:"pushed,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newStateBucket(config StateExportConfig) (*s3.Bucket, error) {
+	if !config.S3.Enabled() {
+		return nil, nil
+	}
+	return s3.Open(config.S3)
+}
+
+// Write the successful build to the file and object of state_export, in the background. Failures are logged.
+func (this *UpdateWatcher) exportState(build store.Build) {
+	config := this.options.StateExport
+	if !config.Enabled() || len(build.Images) == 0 {
+		return
+	}
+	image := finalImage(build.Images)
+	latest := LatestBuild{
+		AppID:     CSGO_APPID,
+		Buildid:   build.Buildid,
+		Image:     image,
+		Tag:       registry.TagOf(image),
+		Pushed:    build.Pushed,
+		Timestamp: time.Now().UTC(),
+	}
+	// e.g. registry.example.com/csgo@sha256:...
+	if inspected, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, image); err == nil && len(inspected.RepoDigests) > 0 {
+		digest := inspected.RepoDigests[0]
+		latest.Digest = digest[strings.LastIndex(digest, "@")+1:]
+	}
+	data, err := json.MarshalIndent(latest, "", "  ")
+	if err != nil {
+		log.Err(err).Msg("Failed to encode exported state")
+		return
+	}
+	data = append(data, '\n')
+
+	this.background(func() {
+		if config.File != "" {
+			path := expandHome(config.File)
+			if err := replaceFile(path, data); err != nil {
+				log.Err(err).Str("path", path).Msg("Failed to export state")
+			}
+		}
+		if this.stateBucket != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), stateExportTimeout)
+			defer cancel()
+			if err := this.stateBucket.Put(ctx, config.S3.Path, bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+				log.Err(err).Str("object", config.S3.String()).Msg("Failed to export state")
+			}
+		}
+		log.Debug().Int("buildid", latest.Buildid).Msg("Exported state")
+	})
+}
+
+// Replace the file at once, readers never see a partial file
+func replaceFile(path string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
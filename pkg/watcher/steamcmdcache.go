@@ -0,0 +1,105 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Where the cache volume is mounted while the installation in it is updated
+const steamcmdCacheMount = "/steamcmd-cache"
+
+// The embedded preinstall Dockerfile keeping the installation in a BuildKit cache mount
+const cacheMountDockerfile = "Dockerfile-preinstall-cache"
+
+// Commits the seeded installation, implemented by the docker client. nerdctl cannot commit containers.
+type steamcmdCacheClient interface {
+	ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error)
+	ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+}
+
+var _ steamcmdCacheClient = &client.Client{}
+
+// Update the installation kept in the cache volume and commit a copy of it onto the base image, so steamcmd in the
+// preinstall build only validates it. Only what changed since the last build is downloaded. Returns the image to
+// build the preinstall image on, removed again by the returned func.
+func (this *UpdateWatcher) seedFromSteamcmdCache(baseImage string) (string, func(), error) {
+	volume := this.options.SteamCMDCache.Volume
+	if volume == "" {
+		return baseImage, func() {}, nil
+	}
+	committer, ok := this.dockerCli.(steamcmdCacheClient)
+	if !ok {
+		return "", nil, fmt.Errorf("the %s engine cannot commit containers, steamcmd_cache.volume is not supported", this.options.Engine)
+	}
+	base, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, baseImage)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to inspect base image: %w", err)
+	}
+
+	log.Info().Str("volume", volume).Msg("Updating the installation in the steamcmd cache")
+	// Run as root to write the new volume, the copy is handed to the owner of the game directory
+	script := "set -eu\n" +
+		": \"${STEAMAPPDIR:?the base image sets no STEAMAPPDIR}\"\n" +
+		"owner=\"$(stat -c %u:%g \"$STEAMAPPDIR\")\"\n" +
+		findSteamcmdCommand + "\n" +
+		"\"$steamcmd\" +force_install_dir " + steamcmdCacheMount + " +login anonymous +app_update " + strconv.Itoa(CSGO_APPID) + " -beta " + CSGO_BRANCH + " +quit\n" +
+		"cp -a " + steamcmdCacheMount + "/. \"$STEAMAPPDIR/\"\n" +
+		"chown -R \"$owner\" \"$STEAMAPPDIR\"\n"
+	created, err := this.dockerCli.ContainerCreate(this.ctx, &container.Config{
+		Image:      baseImage,
+		User:       "root",
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{script},
+		Labels:     this.helperLabels(HELPER_STEAMCMD_CACHE),
+	}, &container.HostConfig{Binds: []string{volume + ":" + steamcmdCacheMount}, Resources: this.options.Resources.containerResources()}, nil, nil, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create container for the steamcmd cache: %w", err)
+	}
+	defer this.dockerCli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := this.dockerCli.ContainerStart(this.ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return "", nil, fmt.Errorf("failed to start container for the steamcmd cache: %w", err)
+	}
+	wait, errs := this.dockerCli.ContainerWait(this.ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errs:
+		return "", nil, fmt.Errorf("error while waiting for the steamcmd cache to update: %w", err)
+	case status := <-wait:
+		if status.StatusCode != 0 {
+			return "", nil, fmt.Errorf("failed to update the steamcmd cache: exit code %d: %s", status.StatusCode, this.containerOutput(created.ID))
+		}
+	}
+
+	// The commit keeps the config of the base image instead of the script's
+	seeded := this.BaseImageName + ":temp-" + uuid.NewString()
+	if _, err := committer.ContainerCommit(this.ctx, created.ID, types.ContainerCommitOptions{Reference: seeded, Config: base.Config}); err != nil {
+		return "", nil, fmt.Errorf("failed to commit the steamcmd cache: %w", err)
+	}
+	remove := func() {
+		if _, err := committer.ImageRemove(context.Background(), seeded, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+			log.Err(err).Str("image", seeded).Msg("Failed to remove image seeded from the steamcmd cache")
+		}
+	}
+	return seeded, remove, nil
+}
+
+// Last lines of the output of a stopped container, for errors
+func (this *UpdateWatcher) containerOutput(containerID string) string {
+	logs, err := this.dockerCli.ContainerLogs(this.ctx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Tail: "5"})
+	if err != nil {
+		return err.Error()
+	}
+	defer logs.Close()
+	var output bytes.Buffer
+	stdcopy.StdCopy(&output, &output, logs)
+	return strings.TrimSpace(output.String())
+}
@@ -0,0 +1,76 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/secrets"
+	"csgo-update-watcher/pkg/steam"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Id of the BuildKit secret holding the steamcmd login script
+const steamLoginSecret = "steam_login"
+
+// Where checker containers and builds find the login script, run with +runscript
+const steamLoginPath = "/run/secrets/" + steamLoginSecret
+
+// The embedded preinstall Dockerfile logging in with the steam_login secret
+const loginDockerfile = "Dockerfile-preinstall-login"
+
+// steamcmd script logging in with the configured account, read fresh every time so rotated secrets and the current
+// Steam Guard code are used
+func (this SteamLoginConfig) script() ([]byte, error) {
+	password, err := secrets.ReadFile(this.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read steam_login.password_file: %w", err)
+	}
+	args := []string{this.Username, password}
+	if this.GuardSecretFile != "" {
+		secret, err := secrets.ReadFile(this.GuardSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read steam_login.guard_secret_file: %w", err)
+		}
+		code, err := steam.GuardCode(secret, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid steam_login.guard_secret_file: %w", err)
+		}
+		args = append(args, code)
+	}
+
+	line := "login"
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\"\n") {
+			return nil, fmt.Errorf("steam_login credentials must not contain quotes or newlines")
+		}
+		line += " \"" + arg + "\""
+	}
+	return []byte(line + "\n"), nil
+}
+
+// Write the login script to a private directory for mounting it, removed by the returned func. Returns no file if
+// steamcmd logs in anonymously.
+func (this *UpdateWatcher) writeSteamLogin() (string, func(), error) {
+	login := this.options.SteamLogin
+	if login.Username == "" {
+		return "", func() {}, nil
+	}
+	script, err := login.script()
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir("", "csgo-watcher-login-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write steam login: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	// Readable by the steam user of the container, the directory keeps other users of the host out
+	file := filepath.Join(dir, steamLoginSecret)
+	if err := ioutil.WriteFile(file, script, 0644); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write steam login: %w", err)
+	}
+	return file, cleanup, nil
+}
@@ -0,0 +1,259 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/steam"
+	"csgo-update-watcher/pkg/store"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// A higher buildid on Steam than the newest build
+	STRATEGY_BUILDID = "buildid"
+	// The branch was updated on Steam after the last build started
+	STRATEGY_TIMEUPDATED = "timeupdated"
+	// A depot of the last build has a different manifest on Steam
+	STRATEGY_MANIFESTS = "manifests"
+	// Every check builds
+	STRATEGY_ALWAYS = "always"
+)
+
+// Sets $steamcmd, located since base images install it in different places
+const findSteamcmdCommand = "steamcmd=\"$(command -v steamcmd || command -v steamcmd.sh || find / -xdev -name steamcmd.sh 2>/dev/null | head -n 1)\""
+
+// Sets $login to the steamcmd arguments logging in, with the steam_login script if it is mounted
+const steamLoginCommand = "login=\"+login anonymous\"; if [ -f " + steamLoginPath + " ]; then login=\"+runscript " + steamLoginPath + "\"; fi"
+
+// Print the app info of the dedicated server
+var printAppInfoCommand = findSteamcmdCommand + " && " + steamLoginCommand + " && " +
+	"\"$steamcmd\" $login +app_info_update 1 +app_info_print " + strconv.Itoa(CSGO_APPID) + " +quit"
+
+// What Steam offers, or what the last build installed
+type BuildVersion struct {
+	// -1 if nothing was built yet
+	Buildid int
+	// Steam: when the branch was last updated. Build: the timeupdated it was installed at, for older builds when it
+	// started since the game is installed right after. Zero if unknown.
+	Updated time.Time
+	// Manifest gid by depot id, nil if unknown
+	Manifests map[int]string
+}
+
+// BuildStrategy decides whether Steam offers something the last build does not contain. Not every title and branch
+// increases its buildid with every update, Steam may also go back to an older build.
+type BuildStrategy interface {
+	// Whether Outdated needs the timeupdated and manifests of Steam, which costs another steamcmd run per check
+	NeedsAppInfo() bool
+	Outdated(steam BuildVersion, local BuildVersion) bool
+}
+
+type buildidStrategy struct{}
+
+func (buildidStrategy) NeedsAppInfo() bool { return false }
+
+func (buildidStrategy) Outdated(steam BuildVersion, local BuildVersion) bool {
+	return local.Buildid < steam.Buildid
+}
+
+// Also catches Valve republishing a buildid with changed depots, which leaves the buildid as it is
+type timeUpdatedStrategy struct{}
+
+func (timeUpdatedStrategy) NeedsAppInfo() bool { return true }
+
+func (timeUpdatedStrategy) Outdated(steam BuildVersion, local BuildVersion) bool {
+	if local.Buildid < 0 {
+		return true
+	}
+	if steam.Updated.IsZero() || local.Updated.IsZero() {
+		return steam.Buildid != local.Buildid
+	}
+	return steam.Updated.After(local.Updated)
+}
+
+type manifestStrategy struct{}
+
+func (manifestStrategy) NeedsAppInfo() bool { return true }
+
+// Only the installed depots are compared, Steam also lists the depots of other platforms
+func (manifestStrategy) Outdated(steam BuildVersion, local BuildVersion) bool {
+	if local.Buildid < 0 {
+		return true
+	}
+	if steam.Manifests == nil || len(local.Manifests) == 0 {
+		return steam.Buildid != local.Buildid
+	}
+	for depot, manifest := range local.Manifests {
+		if remote, ok := steam.Manifests[depot]; ok && remote != manifest {
+			return true
+		}
+	}
+	return false
+}
+
+type alwaysStrategy struct{}
+
+func (alwaysStrategy) NeedsAppInfo() bool { return false }
+
+func (alwaysStrategy) Outdated(BuildVersion, BuildVersion) bool { return true }
+
+// What a lower buildid on Steam than the newest build leads to
+const (
+	// The build strategy decides: buildid only warns, the others compare against the last build and rebuild
+	ROLLBACK_STRATEGY = "strategy"
+	// Never rebuild an older buildid, whatever the build strategy
+	ROLLBACK_WARN = "warn"
+	// Build and tag the older buildid, so servers run what matchmaking expects again
+	ROLLBACK_REBUILD = "rebuild"
+)
+
+func RollbackPolicyNames() []string {
+	return []string{ROLLBACK_REBUILD, ROLLBACK_STRATEGY, ROLLBACK_WARN}
+}
+
+func validateRollbackPolicy(name string) error {
+	for _, policy := range RollbackPolicyNames() {
+		if name == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown rollback policy %q, expected one of %v", name, RollbackPolicyNames())
+}
+
+var buildStrategies = map[string]BuildStrategy{
+	STRATEGY_BUILDID:     buildidStrategy{},
+	STRATEGY_TIMEUPDATED: timeUpdatedStrategy{},
+	STRATEGY_MANIFESTS:   manifestStrategy{},
+	STRATEGY_ALWAYS:      alwaysStrategy{},
+}
+
+func BuildStrategyNames() []string {
+	names := make([]string, 0, len(buildStrategies))
+	for name := range buildStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateBuildStrategy(name string) error {
+	if _, ok := buildStrategies[name]; !ok {
+		return fmt.Errorf("unknown build strategy %q, expected one of %v", name, BuildStrategyNames())
+	}
+	return nil
+}
+
+// The strategy configured for an app, build_strategies taking precedence over build_strategy
+func (this Options) buildStrategy(appid int) BuildStrategy {
+	if name, ok := this.BuildStrategies[appid]; ok {
+		return buildStrategies[name]
+	}
+	return buildStrategies[this.BuildStrategy]
+}
+
+// Compare Steam's branch with the last build using the configured strategy. Returns the buildid of the last build
+// too, -1 if there is none.
+func (this *UpdateWatcher) outdated(steamBuildid int) (bool, int, error) {
+	strategy := this.options.buildStrategy(CSGO_APPID)
+	newest, err := this.newestBuildVersion()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to get buildid of newest build: %w", err)
+	}
+	rollback := steamBuildid < newest
+	if rollback && this.options.Rollback == ROLLBACK_WARN {
+		return false, newest, nil
+	}
+	if _, ok := strategy.(buildidStrategy); ok {
+		if this.options.Rollback == ROLLBACK_REBUILD {
+			// The highest buildid stays the one Steam went back from, the last build tells which one was built since,
+			// e.g. the older one while Steam returned to the newer one
+			local, err := this.lastBuildVersion(newest, false)
+			if err != nil || rollback || local.Buildid != newest {
+				return local.Buildid != steamBuildid, local.Buildid, err
+			}
+		}
+		return strategy.Outdated(BuildVersion{Buildid: steamBuildid}, BuildVersion{Buildid: newest}), newest, nil
+	}
+
+	local, err := this.lastBuildVersion(newest, strategy.NeedsAppInfo())
+	if err != nil {
+		return false, newest, err
+	}
+	remote := BuildVersion{Buildid: steamBuildid}
+	if strategy.NeedsAppInfo() {
+		info, err := this.appInfo()
+		if err != nil {
+			return false, local.Buildid, err
+		}
+		this.lastAppInfo = info
+		remote = BuildVersion{Buildid: info.Buildid, Updated: info.TimeUpdated, Manifests: info.Manifests}
+	}
+	return strategy.Outdated(remote, local), local.Buildid, nil
+}
+
+// Timeupdated and depot manifests of the branch on Steam
+func (this *UpdateWatcher) appInfo() (*steam.AppInfo, error) {
+	logs, err := this.runShell([]string{"-c", printAppInfoCommand}, this.checkerImage())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get app info from Steam: %w", err)
+	}
+	return steam.ParseAppInfo(logs, CSGO_APPID, CSGO_BRANCH)
+}
+
+// The build made last, which is not the highest buildid once Steam went back to an older build. Without history only
+// the highest buildid is known.
+func (this *UpdateWatcher) lastBuildVersion(newest int, manifests bool) (BuildVersion, error) {
+	version := BuildVersion{Buildid: newest}
+	if this.history != nil {
+		builds, err := this.history.Builds(store.BuildQuery{Limit: 20, Host: this.options.State.Host})
+		if err != nil {
+			return version, fmt.Errorf("failed to read build history: %w", err)
+		}
+		for _, build := range builds {
+			if build.Outcome != store.OutcomeFailed {
+				version.Buildid, version.Updated = build.Buildid, build.StartedAt
+				break
+			}
+		}
+	}
+	if version.Buildid < 0 {
+		return version, nil
+	}
+
+	imageTags, err := this.imageTags(version.Buildid)
+	if err != nil {
+		return version, err
+	}
+	if image, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, imageTags[0]); err == nil && image.Config != nil {
+		if updated, err := strconv.ParseInt(image.Config.Labels[LABEL_TIMEUPDATED], 10, 64); err == nil {
+			version.Updated = time.Unix(updated, 0).UTC()
+		} else if version.Updated.IsZero() {
+			version.Updated, _ = time.Parse(time.RFC3339, image.Config.Labels[LABEL_CREATED])
+		}
+	}
+	if manifests {
+		version.Manifests = this.buildManifests(version.Buildid, imageTags[0])
+	}
+	return version, nil
+}
+
+// Installed depots of a build, nil if its image is gone. Read once per buildid, a buildid always installs the same
+// manifests.
+func (this *UpdateWatcher) buildManifests(buildid int, image string) map[int]string {
+	if manifests, ok := this.manifestCache[buildid]; ok {
+		return manifests
+	}
+	installed, err := this.installedManifest(image)
+	if err != nil {
+		log.Err(err).Int("buildid", buildid).Msg("Failed to read installed depots of the last build")
+		return nil
+	}
+	manifests := map[int]string{}
+	for _, depot := range installed.InstalledDepots {
+		manifests[depot.ID] = depot.Manifest
+	}
+	this.manifestCache[buildid] = manifests
+	return manifests
+}
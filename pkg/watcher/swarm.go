@@ -0,0 +1,71 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/swarm"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+// Only the docker API updates swarm services
+var _ swarm.DockerClient = &client.Client{}
+
+func init() {
+	registerStep(STEP_SWARM, func(options Options) bool {
+		return options.Swarm.Enabled
+	}, func(watcher *UpdateWatcher) Step {
+		return stepFunc(watcher.updateSwarm)
+	})
+}
+
+// Point the swarm services running an older build of one of the images at it, the swarm rolls out their tasks.
+// Returns whether every service runs the images now.
+func (this *UpdateWatcher) updateSwarm(images []string) bool {
+	if this.options.Rollout.DryRun {
+		results, err := this.swarmUpdater.DryRun(this.ctx, images)
+		lines := []string{}
+		for _, result := range results {
+			lines = append(lines, result.Service+": "+result.Image)
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to plan swarm service updates")
+		}
+		log.Info().Strs("updates", lines).Msg("Dry run, not updating swarm services")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Dry run, would update "+strconv.Itoa(len(lines))+" swarm services:\n"+strings.Join(lines, "\n"))
+		return false
+	}
+
+	results, err := this.swarmUpdater.Update(this.ctx, images)
+	buildid, _ := this.buildidOf(images[0])
+	this.emit(Event{Type: EVENT_SWARM, Buildid: buildid, Images: images, Swarm: results, Err: err})
+
+	updated := 0
+	for _, result := range results {
+		if result.Err == nil {
+			updated++
+		}
+	}
+	if err != nil {
+		this.notify(notify.EVENT_DEPLOYED, 0, "Updated "+strconv.Itoa(updated)+" swarm services, "+err.Error())
+		return false
+	}
+	if updated > 0 {
+		log.Info().Int("updated", updated).Msg("Rolled out new build to swarm services")
+		this.notify(notify.EVENT_DEPLOYED, 0, "Updated "+strconv.Itoa(updated)+" swarm services with the new build")
+	}
+	return true
+}
+
+func newSwarmUpdater(config SwarmConfig, dockerCli DockerClient, variant func(string) (string, bool), auth swarm.AuthFunc) (*swarm.Updater, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	docker, ok := dockerCli.(swarm.DockerClient)
+	if !ok {
+		return nil, fmt.Errorf("the docker client cannot update swarm services")
+	}
+	return swarm.NewUpdater(docker, config.Services, variant, auth), nil
+}
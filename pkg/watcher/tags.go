@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/tags"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Images produced by every build, in build order
+const (
+	VARIANT_PREINSTALL = "preinstall"
+	VARIANT_GET5       = "get5"
+)
+
+var variants = []string{VARIANT_PREINSTALL, VARIANT_GET5}
+
+// The images of every build in build order: the variants above, then those of build.variants
+func (this Options) variantNames() []string {
+	names := append([]string{}, variants...)
+	for _, variant := range this.Build.Variants {
+		names = append(names, variant.Name)
+	}
+	return names
+}
+
+// Compiled tag templates, by variant
+type tagSet map[string]*tags.Template
+
+func newTagSet(options Options) (tagSet, error) {
+	texts := map[string]string{VARIANT_PREINSTALL: options.Tags.Preinstall, VARIANT_GET5: options.Tags.Get5}
+	for _, variant := range options.Build.Variants {
+		texts[variant.Name] = variant.tag()
+	}
+	set := tagSet{}
+	for variant, text := range texts {
+		template, err := tags.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag: %w", variant, err)
+		}
+		set[variant] = template
+	}
+
+	// Mod versions are only known pinned or watched, commits with repositories
+	plugins, repositories := options.Build.Plugins, options.Build.Repositories.Git
+	for variant, template := range set {
+		if template.Uses("MetaMod") && !plugins.knows(plugins.MetamodVersion) {
+			return nil, fmt.Errorf("%s tag uses {{.MetaMod}}, which needs build.plugins.metamod_version or build.plugins.watch", variant)
+		}
+		if template.Uses("SourceMod") && !plugins.knows(plugins.SourcemodVersion) {
+			return nil, fmt.Errorf("%s tag uses {{.SourceMod}}, which needs build.plugins.sourcemod_version or build.plugins.watch", variant)
+		}
+		if template.Uses("Commit") && len(repositories) == 0 {
+			return nil, fmt.Errorf("%s tag uses {{.Commit}}, which needs build.repositories", variant)
+		}
+	}
+	// A buildid is built again for every mod release and commit, its tags must tell the builds apart
+	get5 := set[VARIANT_GET5]
+	if plugins.Watch.Enabled && !(plugins.MetamodVersion == "" && get5.Uses("MetaMod")) && !(plugins.SourcemodVersion == "" && get5.Uses("SourceMod")) {
+		return nil, fmt.Errorf("get5 tag must contain {{.MetaMod}} or {{.SourceMod}} of a mod without pinned version with build.plugins.watch")
+	}
+	if len(repositories) > 0 && !get5.Uses("Commit") {
+		return nil, fmt.Errorf("get5 tag must contain {{.Commit}} with build.repositories")
+	}
+
+	sample := tags.Data{BuildID: 1234, Branch: CSGO_BRANCH, Date: "20220131", MetaMod: "1.11.0-git1148", SourceMod: "1.11.0-git6911", Commit: "0123abc"}
+	rendered := map[string]string{}
+	for _, variant := range options.variantNames() {
+		tag, err := set[variant].Render(sample)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag: %w", variant, err)
+		}
+		if other, ok := rendered[tag]; ok {
+			return nil, fmt.Errorf("%s and %s tags must differ", other, variant)
+		}
+		rendered[tag] = variant
+	}
+
+	return set, nil
+}
+
+// Local references of the images of a build, in build order
+func (this *UpdateWatcher) renderTags(data tags.Data) ([]string, error) {
+	names := this.options.variantNames()
+	references := make([]string, 0, len(names))
+	for _, variant := range names {
+		tag, err := this.tags[variant].Render(data)
+		if err != nil {
+			return nil, err
+		}
+		references = append(references, this.BaseImageName+":"+tag)
+	}
+	return references, nil
+}
+
+// The get5 image of a build, the last of variants. Further variants are built after it.
+func finalImage(images []string) string {
+	if len(images) >= len(variants) {
+		return images[len(variants)-1]
+	}
+	return images[len(images)-1]
+}
+
+// Local tags of the images produced by a build. The history knows the exact tags, without it they can only be
+// reconstructed if the templates do not contain the build date.
+func (this *UpdateWatcher) imageTags(buildid int) ([]string, error) {
+	if this.history != nil {
+		build, err := this.history.BuildByBuildid(buildid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read build history: %w", err)
+		}
+		if build != nil && len(build.Images) >= len(variants) {
+			return build.Images, nil
+		}
+	}
+
+	for _, variant := range this.options.variantNames() {
+		for _, field := range []string{"Date", "MetaMod", "SourceMod", "Commit"} {
+			if this.tags[variant].Uses(field) {
+				return nil, fmt.Errorf("buildid %d is not in the build history and the %s tag %q contains the build's %s", buildid, variant, this.tags[variant], field)
+			}
+		}
+	}
+	return this.renderTags(tags.Data{BuildID: buildid, Branch: CSGO_BRANCH})
+}
+
+// A reference recognized as one of the watcher's images
+type parsedTag struct {
+	Variant string
+	// Repository and tag prefix of the target (or the local base image) the reference belongs to
+	Repository string
+	TagPrefix  string
+	tags.Data
+}
+
+// Recognize images of the base image repository and of every publish and production target
+func (this *UpdateWatcher) parseTag(image string) (parsedTag, bool) {
+	targets := append([]PublishTarget{{Repository: this.BaseImageName}}, this.options.Publish.AllTargets()...)
+	targets = append(targets, this.options.Publish.Production...)
+	// The most specific prefix wins if targets share a repository
+	sort.SliceStable(targets, func(i, j int) bool { return len(targets[i].TagPrefix) > len(targets[j].TagPrefix) })
+
+	repository, tag := registry.RepositoryOf(image), registry.TagOf(image)
+	for _, target := range targets {
+		if target.Repository != repository || !strings.HasPrefix(tag, target.TagPrefix) {
+			continue
+		}
+		for _, variant := range this.options.variantNames() {
+			if data, ok := this.tags[variant].Match(strings.TrimPrefix(tag, target.TagPrefix)); ok {
+				return parsedTag{variant, repository, target.TagPrefix, data}, true
+			}
+		}
+	}
+	return parsedTag{}, false
+}
+
+// Extract the buildid from a reference of one of the watcher's images
+func (this *UpdateWatcher) buildidOf(image string) (int, bool) {
+	parsed, ok := this.parseTag(image)
+	return parsed.BuildID, ok
+}
+
+// Servers are only moved between builds of the same repository, target, variant and branch
+func (this *UpdateWatcher) rolloutVariant(image string) (string, bool) {
+	parsed, ok := this.parseTag(image)
+	if !ok {
+		return "", false
+	}
+	return parsed.Repository + ":" + parsed.TagPrefix + " " + parsed.Variant + " " + parsed.Branch, true
+}
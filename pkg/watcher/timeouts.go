@@ -0,0 +1,24 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Bound an operation by timeout, it is only cancelled with the watcher if the timeout is 0
+func (this *UpdateWatcher) withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(this.ctx)
+	}
+	return context.WithTimeout(this.ctx, timeout)
+}
+
+// Tell a timed out operation apart from one cancelled by stopping the watcher
+func timedOut(ctx context.Context, operation string, timeout time.Duration, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s: %w", operation, timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"csgo-update-watcher/pkg/trigger"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest body of a steam-update notification
+const maxHookBody = 64 * 1024
+
+// The triggers of the watched app: the Steam poll, the PICS mirror, the steam-update hook, the mods of
+// build.plugins.watch, every repository of build.repositories and the schedules and files of triggers
+func (this *UpdateWatcher) newTriggers() ([]trigger.Trigger, error) {
+	options := this.options
+	triggers := []trigger.Trigger{}
+	if options.Triggers.SteamPoll {
+		triggers = append(triggers, trigger.NewInterval("steam-poll", this.pollInterval))
+	}
+	if options.PICS.Enabled {
+		triggers = append(triggers, trigger.New("pics", this.watchPICS))
+	}
+	if len(options.API.HookTokens) > 0 {
+		this.steamUpdateHook = trigger.NewWebhook("webhook", false)
+		triggers = append(triggers, this.steamUpdateHook)
+	}
+	if options.Build.Plugins.Watch.Enabled {
+		triggers = append(triggers, trigger.New("mods", this.watchMods))
+	}
+	for _, repository := range this.repositories {
+		triggers = append(triggers, trigger.New("git:"+repository.Name, this.watchRepository(repository)))
+	}
+	for _, config := range options.Triggers.Schedules {
+		schedule, err := trigger.NewSchedule(config.Cron, config.Rebuild)
+		if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, schedule)
+	}
+	for _, config := range options.Triggers.Files {
+		triggers = append(triggers, trigger.NewFileWatch(config.Path, config.Interval, config.Rebuild))
+	}
+	return triggers, nil
+}
+
+// Every trigger checks Steam right away, those of updates besides the game build the newest buildid again
+func (this *UpdateWatcher) triggered(event trigger.Event) {
+	if event.Rebuild {
+		log.Info().Str("trigger", event.Trigger).Str("reason", event.Reason).Msg("Build requested")
+		this.requestBuild(event.Reason)
+		return
+	}
+	this.requestCheck(event.Reason)
+}
+
+// Ask the goroutine checking Steam to check right away. Requests while one is pending are merged into it.
+func (this *UpdateWatcher) requestCheck(reason string) {
+	select {
+	case this.checkRequests <- reason:
+	default:
+	}
+}
+
+// Collapse the ticks and check requests that queued up during a build into a single check right after it, which
+// sees the newest buildid if Valve shipped another one meanwhile
+func (this *UpdateWatcher) coalesceChecks() {
+	reasons := []string{}
+	for drained := false; !drained; {
+		select {
+		case reason := <-this.checkRequests:
+			reasons = append(reasons, reason)
+		default:
+			drained = true
+		}
+	}
+	if len(reasons) > 0 {
+		log.Debug().Strs("reasons", reasons).Msg("Coalesced checks queued during the build")
+		this.requestCheck("queued during build: " + strings.Join(reasons, ", "))
+	}
+}
+
+// Optional body of a steam-update notification, only logged: the check decides whether there is something to build
+type steamUpdateHook struct {
+	// Who sent it, e.g. steamdb or ci
+	Source  string `json:"source"`
+	Buildid int    `json:"buildid"`
+}
+
+// POST /hooks/steam-update with Authorization: Bearer <token> or ?token=<token> for senders without headers
+func (this *UpdateWatcher) handleSteamUpdateHook(w http.ResponseWriter, r *http.Request) {
+	if len(this.options.API.HookTokens) == 0 || this.operator != nil {
+		writeError(w, http.StatusNotFound, "steam update hook is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if !this.hookAuthorized(token) {
+		log.Warn().Str("remote", r.RemoteAddr).Msg("Refused unauthorized steam update hook")
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var hook steamUpdateHook
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, &hook); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+	}
+	if hook.Source == "" {
+		hook.Source = "webhook"
+	}
+	log.Info().Str("source", hook.Source).Int("buildid", hook.Buildid).Str("remote", r.RemoteAddr).Msg("Steam update hook received")
+	reason := hook.Source + " hook"
+	if hook.Buildid != 0 {
+		reason += " for buildid " + strconv.Itoa(hook.Buildid)
+	}
+	this.steamUpdateHook.Push(reason)
+	writeJson(w, http.StatusAccepted, map[string]string{"status": "check requested"})
+}
+
+func (this *UpdateWatcher) hookAuthorized(token string) bool {
+	return tokenAccepted(token, this.options.API.HookTokens)
+}
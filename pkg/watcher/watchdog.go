@@ -0,0 +1,97 @@
+package watcher
+
+import (
+	"context"
+	"csgo-update-watcher/pkg/systemd"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Engines answering pings, the docker SDK client. Others are asked for the base image instead.
+type pinger interface {
+	Ping(ctx context.Context) (types.Ping, error)
+}
+
+// Tell systemd the watcher started and feed its watchdog from then on, nothing happens outside of systemd
+func (this *UpdateWatcher) notifyReady() {
+	if notified, err := systemd.Notify(systemd.READY); err != nil {
+		log.Warn().Err(err).Msg("Failed to notify systemd")
+	} else if notified {
+		log.Debug().Msg("Notified systemd")
+	}
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Warn().Err(err).Msg("Not feeding the systemd watchdog")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	log.Info().Dur("interval", interval).Msg("Feeding the systemd watchdog")
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+		this.feedWatchdog(interval)
+	}()
+}
+
+// Ping the watchdog twice per interval as long as the container engine answers and the watch loop makes progress,
+// so systemd restarts a watcher whose engine connection is wedged or whose loop hangs
+func (this *UpdateWatcher) feedWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if err := this.loopStalled(time.Now()); err != nil {
+			log.Warn().Err(err).Msg("Watch loop made no progress, withholding the systemd watchdog ping")
+		} else if err := this.engineResponsive(interval / 2); err != nil {
+			log.Warn().Err(err).Msg("Container engine did not answer, withholding the systemd watchdog ping")
+		} else if _, err := systemd.Notify(systemd.WATCHDOG); err != nil {
+			log.Warn().Err(err).Msg("Failed to ping the systemd watchdog")
+		}
+		select {
+		case <-ticker.C:
+		case <-this.ctx.Done():
+			return
+		}
+	}
+}
+
+// Mark the watch loop busy with a check, or waiting for the next one
+func (this *UpdateWatcher) loopWorking(working bool) {
+	this.stats.mutex.Lock()
+	defer this.stats.mutex.Unlock()
+	if working {
+		this.stats.loopBusy = time.Now()
+	} else {
+		this.stats.loopBusy = time.Time{}
+	}
+}
+
+// Whether the watch loop has been busy with one check for longer than watchdog_stall. A loop waiting for the next
+// check, and the operator without a loop, never stall.
+func (this *UpdateWatcher) loopStalled(now time.Time) error {
+	limit := this.options.WatchdogStall
+	this.stats.mutex.Lock()
+	busy := this.stats.loopBusy
+	this.stats.mutex.Unlock()
+	if limit <= 0 || busy.IsZero() {
+		return nil
+	}
+	if elapsed := now.Sub(busy); elapsed > limit {
+		return fmt.Errorf("busy with one check for %s, more than watchdog_stall of %s", elapsed.Round(time.Second), limit)
+	}
+	return nil
+}
+
+func (this *UpdateWatcher) engineResponsive(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(this.ctx, timeout)
+	defer cancel()
+	if pinger, ok := this.dockerCli.(pinger); ok {
+		_, err := pinger.Ping(ctx)
+		return err
+	}
+	_, _, err := this.dockerCli.ImageInspectWithRaw(ctx, this.baseTag())
+	return err
+}
@@ -0,0 +1,1368 @@
+// Package watcher watches Steam for new CS:GO versions, builds and publishes images of them and rolls them out to
+// game servers. Embedding programs create an UpdateWatcher with New from DefaultOptions or LoadConfig, Start it,
+// optionally read its Events and Stop it when done:
+//
+//	dockerCli, err := engine.Connect(options.Engine, options.Containerd, options.Docker)
+//	...
+//	updateWatcher, err := watcher.New(options, dockerCli)
+//	...
+//	if err := updateWatcher.Start(); err != nil {
+//		...
+//	}
+//	for event := range updateWatcher.Events() {
+//		...
+//	}
+//
+// The build context is compiled into the binary, Options.ContainerFiles adds and replaces files of it.
+package watcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"csgo-update-watcher/pkg/catalog"
+	"csgo-update-watcher/pkg/compose"
+	"csgo-update-watcher/pkg/containerfiles"
+	"csgo-update-watcher/pkg/contextsource"
+	"csgo-update-watcher/pkg/engine"
+	"csgo-update-watcher/pkg/eventstream"
+	"csgo-update-watcher/pkg/export"
+	"csgo-update-watcher/pkg/fleet"
+	"csgo-update-watcher/pkg/gitops"
+	"csgo-update-watcher/pkg/kube"
+	"csgo-update-watcher/pkg/leader"
+	"csgo-update-watcher/pkg/notify"
+	"csgo-update-watcher/pkg/pipeline"
+	"csgo-update-watcher/pkg/registry"
+	"csgo-update-watcher/pkg/rollout"
+	"csgo-update-watcher/pkg/s3"
+	"csgo-update-watcher/pkg/steam"
+	"csgo-update-watcher/pkg/store"
+	"csgo-update-watcher/pkg/swarm"
+	"csgo-update-watcher/pkg/systemd"
+	"csgo-update-watcher/pkg/tags"
+	"csgo-update-watcher/pkg/trigger"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Steam appid of the CS:GO dedicated server
+const CSGO_APPID = 740
+
+// Steam branch the dedicated server is installed from
+const CSGO_BRANCH = "public"
+
+// How long Stop waits for notifications still being sent
+const notificationTimeout = 10 * time.Second
+
+// Set at build time with -ldflags "-X csgo-update-watcher/pkg/watcher.Version=..."
+var Version = "dev"
+
+// UpdateWatcher checks Steam for new CS:GO versions, builds and publishes images of them and rolls them out to the
+// fleet. Create it with New, then Start it.
+type UpdateWatcher struct {
+	ctx              context.Context
+	cancel           context.CancelFunc
+	BaseImageName    string
+	dockerCli        DockerClient
+	checkFrequency   time.Duration
+	notifiers        *notify.Dispatcher
+	options          Options
+	registryAuth     *registry.Resolver
+	history          store.Store
+	tags             tagSet
+	linkTemplates    linkTemplates
+	orchestrator     *rollout.Orchestrator
+	kubeUpdater      *kube.Updater
+	composeUpdater   *compose.Updater
+	gitopsPublisher  *gitops.Publisher
+	swarmUpdater     *swarm.Updater
+	chain            []chainStep
+	catalogPublisher *catalog.Publisher
+	catalog          catalogState
+	// Build waiting for its push or replication window
+	pendingPublish *pendingPublish
+	pendingLoaded  bool
+	publishMutex   sync.Mutex
+	// Builds of this run, only used by the goroutine building
+	buildWindows []buildWindow
+	operator     *kube.Operator
+	// Disk usage of the repository at the last measurement, -1 before the first
+	repositoryBytes int64
+	// Held while checking and building, nil without lock.driver
+	lock         leader.Lock
+	fleetMonitor *fleet.Monitor
+	fleetSources map[string]string
+	// Directory and revision of the build context files of the current build, see fetchContext
+	contextFetcher  *contextsource.Fetcher
+	contextFiles    string
+	contextRevision string
+	// Git repositories copied into the get5 image, see repositories.go
+	repositories []gitRepository
+	// Sources of updates, nil in the operator and once only, see trigger.go
+	triggers        *trigger.Group
+	steamUpdateHook *trigger.Webhook
+	// Held for the whole of a build
+	buildMutex sync.Mutex
+	// The update layer of the last build outgrew build.snapshot.max_update_size, only used by the goroutine building
+	snapshotStale bool
+	// Checks and builds failed in a row, only used by the goroutine checking Steam
+	failures int
+	// Buildid detected outside maintenance.builds, only used by the goroutine checking Steam
+	waitingBuildid int
+	// Images waiting for maintenance.restarts and until when the windows are ignored
+	pendingDeploy    []string
+	forcedUntil      time.Time
+	maintenanceMutex sync.Mutex
+	// Reasons to check Steam before the next tick, see requestCheck
+	checkRequests chan string
+	// Last successful check of Steam, only used by the goroutine checking Steam
+	lastSteamCheck store.Check
+	// Whether the staleness of lastSteamCheck was alerted, until Steam answers again
+	steamStale bool
+	// Newest mods of the last poll of build.plugins.watch
+	watchedMods modVersions
+	modsMutex   sync.Mutex
+	// Installed depots by buildid, only used by the goroutine checking Steam
+	manifestCache map[int]map[int]string
+	// App info of the last check that fetched it, nil if the build strategy does not need it
+	lastAppInfo *steam.AppInfo
+	// Only used by the goroutine checking Steam
+	buildLimiter buildLimiter
+	stats        runStats
+	events       chan Event
+	apiServer    *http.Server
+	// Serves the gRPC control API, nil without api.grpc_listen
+	grpcServer *grpc.Server
+	// Set with Pause and TriggerBuild, see control.go
+	paused         bool
+	buildRequested bool
+	controlMutex   sync.Mutex
+
+	running     sync.WaitGroup
+	err         error
+	closeEvents sync.Once
+	// Notifications still being sent, see background
+	notifications sync.WaitGroup
+
+	// Publishes events to event_stream, nil without brokers
+	eventStream *eventstream.Stream
+	streamHost  string
+	// Started for new builds, without pipelines if none are configured
+	pipelines *pipeline.Runner
+	// Bucket of state_export.s3, nil without
+	stateBucket *s3.Bucket
+	// Writes the archives of export, nil without
+	exporter *export.Exporter
+	// Loads the archives of import, nil unless in import mode
+	importer *importer
+	// Clients of fleet.docker_hosts
+	dockerHosts []dockerHost
+	// Builds on the buildkitd of build.buildkit, nil builds with the engine
+	buildkit *engine.BuildKit
+	// Builds in the jobs of kubernetes.build, nil builds with the engine
+	buildJobs *kube.JobBuilder
+	// The previous build's images in the registry the running build reuses the layers of, with
+	// build_cache.from_registry
+	cacheFrom []string
+}
+
+// New opens the history and connects to the fleet, nothing is watched or built until Start is called
+func New(options Options, dockerCli DockerClient) (*UpdateWatcher, error) {
+	options.BaseImageName = engine.LocalImageName(options.Engine, options.BaseImageName)
+
+	registryAuth, err := registry.NewResolver(options.DockerConfig, options.Registries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+
+	tagSet, err := newTagSet(options)
+	if err != nil {
+		return nil, err
+	}
+	linkTemplates, err := newLinkTemplates(options.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	var history store.Store
+	if options.State.Path != "" || options.State.DSN != "" {
+		history, err = openHistory(&options.State)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notifiers, err := notify.New(options.notifierConfigs())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updateWatcher := &UpdateWatcher{
+		ctx:            ctx,
+		cancel:         cancel,
+		BaseImageName:  options.BaseImageName,
+		dockerCli:      dockerCli,
+		checkFrequency: options.CheckFrequency,
+		notifiers:      notifiers,
+		options:        options,
+		registryAuth:   registryAuth,
+		history:        history,
+		tags:           tagSet,
+		linkTemplates:  linkTemplates,
+		fleetMonitor:   fleet.NewMonitor(),
+		fleetSources:   map[string]string{},
+		manifestCache:  map[int]map[int]string{},
+		events:         make(chan Event, eventBuffer),
+		checkRequests:  make(chan string, 1),
+		// Not measured yet
+		repositoryBytes: -1,
+	}
+	updateWatcher.stats.inFlight = map[string]time.Time{}
+	if updateWatcher.dockerHosts, err = connectDockerHosts(options.Fleet.DockerHosts); err != nil {
+		return nil, err
+	}
+	if options.Fleet.Enabled() {
+		updateWatcher.orchestrator = rollout.NewOrchestrator(rollout.Options{
+			Variant:       updateWatcher.rolloutVariant,
+			MaxPlayers:    options.Rollout.MaxPlayers,
+			DrainTimeout:  options.Rollout.DrainTimeout,
+			DrainInterval: options.Rollout.DrainInterval,
+			Policy:        updateWatcher.rolloutPolicy,
+			CanaryWait:    options.Rollout.CanaryWait,
+			OnProgress:    reportRolloutProgress,
+		})
+		updateWatcher.refreshFleet()
+	}
+	if updateWatcher.kubeUpdater, err = newKubeUpdater(options.Kubernetes, updateWatcher.rolloutVariant); err != nil {
+		return nil, err
+	}
+	updateWatcher.composeUpdater = newComposeUpdater(options.Compose, dockerCli, updateWatcher.rolloutVariant)
+	if options.ContainerSource.Enabled() {
+		updateWatcher.contextFetcher = contextsource.NewFetcher(options.ContainerSource, registryAuth.Keychain())
+	}
+	if updateWatcher.repositories, err = newGitRepositories(options.Build.Repositories); err != nil {
+		return nil, err
+	}
+	if updateWatcher.buildkit, err = newBuildKit(options.Build.BuildKit, dockerCli, options.BaseImageName); err != nil {
+		return nil, err
+	}
+	if updateWatcher.buildJobs, err = newBuildJobs(options.Kubernetes, dockerCli, registryAuth.EncodedAuth, options.BaseImageName); err != nil {
+		return nil, err
+	}
+	triggers, err := updateWatcher.newTriggers()
+	if err != nil {
+		return nil, err
+	}
+	updateWatcher.triggers = trigger.NewGroup(updateWatcher.triggered, triggers...)
+	if config := options.Catalog; config.Enabled() {
+		updateWatcher.catalogPublisher = catalog.NewPublisher(config.Registry, registryAuth.Keychain(), config.URL, config.Headers, expandHome(config.File))
+	}
+	if len(options.GitOps.Repositories) > 0 {
+		updateWatcher.gitopsPublisher = gitops.NewPublisher(options.GitOps.Repositories)
+	}
+	if updateWatcher.swarmUpdater, err = newSwarmUpdater(options.Swarm, dockerCli, updateWatcher.rolloutVariant, registryAuth.EncodedAuth); err != nil {
+		return nil, err
+	}
+	if updateWatcher.pipelines, err = pipeline.New(options.Pipelines); err != nil {
+		return nil, err
+	}
+	if updateWatcher.stateBucket, err = newStateBucket(options.StateExport); err != nil {
+		return nil, err
+	}
+	if updateWatcher.exporter, err = newExporter(options.Export, dockerCli, registryAuth.Keychain()); err != nil {
+		return nil, err
+	}
+	if updateWatcher.importer, err = newImporter(options.Import, dockerCli); err != nil {
+		return nil, err
+	}
+	updateWatcher.chain = updateWatcher.newChain()
+	if updateWatcher.eventStream, updateWatcher.streamHost, err = newEventStream(options); err != nil {
+		return nil, err
+	}
+	if updateWatcher.lock, err = newLock(options); err != nil {
+		return nil, err
+	}
+	if operator := options.Kubernetes.Operator; operator.Enabled {
+		kubeconfig := expandHome(options.Kubernetes.Kubeconfig)
+		if updateWatcher.operator, err = kube.NewOperator(kubeconfig, options.Kubernetes.Context, operator.Namespace, updateWatcher); err != nil {
+			return nil, err
+		}
+	}
+
+	return updateWatcher, nil
+}
+
+// Start checks the build context, prepares the base image, starts the API and then watches Steam in the background,
+// checking right away and then every check_frequency, until Stop is called or the error policy stops it. With
+// lock.driver it stands by until it holds the lock. Under systemd it notifies READY=1 once started.
+func (this *UpdateWatcher) Start() error {
+	this.stats.startedAt = time.Now()
+	if this.options.Once && this.operator != nil {
+		return fmt.Errorf("the operator reconciles GameServerImages continuously and cannot run once")
+	}
+	if dir := this.options.ContainerFiles; dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("failed to find build context: %w", err)
+		}
+	}
+
+	// Imported builds need neither, nor could the images be pulled
+	if this.importer == nil {
+		if err := this.ensureBaseImage(); err != nil {
+			return fmt.Errorf("failed to ensure base image exists: %w", err)
+		}
+		if err := this.ensureCheckerImage(); err != nil {
+			return err
+		}
+	}
+	// The baseline the growth of the first build is measured against
+	this.measureImages()
+
+	serverTLS, err := this.options.API.TLS.serverConfig()
+	if err != nil {
+		return err
+	}
+	if this.options.API.Listen != "" {
+		listener, err := net.Listen("tcp", this.options.API.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for the API: %w", err)
+		}
+		if serverTLS != nil {
+			listener = tls.NewListener(listener, serverTLS)
+		}
+		this.apiServer = this.newAPIServer()
+		go func() {
+			if err := this.apiServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Err(err).Msg("API server failed")
+			}
+		}()
+	}
+
+	if this.options.API.GRPCListen != "" {
+		listener, err := net.Listen("tcp", this.options.API.GRPCListen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for the gRPC API: %w", err)
+		}
+		this.grpcServer = this.newGRPCServer(serverTLS)
+		go func() {
+			if err := this.grpcServer.Serve(listener); err != nil {
+				log.Err(err).Msg("gRPC server failed")
+			}
+		}()
+	}
+
+	if this.orchestrator != nil {
+		this.running.Add(1)
+		go func() {
+			defer this.running.Done()
+			this.watchFleet()
+		}()
+	}
+
+	// The operator reconciles on its own, a single check needs no triggers
+	if this.operator == nil && !this.options.Once {
+		if names := this.triggers.Names(); len(names) > 0 {
+			log.Info().Strs("triggers", names).Msg("Watching for updates")
+		} else {
+			log.Warn().Msg("No triggers, checking Steam at startup and on request only")
+		}
+		this.running.Add(1)
+		go func() {
+			defer this.running.Done()
+			this.triggers.Run(this.ctx)
+		}()
+	}
+
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+		defer this.cancel()
+		this.refreshSLO()
+		this.err = this.whileLeading(func() error {
+			this.sweepOrphans()
+			// Standbys restart nothing
+			if this.orchestrator != nil {
+				this.running.Add(1)
+				go func() {
+					defer this.running.Done()
+					this.scheduleRestarts()
+				}()
+			}
+			if this.operator != nil {
+				return this.operator.Run(this.ctx)
+			}
+			if this.importer != nil {
+				return this.watchAndImport()
+			}
+			return this.watchAndBuild()
+		})
+	}()
+
+	this.writeHealthFile()
+	this.notifyReady()
+	return nil
+}
+
+// Stop cancels a build or rollout in progress and waits until the watcher stopped. The event channel is closed
+// afterwards and the shutdown report logged.
+func (this *UpdateWatcher) Stop() {
+	if _, err := systemd.Notify(systemd.STOPPING); err != nil {
+		log.Warn().Err(err).Msg("Failed to notify systemd")
+	}
+	report := this.beginShutdownReport()
+	this.cancel()
+	if this.apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := this.apiServer.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("Failed to shut down API server")
+		}
+	}
+	if this.grpcServer != nil {
+		this.stopGRPCServer()
+	}
+	this.Wait()
+	this.waitForNotifications()
+	this.closeEvents.Do(func() {
+		close(this.events)
+		if this.eventStream != nil {
+			this.eventStream.Close(streamCloseTimeout)
+		}
+		this.writeShutdownReport(this.finishShutdownReport(report))
+	})
+}
+
+// Wait blocks until the watcher stopped and returns the error it stopped on with Options.StopOnError or
+// Options.Once
+func (this *UpdateWatcher) Wait() error {
+	this.running.Wait()
+	return this.err
+}
+
+// Run fn, which sends notifications, without blocking the caller. Stop waits a while for them.
+func (this *UpdateWatcher) background(fn func()) {
+	this.notifications.Add(1)
+	go func() {
+		defer this.notifications.Done()
+		fn()
+	}()
+}
+
+func (this *UpdateWatcher) waitForNotifications() {
+	sent := make(chan struct{})
+	go func() {
+		this.notifications.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(notificationTimeout):
+		log.Warn().Msg("Stopped before every notification was sent")
+	}
+}
+
+func (this *UpdateWatcher) announceNewVersion(buildid int, localBuildid int) {
+	if buildid == localBuildid {
+		this.notify(notify.EVENT_UPDATE_DETECTED, buildid, "CS:GO buildid "+strconv.Itoa(buildid)+" was republished on Steam"+this.buildLink(buildid))
+		return
+	}
+	if buildid < localBuildid {
+		this.notify(notify.EVENT_UPDATE_DETECTED, buildid, "Steam rolled CS:GO back from buildid "+strconv.Itoa(localBuildid)+" to "+strconv.Itoa(buildid)+this.buildLink(buildid))
+		return
+	}
+	this.notify(notify.EVENT_UPDATE_DETECTED, buildid, "New CS:GO version released, buildid "+strconv.Itoa(buildid)+this.buildLink(buildid))
+}
+
+// Stream the files of the build context as a tar written while the build reads it, so the next build picks up
+// edits to the Dockerfiles. The files of dir, if set, replace the embedded default files of the same name and add to
+// them, the overlays add directories of their own. The dockerfiles are sent even if the .dockerignore of dir excludes
+// them. A failing walk ends the stream with its error, failing the build. Closing the reader stops the walk.
+func buildContext(dir string, dockerfiles []string, overlays ...contextOverlay) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, dir, dockerfiles, overlays))
+	}()
+	return reader
+}
+
+// A directory added to the build context at prefix, without its .git
+type contextOverlay struct {
+	prefix string
+	dir    string
+}
+
+// Fetch the build context files of container_source for the next build. Without it the container_files are used.
+func (this *UpdateWatcher) fetchContext() error {
+	if this.contextFetcher == nil {
+		this.contextFiles = this.options.ContainerFiles
+		return nil
+	}
+	dir, revision, err := this.contextFetcher.Fetch(this.ctx)
+	if err != nil {
+		if dir == "" {
+			return fmt.Errorf("failed to fetch build context: %w", err)
+		}
+		log.Err(err).Str("revision", revision).Msg("Failed to fetch build context, building with the cached files")
+	}
+	if revision != this.contextRevision {
+		log.Info().Str("revision", revision).Msg("Fetched new build context")
+	}
+	this.contextFiles, this.contextRevision = dir, revision
+	return nil
+}
+
+func writeBuildContext(w io.Writer, dir string, dockerfiles []string, overlays []contextOverlay) error {
+	tw := tar.NewWriter(w)
+
+	overridden := map[string]bool{}
+	excluded := map[string]bool{}
+	if dir != "" {
+		walkRoot, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of build context: %w", err)
+		}
+		matcher, err := readDockerignore(walkRoot)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(walkRoot, func(path string, info os.FileInfo, e error) error {
+			if e != nil {
+				return e
+			}
+			if path == walkRoot {
+				return nil
+			}
+			name := filepath.ToSlash(path[len(walkRoot)+1:])
+			if skip, err := ignored(matcher, dockerfiles, name); err != nil {
+				return fmt.Errorf("failed to match %s against .dockerignore: %w", name, err)
+			} else if skip {
+				// Ignored files do not fall back to the embedded ones
+				overridden[name], excluded[name] = true, true
+				// Exclusions like !dir/file may bring back files of ignored directories
+				if info.IsDir() && !matcher.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			overridden[name] = true
+			return writeContextEntry(tw, walkRoot, path, name, info)
+		})
+		if err != nil {
+			return fmt.Errorf("build context tar failed to build: %w", err)
+		}
+	}
+
+	// The embedded files have no permissions or times of their own, the Dockerfiles set the modes they need
+	defaults := containerfiles.FS()
+	err := fs.WalkDir(defaults, ".", func(path string, entry fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if excluded[path] && entry.IsDir() {
+			return fs.SkipDir
+		}
+		if path == "." || overridden[path] {
+			return nil
+		}
+		if entry.IsDir() {
+			return writeContextHeader(tw, &tar.Header{Typeflag: tar.TypeDir, Name: path + "/", Mode: 0755})
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: path, Mode: 0644, Size: info.Size()}
+		return writeContextFile(tw, header, func() (io.ReadCloser, error) {
+			return defaults.Open(path)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("build context tar failed to build: %w", err)
+	}
+
+	for _, overlay := range overlays {
+		walkRoot, err := filepath.Abs(overlay.dir)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of %s: %w", overlay.dir, err)
+		}
+		err = filepath.Walk(walkRoot, func(path string, info os.FileInfo, e error) error {
+			if e != nil {
+				return e
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			name := overlay.prefix
+			if path != walkRoot {
+				name += "/" + filepath.ToSlash(path[len(walkRoot)+1:])
+			}
+			return writeContextEntry(tw, walkRoot, path, name, info)
+		})
+		if err != nil {
+			return fmt.Errorf("build context tar failed to build: %w", err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// Write a file, directory or symlink of the context directory with its mode and modification time. Symlinks within
+// the context are kept, the engine cannot resolve symlinks pointing outside of it so their target files are written
+// instead.
+func writeContextEntry(tw *tar.Writer, root string, path string, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", name, err)
+		}
+		resolved := target
+		if !filepath.IsAbs(resolved) {
+			resolved = filepath.Join(filepath.Dir(path), resolved)
+		}
+		if relative, err := filepath.Rel(root, resolved); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			link = filepath.ToSlash(target)
+			if filepath.IsAbs(target) {
+				// Absolute links would point into the image's filesystem
+				link, _ = filepath.Rel(filepath.Dir(path), resolved)
+				link = filepath.ToSlash(link)
+			}
+		} else {
+			if info, err = os.Stat(path); err != nil {
+				return fmt.Errorf("failed to follow symlink %s: %w", name, err)
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("symlink %s points to %s outside of the build context, only files can be followed", name, target)
+			}
+		}
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() && link == "" {
+		// Sockets, devices and pipes have no place in an image
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to create header of %s in build context tar: %w", name, err)
+	}
+	// Owned by root like the docker CLI sends it, the Dockerfiles chown where needed
+	header.Name = name
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	switch {
+	case info.IsDir():
+		header.Name += "/"
+		return writeContextHeader(tw, header)
+	case link != "":
+		return writeContextHeader(tw, header)
+	}
+	return writeContextFile(tw, header, func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+}
+
+func writeContextHeader(tw *tar.Writer, header *tar.Header) error {
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header in build context tar: %w", err)
+	}
+	return nil
+}
+
+func writeContextFile(tw *tar.Writer, header *tar.Header, open func() (io.ReadCloser, error)) error {
+	if err := writeContextHeader(tw, header); err != nil {
+		return err
+	}
+
+	file, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open file from build context: %w", err)
+	}
+	defer file.Close()
+	written, err := io.Copy(tw, io.LimitReader(file, header.Size))
+	if err != nil {
+		return fmt.Errorf("failed to write file from build context into build context tar: %w", err)
+	}
+	if written < header.Size {
+		return fmt.Errorf("%s shrank while writing it into the build context tar", header.Name)
+	}
+	return nil
+}
+
+func (this *UpdateWatcher) watchAndBuild() error {
+	stopOnError := this.options.StopOnError || this.options.Once
+	interval := this.checkFrequency
+	// A restart during an update should not wait out a whole interval
+	this.requestCheck("startup")
+	this.setCheckInterval(interval)
+	for checks := 0; ; checks++ {
+		if this.options.Once && checks == 1 {
+			log.Info().Msg("Checked once, stopping")
+			return nil
+		}
+		// Degraded watchers check less often, the Steam poll picks the interval up after its next tick
+		if next := this.checkInterval(); next != interval {
+			interval = next
+			this.setCheckInterval(interval)
+		}
+		this.loopWorking(false)
+		select {
+		case reason := <-this.checkRequests:
+			if reason != trigger.TICK_REASON {
+				log.Info().Str("reason", reason).Msg("Checking Steam ahead of schedule")
+			}
+		case <-this.ctx.Done():
+			return nil
+		}
+		this.loopWorking(true)
+
+		if this.isPaused() {
+			log.Debug().Msg("Paused, skipping check")
+			continue
+		}
+		this.publishPending()
+		this.deployPending()
+		if err := this.runHooks(HOOK_PRE_CHECK, hookData{SteamBuildid: this.lastSteamCheck.SteamBuildid}); err != nil {
+			log.Err(err).Msg("Skipped check")
+			continue
+		}
+		latestVersion, err := this.latestVersion()
+		if err != nil {
+			log.Err(err).Msg("Failed to get latest version from Steam")
+			this.checked(store.Check{Time: time.Now(), Error: err.Error()}, err)
+			this.steamFailed(err)
+			if err := this.failed(err); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Debug().Int("latest-version", latestVersion).Msg("Latest CS:GO buildid")
+		releasedAt := this.steamChecked(latestVersion)
+		outdated, newestBuildVersion, err := this.outdated(latestVersion)
+		if err != nil {
+			log.Err(err).Msg("Failed to compare latest version with newest build CS:GO container")
+			this.checked(store.Check{Time: time.Now(), SteamBuildid: latestVersion, Error: err.Error()}, err)
+			if err := this.failed(err); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Debug().Int("newest-build-version", newestBuildVersion).Msg("Newest CS:GO buildid with build container image")
+		this.checked(store.Check{Time: time.Now(), SteamBuildid: latestVersion, LocalBuildid: newestBuildVersion}, nil)
+
+		requested := !outdated && this.buildPending()
+		if requested {
+			log.Info().Int("buildid", latestVersion).Msg("Rebuilding the newest buildid on request")
+			outdated = true
+		}
+		if outdated {
+			if newestBuildVersion == latestVersion && !requested {
+				log.Info().Int("buildid", latestVersion).Msg("Steam republished the buildid of the last build")
+			} else if newestBuildVersion > latestVersion {
+				log.Warn().Int("steam-version", latestVersion).Int("local-version", newestBuildVersion).Msg("Steam went back to an older build, rebuilding it")
+			}
+			// Detected and announced once, the build starts on the first check within maintenance.builds
+			waited := this.waitingBuildid == latestVersion
+			if !this.maintenanceOpen(this.options.Maintenance.Builds) {
+				if !waited {
+					this.waitingBuildid = latestVersion
+					this.recordDetection(latestVersion, releasedAt)
+					if !requested {
+						this.emit(Event{Type: EVENT_NEW_VERSION, Buildid: latestVersion, LocalBuildid: newestBuildVersion})
+						this.background(func() { this.announceNewVersion(latestVersion, newestBuildVersion) })
+					}
+					log.Info().Int("buildid", latestVersion).Str("window", this.options.Maintenance.Builds).Msg("Build waits for maintenance window")
+				}
+				this.succeeded()
+				continue
+			}
+			this.waitingBuildid = 0
+			if !waited {
+				this.recordDetection(latestVersion, releasedAt)
+			}
+			if err := this.reserveBuild(CSGO_APPID); err != nil {
+				if stopOnError {
+					return err
+				}
+				continue
+			}
+			// Requested rebuilds are no news
+			if !waited && !requested {
+				this.emit(Event{Type: EVENT_NEW_VERSION, Buildid: latestVersion, LocalBuildid: newestBuildVersion})
+				this.background(func() { this.announceNewVersion(latestVersion, newestBuildVersion) })
+			}
+			this.clearBuildRequest()
+
+			containerImage, buildid, err := this.buildContainerAndPublish(latestVersion)
+			this.coalesceChecks()
+			if err != nil {
+				log.Err(err).Msg("Failed to build container image with latest CS:GO version")
+				if err := this.failed(err); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Info().
+				Str("container-image", containerImage).
+				Int("builid", buildid).
+				Msg("Build new CS:GO container image")
+		} else if newestBuildVersion > latestVersion {
+			log.Warn().
+				Int("steam-version", latestVersion).
+				Int("local-version", newestBuildVersion).
+				Msg("Docker host contains CS:GO container with newer version than Steam provides")
+		}
+		this.succeeded()
+	}
+}
+
+// Remember a successful check of Steam. Returns the time of the previous check if it still saw an older buildid, the
+// buildid was released since then, zero otherwise.
+func (this *UpdateWatcher) steamChecked(buildid int) time.Time {
+	previous := this.lastSteamCheck
+	this.lastSteamCheck = store.Check{Time: time.Now(), SteamBuildid: buildid}
+	this.steamAnswered()
+	if previous.SteamBuildid != 0 && previous.SteamBuildid < buildid {
+		return previous.Time
+	}
+	return time.Time{}
+}
+
+// Record the check and tell the event readers about it
+func (this *UpdateWatcher) checked(check store.Check, err error) {
+	this.countCheck(check, err)
+	this.recordCheck(check)
+	this.writeHealthFile()
+	// Updates stuck in a phase become overdue
+	this.refreshSLO()
+	this.emit(Event{Type: EVENT_CHECK, Time: check.Time, Buildid: check.SteamBuildid, LocalBuildid: check.LocalBuildid, Err: err})
+}
+
+func (this *UpdateWatcher) runScript(script string, image string) (string, error) {
+	return this.runShell([]string{script}, image)
+}
+
+// Run /bin/sh with the given arguments in a new container from image and return its stdout
+func (this *UpdateWatcher) runShell(args []string, image string) (string, error) {
+	containerConfig := &container.Config{
+		Image:      image,
+		Shell:      []string{"/bin/sh"},
+		Cmd:        args,
+		Entrypoint: []string{"/bin/sh"},
+		Labels:     this.helperLabels(HELPER_SHELL),
+	}
+	hostConfig := &container.HostConfig{Resources: this.options.Resources.containerResources()}
+	login, removeLogin, err := this.writeSteamLogin()
+	if err != nil {
+		return "", err
+	}
+	defer removeLogin()
+	if login != "" {
+		hostConfig.Binds = []string{login + ":" + steamLoginPath + ":ro"}
+	}
+	// Removing the container below kills it if it got stuck
+	timeout := this.options.Timeouts.Helper
+	ctx, cancel := this.withTimeout(timeout)
+	defer cancel()
+	result, err := this.dockerCli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create container for getting latest version on Steam: %w", err)
+	}
+	containerID := result.ID
+	log.Trace().Msg("Created container")
+	// Also after failures, the container is of no use then either
+	defer func() {
+		if err := this.dockerCli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Err(err).Str("container", containerID).Msg("Failed to remove container")
+		}
+	}()
+
+	if err := this.dockerCli.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start container that gets latest version from Steam: %w", err)
+	}
+	log.Trace().Msg("Started container")
+
+	var exitCode int64
+	wait, errChan := this.dockerCli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errChan:
+		err = timedOut(ctx, "container of "+image, timeout, err)
+		return "", fmt.Errorf("error while waiting for Steam version retriever container to stop: %w", err)
+	case status := <-wait:
+		if status.Error != nil {
+			return "", fmt.Errorf("error while waiting for Steam version retriever container to stop: %s", status.Error.Message)
+		}
+		exitCode = status.StatusCode
+	}
+	log.Trace().Int64("exit-code", exitCode).Msg("Container stopped container")
+
+	// Read container logs
+	logOptions := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	}
+	logReader, err := this.dockerCli.ContainerLogs(ctx, containerID, logOptions)
+	if err != nil {
+		return "", fmt.Errorf("could not request logs from container: %w", err)
+	}
+	defer logReader.Close()
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, logReader); err != nil {
+		return "", fmt.Errorf("error while demultiplexing container logs: %w", err)
+	}
+
+	if exitCode != 0 {
+		// steamcmd reports most of its errors on stdout
+		output := stderr.String()
+		if strings.TrimSpace(output) == "" {
+			output = stdout.String()
+		}
+		return "", fmt.Errorf("container of %s exited with code %d: %s", image, exitCode, lastLines(output, helperErrorLines))
+	}
+	return stdout.String(), nil
+}
+
+// Lines of a failed helper container's output included in its error
+const helperErrorLines = 10
+
+// The buildid printed by a helper script, custom container_files and checker_image scripts may print anything else
+func parseBuildid(output string) (int, error) {
+	buildid, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse buildid from helper output %q: %w", lastLines(output, helperErrorLines), err)
+	}
+	return buildid, nil
+}
+
+// The last n lines of text, without surrounding whitespace
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Retrieve the latest buildid/version from Steam
+func (this *UpdateWatcher) latestVersion() (int, error) {
+	if this.options.CheckMethod == CHECK_HTTP {
+		return this.picsBuildid()
+	}
+	// Start base image running the helper-latest-version.sh script
+	logs, err := this.runScript("/usr/src/helper-latest-buildid.sh", this.checkerImage())
+	if err != nil {
+		return 0, fmt.Errorf("failed to run script for checking latest CS:GO version on Steam: %w", err)
+	}
+	return parseBuildid(logs)
+}
+
+// Get the buildid of newest version of CS:GO that the host have a container image of
+func (this *UpdateWatcher) newestBuildVersion() (int, error) {
+	// Check list of container images on Docker host and extract buildid from their labels, or the tag for images
+	// built before they were labeled
+
+	images, err := this.dockerCli.ImageList(this.ctx, types.ImageListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images on docker host: %w", err)
+	}
+
+	largestBuildid := -1
+	for _, image := range images {
+		if buildid, ok := labeledBuildid(image.Labels); ok {
+			if largestBuildid < buildid {
+				largestBuildid = buildid
+			}
+			continue
+		}
+
+		for _, tag := range image.RepoTags {
+			buildid, ok := this.buildidOf(tag)
+			if !ok {
+				continue
+			}
+
+			if largestBuildid < buildid {
+				largestBuildid = buildid
+			}
+		}
+	}
+
+	// Images may have been pruned from the host, the history still knows what was built
+	if this.history != nil {
+		storedBuildid, err := this.history.NewestBuildid()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get newest buildid from history: %w", err)
+		}
+		if largestBuildid < storedBuildid {
+			largestBuildid = storedBuildid
+		}
+	}
+
+	return largestBuildid, nil
+}
+
+// Build a new container image with the latest version installed, and tag it with the buildid. Target is the Steam
+// buildid the build was started for, 0 to accept whatever Steam installs.
+// Returns the container image name.
+func (this *UpdateWatcher) buildContainerAndPublish(target int) (_ string, _ int, err error) {
+	// The watch loop and reconciles of several GameServerImages never build at once
+	this.buildMutex.Lock()
+	defer this.buildMutex.Unlock()
+	log.Info().Msg("Building new CS:GO container")
+	// Looked up before the build, whose images count as the newest build once labeled
+	cacheFrom, pulled := this.cacheImages()
+	this.cacheFrom = cacheFrom
+	defer func() {
+		this.cacheFrom = nil
+		for _, image := range pulled {
+			this.removeTempImage(image)
+		}
+	}()
+	if target != 0 {
+		this.notifyInBackground(notify.EVENT_BUILD_STARTED, target, "Building CS:GO buildid "+strconv.Itoa(target))
+	} else {
+		this.notifyInBackground(notify.EVENT_BUILD_STARTED, 0, "Building the latest CS:GO version")
+	}
+
+	defer this.track("build")()
+	startedAt := time.Now()
+	record := &store.Build{StartedAt: startedAt}
+	defer func() {
+		if err != nil {
+			// Builds failing before the game is installed only know what they were started for
+			buildid := record.Buildid
+			if buildid == 0 {
+				buildid = target
+			}
+			this.notifyInBackground(notify.EVENT_BUILD_FAILED, buildid, "Failed to build CS:GO buildid "+strconv.Itoa(buildid)+": "+err.Error())
+		} else {
+			this.notifyInBackground(notify.EVENT_BUILD_SUCCEEDED, record.Buildid, "Built CS:GO buildid "+strconv.Itoa(record.Buildid)+":\n"+strings.Join(append(record.Images, record.Pushed...), "\n"))
+		}
+		this.countBuild(record.Buildid, err)
+		this.recordBuild(record, err)
+		if err == nil {
+			this.exportState(*record)
+		}
+		this.collectBuildCache(buildWindow{startedAt, time.Now()})
+		this.measureImages()
+		this.emit(Event{Type: EVENT_BUILD, Buildid: record.Buildid, Images: append(record.Images, record.Pushed...), Err: err})
+		if err != nil {
+			this.notifyHooks(HOOK_ON_FAILURE, this.buildHookData(record, err))
+		}
+	}()
+
+	if err := this.runHooks(HOOK_PRE_BUILD, this.buildHookData(record, nil)); err != nil {
+		return "", 0, err
+	}
+	if err := this.fetchContext(); err != nil {
+		return "", 0, err
+	}
+	if this.options.Build.RebuildBase {
+		if err := this.buildBaseImage(); err != nil {
+			return "", 0, fmt.Errorf("failed to rebuild base image: %w", err)
+		}
+	}
+	labels, err := this.buildLabels(this.baseTag())
+	if err != nil {
+		return "", 0, err
+	}
+
+	baseImage, snapshot, err := this.snapshotImage(labels)
+	if err != nil {
+		return "", 0, err
+	}
+	if snapshot != "" {
+		labels[LABEL_SNAPSHOT] = snapshot
+	} else {
+		var removeSeeded func()
+		baseImage, removeSeeded, err = this.seedFromSteamcmdCache(baseImage)
+		if err != nil {
+			return "", 0, err
+		}
+		defer removeSeeded()
+	}
+
+	// build CS:GO container image with game preinstalled
+	record.ContextDigest = labels[LABEL_CONTEXT_DIGEST]
+	tempTag, buildid, err := this.installGame(baseImage, labels, target, record)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := this.updateSnapshot(tempTag, snapshot); err != nil {
+		return "", 0, err
+	}
+	record.Buildid = buildid
+	labels[LABEL_BUILDID] = strconv.Itoa(buildid)
+	installedLabels := map[string]string{LABEL_BUILDID: labels[LABEL_BUILDID]}
+	// Steam's time of the installed build, the check before the build saw it
+	if info := this.lastAppInfo; info != nil && info.Buildid == buildid && !info.TimeUpdated.IsZero() {
+		labels[LABEL_TIMEUPDATED] = strconv.FormatInt(info.TimeUpdated.Unix(), 10)
+		installedLabels[LABEL_TIMEUPDATED] = labels[LABEL_TIMEUPDATED]
+	}
+
+	mods, err := this.buildMods()
+	if err != nil {
+		return "", 0, err
+	}
+	checkouts, err := this.checkoutRepositories()
+	if err != nil {
+		return "", 0, err
+	}
+	data := tags.NewData(buildid, CSGO_BRANCH, startedAt)
+	data.MetaMod, data.SourceMod, data.Commit = mods.MetaMod, mods.SourceMod, commitTag(checkouts)
+	imageTags, err := this.renderTags(data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// tag container with buildid, which is only known once the game is installed
+	taggedImage := imageTags[0]
+	if err := this.labelImage(tempTag, taggedImage, installedLabels); err != nil {
+		return "", 0, fmt.Errorf("failed to tag newly build cs:go container with buildid: %w", err)
+	}
+
+	// build get5 container
+	get5TaggedImage := imageTags[1]
+	labels[LABEL_CREATED] = time.Now().UTC().Format(time.RFC3339)
+	if err := this.buildGet5(taggedImage, get5TaggedImage, labels, mods, checkouts); err != nil {
+		return "", 0, err
+	}
+
+	record.Images = []string{taggedImage, get5TaggedImage}
+	for i, variant := range this.options.Build.Variants {
+		from := taggedImage
+		if variant.From == VARIANT_GET5 {
+			from = get5TaggedImage
+		}
+		variantImage := imageTags[len(variants)+i]
+		if err := this.buildContainer(from, variantImage, variant.ImageBuildConfig, labels); err != nil {
+			return "", 0, fmt.Errorf("failed to build variant %s: %w", variant.Name, err)
+		}
+		record.Images = append(record.Images, variantImage)
+	}
+	err = this.smokeTest(record.Images)
+	if this.options.SmokeTest.Enabled {
+		recordValidation(record, VALIDATION_SMOKE_TEST, "booted "+strings.Join(this.options.SmokeTest.Variants, ", "), err)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if err := this.runHooks(HOOK_POST_BUILD, this.buildHookData(record, nil)); err != nil {
+		return "", 0, err
+	}
+	publishTags := record.Images
+	// The moving tag is pushed last, so it only moves once the buildid tags are in place
+	if latest := this.latestTag(); latest != "" {
+		if err := this.dockerCli.ImageTag(this.ctx, get5TaggedImage, latest); err != nil {
+			return "", 0, fmt.Errorf("failed to tag %s as %s: %w", get5TaggedImage, latest, err)
+		}
+		publishTags = append(publishTags, latest)
+	}
+	if err := this.publisher(CSGO_APPID).Publish(record, publishTags); err != nil {
+		return "", 0, err
+	}
+	this.notifyHooks(HOOK_POST_PUBLISH, this.buildHookData(record, nil))
+
+	return taggedImage, buildid, nil
+}
+
+// Build the base image if it is not present on the docker host, with build.rebuild_base also if its build context
+// changed
+func (this *UpdateWatcher) ensureBaseImage() error {
+	if !this.options.Build.RebuildBase {
+		_, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, this.baseTag())
+		if err == nil {
+			log.Trace().Msg("Base image already exists, not rebuilding")
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("could not inspect base image: %w", err)
+		}
+	}
+
+	if err := this.fetchContext(); err != nil {
+		return err
+	}
+	return this.buildBaseImage()
+}
+
+// Build the base image from the fetched build context. With build.rebuild_base an image built from the same context
+// and build args is kept.
+func (this *UpdateWatcher) buildBaseImage() error {
+	tag := this.baseTag()
+	build := this.options.Build.Base
+	args := this.options.Build.steamcmdArgs(build)
+	labels := map[string]string{}
+	if this.options.Build.RebuildBase {
+		digest, err := this.baseContextDigest(args)
+		if err != nil {
+			return err
+		}
+		image, _, err := this.dockerCli.ImageInspectWithRaw(this.ctx, tag)
+		if err == nil && image.Config != nil && image.Config.Labels[LABEL_BASE_CONTEXT] == digest {
+			log.Trace().Msg("Base image is up to date, not rebuilding")
+			return nil
+		}
+		if err != nil && !client.IsErrNotFound(err) {
+			return fmt.Errorf("could not inspect base image: %w", err)
+		}
+		if err == nil {
+			log.Info().Str("context", digest).Msg("Build context of the base image changed")
+		}
+		labels[LABEL_BASE_CONTEXT] = digest
+	}
+
+	log.Info().Msg("Building base image")
+	if err := this.buildPlainImage(tag, build, args, labels); err != nil {
+		return err
+	}
+	log.Trace().Msg("Finished building base image")
+	return nil
+}
+
+func newBuildKit(options engine.BuildKitOptions, dockerCli DockerClient, baseImageName string) (*engine.BuildKit, error) {
+	if !options.Enabled() {
+		return nil, nil
+	}
+	transfer, ok := dockerCli.(engine.ImageTransfer)
+	if !ok {
+		return nil, fmt.Errorf("the container engine cannot save and load images, build.buildkit is not supported")
+	}
+	return engine.NewBuildKit(options, transfer, baseImageName)
+}
+
+// Images are built by the buildkitd of build.buildkit or the jobs of kubernetes.build if configured, by the engine
+// otherwise
+func (this *UpdateWatcher) imageBuilder() engine.Builder {
+	if this.buildkit != nil {
+		return this.buildkit
+	}
+	if this.buildJobs != nil {
+		return this.buildJobs
+	}
+	return this.dockerCli
+}
+
+// Build an image of the build context that needs nothing from the watcher at build time, unlike the preinstall
+// image installing the game
+func (this *UpdateWatcher) buildPlainImage(tag string, build ImageBuildConfig, args map[string]*string, labels map[string]string) error {
+	contextTar := buildContext(this.contextFiles, this.options.Build.dockerfiles())
+	defer contextTar.Close()
+
+	authConfigs, err := this.registryAuth.AuthConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for build: %w", err)
+	}
+
+	options := types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  build.Dockerfile,
+		Target:      build.Target,
+		BuildArgs:   args,
+		AuthConfigs: authConfigs,
+		Labels:      labels,
+	}
+	this.applyCache(&options)
+	this.options.Resources.applyToBuild(&options)
+	timeout := this.options.Timeouts.Build
+	ctx, cancel := this.withTimeout(timeout)
+	defer cancel()
+	buildResp, err := this.imageBuilder().ImageBuild(ctx, contextTar, engine.BuildOptions(this.options.Engine, options))
+	if err != nil {
+		return fmt.Errorf("failed to build cs:go container: %w", timedOut(ctx, "build", timeout, err))
+	}
+	defer buildResp.Body.Close()
+
+	if _, err := io.Copy(ioutil.Discard, buildResp.Body); err != nil {
+		return fmt.Errorf("error while reading build log: %w", timedOut(ctx, "build", timeout, err))
+	}
+	return nil
+}
+
+func (this *UpdateWatcher) buildContainer(baseImage string, resultTag string, build ImageBuildConfig, labels map[string]string, overlays ...contextOverlay) error {
+	log.Info().Msg("Building preinstalled image")
+
+	contextTar := buildContext(this.contextFiles, this.options.Build.dockerfiles(), overlays...)
+	defer contextTar.Close()
+
+	authConfigs, err := this.registryAuth.AuthConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for build: %w", err)
+	}
+
+	options := engine.BuildOptions(this.options.Engine, types.ImageBuildOptions{
+		Tags:        []string{resultTag},
+		Dockerfile:  build.Dockerfile,
+		Target:      build.Target,
+		BuildArgs:   this.options.Build.buildArgs(build, baseImage),
+		AuthConfigs: authConfigs,
+		Labels:      labels,
+	})
+	this.applyCache(&options)
+	this.options.Resources.applyToBuild(&options)
+	login, removeLogin, err := this.writeSteamLogin()
+	if err != nil {
+		return err
+	}
+	defer removeLogin()
+	// Cancelling the build stops the engine's build and its containers
+	timeout := this.options.Timeouts.Build
+	ctx, cancel := this.withTimeout(timeout)
+	defer cancel()
+	var buildResp types.ImageBuildResponse
+	if login != "" {
+		builder, ok := this.imageBuilder().(engine.SecretBuilder)
+		if !ok {
+			return fmt.Errorf("the %s engine cannot build with secrets, steam_login is not supported", this.options.Engine)
+		}
+		buildResp, err = builder.ImageBuildWithSecrets(ctx, contextTar, options, map[string]string{steamLoginSecret: login})
+	} else {
+		buildResp, err = this.imageBuilder().ImageBuild(ctx, contextTar, options)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build cs:go container: %w", timedOut(ctx, "build", timeout, err))
+	}
+	defer buildResp.Body.Close()
+
+	//buildOutput := ioutil.Discard
+	buildOutput := os.Stdout
+	if _, err := io.Copy(buildOutput, buildResp.Body); err != nil {
+		return fmt.Errorf("error while reading build log: %w", timedOut(ctx, "build", timeout, err))
+	}
+
+	log.Trace().Msg("Finished building preinstalled image")
+
+	return err
+}
+
+func (this *UpdateWatcher) getImageBuildid(tag string) (int, error) {
+	logs, err := this.runScript("/usr/src/helper-installed-buildid.sh", tag)
+	if err != nil {
+		return 0, fmt.Errorf("faile to run script for getting installed CS:GO version: %w", err)
+	}
+
+	buildid, err := parseBuildid(logs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get buildid of newly build cs:go container: %w", err)
+	}
+
+	return buildid, nil
+}
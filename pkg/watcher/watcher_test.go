@@ -0,0 +1,323 @@
+package watcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"csgo-update-watcher/pkg/store"
+	"csgo-update-watcher/pkg/tags"
+	"csgo-update-watcher/pkg/watcher/mocks"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/golang/mock/gomock"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWatcher(t *testing.T) (*UpdateWatcher, *mocks.MockDockerClient) {
+	dockerCli := mocks.NewMockDockerClient(gomock.NewController(t))
+	options := DefaultOptions()
+	// Without a history only the images count
+	options.State.Path = ""
+	watcher, err := New(options, dockerCli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return watcher, dockerCli
+}
+
+func TestNewestBuildVersionFromLabelsAndTags(t *testing.T) {
+	watcher, dockerCli := newTestWatcher(t)
+	tagged, err := watcher.renderTags(tags.Data{BuildID: 8200, Branch: CSGO_BRANCH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerCli.EXPECT().ImageList(gomock.Any(), gomock.Any()).Return([]types.ImageSummary{
+		{Labels: map[string]string{LABEL_BUILDID: "8100"}, RepoTags: []string{"csgo-watched:9999"}},
+		// Built before images were labeled
+		{RepoTags: tagged},
+		{RepoTags: []string{"other:8300"}},
+	}, nil)
+
+	buildid, err := watcher.newestBuildVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildid != 8200 {
+		t.Errorf("newest build version is %d, want 8200", buildid)
+	}
+}
+
+func TestNewestBuildVersionWithoutImages(t *testing.T) {
+	watcher, dockerCli := newTestWatcher(t)
+	dockerCli.EXPECT().ImageList(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	buildid, err := watcher.newestBuildVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildid != -1 {
+		t.Errorf("newest build version is %d, want -1", buildid)
+	}
+}
+
+// Expect a helper container exiting with exitCode after printing stdout
+func expectHelper(dockerCli *mocks.MockDockerClient, exitCode int64, stdout string) {
+	logs := &bytes.Buffer{}
+	stdcopy.NewStdWriter(logs, stdcopy.Stdout).Write([]byte(stdout))
+	wait := make(chan container.ContainerWaitOKBody, 1)
+	wait <- container.ContainerWaitOKBody{StatusCode: exitCode}
+
+	dockerCli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(container.ContainerCreateCreatedBody{ID: "helper"}, nil)
+	dockerCli.EXPECT().ContainerStart(gomock.Any(), "helper", gomock.Any()).Return(nil)
+	dockerCli.EXPECT().ContainerWait(gomock.Any(), "helper", container.WaitConditionNotRunning).Return(wait, make(chan error))
+	dockerCli.EXPECT().ContainerLogs(gomock.Any(), "helper", gomock.Any()).Return(ioutil.NopCloser(logs), nil)
+	dockerCli.EXPECT().ContainerRemove(gomock.Any(), "helper", gomock.Any()).Return(nil)
+}
+
+func TestLatestVersion(t *testing.T) {
+	watcher, dockerCli := newTestWatcher(t)
+	expectHelper(dockerCli, 0, "8200\n")
+
+	buildid, err := watcher.latestVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildid != 8200 {
+		t.Errorf("latest version is %d, want 8200", buildid)
+	}
+}
+
+func TestLatestVersionWithoutOutput(t *testing.T) {
+	watcher, dockerCli := newTestWatcher(t)
+	expectHelper(dockerCli, 0, "")
+
+	if _, err := watcher.latestVersion(); err == nil {
+		t.Error("latest version without output did not fail")
+	}
+}
+
+func TestLatestVersionFailingHelper(t *testing.T) {
+	watcher, dockerCli := newTestWatcher(t)
+	expectHelper(dockerCli, 1, "ERROR! Failed to install app '740' (No subscription)\n")
+
+	_, err := watcher.latestVersion()
+	if err == nil || !strings.Contains(err.Error(), "No subscription") {
+		t.Errorf("latest version of a failing helper returned %v, want its output", err)
+	}
+}
+
+func TestWriteBuildContextEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	mtime := time.Date(2022, 1, 31, 12, 0, 0, 0, time.UTC)
+	if err := os.Mkdir(filepath.Join(dir, "scripts"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "scripts", "start.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("scripts/start.sh", filepath.Join(dir, "start.sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "server.cfg"), []byte("hostname csgo\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "server.cfg"), filepath.Join(dir, "server.cfg")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"scripts/start.sh", "scripts"} {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(outside, "server.cfg"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	context := &bytes.Buffer{}
+	if err := writeBuildContext(context, dir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(context)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[header.Name], contents[header.Name] = header, string(content)
+	}
+
+	tests := []struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+		content  string
+	}{
+		{"scripts/", tar.TypeDir, 0750, "", ""},
+		{"scripts/start.sh", tar.TypeReg, 0755, "", "#!/bin/sh\n"},
+		{"start.sh", tar.TypeSymlink, 0777, "scripts/start.sh", ""},
+		// Links leaving the context are followed
+		{"server.cfg", tar.TypeReg, 0640, "", "hostname csgo\n"},
+	}
+	for _, test := range tests {
+		header, ok := headers[test.name]
+		if !ok {
+			t.Errorf("%s is missing from the build context", test.name)
+			continue
+		}
+		if header.Typeflag != test.typeflag || header.Mode&0777 != test.mode || header.Linkname != test.linkname {
+			t.Errorf("%s has the type %c, mode %o and link %q, want %c, %o and %q", test.name, header.Typeflag, header.Mode&0777, header.Linkname, test.typeflag, test.mode, test.linkname)
+		}
+		if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+			t.Errorf("%s is owned by %d:%d (%s:%s), want root", test.name, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+		if test.typeflag != tar.TypeSymlink && !header.ModTime.Equal(mtime) {
+			t.Errorf("%s was modified at %s, want %s", test.name, header.ModTime, mtime)
+		}
+		if contents[test.name] != test.content {
+			t.Errorf("%s holds %q, want %q", test.name, contents[test.name], test.content)
+		}
+	}
+}
+
+// The names in the build context of dir
+func contextNames(t *testing.T, dir string, dockerfiles []string) map[string]bool {
+	context := &bytes.Buffer{}
+	if err := writeBuildContext(context, dir, dockerfiles, nil); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	tr := tar.NewReader(context)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[header.Name] = true
+	}
+}
+
+func TestWriteBuildContextDockerignore(t *testing.T) {
+	tests := []struct {
+		dockerignore string
+		sent         []string
+		left         []string
+	}{
+		{"docker/\n*.sh\n", []string{"docker/", "docker/Dockerfile", "Dockerfile-get5", "notes.txt"}, []string{"docker/notes.txt", "helper-latest-buildid.sh"}},
+		// Cleaned to * like the docker CLI does
+		{"*/\n", []string{".dockerignore", "docker/", "docker/Dockerfile", "Dockerfile-get5"}, []string{"docker/notes.txt", "notes.txt", "helper-latest-buildid.sh"}},
+		{"*\n!notes.txt\n", []string{".dockerignore", "docker/Dockerfile", "Dockerfile-get5", "notes.txt"}, []string{"docker/notes.txt", "helper-latest-buildid.sh"}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "context")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := os.Mkdir(filepath.Join(dir, "docker"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range map[string]string{".dockerignore": test.dockerignore, "docker/Dockerfile": "FROM scratch\n", "docker/notes.txt": "", "notes.txt": "", "helper-latest-buildid.sh": "#!/bin/sh\n"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		names := contextNames(t, dir, []string{"Dockerfile", "./docker/Dockerfile"})
+		for _, name := range test.sent {
+			if !names[name] {
+				t.Errorf("with the .dockerignore %q %s is not sent", test.dockerignore, name)
+			}
+		}
+		// Ignored files do not bring back the embedded ones either
+		for _, name := range test.left {
+			if names[name] {
+				t.Errorf("with the .dockerignore %q %s is sent", test.dockerignore, name)
+			}
+		}
+	}
+}
+
+func TestOutdatedAfterRollbackRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dockerCli := mocks.NewMockDockerClient(gomock.NewController(t))
+	options := DefaultOptions()
+	options.State.Path = filepath.Join(dir, "state.db")
+	options.Rollback = ROLLBACK_REBUILD
+	watcher, err := New(options, dockerCli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.history.Close()
+	dockerCli.EXPECT().ImageList(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	dockerCli.EXPECT().ImageInspectWithRaw(gomock.Any(), gomock.Any()).Return(types.ImageInspect{}, nil, errors.New("no such image")).AnyTimes()
+
+	// Steam goes from 8200 back to 8100 and returns to 8200, every buildid is built once Steam has it
+	tests := []struct {
+		steam    int
+		outdated bool
+		local    int
+	}{
+		{8200, false, 8200},
+		{8100, true, 8200},
+		{8100, false, 8100},
+		{8200, true, 8100},
+		{8200, false, 8200},
+		{8300, true, 8200},
+	}
+	build := func(buildid int) {
+		images, err := watcher.renderTags(tags.Data{BuildID: buildid, Branch: CSGO_BRANCH})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := watcher.history.RecordBuild(&store.Build{Buildid: buildid, StartedAt: time.Now(), Outcome: store.OutcomeSuccess, Images: images}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(8200)
+	for i, test := range tests {
+		outdated, local, err := watcher.outdated(test.steam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outdated != test.outdated || local != test.local {
+			t.Errorf("check %d with %d on Steam returned outdated %t and local %d, want %t and %d", i, test.steam, outdated, local, test.outdated, test.local)
+		}
+		if outdated {
+			build(test.steam)
+		}
+	}
+}
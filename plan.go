@@ -0,0 +1,64 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/rollout"
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func runPlan(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	production := flags.Bool("production", false, "include the production images, as promote would roll them out")
+	restart := flags.String("restart", "", "show the scheduled restart with this name instead of a rollout")
+	asJson := flags.Bool("json", false, "print the steps as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher plan [--production] [--json] [<buildid>]")
+		fmt.Fprintln(flags.Output(), "       csgo-update-watcher plan --restart <name> [--json]")
+		fmt.Fprintln(flags.Output(), "Shows which servers a rollout of the build (the newest by default) or a scheduled restart would restart right now, in order, without changing anything.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() > 1 || (*restart != "" && (flags.NArg() != 0 || *production)) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var steps []rollout.Step
+	var err error
+	if *restart != "" {
+		steps, err = updateWatcher.DryRunRestart(*restart)
+	} else {
+		buildid := 0
+		if flags.NArg() == 1 {
+			if buildid, err = strconv.Atoi(flags.Arg(0)); err != nil {
+				return fmt.Errorf("invalid buildid %q", flags.Arg(0))
+			}
+		}
+		steps, err = updateWatcher.DryRun(buildid, *production)
+	}
+	// Failing targets still leave a partial plan
+	if steps == nil {
+		return err
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(steps); encodeErr != nil {
+			return encodeErr
+		}
+		return err
+	}
+
+	if len(steps) == 0 {
+		fmt.Println("No servers would be restarted")
+	}
+	for _, line := range updateWatcher.FormatSteps(steps) {
+		fmt.Println(line)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/watcher"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func runPromote(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher promote <buildid>")
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	buildid, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid buildid %q", flags.Arg(0))
+	}
+
+	return updateWatcher.Promote(buildid)
+}
+
+// Copy arbitrary images between registries, using the watcher's registry credentials
+func runCopy(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher copy <source> <destination>")
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	digest, err := updateWatcher.Copy(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest)
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/watcher"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runRollback(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	to := flags.Int("to", 0, "buildid to point the latest tag at")
+	restart := flags.Bool("restart", false, "also restart the game servers in the fleet with the chosen build")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher rollback --to <buildid> [--restart]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *to <= 0 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	return updateWatcher.Rollback(*to, *restart)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"csgo-update-watcher/pkg/watcher"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runSLO(updateWatcher *watcher.UpdateWatcher, args []string) error {
+	flags := flag.NewFlagSet("slo", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: csgo-update-watcher slo [--json]")
+		fmt.Fprintln(flags.Output(), "Shows the latency percentiles of the updates within the SLO window, from their release on Steam until the servers run them.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	report, err := updateWatcher.SLOReport()
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Printf("Updates detected since %s\n\n", formatTime(report.Since))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tUPDATES\tP50\tP90\tP95\tP99\tMAX\tOBJECTIVE\tMET")
+	for _, phase := range report.Phases {
+		met := "-"
+		if attainment, ok := phase.Attainment(); ok {
+			met = fmt.Sprintf("%d/%d (%.1f%%)", phase.Met, phase.Met+phase.Missed, attainment*100)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			phase.Phase,
+			phase.Count,
+			formatSeconds(phase.P50),
+			formatSeconds(phase.P90),
+			formatSeconds(phase.P95),
+			formatSeconds(phase.P99),
+			formatSeconds(phase.Max),
+			formatSeconds(phase.Objective),
+			met,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILDID\tRELEASED\tDETECTED\tPUBLISHED\tDEPLOYED")
+	for _, update := range report.Updates {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			update.Buildid,
+			formatTime(update.ReleasedAt),
+			formatTime(update.DetectedAt),
+			formatTime(update.PublishedAt),
+			formatTime(update.DeployedAt),
+		)
+	}
+	return w.Flush()
+}
+
+func formatSeconds(seconds float64) string {
+	return formatDuration(time.Duration(seconds * float64(time.Second)))
+}